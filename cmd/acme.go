@@ -0,0 +1,46 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeDir returns the directory ACME accounts and certificates are cached
+// in.
+func acmeDir() (string, error) {
+	if dir := currentSettings().ACME.CacheDir; dir != "" {
+		return os.ExpandEnv(dir), nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".sshhttpproxy", "acme"), nil
+}
+
+// acmeTLS returns a TLS config that obtains certificates for the domains
+// of fwd from an ACME CA. Challenges are answered with TLS-ALPN-01 on the
+// forwarded port itself, so the ssh server must expose it as port 443.
+func acmeTLS(fwd reverseConfig) (*tls.Config, error) {
+	dir, err := acmeDir()
+	if err != nil {
+		return nil, err
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(dir),
+		HostPolicy: autocert.HostWhitelist(fwd.ACME.Domains...),
+		Email:      fwd.ACME.Email,
+	}
+	if fwd.ACME.Directory != "" {
+		m.Client = &acme.Client{DirectoryURL: fwd.ACME.Directory}
+	}
+	return m.TLSConfig(), nil
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"github.com/spf13/cobra"
+)
+
+// auditCmd groups commands that work with audit logs.
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Work with connection audit logs",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify <file>",
+	Short: "Check that an audit log has not been tampered with",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := proxy.VerifyAuditLog(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		fmt.Printf("%s: %d records, chain intact\n", args[0], n)
+		return nil
+	},
+}
+
+// openAudit opens the audit log configured in audit.file for appending,
+// continuing its hash chain. It returns a nil log if auditing is off.
+func openAudit() (*proxy.AuditLog, func(), error) {
+	path := os.ExpandEnv(currentSettings().Audit.File)
+	if path == "" {
+		return nil, func() {}, nil
+	}
+	var prev *os.File
+	if f, err := os.Open(path); err == nil {
+		prev = f
+		defer prev.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	var a *proxy.AuditLog
+	if prev != nil {
+		a, err = proxy.NewAuditLog(f, prev)
+	} else {
+		a, err = proxy.NewAuditLog(f, nil)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("audit log %s: %w", path, err)
+	}
+	a.Digests = currentSettings().Audit.Digests
+	logger.Infof("recording connections in %s", path)
+	return a, func() {
+		if err := f.Close(); err != nil {
+			logger.Errorf("error closing %s: %s", path, err)
+		}
+	}, nil
+}
+
+// openConnectLog opens the log of connect mode destinations configured in
+// connectlog.file for appending. It returns a nil log if it is off.
+func openConnectLog() (*proxy.ConnectLog, func(), error) {
+	path := os.ExpandEnv(currentSettings().ConnectLog.File)
+	if path == "" {
+		return nil, func() {}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger.Infof("recording connect destinations in %s", path)
+	return proxy.NewConnectLog(f), func() {
+		if err := f.Close(); err != nil {
+			logger.Errorf("error closing %s: %s", path, err)
+		}
+	}, nil
+}
+
+func init() {
+	auditCmd.AddCommand(auditVerifyCmd)
+	rootCmd.AddCommand(auditCmd)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/elliotpeele/sshhttpproxy/localca"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+)
+
+// certCmd groups commands that manage the local development CA.
+var certCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "Manage the local development CA",
+}
+
+var certInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create a local CA and certificates for forwards with tls hosts",
+	Long: `Create a local certificate authority and issue certificates for all
+forwards that have tls hosts configured. With --trust the CA is added to the
+trust store of the operating system, so browsers accept the certificates.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir, err := caDir()
+		if err != nil {
+			return err
+		}
+		ca, err := localca.Init(dir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created CA %s\n", ca.CertPath())
+		forwards, err := forwardsFromConfig()
+		if err != nil {
+			return err
+		}
+		for _, fwd := range forwards {
+			if len(fwd.TLS.Hosts) == 0 {
+				continue
+			}
+			if _, err := ca.Leaf(fwd.Name, fwd.TLS.Hosts); err != nil {
+				return err
+			}
+			fmt.Printf("issued certificate for %s: %v\n", fwd.Name, fwd.TLS.Hosts)
+		}
+		if trust, _ := cmd.Flags().GetBool("trust"); trust {
+			if err := ca.Trust(); err != nil {
+				return err
+			}
+			fmt.Println("added CA to the system trust store")
+		}
+		return nil
+	},
+}
+
+// caDir returns the directory holding the local CA.
+func caDir() (string, error) {
+	if dir := currentSettings().TLS.CADir; dir != "" {
+		return os.ExpandEnv(dir), nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".sshhttpproxy", "ca"), nil
+}
+
+// forwardTLS returns a TLS config serving a certificate from the local CA
+// for the hosts of fwd.
+func forwardTLS(fwd forwardConfig) (*tls.Config, error) {
+	dir, err := caDir()
+	if err != nil {
+		return nil, err
+	}
+	ca, err := localca.Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ca.Leaf(fwd.Name, fwd.TLS.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// parsePin parses a SHA-256 certificate fingerprint in hex, with or
+// without colons as printed by openssl x509 -fingerprint -sha256.
+func parsePin(pin string) ([]byte, error) {
+	sum, err := hex.DecodeString(strings.Replace(strings.TrimPrefix(pin, "sha256:"), ":", "", -1))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("pin %q is not a SHA-256 fingerprint", pin)
+	}
+	return sum, nil
+}
+
+// remoteTLS returns the TLS config to originate TLS to the remote of a
+// forward with, or nil if c does not enable it.
+func remoteTLS(c remoteTLSConfig) (*tls.Config, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	cfg := &tls.Config{ServerName: c.ServerName}
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(os.ExpandEnv(c.Cert), os.ExpandEnv(c.Key))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.CA != "" {
+		path := os.ExpandEnv(c.CA)
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", path)
+		}
+	}
+	if c.Pin != "" {
+		pin, err := parsePin(c.Pin)
+		if err != nil {
+			return nil, err
+		}
+		// The pin replaces verifying the chain and the name.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(certs [][]byte, _ [][]*x509.Certificate) error {
+			if len(certs) == 0 {
+				return errors.New("no certificate presented")
+			}
+			if sum := sha256.Sum256(certs[0]); !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("certificate fingerprint %x does not match the pin", sum)
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
+
+func init() {
+	certInitCmd.Flags().Bool("trust", false, "add the CA to the system trust store")
+	certCmd.AddCommand(certInitCmd)
+	rootCmd.AddCommand(certCmd)
+}
@@ -3,18 +3,631 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/elliotpeele/sshhttpproxy/proxy"
-	"github.com/spf13/viper"
 )
 
 // ProxyFromConfig creates a proxy instance based on config file content.
 func ProxyFromConfig() (*proxy.SSHProxy, error) {
-	cfg := &proxy.Config{
-		PrivateKeyPath: os.ExpandEnv(viper.GetString("sshproxy.privatekey")),
-		RemoteUser:     viper.GetString("sshproxy.user"),
-		RemoteAddress:  viper.GetString("sshproxy.remote"),
+	access, err := loadAccessPolicy()
+	if err != nil {
+		return nil, err
 	}
+	cfg := proxyConfig()
+	access.apply(cfg)
 	return proxy.New(cfg)
 }
+
+// proxyConfig returns the proxy config of the sshproxy settings.
+func proxyConfig() *proxy.Config {
+	c := currentSettings().SSHProxy
+	cfg := &proxy.Config{
+		PrivateKeyPath: os.ExpandEnv(c.PrivateKey),
+		PrivateKey:     []byte(c.PrivateKeyData),
+		Passphrase:     c.Passphrase,
+		Password:       c.Password,
+		RemoteUser:     c.User,
+		RemoteAddress:  remoteAddress(),
+		MaxStartups:    c.MaxStartups,
+
+		MaxBufferedBytes: c.MaxBufferedBytes,
+		FairScheduling:   c.FairScheduling,
+		SlowThreshold:    c.SlowThreshold,
+		StallThreshold:   c.StallThreshold,
+		HappyEyeballs:    c.HappyEyeballs,
+		PreferFamily:     c.PreferFamily,
+		ParkTimeout:      c.ParkTimeout,
+		ParkQueue:        c.ParkQueue,
+		ProxyCommand:     c.ProxyCommand,
+		Paths:            c.Paths,
+		PathMode:         c.PathMode,
+		Knock:            knockSteps(c.Knock),
+		ClientVersion:    c.ClientVersion,
+		DNSServer:        c.DNSServer,
+		ConsulAddress:    c.ConsulAddress,
+		ConsulToken:      c.ConsulToken,
+
+		KeepAliveInterval: c.KeepAliveInterval,
+		KeepAliveCountMax: c.KeepAliveCountMax,
+		ResolveCacheTTL:   c.ResolveCacheTTL,
+	}
+	if c.ObfuscationKeyword != "" {
+		cfg.Obfuscate = proxy.ObfuscatedSSH(os.ExpandEnv(c.ObfuscationKeyword))
+	}
+	if c.GSSAPI {
+		cfg.GSSAPI = newGSSAPIClient
+		cfg.GSSAPITarget = c.GSSAPITarget
+	}
+	if auth := keyAuth(c); auth != nil {
+		cfg.AuthMethods = append(cfg.AuthMethods, auth)
+	}
+	return cfg
+}
+
+// remoteAddress returns the address of the ssh server from sshproxy.remote,
+// with the host and port replaced by sshproxy.host and sshproxy.port if
+// they are set.
+func remoteAddress() string {
+	c := currentSettings().SSHProxy
+	host, port, err := net.SplitHostPort(c.Remote)
+	if err != nil {
+		host, port = c.Remote, "22"
+	}
+	if c.Host != "" {
+		host = c.Host
+	}
+	if c.Port != 0 {
+		port = strconv.Itoa(c.Port)
+	}
+	if host == "" {
+		return ""
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// forwardConfig describes a forward in the forwards list of the config file.
+type forwardConfig struct {
+	// Name identifies the forward, it defaults to the remote address.
+	Name string
+	// Host names the ssh server from the hosts map to forward through,
+	// it defaults to the sshproxy server.
+	Host string
+	// Group is the name of the group the forward is listed under in the
+	// groups map, if any.
+	Group string
+	// Local is the local port to listen on, 0 picks a random port, or a
+	// host:port to listen elsewhere than on loopback. On Windows it may
+	// also be a named pipe, e.g. npipe:////./pipe/name.
+	Local string
+	// Remote is the default address connections are forwarded to, or
+	// exec: followed by a command run on the ssh server for each
+	// connection, or a service to look up, srv:_service._tcp.name or
+	// consul:service.
+	Remote string
+	// SNI routes TLS connections to other remotes by server name.
+	SNI []routeConfig
+	// Mode is "tcp" (the default), "http" for L7 forwards, "connect" or
+	// "socks" for an HTTP CONNECT or SOCKS5 proxy, or "transparent" for
+	// connections redirected by the firewall.
+	Mode string
+	// Routes sends requests to other remotes by Host header, path and
+	// other headers in http mode.
+	Routes []routeConfig
+	// Headers changes request and response headers in http mode.
+	Headers headersConfig
+	// Auth injects credentials into requests in http mode.
+	Auth authConfig
+	// Mirror copies a share of the requests to a second remote in http
+	// mode.
+	Mirror mirrorConfig
+	// TLS terminates TLS locally with a certificate from the local CA.
+	TLS tlsConfig
+	// RemoteTLS originates TLS to the remote in tcp and http mode.
+	RemoteTLS remoteTLSConfig
+	// Destinations allow or deny destinations in the proxy modes.
+	Destinations []destinationConfig
+	// Upstream chains a connect mode forward to an HTTP proxy on the
+	// remote network.
+	Upstream upstreamConfig
+	// Timeouts bound the phases of the connections of the forward.
+	Timeouts timeoutsConfig
+	// Priority is "high", "normal" (the default) or "low", which decides
+	// the forwards that get capacity first under --max-startups,
+	// --max-buffered-bytes and --fair-scheduling.
+	Priority string
+	// Chaos injects faults for resilience testing.
+	Chaos chaosConfig
+	// Watch, if set, checks this often that the remote is listening and
+	// refuses connections while it is not.
+	Watch time.Duration
+	// Health, if set, is a path on the remote, e.g. /healthz, requested
+	// through the tunnel for /health/<name> on the metrics listener, which
+	// answers with its status so local load balancers follow the remote.
+	Health string
+	// MDNS advertises the forward on the LAN as <name>.local and as an
+	// HTTP service with --mdns.
+	MDNS bool
+	// Log sets the level and categories of the messages about the
+	// forward.
+	Log logConfig
+}
+
+// knockConfig describes a step of a port knocking sequence, see
+// proxy.KnockStep.
+type knockConfig struct {
+	Port int
+	// Protocol is "tcp" (the default) or "udp".
+	Protocol string
+	Delay    time.Duration
+}
+
+// knockSteps converts knock configs to a proxy knock sequence.
+func knockSteps(cfgs []knockConfig) []proxy.KnockStep {
+	var steps []proxy.KnockStep
+	for _, cfg := range cfgs {
+		steps = append(steps, proxy.KnockStep{Port: cfg.Port, Protocol: cfg.Protocol, Delay: cfg.Delay})
+	}
+	return steps
+}
+
+// mirrorConfig describes request mirroring, see proxy.Mirror.
+type mirrorConfig struct {
+	Remote string
+	// Percent is the share of requests mirrored, it defaults to 100.
+	Percent float64
+}
+
+// chaosConfig describes the faults injected into a forward, see
+// proxy.Chaos.
+type chaosConfig struct {
+	Latency time.Duration
+	// Drop is the percentage of connections closed right away.
+	Drop float64
+	// Truncate is the percentage of connections, or responses in http
+	// mode, cut off after TruncateAfter bytes.
+	Truncate      float64
+	TruncateAfter int64
+}
+
+// timeoutsConfig holds the timeouts of a forward, see
+// proxy.ForwardOptions.
+type timeoutsConfig struct {
+	Accept      time.Duration
+	Dial        time.Duration
+	MaxLifetime time.Duration
+}
+
+// upstreamConfig describes an HTTP proxy on the remote network.
+type upstreamConfig struct {
+	// Address is the host:port of the proxy.
+	Address  string
+	Username string
+	// Password may refer to environment variables, e.g. $PROXY_PASSWORD.
+	Password string
+}
+
+// proxyMode reports whether clients choose the destinations of fwd.
+func (fwd *forwardConfig) proxyMode() bool {
+	return fwd.Mode == "connect" || fwd.Mode == "socks" || fwd.Mode == "transparent"
+}
+
+// destinationConfig is a single destination rule, see
+// proxy.DestinationRule.
+type destinationConfig struct {
+	// Action is "allow" or "deny".
+	Action string
+	Host   string
+	Ports  []int
+}
+
+// tlsConfig describes local TLS termination of a forward.
+type tlsConfig struct {
+	// Hosts are the names and addresses the certificate is issued for.
+	Hosts []string
+}
+
+// remoteTLSConfig describes TLS origination to the remote of a forward.
+type remoteTLSConfig struct {
+	// Enabled originates TLS, verifying the remote against the system
+	// roots. Setting any of the other fields implies it.
+	Enabled bool
+	// ServerName is sent as SNI and checked against the certificate of
+	// the remote instead of the host of its address.
+	ServerName string
+	// CA is a PEM bundle of the CAs the certificate of the remote is
+	// verified against instead of the system roots.
+	CA string
+	// Pin is the SHA-256 fingerprint of the certificate of the remote,
+	// which is then accepted without verifying its chain, e.g. when it is
+	// self-signed.
+	Pin string
+	// Cert and Key are PEM files of a client certificate and its key,
+	// presented to remotes that require mutual TLS.
+	Cert string
+	Key  string
+}
+
+// enabled reports whether TLS is originated to the remote.
+func (c remoteTLSConfig) enabled() bool {
+	return c != (remoteTLSConfig{})
+}
+
+// authConfig describes credentials injected into requests.
+type authConfig struct {
+	Bearer tokenConfig
+}
+
+// tokenConfig describes where to get a token from. Exactly one of Env,
+// File and Command may be set.
+type tokenConfig struct {
+	Env     string
+	File    string
+	Command string
+	// TTL is how long a token is reused before it is fetched again.
+	TTL time.Duration
+}
+
+// source returns the token source described by c, or nil if c is empty.
+func (c tokenConfig) source() (proxy.TokenSource, error) {
+	var src proxy.TokenSource
+	set := 0
+	if c.Env != "" {
+		src = proxy.EnvToken(c.Env)
+		set++
+	}
+	if c.File != "" {
+		src = proxy.FileToken(os.ExpandEnv(c.File))
+		set++
+	}
+	if c.Command != "" {
+		src = proxy.CommandToken(c.Command)
+		set++
+	}
+	switch {
+	case set == 0:
+		return nil, nil
+	case set > 1:
+		return nil, fmt.Errorf("only one of env, file and command may be set")
+	}
+	ttl := c.TTL
+	if ttl == 0 && c.Command != "" {
+		// Commands are usually slow, don't run them for every request.
+		ttl = time.Minute
+	}
+	if ttl > 0 {
+		src = proxy.CachedToken(src, ttl)
+	}
+	return src, nil
+}
+
+// headersConfig holds the header rules of a forward.
+type headersConfig struct {
+	Request  []headerRuleConfig
+	Response []headerRuleConfig
+}
+
+// headerRuleConfig is a single header rule, see proxy.HeaderRule.
+type headerRuleConfig struct {
+	Action string
+	Name   string
+	Value  string
+	Match  string
+}
+
+// routeConfig maps a host name pattern, path prefix and request headers
+// to a remote address.
+type routeConfig struct {
+	Host    string
+	Path    string
+	Strip   bool
+	Headers map[string]string
+	Remote  string
+}
+
+// forwardsFromConfig reads the forwards list and the forwards of all
+// groups from the config file.
+func forwardsFromConfig() ([]forwardConfig, error) {
+	var forwards []forwardConfig
+	if err := conf().UnmarshalKey("forwards", &forwards); err != nil {
+		return nil, err
+	}
+	for i := range forwards {
+		if forwards[i].Group != "" {
+			return nil, fmt.Errorf("forwards[%d].group: set by the groups map", i)
+		}
+		if err := checkForward(&forwards[i]); err != nil {
+			return nil, fmt.Errorf("forwards[%d]: %s", i, err)
+		}
+	}
+	var groups map[string][]forwardConfig
+	if err := conf().UnmarshalKey("groups", &groups); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for i := range groups[name] {
+			fwd := &groups[name][i]
+			fwd.Group = name
+			if err := checkForward(fwd); err != nil {
+				return nil, fmt.Errorf("groups.%s[%d]: %s", name, i, err)
+			}
+			forwards = append(forwards, *fwd)
+		}
+	}
+	return forwards, nil
+}
+
+// checkForward validates fwd and fills in defaults.
+func checkForward(fwd *forwardConfig) error {
+	if fwd.Mode != "http" {
+		if len(fwd.Routes) > 0 {
+			return errors.New("routes requires mode http")
+		}
+		if fwd.Mirror != (mirrorConfig{}) {
+			return errors.New("mirror requires mode http")
+		}
+		if len(fwd.Headers.Request) > 0 || len(fwd.Headers.Response) > 0 {
+			return errors.New("headers requires mode http")
+		}
+		if fwd.Auth != (authConfig{}) {
+			return errors.New("auth requires mode http")
+		}
+	}
+	if fwd.Mode != "connect" && fwd.Upstream != (upstreamConfig{}) {
+		return errors.New("upstream requires mode connect")
+	}
+	if fwd.Upstream != (upstreamConfig{}) && fwd.Upstream.Address == "" {
+		return errors.New("upstream.address is required")
+	}
+	if !fwd.proxyMode() && len(fwd.Destinations) > 0 {
+		return errors.New("destinations requires mode connect, socks or transparent")
+	}
+	switch fwd.Mode {
+	case "", "tcp":
+	case "http":
+		if len(fwd.SNI) > 0 {
+			return errors.New("sni is not supported in mode http")
+		}
+		for _, prefix := range []string{"exec:", "srv:", "consul:"} {
+			if strings.HasPrefix(fwd.Remote, prefix) {
+				return fmt.Errorf("%s remotes are not supported in mode http", strings.TrimSuffix(prefix, ":"))
+			}
+		}
+	case "connect", "socks", "transparent":
+		if fwd.Remote != "" || len(fwd.SNI) > 0 {
+			return fmt.Errorf("remote and sni are not supported in mode %s", fwd.Mode)
+		}
+		if fwd.Mode == "transparent" && len(fwd.TLS.Hosts) > 0 {
+			return errors.New("tls is not supported in mode transparent")
+		}
+		if fwd.RemoteTLS.enabled() {
+			return fmt.Errorf("remotetls is not supported in mode %s", fwd.Mode)
+		}
+		for _, dest := range fwd.Destinations {
+			if dest.Action != "allow" && dest.Action != "deny" {
+				return fmt.Errorf("destination %s: action must be allow or deny", dest.Host)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", fwd.Mode)
+	}
+	if !fwd.proxyMode() && fwd.Remote == "" && len(fwd.SNI) == 0 && len(fwd.Routes) == 0 {
+		return errors.New("remote is required")
+	}
+	if fwd.Name == "" {
+		fwd.Name = fwd.Remote
+	}
+	if fwd.Name == "" {
+		return errors.New("name is required without a default remote")
+	}
+	if err := fwd.Log.check(); err != nil {
+		return err
+	}
+	if len(fwd.TLS.Hosts) > 0 && len(fwd.SNI) > 0 {
+		return errors.New("tls cannot be combined with sni")
+	}
+	for _, route := range fwd.SNI {
+		if len(route.Headers) > 0 {
+			return errors.New("sni routes cannot match headers")
+		}
+	}
+	if fwd.RemoteTLS.enabled() && len(fwd.SNI) > 0 {
+		return errors.New("remotetls cannot be combined with sni")
+	}
+	if fwd.RemoteTLS.CA != "" && fwd.RemoteTLS.Pin != "" {
+		return errors.New("remotetls: ca and pin cannot be combined")
+	}
+	if (fwd.RemoteTLS.Cert == "") != (fwd.RemoteTLS.Key == "") {
+		return errors.New("remotetls: cert and key must be set together")
+	}
+	if fwd.RemoteTLS.Pin != "" {
+		if _, err := parsePin(fwd.RemoteTLS.Pin); err != nil {
+			return fmt.Errorf("remotetls: %s", err)
+		}
+	}
+	if _, err := fwd.Auth.Bearer.source(); err != nil {
+		return fmt.Errorf("auth.bearer: %s", err)
+	}
+	if fwd.Mirror != (mirrorConfig{}) {
+		if fwd.Mirror.Remote == "" {
+			return errors.New("mirror.remote is required")
+		}
+		if fwd.Mirror.Percent == 0 {
+			fwd.Mirror.Percent = 100
+		}
+		if fwd.Mirror.Percent < 0 || fwd.Mirror.Percent > 100 {
+			return errors.New("mirror.percent must be between 0 and 100")
+		}
+	}
+	if fwd.Chaos.Drop < 0 || fwd.Chaos.Drop > 100 || fwd.Chaos.Truncate < 0 || fwd.Chaos.Truncate > 100 {
+		return errors.New("chaos percentages must be between 0 and 100")
+	}
+	if fwd.Health != "" {
+		if fwd.proxyMode() || fwd.Remote == "" {
+			return errors.New("health requires a remote")
+		}
+		if strings.HasPrefix(fwd.Remote, "exec:") || strings.HasPrefix(fwd.Remote, "srv:") || strings.HasPrefix(fwd.Remote, "consul:") {
+			return errors.New("health is not supported with exec, srv and consul remotes")
+		}
+		if !strings.HasPrefix(fwd.Health, "/") {
+			return errors.New("health must be a path starting with /")
+		}
+	}
+	if fwd.MDNS && !dnsLabel.MatchString(fwd.Name) {
+		return fmt.Errorf("mdns: %q is not a valid host name", fwd.Name)
+	}
+	switch fwd.Priority {
+	case "", "high", "normal", "low":
+	default:
+		return fmt.Errorf("unknown priority %q", fwd.Priority)
+	}
+	if fwd.Local == "" {
+		fwd.Local = "0"
+	}
+	return nil
+}
+
+// checkForwardNames makes sure forward names are unique, as forwards are
+// managed by name across all hosts.
+func checkForwardNames(forwards []forwardConfig, reverse []reverseConfig) error {
+	names := make(map[string]bool)
+	for _, fwd := range forwards {
+		if names[fwd.Name] {
+			return fmt.Errorf("forward %q is defined more than once", fwd.Name)
+		}
+		names[fwd.Name] = true
+	}
+	for _, fwd := range reverse {
+		if names[fwd.Name] {
+			return fmt.Errorf("forward %q is defined more than once", fwd.Name)
+		}
+		names[fwd.Name] = true
+	}
+	return nil
+}
+
+// reverseConfig describes a forward in the reverse list of the config
+// file, which publishes a local service on the ssh server.
+type reverseConfig struct {
+	// Name identifies the forward, it defaults to the local address.
+	Name string
+	// Host names the ssh server from the hosts map to listen on, it
+	// defaults to the sshproxy server.
+	Host string
+	// Remote is the address the ssh server listens on. If it is only a
+	// port, the server listens on loopback unless Public is set.
+	Remote string
+	// Public listens on all interfaces of the ssh server, which requires
+	// GatewayPorts to be enabled there.
+	Public bool
+	// Local is the address connections are forwarded to.
+	Local string
+	// ACME terminates TLS with certificates from an ACME CA.
+	ACME acmeConfig
+	// Origins allow or deny connections by the originator address the ssh
+	// server reports for them, like destinations but without ports.
+	Origins []destinationConfig
+	// Log sets the level and categories of the messages about the
+	// forward.
+	Log logConfig
+}
+
+// acmeConfig describes how to obtain certificates for a reverse forward.
+type acmeConfig struct {
+	// Domains are the names certificates are requested for.
+	Domains []string
+	// Email is the contact address of the ACME account.
+	Email string
+	// Directory is the directory URL of the CA, it defaults to Let's
+	// Encrypt.
+	Directory string
+}
+
+// reverseFromConfig reads the reverse list from the config file.
+func reverseFromConfig() ([]reverseConfig, error) {
+	var forwards []reverseConfig
+	if err := conf().UnmarshalKey("reverse", &forwards); err != nil {
+		return nil, err
+	}
+	for i := range forwards {
+		fwd := &forwards[i]
+		if fwd.Remote == "" {
+			return nil, fmt.Errorf("reverse[%d].remote is required", i)
+		}
+		if fwd.Local == "" {
+			return nil, fmt.Errorf("reverse[%d].local is required", i)
+		}
+		if fwd.Name == "" {
+			fwd.Name = fwd.Local
+		}
+		if fwd.ACME.Email != "" && len(fwd.ACME.Domains) == 0 {
+			return nil, fmt.Errorf("reverse[%d].acme: requires domains", i)
+		}
+		if err := fwd.Log.check(); err != nil {
+			return nil, fmt.Errorf("reverse[%d].%s", i, err)
+		}
+		for _, origin := range fwd.Origins {
+			if origin.Action != "allow" && origin.Action != "deny" {
+				return nil, fmt.Errorf("reverse[%d].origins: %s: action must be allow or deny", i, origin.Host)
+			}
+			if len(origin.Ports) > 0 {
+				return nil, fmt.Errorf("reverse[%d].origins: %s: ports cannot be set", i, origin.Host)
+			}
+		}
+	}
+	return forwards, nil
+}
+
+// routes converts route configs to proxy routes.
+func routes(cfgs []routeConfig) []proxy.Route {
+	var routes []proxy.Route
+	for _, cfg := range cfgs {
+		routes = append(routes, proxy.Route{
+			Host:        cfg.Host,
+			Path:        cfg.Path,
+			StripPrefix: cfg.Strip,
+			Headers:     cfg.Headers,
+			Remote:      cfg.Remote,
+		})
+	}
+	return routes
+}
+
+// destinationRules converts destination configs to proxy destination rules.
+func destinationRules(cfgs []destinationConfig) []proxy.DestinationRule {
+	var rules []proxy.DestinationRule
+	for _, cfg := range cfgs {
+		rules = append(rules, proxy.DestinationRule{
+			Deny:  cfg.Action == "deny",
+			Host:  cfg.Host,
+			Ports: cfg.Ports,
+		})
+	}
+	return rules
+}
+
+// headerRules converts header rule configs to proxy header rules.
+func headerRules(cfgs []headerRuleConfig) []proxy.HeaderRule {
+	var rules []proxy.HeaderRule
+	for _, cfg := range cfgs {
+		rules = append(rules, proxy.HeaderRule{
+			Action: proxy.HeaderAction(cfg.Action),
+			Name:   cfg.Name,
+			Value:  cfg.Value,
+			Match:  cfg.Match,
+		})
+	}
+	return rules
+}
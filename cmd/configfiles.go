@@ -0,0 +1,193 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// configName is the base name of user and project config files.
+const configName = ".sshhttpproxy"
+
+// configFiles are the config files loaded, in the order they were merged.
+// Like settings, it is guarded by configMu.
+var configFiles []string
+
+// systemConfigPath returns the path of the system wide config file.
+func systemConfigPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "sshhttpproxy", "config.yaml")
+	}
+	return "/etc/sshhttpproxy/config.yaml"
+}
+
+// findConfig returns the config file named configName in dir with any
+// extension viper supports, or "" if there is none.
+func findConfig(dir string) string {
+	for _, ext := range viper.SupportedExts {
+		path := filepath.Join(dir, configName+"."+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// projectConfigPath walks up from the working directory and returns the
+// first config file found, or "" if there is none. The user config in the
+// home directory is not a project config.
+func projectConfigPath(home string) string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		if dir != home {
+			if path := findConfig(dir); path != "" {
+				return path
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// configLayers returns the config files to merge, lowest precedence first:
+// the system file, the user file in the home directory and the project
+// file closest to the working directory. An explicit file replaces the
+// user and project files.
+func configLayers(explicit string) ([]string, error) {
+	var layers []string
+	if _, err := os.Stat(systemConfigPath()); err == nil {
+		layers = append(layers, systemConfigPath())
+	}
+	if explicit != "" {
+		return append(layers, explicit), nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return nil, err
+	}
+	if path := findConfig(home); path != "" {
+		layers = append(layers, path)
+	}
+	if path := projectConfigPath(home); path != "" {
+		layers = append(layers, path)
+	}
+	return layers, nil
+}
+
+// mergeConfigFile merges path into dst and appends the files merged to
+// files. Files listed under include are merged first, so the including
+// file overrides them. Include paths are relative to the including file
+// and may be globs. Maps are merged key by key, lists such as forwards are
+// replaced as a whole.
+func mergeConfigFile(dst *viper.Viper, path string, seen map[string]bool, files *[]string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if seen[abs] {
+		return fmt.Errorf("%s: include cycle", path)
+	}
+	seen[abs] = true
+	defer delete(seen, abs)
+
+	v := viper.New()
+	v.SetConfigFile(abs)
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	for _, include := range v.GetStringSlice("include") {
+		include, err := homedir.Expand(os.ExpandEnv(include))
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(abs), include)
+		}
+		matches, err := filepath.Glob(include)
+		if err != nil {
+			return fmt.Errorf("%s: include %s: %s", path, include, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("%s: include %s: no such file", path, include)
+		}
+		for _, match := range matches {
+			if err := mergeConfigFile(dst, match, seen, files); err != nil {
+				return err
+			}
+		}
+	}
+	*files = append(*files, abs)
+	return dst.MergeConfigMap(v.AllSettings())
+}
+
+// rewriteConfig replaces every string in the config in v, including those
+// in lists and nested maps, with what fn returns for it and its path, the
+// keys and list indexes leading to it joined with dots.
+func rewriteConfig(v *viper.Viper, fn func(path, s string) (string, error)) error {
+	for key, value := range v.AllSettings() {
+		rewritten, changed, err := rewriteStrings(key, value, fn)
+		if err != nil {
+			return fmt.Errorf("%s.%s", key, err)
+		}
+		if changed {
+			v.Set(key, rewritten)
+		}
+	}
+	return nil
+}
+
+// rewriteStrings returns v, found at path, with fn applied to all strings
+// in it and whether any of them changed.
+func rewriteStrings(path string, v interface{}, fn func(path, s string) (string, error)) (interface{}, bool, error) {
+	switch v := v.(type) {
+	case string:
+		s, err := fn(path, v)
+		return s, s != v, err
+	case map[string]interface{}:
+		changed := false
+		for k, item := range v {
+			rewritten, ok, err := rewriteStrings(path+"."+k, item, fn)
+			if err != nil {
+				return nil, false, fmt.Errorf("%s: %s", k, err)
+			}
+			v[k] = rewritten
+			changed = changed || ok
+		}
+		return v, changed, nil
+	case map[interface{}]interface{}:
+		changed := false
+		for k, item := range v {
+			rewritten, ok, err := rewriteStrings(fmt.Sprintf("%s.%v", path, k), item, fn)
+			if err != nil {
+				return nil, false, fmt.Errorf("%v: %s", k, err)
+			}
+			v[k] = rewritten
+			changed = changed || ok
+		}
+		return v, changed, nil
+	case []interface{}:
+		changed := false
+		for i, item := range v {
+			rewritten, ok, err := rewriteStrings(fmt.Sprintf("%s.%d", path, i), item, fn)
+			if err != nil {
+				return nil, false, fmt.Errorf("%d: %s", i, err)
+			}
+			v[i] = rewritten
+			changed = changed || ok
+		}
+		return v, changed, nil
+	}
+	return v, false, nil
+}
@@ -0,0 +1,277 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// testTree writes files, by path relative to a new directory, and returns
+// the directory.
+func testTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	// Resolve symlinks such as /tmp on macOS, as os.Getwd does.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, doc := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(doc), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// useHome makes home the home directory for the rest of the test.
+func useHome(t *testing.T, home string) {
+	t.Helper()
+	setenv(t, "HOME", home)
+	setenv(t, "USERPROFILE", home)
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+}
+
+// chdir changes the working directory for the rest of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// systemLayers returns the system config file if the machine has one.
+func systemLayers() []string {
+	if _, err := os.Stat(systemConfigPath()); err == nil {
+		return []string{systemConfigPath()}
+	}
+	return nil
+}
+
+func TestConfigLayers(t *testing.T) {
+	dir := testTree(t, map[string]string{
+		"home/.sshhttpproxy.yaml":        "",
+		"home/work/.keep":                "",
+		"home/src/app/.sshhttpproxy.yml": "",
+		"nohome/.keep":                   "",
+		"project/.sshhttpproxy.yaml":     "",
+		"project/sub/.sshhttpproxy.json": "{}",
+		"project/sub/deeper/.keep":       "",
+		"project/other/.keep":            "",
+		"explicit.yaml":                  "",
+	})
+	path := func(name string) string { return filepath.Join(dir, filepath.FromSlash(name)) }
+	for _, tt := range []struct {
+		name     string
+		home     string
+		wd       string
+		explicit string
+		want     []string
+	}{
+		{
+			name: "user file",
+			home: "home",
+			wd:   "nohome",
+			want: []string{"home/.sshhttpproxy.yaml"},
+		},
+		{
+			name: "no files",
+			home: "nohome",
+			wd:   "nohome",
+		},
+		{
+			name: "project file above the user file",
+			home: "home",
+			wd:   "project/other",
+			want: []string{"home/.sshhttpproxy.yaml", "project/.sshhttpproxy.yaml"},
+		},
+		{
+			name: "closest project file",
+			home: "home",
+			wd:   "project/sub/deeper",
+			want: []string{"home/.sshhttpproxy.yaml", "project/sub/.sshhttpproxy.json"},
+		},
+		{
+			name: "user file is not a project file",
+			home: "home",
+			wd:   "home/work",
+			want: []string{"home/.sshhttpproxy.yaml"},
+		},
+		{
+			name: "project in the home directory",
+			home: "home",
+			wd:   "home/src/app",
+			want: []string{"home/.sshhttpproxy.yaml", "home/src/app/.sshhttpproxy.yml"},
+		},
+		{
+			name:     "explicit file replaces user and project files",
+			home:     "home",
+			wd:       "project/sub",
+			explicit: "explicit.yaml",
+			want:     []string{"explicit.yaml"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useHome(t, path(tt.home))
+			chdir(t, path(tt.wd))
+			explicit := ""
+			if tt.explicit != "" {
+				explicit = path(tt.explicit)
+			}
+			got, err := configLayers(explicit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := systemLayers()
+			for _, name := range tt.want {
+				want = append(want, path(name))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMergeConfigFile(t *testing.T) {
+	dir := testTree(t, map[string]string{
+		"common.yaml":   "sshproxy:\n  user: common\n  remote: bastion:22\nforwards:\n- name: common\n  remote: a:80\n",
+		"base.yaml":     "include: [common.yaml]\nsshproxy:\n  user: base\n",
+		"lists.yaml":    "include: [common.yaml]\nforwards:\n- name: own\n  remote: b:80\n",
+		"glob.yaml":     "include: [conf.d/*.yaml]\n",
+		"conf.d/a.yaml": "sshproxy:\n  user: a\n  remote: a:22\n",
+		"conf.d/b.yaml": "sshproxy:\n  user: b\n",
+		"diamond.yaml":  "include: [left.yaml, right.yaml]\n",
+		"left.yaml":     "include: [common.yaml]\nsshproxy:\n  user: left\n",
+		"right.yaml":    "include: [common.yaml]\n",
+		"cycle.yaml":    "include: [loop.yaml]\n",
+		"loop.yaml":     "include: [cycle.yaml]\n",
+		"self.yaml":     "include: [self.yaml]\n",
+		"missing.yaml":  "include: [nothing/*.yaml]\n",
+		"broken.yaml":   "include: [bad.yaml]\n",
+		"bad.yaml":      "sshproxy: [\n",
+	})
+	for _, tt := range []struct {
+		name  string
+		file  string
+		files []string
+		user  string
+		err   string
+	}{
+		{
+			name:  "including file overrides",
+			file:  "base.yaml",
+			files: []string{"common.yaml", "base.yaml"},
+			user:  "base",
+		},
+		{
+			name:  "globs in order",
+			file:  "glob.yaml",
+			files: []string{"conf.d/a.yaml", "conf.d/b.yaml", "glob.yaml"},
+			user:  "b",
+		},
+		{
+			name:  "included twice",
+			file:  "diamond.yaml",
+			files: []string{"common.yaml", "left.yaml", "common.yaml", "right.yaml", "diamond.yaml"},
+			user:  "common",
+		},
+		{name: "cycle", file: "cycle.yaml", err: "include cycle"},
+		{name: "includes itself", file: "self.yaml", err: "include cycle"},
+		{name: "no match", file: "missing.yaml", err: "no such file"},
+		{name: "broken include", file: "broken.yaml", err: "bad.yaml"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			var files []string
+			err := mergeConfigFile(v, filepath.Join(dir, tt.file), map[string]bool{}, &files)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want an error with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, name := range tt.files {
+				want = append(want, filepath.Join(dir, filepath.FromSlash(name)))
+			}
+			if !reflect.DeepEqual(files, want) {
+				t.Errorf("got files %q, want %q", files, want)
+			}
+			if got := v.GetString("sshproxy.user"); got != tt.user {
+				t.Errorf("got user %q, want %q", got, tt.user)
+			}
+			if v.GetString("sshproxy.remote") == "" {
+				t.Error("keys of included files lost")
+			}
+		})
+	}
+
+	// Lists are replaced, not appended to.
+	v := viper.New()
+	var files []string
+	if err := mergeConfigFile(v, filepath.Join(dir, "lists.yaml"), map[string]bool{}, &files); err != nil {
+		t.Fatal(err)
+	}
+	forwards, _ := v.Get("forwards").([]interface{})
+	if len(forwards) != 1 {
+		t.Fatalf("got forwards %v, want the list of lists.yaml", forwards)
+	}
+}
+
+func TestConfigLayerPrecedence(t *testing.T) {
+	if systemLayers() != nil {
+		t.Skip("the system config file would be merged too")
+	}
+	dir := testTree(t, map[string]string{
+		"home/.sshhttpproxy.yaml":    "sshproxy:\n  user: home\n  remote: bastion:22\n",
+		"project/.sshhttpproxy.yaml": "include: [shared.yaml]\nsshproxy:\n  user: project\n",
+		"project/shared.yaml":        "sshproxy:\n  user: shared\n  privatekey: ~/.ssh/shared\n",
+	})
+	useHome(t, filepath.Join(dir, "home"))
+	chdir(t, filepath.Join(dir, "project"))
+	useConfigFile(t, "")
+
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	s := currentSettings().SSHProxy
+	if s.User != "project" || s.Remote != "bastion:22" || s.PrivateKey != "~/.ssh/shared" {
+		t.Errorf("got user %q, remote %q, private key %q", s.User, s.Remote, s.PrivateKey)
+	}
+	configMu.RLock()
+	files := configFiles
+	configMu.RUnlock()
+	want := []string{
+		filepath.Join(dir, "home", ".sshhttpproxy.yaml"),
+		filepath.Join(dir, "project", "shared.yaml"),
+		filepath.Join(dir, "project", ".sshhttpproxy.yaml"),
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %q, want %q", files, want)
+	}
+}
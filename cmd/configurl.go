@@ -0,0 +1,163 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// configURLTimeout bounds fetching the shared config.
+const configURLTimeout = 10 * time.Second
+
+// configURL is the shared config given with --config-url.
+var configURL string
+
+// configURLCache returns where the config at u is kept between
+// fetches, with the extension of its path so viper knows the format.
+func configURLCache(u *url.URL) (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	ext := path.Ext(u.Path)
+	if !stringInSlice(strings.TrimPrefix(ext, "."), viper.SupportedExts) {
+		ext = ".yaml"
+	}
+	sum := sha256.Sum256([]byte(u.String()))
+	name := hex.EncodeToString(sum[:8]) + ext
+	return filepath.Join(home, ".sshhttpproxy", "cache", name), nil
+}
+
+// syncConfigURL brings the local copy of the shared config at rawurl up to
+// date and returns its path and whether it changed. The ETag of the copy
+// is sent along, so an unchanged config is not downloaded again. If the
+// server cannot be reached, the copy from the last fetch is used.
+func syncConfigURL(rawurl string) (string, bool, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", false, err
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopbackHost(u.Hostname())) {
+		return "", false, fmt.Errorf("%s: only https URLs can be used, or http on loopback", rawurl)
+	}
+	cache, err := configURLCache(u)
+	if err != nil {
+		return "", false, err
+	}
+	changed, err := fetchConfigURL(rawurl, cache)
+	if err != nil {
+		if _, statErr := os.Stat(cache); statErr != nil {
+			return "", false, err
+		}
+		logger.Warningf("%s, using the copy from the last fetch", err)
+	}
+	return cache, changed, nil
+}
+
+// fetchConfigURL downloads rawurl to cache unless its ETag matches the one
+// kept with the cache, and reports whether the config changed.
+func fetchConfigURL(rawurl, cache string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return false, err
+	}
+	etagPath := cache + ".etag"
+	if _, err := os.Stat(cache); err == nil {
+		if etag, err := ioutil.ReadFile(etagPath); err == nil {
+			req.Header.Set("If-None-Match", strings.TrimSpace(string(etag)))
+		}
+	}
+	client := &http.Client{Timeout: configURLTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("%s: %s", rawurl, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", rawurl, err)
+	}
+	old, err := ioutil.ReadFile(cache)
+	changed := err != nil || string(old) != string(body)
+	if err := os.MkdirAll(filepath.Dir(cache), 0700); err != nil {
+		return false, err
+	}
+	if changed {
+		if err := writeFileAtomic(cache, body, 0600); err != nil {
+			return false, err
+		}
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		err = writeFileAtomic(etagPath, []byte(etag+"\n"), 0600)
+	} else {
+		err = os.Remove(etagPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	return changed, err
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshConfigURL checks the shared config for changes every interval
+// until ctx is done and reloads the config of m when it changed.
+func refreshConfigURL(ctx context.Context, m *forwardManager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, changed, err := syncConfigURL(configURL)
+		if err != nil {
+			logger.Warningf("checking %s: %s", configURL, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		logger.Infof("%s changed, reloading config", configURL)
+		if err := m.reload(); err != nil {
+			logger.Errorf("reloading config: %s", err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// configServer serves a config document with an ETag and honours
+// If-None-Match.
+type configServer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	doc         string
+	etag        string
+	status      int
+	ifNoneMatch string
+}
+
+func newConfigServer(t *testing.T, doc, etag string) *configServer {
+	t.Helper()
+	s := &configServer{doc: doc, etag: etag}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *configServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ifNoneMatch = r.Header.Get("If-None-Match")
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	if s.etag != "" {
+		w.Header().Set("ETag", s.etag)
+		if s.ifNoneMatch == s.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	fmt.Fprint(w, s.doc)
+}
+
+func (s *configServer) set(doc, etag string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.doc, s.etag, s.status = doc, etag, status
+}
+
+func (s *configServer) sent() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ifNoneMatch
+}
+
+func TestSyncConfigURL(t *testing.T) {
+	useHome(t, testTree(t, nil))
+	srv := newConfigServer(t, "sshproxy:\n  user: one\n", `"v1"`)
+	rawurl := srv.URL + "/shared.yaml"
+
+	check := func(step string, wantChanged bool, wantDoc string) {
+		t.Helper()
+		path, changed, err := syncConfigURL(rawurl)
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if changed != wantChanged {
+			t.Errorf("%s: got changed %v, want %v", step, changed, wantChanged)
+		}
+		if filepath.Ext(path) != ".yaml" {
+			t.Errorf("%s: cache %s lost the extension", step, path)
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != wantDoc {
+			t.Errorf("%s: got %q, want %q", step, buf, wantDoc)
+		}
+	}
+
+	check("first fetch", true, "sshproxy:\n  user: one\n")
+	if srv.sent() != "" {
+		t.Errorf("first fetch sent If-None-Match %s", srv.sent())
+	}
+	check("unchanged", false, "sshproxy:\n  user: one\n")
+	if srv.sent() != `"v1"` {
+		t.Errorf("got If-None-Match %q, want the ETag of the copy", srv.sent())
+	}
+	srv.set("sshproxy:\n  user: two\n", `"v2"`, 0)
+	check("changed", true, "sshproxy:\n  user: two\n")
+	srv.set("sshproxy:\n  user: three\n", "", 0)
+	check("without an ETag", true, "sshproxy:\n  user: three\n")
+	check("without an ETag again", false, "sshproxy:\n  user: three\n")
+
+	// The copy is used while the server fails or is gone.
+	srv.set("", "", http.StatusInternalServerError)
+	check("server error", false, "sshproxy:\n  user: three\n")
+	srv.Close()
+	check("offline", false, "sshproxy:\n  user: three\n")
+
+	// Without a copy, failures are errors.
+	if _, _, err := syncConfigURL(srv.URL + "/other.yaml"); err == nil {
+		t.Error("offline without a copy: no error")
+	}
+	for _, rawurl := range []string{"http://example.com/shared.yaml", "ftp://127.0.0.1/shared.yaml"} {
+		if _, _, err := syncConfigURL(rawurl); err == nil {
+			t.Errorf("%s: no error", rawurl)
+		}
+	}
+}
+
+func TestConfigURLPrecedence(t *testing.T) {
+	if systemLayers() != nil {
+		t.Skip("the system config file would be merged too")
+	}
+	dir := testTree(t, map[string]string{
+		"home/.sshhttpproxy.yaml":    "sshproxy:\n  user: home\n",
+		"project/.sshhttpproxy.yaml": "sshproxy:\n  port: 2222\n",
+	})
+	useHome(t, filepath.Join(dir, "home"))
+	chdir(t, filepath.Join(dir, "project"))
+	useConfigFile(t, "")
+	srv := newConfigServer(t, "sshproxy:\n  user: shared\n  remote: bastion:22\n  port: 22\n", `"v1"`)
+	configURL = srv.URL + "/shared.yaml"
+
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	s := currentSettings().SSHProxy
+	if s.User != "home" || s.Remote != "bastion:22" || s.Port != 2222 {
+		t.Errorf("got user %q, remote %q, port %d", s.User, s.Remote, s.Port)
+	}
+	configMu.RLock()
+	files := configFiles
+	configMu.RUnlock()
+	if len(files) != 3 || !reflect.DeepEqual(files[1:], []string{
+		filepath.Join(dir, "home", ".sshhttpproxy.yaml"),
+		filepath.Join(dir, "project", ".sshhttpproxy.yaml"),
+	}) {
+		t.Errorf("got files %q, want the shared config first", files)
+	}
+}
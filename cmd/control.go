@@ -0,0 +1,178 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// defaultDrainTimeout is how long a drain request waits for open
+// connections without a timeout.
+const defaultDrainTimeout = time.Minute
+
+// controlSocketPath returns the path of the unix socket used by the control API.
+func controlSocketPath() (string, error) {
+	if path := currentSettings().Control.Socket; path != "" {
+		return os.ExpandEnv(path), nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".sshhttpproxy.sock"), nil
+}
+
+// startControlServer serves the control API on a unix socket until ctx is
+// done. A drain request calls cancel once the forwards are drained.
+func startControlServer(ctx context.Context, cancel func(), m *forwardManager) error {
+	path, err := controlSocketPath()
+	if err != nil {
+		return err
+	}
+	listener := takeListener(controlListenerName)
+	if listener == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("control socket %s is already in use", path)
+		}
+		// Remove a stale socket left behind by a previous instance.
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if listener, err = net.Listen("unix", path); err != nil {
+			return err
+		}
+	}
+	controlListener, _ = listener.(*net.UnixListener)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/forwards", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.ps.Forwards())
+	})
+	mux.HandleFunc("/forwards/pause", forwardAction(m.ps.Pause))
+	mux.HandleFunc("/forwards/resume", forwardAction(m.ps.Resume))
+	mux.HandleFunc("/groups", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.Groups())
+	})
+	mux.HandleFunc("/groups/enable", forwardAction(m.Enable))
+	mux.HandleFunc("/groups/disable", forwardAction(m.Disable))
+	mux.HandleFunc("/hosts/reconnect", forwardAction(m.ps.Reconnect))
+	mux.HandleFunc("/drain", drainHandler(m.ps, cancel))
+	mux.Handle("/metrics", metricsHandler(m.ps))
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			logger.Errorf("error closing control server: %s", err)
+		}
+	}()
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("control server error: %s", err)
+		}
+	}()
+	logger.Debugf("control API listening on %s", path)
+	return nil
+}
+
+func forwardAction(action func(name string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := action(r.URL.Query().Get("name")); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, proxy.ErrUnknownForward) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// drainStatus is the response to a drain request.
+type drainStatus struct {
+	// Drained is set if all connections finished within the timeout.
+	Drained bool
+}
+
+// drainHandler drains the forwards of ps for the timeout query parameter,
+// 60s by default, replies and calls cancel to exit.
+func drainHandler(ps *proxySet, cancel func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		timeout := defaultDrainTimeout
+		if s := r.URL.Query().Get("timeout"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				http.Error(w, fmt.Sprintf("invalid timeout %q", s), http.StatusBadRequest)
+				return
+			}
+			timeout = d
+		}
+		logger.Infof("draining on request")
+		status := drainStatus{Drained: drain(ps, timeout)}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		// Closing the server must not cut off the response.
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		cancel()
+	}
+}
+
+// controlRequest sends a request to the control API of a running instance.
+func controlRequest(method, path string, query url.Values) ([]byte, error) {
+	sock, err := controlSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+	u := url.URL{Scheme: "http", Host: "sshhttpproxy", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("control API: %s", strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,42 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/spf13/cobra"
+)
+
+var drainCmd = &cobra.Command{
+	Use:   "drain",
+	Short: "Drain a running proxy and make it exit",
+	Long: `Stop all forwards of a running proxy from accepting connections, wait for
+the open ones to finish, for up to --timeout, and make the proxy exit. This
+returns once the proxy is drained, e.g. for deployments or a sleep hook.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		body, err := controlRequest(http.MethodPost, "/drain", url.Values{"timeout": {timeout.String()}})
+		if err != nil {
+			return err
+		}
+		var status drainStatus
+		if err := json.Unmarshal(body, &status); err != nil {
+			return err
+		}
+		if !status.Drained {
+			return fmt.Errorf("connections were still open after %s", timeout)
+		}
+		fmt.Println("drained")
+		return nil
+	},
+}
+
+func init() {
+	drainCmd.Flags().Duration("timeout", defaultDrainTimeout, "how long to wait for open connections to finish")
+	rootCmd.AddCommand(drainCmd)
+}
@@ -0,0 +1,49 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+)
+
+// openDumps parses --dump values of the form <forward>:<file.pcap> and opens
+// a pcap writer for each forward. Forward names may contain colons, so the
+// file name is everything after the last one. The returned function closes
+// all opened files.
+func openDumps(specs []string) (map[string]*proxy.PcapWriter, func(), error) {
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			if err := f.Close(); err != nil {
+				logger.Errorf("error closing %s: %s", f.Name(), err)
+			}
+		}
+	}
+	dumps := make(map[string]*proxy.PcapWriter)
+	for _, spec := range specs {
+		idx := strings.LastIndex(spec, ":")
+		if idx <= 0 || idx == len(spec)-1 {
+			closeAll()
+			return nil, nil, fmt.Errorf("invalid dump %q, expected <forward>:<file.pcap>", spec)
+		}
+		name, path := spec[:idx], spec[idx+1:]
+		f, err := os.Create(path)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		files = append(files, f)
+		w, err := proxy.NewPcapWriter(f)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		dumps[name] = w
+		logger.Infof("dumping traffic of %s to %s", name, path)
+	}
+	return dumps, closeAll, nil
+}
@@ -0,0 +1,178 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// proxyEnvVars are set to the proxy URL, in both cases as tools differ in
+// which they read.
+var proxyEnvVars = []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"}
+
+// socksEnvVars are set to the URL of a socks forward.
+var socksEnvVars = []string{"ALL_PROXY", "all_proxy"}
+
+// noProxyEnvVars are set to the hosts that bypass the proxy.
+var noProxyEnvVars = []string{"NO_PROXY", "no_proxy"}
+
+// shellFormats print a statement setting or, with an empty value, unsetting
+// an environment variable.
+var shellFormats = map[string]func(name, value string) string{
+	"sh": func(name, value string) string {
+		if value == "" {
+			return "unset " + name
+		}
+		return fmt.Sprintf("export %s=%s", name, shellQuote(value))
+	},
+	"fish": func(name, value string) string {
+		if value == "" {
+			return fmt.Sprintf("set -e %s;", name)
+		}
+		return fmt.Sprintf("set -gx %s %s;", name, shellQuote(value))
+	},
+	"powershell": func(name, value string) string {
+		if value == "" {
+			return fmt.Sprintf("Remove-Item Env:%s -ErrorAction SilentlyContinue", name)
+		}
+		return fmt.Sprintf("$env:%s = '%s'", name, strings.Replace(value, "'", "''", -1))
+	},
+	"cmd": func(name, value string) string {
+		return fmt.Sprintf("set %s=%s", name, value)
+	},
+}
+
+// shellQuote quotes s for POSIX shells and fish.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// defaultShell guesses the shell the output is for.
+func defaultShell() string {
+	if runtime.GOOS == "windows" {
+		return "powershell"
+	}
+	if filepath.Base(os.Getenv("SHELL")) == "fish" {
+		return "fish"
+	}
+	return "sh"
+}
+
+// runningForwards returns the forwards of a running instance.
+func runningForwards() ([]forwardStatus, error) {
+	body, err := controlRequest(http.MethodGet, "/forwards", nil)
+	if err != nil {
+		return nil, err
+	}
+	var infos []forwardStatus
+	if err := json.Unmarshal(body, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// proxyForwards returns the connect and socks forwards of a running
+// instance, or only the forward name if it is not empty.
+func proxyForwards(name string) (connect, socks *forwardStatus, err error) {
+	infos, err := runningForwards()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range infos {
+		info := &infos[i]
+		if name != "" && info.Name != name {
+			continue
+		}
+		switch {
+		case info.Mode == "connect" && connect == nil:
+			connect = info
+		case info.Mode == "socks" && socks == nil:
+			socks = info
+		case name != "":
+			return nil, nil, fmt.Errorf("forward %s is neither a connect nor a socks forward", name)
+		}
+	}
+	if connect == nil && socks == nil {
+		if name != "" {
+			return nil, nil, fmt.Errorf("no forward named %s", name)
+		}
+		return nil, nil, fmt.Errorf("no connect or socks forward is running")
+	}
+	return connect, socks, nil
+}
+
+var envCmd = &cobra.Command{
+	Use:   "env",
+	Short: "Print shell commands pointing proxy variables at the running proxy",
+	Long: `Print shell commands that set HTTP_PROXY, HTTPS_PROXY and NO_PROXY to the
+connect forward of the running proxy, and ALL_PROXY to its socks forward, so
+programs in the shell use it:
+
+  eval "$(sshhttpproxy env)"
+  sshhttpproxy env --shell powershell | Invoke-Expression
+
+With --unset the commands remove the variables again.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		shell, _ := cmd.Flags().GetString("shell")
+		if shell == "" {
+			shell = defaultShell()
+		}
+		format, ok := shellFormats[shell]
+		if !ok {
+			return fmt.Errorf("unknown shell %q, use sh, fish, powershell or cmd", shell)
+		}
+		vars := make(map[string]string)
+		unset, _ := cmd.Flags().GetBool("unset")
+		if !unset {
+			name, _ := cmd.Flags().GetString("forward")
+			connect, socks, err := proxyForwards(name)
+			if err != nil {
+				return err
+			}
+			if connect != nil {
+				for _, v := range proxyEnvVars {
+					vars[v] = "http://" + connect.Local
+				}
+			}
+			if socks != nil {
+				for _, v := range socksEnvVars {
+					vars[v] = "socks5h://" + socks.Local
+				}
+			}
+			noProxy, _ := cmd.Flags().GetStringSlice("no-proxy")
+			for _, v := range noProxyEnvVars {
+				vars[v] = strings.Join(noProxy, ",")
+			}
+		}
+		for _, names := range [][]string{proxyEnvVars, socksEnvVars, noProxyEnvVars} {
+			for _, name := range names {
+				// cmd variables are case insensitive.
+				if shell == "cmd" && strings.ToLower(name) == name {
+					continue
+				}
+				if vars[name] == "" && !unset {
+					continue
+				}
+				fmt.Println(format(name, vars[name]))
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	envCmd.Flags().String("shell", "", "shell syntax: sh, fish, powershell or cmd (default from the platform and $SHELL)")
+	envCmd.Flags().String("forward", "", "use this connect or socks forward instead of the first of each")
+	envCmd.Flags().StringSlice("no-proxy", []string{"localhost", "127.0.0.1", "::1"}, "hosts that bypass the proxy")
+	envCmd.Flags().Bool("unset", false, "print commands removing the variables instead")
+	rootCmd.AddCommand(envCmd)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// envYAMLKeys are the keys whose environment variables hold YAML (or JSON),
+// as lists and maps cannot be given as plain strings. They replace the
+// value of the config files as a whole.
+var envYAMLKeys = []string{"forwards", "reverse", "hosts"}
+
+// envFileKeys are the secrets that can also be read from the file named by
+// their environment variable with a _FILE suffix, e.g. a mounted secret.
+var envFileKeys = []string{"sshproxy.privatekeydata", "sshproxy.passphrase", "sshproxy.password", "sshproxy.pkcs11.pin"}
+
+// envName returns the environment variable that overrides key.
+func envName(key string) string {
+	return "SSHHTTPPROXY_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// loadEnvConfig applies the environment variables viper cannot read by
+// itself to the config in dst: YAML values of envYAMLKeys and _FILE
+// variables of envFileKeys.
+func loadEnvConfig(dst *viper.Viper) error {
+	for _, key := range envYAMLKeys {
+		value, ok := os.LookupEnv(envName(key))
+		if !ok {
+			continue
+		}
+		// Nest the value under its key so lists and maps can be read as
+		// a document, block style or flow style alike.
+		doc := key + ":\n  " + strings.Replace(value, "\n", "\n  ", -1)
+		v := viper.New()
+		v.SetConfigType("yaml")
+		if err := v.ReadConfig(strings.NewReader(doc)); err != nil {
+			return fmt.Errorf("%s: %s", envName(key), err)
+		}
+		dst.Set(key, v.Get(key))
+	}
+	for _, key := range envFileKeys {
+		path := os.Getenv(envName(key) + "_FILE")
+		if path == "" {
+			continue
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s_FILE: %s", envName(key), err)
+		}
+		dst.Set(key, strings.TrimRight(string(buf), "\n"))
+	}
+	return nil
+}
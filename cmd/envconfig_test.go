@@ -0,0 +1,106 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// setFlag sets the flag name of the root command for the rest of the test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	flag := rootCmd.PersistentFlags().Lookup(name)
+	old, changed := flag.Value.String(), flag.Changed
+	if err := flag.Value.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	flag.Changed = true
+	t.Cleanup(func() {
+		flag.Value.Set(old)
+		flag.Changed = changed
+	})
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "precedence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	useConfigFile(t, path)
+	// The flags are bound to the global instance at startup.
+	for key, flag := range flagBindings {
+		viper.BindPFlag(key, flag)
+	}
+
+	writeConfig(t, path, `
+sshproxy:
+  user: file
+  remote: file.example.com:22
+  port: 2200
+  password: file-password
+forwards:
+  - name: file
+    remote: file.internal:80
+`)
+	password := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(password, []byte("mounted-password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "SSHHTTPPROXY_SSHPROXY_USER", "env")
+	setenv(t, "SSHHTTPPROXY_SSHPROXY_PORT", "2300")
+	setenv(t, "SSHHTTPPROXY_SSHPROXY_PASSWORD_FILE", password)
+	setenv(t, "SSHHTTPPROXY_FORWARDS", `[{name: env, remote: "env.internal:80"}]`)
+	setFlag(t, "port", "2400")
+
+	check := func(step, user, remote string) {
+		t.Helper()
+		s := currentSettings()
+		if s.SSHProxy.User != user {
+			t.Errorf("%s: got user %q, want %q", step, s.SSHProxy.User, user)
+		}
+		if s.SSHProxy.Remote != remote {
+			t.Errorf("%s: got remote %q, want %q from the file", step, s.SSHProxy.Remote, remote)
+		}
+		if s.SSHProxy.Port != 2400 {
+			t.Errorf("%s: got port %d, want 2400 from the flag", step, s.SSHProxy.Port)
+		}
+		if s.SSHProxy.Password != "mounted-password" {
+			t.Errorf("%s: got password %q, want the one of the _FILE variable", step, s.SSHProxy.Password)
+		}
+		if len(s.Forwards) != 1 || s.Forwards[0].Name != "env" {
+			t.Errorf("%s: got forwards %+v, want the list of the environment", step, s.Forwards)
+		}
+	}
+
+	// Flags override the environment, which overrides the files.
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	check("load", "env", "file.example.com:22")
+
+	// The same holds for the config reloaded from changed files.
+	writeConfig(t, path, `
+sshproxy:
+  user: changed
+  remote: changed.example.com:22
+  port: 2200
+`)
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	check("reload", "env", "changed.example.com:22")
+
+	// A variable unset since is no longer applied.
+	os.Unsetenv("SSHHTTPPROXY_SSHPROXY_USER")
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	check("reload without the variable", "changed", "changed.example.com:22")
+}
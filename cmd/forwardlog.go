@@ -0,0 +1,73 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	logging "github.com/op/go-logging"
+)
+
+// logConfig sets what is logged about a forward, so a busy forward can be
+// quieted, or the one being investigated made more verbose, without
+// changing the output of the others.
+type logConfig struct {
+	// Level is the most verbose level logged about the forward: debug,
+	// info, notice, warning, error or critical. It defaults to the level
+	// of the rest of the output.
+	Level string
+	// Only, if set, are the categories of messages logged below error:
+	// forward, connections or copy, see proxy.LogCategory. Errors are
+	// logged whatever their category.
+	Only []string
+}
+
+func (c logConfig) check() error {
+	if c.Level != "" {
+		if _, err := logging.LogLevel(c.Level); err != nil {
+			return fmt.Errorf("log.level: unknown level %q", c.Level)
+		}
+	}
+	for _, only := range c.Only {
+		if !isLogCategory(only) {
+			return fmt.Errorf("log.only: unknown category %q", only)
+		}
+	}
+	return nil
+}
+
+func isLogCategory(name string) bool {
+	for _, category := range proxy.LogCategories {
+		if string(category) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the levels of the logging modules of the forward name. A
+// forward without a log config follows the default level again.
+func (c logConfig) apply(name string) {
+	level := logging.GetLevel("")
+	if c.Level != "" {
+		level, _ = logging.LogLevel(c.Level)
+	}
+	for _, category := range proxy.LogCategories {
+		l := level
+		if len(c.Only) > 0 && !c.logs(category) && l > logging.ERROR {
+			l = logging.ERROR
+		}
+		logging.SetLevel(l, proxy.ForwardLogModule(name, category))
+	}
+}
+
+// logs reports whether category is one of Only.
+func (c logConfig) logs(category proxy.LogCategory) bool {
+	for _, only := range c.Only {
+		if only == string(category) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// forwardsCmd groups commands that manage the forwards of a running instance.
+var forwardsCmd = &cobra.Command{
+	Use:   "forwards",
+	Short: "Manage forwards of a running proxy",
+}
+
+var forwardsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Show the forwards of a running proxy",
+	Long: `Show the forwards of a running proxy. For reverse forwards REMOTE is the
+address the ssh server was asked to listen on; servers without GatewayPorts
+enabled listen on loopback instead of all interfaces.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		body, err := controlRequest(http.MethodGet, "/forwards", nil)
+		if err != nil {
+			return err
+		}
+		var infos []forwardStatus
+		if err := json.Unmarshal(body, &infos); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tHOST\tDIRECTION\tLOCAL\tREMOTE\tSTATE")
+		for _, info := range infos {
+			dir, state := "local", "active"
+			if info.Reverse {
+				dir = "reverse"
+			}
+			if info.Down {
+				state = "target down"
+			}
+			if info.Paused {
+				state = "paused"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.Name, info.Host, dir, info.Local, info.Remote, state)
+		}
+		return w.Flush()
+	},
+}
+
+var forwardsPauseCmd = &cobra.Command{
+	Use:   "pause <name>",
+	Short: "Stop a forward from accepting new connections",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := controlRequest(http.MethodPost, "/forwards/pause", url.Values{"name": {args[0]}}); err != nil {
+			return err
+		}
+		fmt.Printf("paused %s\n", args[0])
+		return nil
+	},
+}
+
+var forwardsResumeCmd = &cobra.Command{
+	Use:   "resume <name>",
+	Short: "Let a paused forward accept connections again",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := controlRequest(http.MethodPost, "/forwards/resume", url.Values{"name": {args[0]}}); err != nil {
+			return err
+		}
+		fmt.Printf("resumed %s\n", args[0])
+		return nil
+	},
+}
+
+// groupsCmd groups commands that turn groups of forwards on and off.
+var groupsCmd = &cobra.Command{
+	Use:   "groups",
+	Short: "Manage forward groups of a running proxy",
+}
+
+var groupsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Show the forward groups of a running proxy",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		body, err := controlRequest(http.MethodGet, "/groups", nil)
+		if err != nil {
+			return err
+		}
+		var groups []groupStatus
+		if err := json.Unmarshal(body, &groups); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "GROUP\tSTATE\tFORWARDS")
+		for _, group := range groups {
+			state := "disabled"
+			if group.Enabled {
+				state = "enabled"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", group.Name, state, strings.Join(group.Forwards, ","))
+		}
+		return w.Flush()
+	},
+}
+
+var groupsEnableCmd = &cobra.Command{
+	Use:   "enable <group>",
+	Short: "Start the forwards of a group",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := controlRequest(http.MethodPost, "/groups/enable", url.Values{"name": {args[0]}}); err != nil {
+			return err
+		}
+		fmt.Printf("enabled %s\n", args[0])
+		return nil
+	},
+}
+
+var groupsDisableCmd = &cobra.Command{
+	Use:   "disable <group>",
+	Short: "Stop the forwards of a group",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := controlRequest(http.MethodPost, "/groups/disable", url.Values{"name": {args[0]}}); err != nil {
+			return err
+		}
+		fmt.Printf("disabled %s\n", args[0])
+		return nil
+	},
+}
+
+var reconnectCmd = &cobra.Command{
+	Use:   "reconnect [host]",
+	Short: "Replace the ssh connection of a host, or of all hosts",
+	Long: `Replace the ssh connection of a host, or of all hosts. Local forwards stay
+bound and new connections wait for the new ssh connection; connections open
+over the old one are closed.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var host string
+		if len(args) > 0 {
+			host = args[0]
+		}
+		if _, err := controlRequest(http.MethodPost, "/hosts/reconnect", url.Values{"name": {host}}); err != nil {
+			return err
+		}
+		fmt.Println("reconnected")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reconnectCmd)
+	forwardsCmd.AddCommand(forwardsListCmd)
+	forwardsCmd.AddCommand(forwardsPauseCmd)
+	forwardsCmd.AddCommand(forwardsResumeCmd)
+	rootCmd.AddCommand(forwardsCmd)
+	groupsCmd.AddCommand(groupsListCmd)
+	groupsCmd.AddCommand(groupsEnableCmd)
+	groupsCmd.AddCommand(groupsDisableCmd)
+	rootCmd.AddCommand(groupsCmd)
+}
@@ -0,0 +1,314 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+)
+
+// forwardManager starts the configured forwards and turns groups of them
+// on and off.
+type forwardManager struct {
+	ps       *proxySet
+	dumps    map[string]*proxy.PcapWriter
+	forwards []forwardConfig
+	// served are the forwards that forwards commands added to forwards.
+	served []forwardConfig
+	// state, if set, has the ports forwards listened on last time.
+	state *profileState
+
+	mu      sync.Mutex
+	enabled map[string]bool
+	// allGroups is set if groups start enabled, which also applies to
+	// groups added by a reload.
+	allGroups bool
+}
+
+// newForwardManager returns a manager for forwards with the groups in
+// enabled turned on. If enabled is empty, all groups are.
+func newForwardManager(ps *proxySet, dumps map[string]*proxy.PcapWriter, forwards []forwardConfig, enabled []string) (*forwardManager, error) {
+	m := &forwardManager{
+		ps:        ps,
+		dumps:     dumps,
+		forwards:  forwards,
+		enabled:   make(map[string]bool),
+		allGroups: len(enabled) == 0,
+	}
+	for _, group := range m.groups() {
+		m.enabled[group] = m.allGroups
+	}
+	for _, group := range enabled {
+		if _, ok := m.enabled[group]; !ok {
+			return nil, fmt.Errorf("unknown group %q", group)
+		}
+		m.enabled[group] = true
+	}
+	return m, nil
+}
+
+// groups returns the names of all groups in order.
+func (m *forwardManager) groups() []string {
+	seen := make(map[string]bool)
+	var groups []string
+	for _, fwd := range m.forwards {
+		if fwd.Group != "" && !seen[fwd.Group] {
+			seen[fwd.Group] = true
+			groups = append(groups, fwd.Group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// hosts returns the hosts used by forwards that start enabled.
+func (m *forwardManager) hosts() []string {
+	var hosts []string
+	for _, fwd := range m.forwards {
+		if m.isActive(fwd) {
+			hosts = append(hosts, fwd.Host)
+		}
+	}
+	return hosts
+}
+
+// isActive reports whether fwd is not in a disabled group.
+func (m *forwardManager) isActive(fwd forwardConfig) bool {
+	return fwd.Group == "" || m.enabled[fwd.Group]
+}
+
+// active returns the names of forwards that are not in a disabled group.
+func (m *forwardManager) active() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for _, fwd := range m.forwards {
+		if m.isActive(fwd) {
+			names = append(names, fwd.Name)
+		}
+	}
+	return names
+}
+
+// start starts all forwards that are not in a disabled group, several at
+// a time.
+func (m *forwardManager) start() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var jobs []startJob
+	for _, fwd := range m.forwards {
+		if fwd.Group != "" && !m.enabled[fwd.Group] {
+			continue
+		}
+		fwd := fwd
+		jobs = append(jobs, startJob{"forward " + fwd.Name, func() error {
+			if err := m.startForward(fwd); err != nil {
+				return fmt.Errorf("%s: %w", fwd.Name, err)
+			}
+			return nil
+		}})
+	}
+	return m.ps.startAll(jobs)
+}
+
+// startForward sets up fwd on its host, connecting the host if needed, or
+// only once fwd is bound with sshproxy.listenearly.
+func (m *forwardManager) startForward(fwd forwardConfig) error {
+	early := currentSettings().SSHProxy.ListenEarly
+	host := m.ps.ensure
+	if early {
+		host = m.ps.add
+	}
+	p, err := host(fwd.Host)
+	if err != nil {
+		return err
+	}
+	opts, err := m.options(fwd)
+	if err != nil {
+		return err
+	}
+	opts.Listener = takeListener(fwd.Name)
+	fwd.Log.apply(fwd.Name)
+	local, err := p.ForwardWithOptions(fwd.Name, fwd.Remote, m.localAddr(fwd), opts)
+	if err != nil && opts.Listener == nil && m.localAddr(fwd) != fwd.Local {
+		// The port of the last run is taken, pick another.
+		local, err = p.ForwardWithOptions(fwd.Name, fwd.Remote, fwd.Local, opts)
+	}
+	if err != nil {
+		return err
+	}
+	m.ps.hold(fwd.Host)
+	logger.Debugf("%s -> %s", fwd.Name, local)
+	if early {
+		_, err = m.ps.ensure(fwd.Host)
+	}
+	return err
+}
+
+// localAddr returns the address fwd listens on: the one it had last time if
+// it listens on a random port, so clients can keep using it across
+// restarts.
+func (m *forwardManager) localAddr(fwd forwardConfig) string {
+	if m.state == nil || (fwd.Local != "" && fwd.Local != "0") {
+		return fwd.Local
+	}
+	if addr := m.state.port(fwd.Name); addr != "" {
+		return addr
+	}
+	return fwd.Local
+}
+
+// options returns the proxy options of fwd.
+func (m *forwardManager) options(fwd forwardConfig) (*proxy.ForwardOptions, error) {
+	var err error
+	opts := forwardOptions(fwd.Name, m.dumps)
+	opts.SNIRoutes = routes(fwd.SNI)
+	opts.HTTP = fwd.Mode == "http"
+	opts.Connect = fwd.Mode == "connect"
+	opts.SOCKS = fwd.Mode == "socks"
+	opts.Transparent = fwd.Mode == "transparent"
+	opts.Destinations = destinationRules(fwd.Destinations)
+	opts.AcceptTimeout = fwd.Timeouts.Accept
+	opts.DialTimeout = fwd.Timeouts.Dial
+	opts.MaxLifetime = fwd.Timeouts.MaxLifetime
+	opts.Priority = proxy.Priority(fwd.Priority)
+	opts.Watch = fwd.Watch
+	if fwd.Chaos != (chaosConfig{}) {
+		opts.Chaos = &proxy.Chaos{
+			Latency:         fwd.Chaos.Latency,
+			DropPercent:     fwd.Chaos.Drop,
+			TruncatePercent: fwd.Chaos.Truncate,
+			TruncateAfter:   fwd.Chaos.TruncateAfter,
+		}
+	}
+	if fwd.Upstream.Address != "" {
+		opts.Upstream = &proxy.Upstream{
+			Addr:     fwd.Upstream.Address,
+			Username: fwd.Upstream.Username,
+			Password: os.ExpandEnv(fwd.Upstream.Password),
+		}
+	}
+	opts.HTTPRoutes = routes(fwd.Routes)
+	opts.RequestHeaders = headerRules(fwd.Headers.Request)
+	opts.ResponseHeaders = headerRules(fwd.Headers.Response)
+	if fwd.Mirror.Remote != "" {
+		opts.Mirror = &proxy.Mirror{Remote: fwd.Mirror.Remote, Percent: fwd.Mirror.Percent}
+	}
+	if opts.BearerToken, err = fwd.Auth.Bearer.source(); err != nil {
+		return nil, err
+	}
+	if len(fwd.TLS.Hosts) > 0 {
+		if opts.TLS, err = forwardTLS(fwd); err != nil {
+			return nil, err
+		}
+	}
+	if opts.RemoteTLS, err = remoteTLS(fwd.RemoteTLS); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// Enable starts the forwards of group. If one fails, those already
+// started are closed again.
+func (m *forwardManager) Enable(group string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	enabled, ok := m.enabled[group]
+	if !ok {
+		return fmt.Errorf("unknown group %q", group)
+	}
+	if enabled {
+		return nil
+	}
+	var started []forwardConfig
+	for _, fwd := range m.forwards {
+		if fwd.Group != group {
+			continue
+		}
+		if err := m.startForward(fwd); err != nil {
+			m.closeForwards(started)
+			return fmt.Errorf("%s: %w", fwd.Name, err)
+		}
+		started = append(started, fwd)
+	}
+	m.enabled[group] = true
+	logger.Infof("group %s enabled", group)
+	return nil
+}
+
+// Disable closes the forwards of group. Their open connections are left
+// alone.
+func (m *forwardManager) Disable(group string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	enabled, ok := m.enabled[group]
+	if !ok {
+		return fmt.Errorf("unknown group %q", group)
+	}
+	if !enabled {
+		return nil
+	}
+	var forwards []forwardConfig
+	for _, fwd := range m.forwards {
+		if fwd.Group == group {
+			forwards = append(forwards, fwd)
+		}
+	}
+	m.closeForwards(forwards)
+	m.enabled[group] = false
+	logger.Infof("group %s disabled", group)
+	return nil
+}
+
+// closeForwards closes forwards, releasing their connections.
+func (m *forwardManager) closeForwards(forwards []forwardConfig) {
+	for _, fwd := range forwards {
+		p, err := m.ps.get(fwd.Host)
+		if err != nil {
+			continue
+		}
+		if err := p.CloseForward(fwd.Name); err != nil {
+			logger.Errorf("error closing forward %s: %s", fwd.Name, err)
+			continue
+		}
+		m.ps.release(fwd.Host)
+	}
+}
+
+// groupStatus is a group in the output of the control API.
+type groupStatus struct {
+	Name     string
+	Enabled  bool
+	Forwards []string
+}
+
+// Groups returns the state of all groups.
+func (m *forwardManager) Groups() []groupStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var statuses []groupStatus
+	for _, group := range m.groups() {
+		status := groupStatus{Name: group, Enabled: m.enabled[group]}
+		for _, fwd := range m.forwards {
+			if fwd.Group == group {
+				status.Forwards = append(status.Forwards, fwd.Name)
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// forwardOptions returns the options shared by all forwards.
+func forwardOptions(name string, dumps map[string]*proxy.PcapWriter) *proxy.ForwardOptions {
+	c := currentSettings().SSHProxy
+	return &proxy.ForwardOptions{
+		AcceptRate:  c.AcceptRate,
+		AcceptBurst: c.AcceptBurst,
+		Dump:        dumps[name],
+	}
+}
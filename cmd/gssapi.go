@@ -0,0 +1,143 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+//go:build gssapi && cgo
+// +build gssapi,cgo
+
+package cmd
+
+/*
+#cgo LDFLAGS: -lgssapi_krb5
+#include <stdlib.h>
+#include <string.h>
+#include <gssapi/gssapi.h>
+
+// krb5_mech is the Kerberos V5 mechanism, the only one ssh servers support
+// for gssapi-with-mic.
+static gss_OID_desc krb5_mech = {9, "\x2a\x86\x48\x86\xf7\x12\x01\x02\x02"};
+
+static OM_uint32 import_name(OM_uint32 *minor, char *name, gss_name_t *out) {
+	gss_buffer_desc buf = {strlen(name), name};
+	return gss_import_name(minor, &buf, GSS_C_NT_HOSTBASED_SERVICE, out);
+}
+
+static OM_uint32 init_sec_context(OM_uint32 *minor, gss_ctx_id_t *ctx, gss_name_t target, OM_uint32 flags, void *token, size_t len, gss_buffer_desc *out) {
+	gss_buffer_desc in = {len, token};
+	return gss_init_sec_context(minor, GSS_C_NO_CREDENTIAL, ctx, target, &krb5_mech, flags, 0, GSS_C_NO_CHANNEL_BINDINGS, len ? &in : GSS_C_NO_BUFFER, NULL, out, NULL, NULL);
+}
+
+static OM_uint32 get_mic(OM_uint32 *minor, gss_ctx_id_t ctx, void *msg, size_t len, gss_buffer_desc *out) {
+	gss_buffer_desc in = {len, msg};
+	return gss_get_mic(minor, ctx, GSS_C_QOP_DEFAULT, &in, out);
+}
+
+static OM_uint32 display_status(OM_uint32 *minor, OM_uint32 code, int type, OM_uint32 *more, gss_buffer_desc *out) {
+	return gss_display_status(minor, code, type, GSS_C_NO_OID, more, out);
+}
+
+static int failed(OM_uint32 major) {
+	return GSS_ERROR(major) != 0;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// gssapiClient is a GSSAPI initiator over the system GSSAPI library, e.g.
+// MIT Kerberos, using the default credentials of the user, the tickets
+// of kinit. It establishes one security context.
+type gssapiClient struct {
+	name C.gss_name_t
+	ctx  C.gss_ctx_id_t
+}
+
+func newGSSAPIClient() (ssh.GSSAPIClient, error) {
+	return &gssapiClient{}, nil
+}
+
+func (c *gssapiClient) InitSecContext(target string, token []byte, delegate bool) ([]byte, bool, error) {
+	var minor C.OM_uint32
+	if c.name == nil {
+		ctarget := C.CString(target)
+		defer C.free(unsafe.Pointer(ctarget))
+		if major := C.import_name(&minor, ctarget, &c.name); C.failed(major) != 0 {
+			return nil, false, gssapiError("importing "+target, major, minor)
+		}
+	}
+	flags := C.OM_uint32(C.GSS_C_MUTUAL_FLAG | C.GSS_C_INTEG_FLAG)
+	if delegate {
+		flags |= C.GSS_C_DELEG_FLAG
+	}
+	var out C.gss_buffer_desc
+	major := C.init_sec_context(&minor, &c.ctx, c.name, flags, bytesPointer(token), C.size_t(len(token)), &out)
+	defer C.gss_release_buffer(new(C.OM_uint32), &out)
+	if C.failed(major) != 0 {
+		return nil, false, gssapiError("initializing the context for "+target, major, minor)
+	}
+	return C.GoBytes(out.value, C.int(out.length)), major&C.GSS_S_CONTINUE_NEEDED != 0, nil
+}
+
+func (c *gssapiClient) GetMIC(micField []byte) ([]byte, error) {
+	var minor C.OM_uint32
+	var out C.gss_buffer_desc
+	major := C.get_mic(&minor, c.ctx, bytesPointer(micField), C.size_t(len(micField)), &out)
+	defer C.gss_release_buffer(new(C.OM_uint32), &out)
+	if C.failed(major) != 0 {
+		return nil, gssapiError("signing", major, minor)
+	}
+	return C.GoBytes(out.value, C.int(out.length)), nil
+}
+
+func (c *gssapiClient) DeleteSecContext() error {
+	var minor C.OM_uint32
+	if c.ctx != nil {
+		C.gss_delete_sec_context(&minor, &c.ctx, nil)
+		c.ctx = nil
+	}
+	if c.name != nil {
+		C.gss_release_name(&minor, &c.name)
+		c.name = nil
+	}
+	return nil
+}
+
+// bytesPointer returns the address of the contents of b for the C side,
+// nil if it is empty.
+func bytesPointer(b []byte) unsafe.Pointer {
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(&b[0])
+}
+
+// gssapiError describes the failure of what with the messages of the
+// GSSAPI library for the major and minor status codes.
+func gssapiError(what string, major, minor C.OM_uint32) error {
+	msgs := gssapiStatus(major, C.GSS_C_GSS_CODE)
+	if minor != 0 {
+		msgs = append(msgs, gssapiStatus(minor, C.GSS_C_MECH_CODE)...)
+	}
+	return fmt.Errorf("gssapi: %s: %s", what, strings.Join(msgs, ": "))
+}
+
+func gssapiStatus(code C.OM_uint32, kind C.int) []string {
+	var msgs []string
+	var minor, more C.OM_uint32
+	for {
+		var buf C.gss_buffer_desc
+		if C.failed(C.display_status(&minor, code, kind, &more, &buf)) != 0 {
+			break
+		}
+		msgs = append(msgs, C.GoStringN((*C.char)(buf.value), C.int(buf.length)))
+		C.gss_release_buffer(&minor, &buf)
+		if more == 0 {
+			break
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,18 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+//go:build !gssapi || !cgo
+// +build !gssapi !cgo
+
+package cmd
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errGSSAPIUnsupported = errors.New("built without gssapi support, rebuild with -tags gssapi")
+
+func newGSSAPIClient() (ssh.GSSAPIClient, error) {
+	return nil, errGSSAPIUnsupported
+}
@@ -0,0 +1,306 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+)
+
+const (
+	// listenFdsStart is the first descriptor passed with the systemd
+	// socket activation protocol.
+	listenFdsStart = 3
+	// upgradeFdEnv names the descriptor a process started by an upgrade
+	// writes to once its forwards are up.
+	upgradeFdEnv = "SSHHTTPPROXY_UPGRADE_FD"
+	// upgradeTimeout bounds how long the new process may take to start.
+	upgradeTimeout = time.Minute
+	// controlListenerName names the control socket among the sockets
+	// handed over in an upgrade.
+	controlListenerName = "sshhttpproxy-control"
+)
+
+// controlListener is the listener of the control API, if it is running.
+var controlListener *net.UnixListener
+
+// inherited holds listening sockets passed in by systemd socket activation
+// or by the process that was upgraded, by forward name.
+var inherited = struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}{}
+
+// inheritListeners takes over the listening sockets described by the
+// LISTEN_FDS and LISTEN_FDNAMES environment variables. Each must be named
+// after the forward it belongs to, query escaped as names are separated by
+// colons.
+func inheritListeners() error {
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	pid := os.Getenv("LISTEN_PID")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, env := range []string{"LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+	if n == 0 || (pid != "" && pid != strconv.Itoa(os.Getpid())) {
+		return nil
+	}
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(listenFdsStart+i), "")
+		var name string
+		if i < len(names) {
+			name, _ = url.QueryUnescape(names[i])
+		}
+		if name == "" {
+			f.Close()
+			return fmt.Errorf("inherited socket %d has no name", listenFdsStart+i)
+		}
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited socket %s: %w", name, err)
+		}
+		listeners[name] = l
+	}
+	inherited.mu.Lock()
+	inherited.listeners = listeners
+	inherited.mu.Unlock()
+	logger.Infof("inherited %d listening sockets", n)
+	return nil
+}
+
+// takeListener returns the inherited listener of forward name, or nil. A
+// listener is only handed out once.
+func takeListener(name string) net.Listener {
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	l := inherited.listeners[name]
+	delete(inherited.listeners, name)
+	return l
+}
+
+// closeInherited closes inherited listeners no forward took.
+func closeInherited() {
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	for name, l := range inherited.listeners {
+		logger.Warningf("no forward named %s, closing its inherited socket", name)
+		l.Close()
+	}
+	inherited.listeners = nil
+}
+
+// notifyUpgraded tells the process that started this one for an upgrade
+// that the forwards are up.
+func notifyUpgraded() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeFdEnv))
+	os.Unsetenv(upgradeFdEnv)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+	if _, err := f.Write([]byte{1}); err != nil {
+		logger.Errorf("error notifying the old process: %s", err)
+	}
+	f.Close()
+}
+
+// upgradeOnSignal starts the binary again on upgradeSignal, hands it the
+// listening sockets and, once it is up, drains this process for up to
+// drainTimeout and calls cancel. The reverse forwards are closed first and
+// started again if the upgrade fails.
+func upgradeOnSignal(ctx context.Context, cancel func(), ps *proxySet, reverse []reverseConfig, dumps map[string]*proxy.PcapWriter, drainTimeout time.Duration) {
+	if upgradeSignal == nil {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, upgradeSignal)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				logger.Infof("upgrading")
+				closeReverse(ps, reverse)
+				if err := upgrade(ps); err != nil {
+					logger.Errorf("upgrade failed: %s", err)
+					restartReverse(ps, reverse, dumps)
+					continue
+				}
+				drain(ps, drainTimeout)
+				cancel()
+				return
+			}
+		}
+	}()
+}
+
+// closeReverse closes the reverse forwards. Their sockets live on the ssh
+// servers and cannot be handed over, and a server refuses the new process
+// a port this one still listens on. Connections open on them are drained
+// like the others.
+func closeReverse(ps *proxySet, reverse []reverseConfig) {
+	for _, fwd := range reverse {
+		p, err := ps.get(fwd.Host)
+		if err != nil {
+			continue
+		}
+		if err := p.CloseForward(fwd.Name); err != nil && !errors.Is(err, proxy.ErrUnknownForward) {
+			logger.Errorf("error closing reverse forward %s: %s", fwd.Name, err)
+		}
+	}
+}
+
+// restartReverse starts the reverse forwards closed by closeReverse again
+// after a failed upgrade. It retries in the background, as the ssh server
+// may not have released the ports bound by the failed process yet.
+func restartReverse(ps *proxySet, reverse []reverseConfig, dumps map[string]*proxy.PcapWriter) {
+	for _, fwd := range reverse {
+		fwd := fwd
+		go retry(ps.ctx, "restarting reverse forward "+fwd.Name, func() error {
+			return startReverse(ps, fwd, dumps)
+		})
+	}
+}
+
+// upgrade starts the current binary with the same arguments, passing it
+// the local listening sockets of all forwards, and waits until it reports
+// that its forwards are up.
+func upgrade(ps *proxySet) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, host := range ps.names() {
+		p, _ := ps.get(host)
+		hostFiles, err := p.ListenerFiles()
+		if err != nil {
+			return err
+		}
+		for name, f := range hostFiles {
+			files[name] = f
+		}
+	}
+	if controlListener != nil {
+		f, err := controlListener.File()
+		if err != nil {
+			return err
+		}
+		files[controlListenerName] = f
+	}
+	names := make([]string, 0, len(files))
+	escaped := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		escaped = append(escaped, url.QueryEscape(name))
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	for _, name := range names {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, files[name])
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	for _, env := range os.Environ() {
+		// The watchdog of a service manager is the job of the new
+		// process once it takes over.
+		if !strings.HasPrefix(env, "LISTEN_") && !strings.HasPrefix(env, upgradeFdEnv+"=") && !strings.HasPrefix(env, "WATCHDOG_PID=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	if activeSystemProxy != nil {
+		saved, err := json.Marshal(activeSystemProxy)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, systemProxyEnv+"="+string(saved))
+	}
+	cmd.Env = append(cmd.Env,
+		"LISTEN_FDS="+strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES="+strings.Join(escaped, ":"),
+		upgradeFdEnv+"="+strconv.Itoa(listenFdsStart+len(names)),
+	)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			go cmd.Wait()
+			return errors.New("the new process exited before its forwards were up")
+		}
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return fmt.Errorf("the new process was not up after %s", upgradeTimeout)
+	}
+	logger.Infof("process %d took over", cmd.Process.Pid)
+	// The new process restores the system proxy settings.
+	activeSystemProxy = nil
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		logger.Warningf("error notifying systemd: %s", err)
+	}
+	if controlListener != nil {
+		// The socket file now belongs to the new process.
+		controlListener.SetUnlinkOnClose(false)
+	}
+	return cmd.Process.Release()
+}
+
+// drain stops all forwards from accepting connections and waits up to
+// timeout for the open ones to finish. It reports whether they did.
+func drain(ps *proxySet, timeout time.Duration) bool {
+	for _, host := range ps.names() {
+		p, _ := ps.get(host)
+		for _, info := range p.Forwards() {
+			if err := p.CloseForward(info.Name); err != nil {
+				logger.Errorf("error closing forward %s: %s", info.Name, err)
+			}
+		}
+	}
+	logger.Infof("draining open connections for up to %s", timeout)
+	deadline := time.Now().Add(timeout)
+	for ps.Idle() == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return ps.Idle() != 0
+}
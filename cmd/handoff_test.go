@@ -0,0 +1,124 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"github.com/elliotpeele/sshhttpproxy/proxy/proxytest"
+)
+
+// testProxySet returns a set holding a connected proxy to srv as the
+// default host.
+func testProxySet(t *testing.T, srv *proxytest.Server) *proxySet {
+	t.Helper()
+	p, err := proxy.New(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ps := &proxySet{
+		ctx:      ctx,
+		fatal:    make(chan error, 1),
+		proxies:  map[string]*proxy.SSHProxy{defaultHost: p},
+		refs:     make(map[string]int),
+		retiring: make(map[*proxy.SSHProxy]bool),
+		stop:     make(chan struct{}),
+	}
+	t.Cleanup(func() {
+		cancel()
+		ps.Shutdown()
+	})
+	return ps
+}
+
+// freePort returns a local port nothing listens on.
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+// echoes reports whether a message sent to addr comes back.
+func echoes(addr, msg string) bool {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		return false
+	}
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	return err == nil && string(buf) == msg
+}
+
+func TestUpgradeReverseForwards(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	port := freePort(t)
+	addr := net.JoinHostPort("127.0.0.1", port)
+	reverse := []reverseConfig{{Name: "echo", Remote: port, Local: backend.Addr}}
+
+	old := testProxySet(t, srv)
+	if err := startReverse(old, reverse[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	if !echoes(addr, "old") {
+		t.Fatal("reverse forward of the old process does not work")
+	}
+	// The server refuses the port to the new process while the old one
+	// listens on it.
+	upgraded := testProxySet(t, srv)
+	if err := startReverse(upgraded, reverse[0], nil); err == nil {
+		t.Fatal("bound a port the old process listens on")
+	}
+
+	closeReverse(old, reverse)
+	// Forwards already gone are skipped.
+	closeReverse(old, reverse)
+	if fwds := old.Forwards(); len(fwds) != 0 {
+		t.Fatalf("old process still has forwards %+v", fwds)
+	}
+	if err := startReverse(upgraded, reverse[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	if !echoes(addr, "new") {
+		t.Fatal("reverse forward of the new process does not work")
+	}
+
+	// A failed new process exits, and the old one listens again once the
+	// server released the port.
+	p, _ := upgraded.get(defaultHost)
+	if err := p.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	restartReverse(old, reverse, nil)
+	deadline := time.Now().Add(10 * time.Second)
+	for !echoes(addr, "restarted") {
+		if time.Now().After(deadline) {
+			t.Fatal("reverse forward not restarted after a failed upgrade")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if fwds := old.Forwards(); len(fwds) != 1 || fwds[0].Name != "echo" {
+		t.Fatalf("old process has forwards %+v", fwds)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthz reports that the process is up.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports whether all hosts have an ssh connection and all
+// required forwards are bound, listing what is missing if not.
+func readyzHandler(ps *proxySet, required func() []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var problems []string
+		for _, host := range ps.names() {
+			if p, _ := ps.get(host); !p.Connected() {
+				problems = append(problems, fmt.Sprintf("host %s is not connected", host))
+			}
+		}
+		bound := make(map[string]bool)
+		for _, fwd := range ps.Forwards() {
+			bound[fwd.Name] = true
+		}
+		for _, name := range required() {
+			if !bound[name] {
+				problems = append(problems, fmt.Sprintf("forward %s is not bound", name))
+			}
+		}
+		if len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+const (
+	// remoteHealthTimeout bounds a health check of a remote.
+	remoteHealthTimeout = 5 * time.Second
+	// remoteHealthBody is the most of the body of a health check passed
+	// on.
+	remoteHealthBody = 64 * 1024
+)
+
+// remoteHealthHandler serves /health/<forward>, the result of requesting
+// the health path of the forward from its remote through the tunnel: the
+// status, content type and body of the remote, or 503 if it cannot be
+// reached.
+func remoteHealthHandler(m *forwardManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/health/")
+		fwd, ok := m.lookup(name)
+		if !ok || fwd.Health == "" {
+			http.Error(w, fmt.Sprintf("forward %s has no health check", name), http.StatusNotFound)
+			return
+		}
+		p, err := m.ps.get(fwd.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), remoteHealthTimeout)
+		defer cancel()
+		resp, err := p.CheckHealth(ctx, fwd.Name, fwd.Health)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("forward %s: %s", fwd.Name, err), http.StatusServiceUnavailable)
+			return
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, io.LimitReader(resp.Body, remoteHealthBody))
+	})
+}
+
+// lookup returns the forward name, from the config or a forwards command.
+func (m *forwardManager) lookup(name string) (forwardConfig, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, fwd := range m.forwards {
+		if fwd.Name == name {
+			return fwd, true
+		}
+	}
+	return forwardConfig{}, false
+}
@@ -0,0 +1,559 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+)
+
+// defaultHost names the ssh server configured under sshproxy.
+const defaultHost = "default"
+
+// hostConfig describes an additional ssh server in the hosts map of the
+// config file. Empty fields default to the sshproxy settings.
+type hostConfig struct {
+	User       string
+	Remote     string
+	PrivateKey string
+	Passphrase string
+	Password   string
+	// ForwardsCommand is like sshproxy.forwards_command for the host.
+	ForwardsCommand string `mapstructure:"forwards_command"`
+	// Knock is like sshproxy.knock for the host.
+	Knock []knockConfig
+}
+
+// hostsFromConfig reads the hosts map from the config file.
+func hostsFromConfig() (map[string]hostConfig, error) {
+	hosts := make(map[string]hostConfig)
+	if err := conf().UnmarshalKey("hosts", &hosts); err != nil {
+		return nil, err
+	}
+	for name, host := range hosts {
+		if name == defaultHost {
+			return nil, fmt.Errorf("host %q is reserved for sshproxy", defaultHost)
+		}
+		if host.Remote == "" {
+			return nil, fmt.Errorf("hosts.%s.remote is required", name)
+		}
+	}
+	return hosts, nil
+}
+
+// hostProxyConfig returns the proxy config of host, using the sshproxy
+// settings for anything host leaves empty.
+func hostProxyConfig(host hostConfig) *proxy.Config {
+	cfg := proxyConfig()
+	if host.User != "" {
+		cfg.RemoteUser = host.User
+	}
+	if _, _, err := net.SplitHostPort(host.Remote); err != nil {
+		host.Remote = net.JoinHostPort(host.Remote, "22")
+	}
+	cfg.RemoteAddress = host.Remote
+	if host.PrivateKey != "" {
+		cfg.PrivateKeyPath = os.ExpandEnv(host.PrivateKey)
+		cfg.PrivateKey = nil
+		cfg.Passphrase = host.Passphrase
+	}
+	if host.Password != "" {
+		cfg.Password = host.Password
+	}
+	if len(host.Knock) > 0 {
+		cfg.Knock = knockSteps(host.Knock)
+	}
+	return cfg
+}
+
+// proxiesFromConfig returns an empty set of proxies for the default host
+// and the hosts map of the config file.
+func proxiesFromConfig(ctx context.Context, policy startupPolicy) (*proxySet, error) {
+	hosts, err := hostsFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	access, err := loadAccessPolicy()
+	if err != nil {
+		return nil, err
+	}
+	return &proxySet{
+		ctx:        ctx,
+		hosts:      hosts,
+		policy:     policy,
+		access:     access,
+		fatal:      make(chan error, 1),
+		proxies:    make(map[string]*proxy.SSHProxy),
+		addrs:      make(map[string]string),
+		connecting: make(map[string]bool),
+		owners:     make(map[connKey]string),
+		shared:     make(map[string]string),
+		refs:       make(map[string]int),
+		retiring:   make(map[*proxy.SSHProxy]bool),
+		stop:       make(chan struct{}),
+	}, nil
+}
+
+// proxySet holds one proxy per ssh server, keyed by host name.
+type proxySet struct {
+	ctx    context.Context
+	hosts  map[string]hostConfig
+	policy startupPolicy
+	// access, if set, restricts the destinations of all hosts.
+	access *accessPolicy
+	// fatal receives errors that should stop the process.
+	fatal chan error
+	// audit, if set, records the connections of all hosts.
+	audit *proxy.AuditLog
+	// connectLog, if set, records the connect mode destinations of all
+	// hosts.
+	connectLog *proxy.ConnectLog
+	// session, if set, totals the connections of all hosts.
+	session *proxy.SessionStats
+	// state, if set, keeps the host keys of the ssh servers.
+	state *profileState
+
+	mu      sync.Mutex
+	proxies map[string]*proxy.SSHProxy
+	// addrs are the user@address of each host, for logging.
+	addrs map[string]string
+	// connecting is set for hosts connected or being connected.
+	connecting map[string]bool
+	// owners are the hosts that opened each ssh connection, by its key.
+	owners map[connKey]string
+	// shared are the hosts using the proxy of another host with the
+	// same connection, by the name of that host.
+	shared map[string]string
+	// refs count the forwards using each ssh connection, by the name of
+	// its owner, see hold and release.
+	refs map[string]int
+	// retiring are the released proxies still carrying connections.
+	retiring map[*proxy.SSHProxy]bool
+	// retirers are the running retire calls, which Shutdown waits for.
+	retirers sync.WaitGroup
+	// stop is closed by Shutdown to retire the released proxies at once.
+	stop   chan struct{}
+	closed bool
+}
+
+// connKey identifies the ssh connection of a proxy config: the server,
+// the credentials and everything about how the connection is made. Hosts
+// with the same key, e.g. two names for one user@host, share one
+// connection.
+type connKey struct {
+	user, addr, keyPath, key, passphrase, password          string
+	proxyCommand, paths, knock, clientVersion, gssapiTarget string
+	pathMode                                                proxy.PathMode
+	preferFamily                                            proxy.Family
+	keepAliveInterval                                       time.Duration
+	keepAliveCountMax                                       int
+	// obfuscated and gssapi are set with the sshproxy settings, which
+	// all hosts share, so whether they are used tells them apart.
+	obfuscated, gssapi bool
+}
+
+func connKeyOf(cfg *proxy.Config) connKey {
+	return connKey{
+		user:              cfg.RemoteUser,
+		addr:              cfg.RemoteAddress,
+		keyPath:           cfg.PrivateKeyPath,
+		key:               string(cfg.PrivateKey),
+		passphrase:        cfg.Passphrase,
+		password:          cfg.Password,
+		proxyCommand:      cfg.ProxyCommand,
+		paths:             strings.Join(cfg.Paths, ","),
+		knock:             fmt.Sprint(cfg.Knock),
+		clientVersion:     cfg.ClientVersion,
+		pathMode:          cfg.PathMode,
+		preferFamily:      cfg.PreferFamily,
+		keepAliveInterval: cfg.KeepAliveInterval,
+		keepAliveCountMax: cfg.KeepAliveCountMax,
+		gssapiTarget:      cfg.GSSAPITarget,
+		obfuscated:        cfg.Obfuscate != nil,
+		gssapi:            cfg.GSSAPI != nil,
+	}
+}
+
+// owner returns the host whose proxy host uses, host itself unless it
+// shares the connection of another.
+func (s *proxySet) owner(host string) string {
+	if host == "" {
+		host = defaultHost
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner, ok := s.shared[host]; ok {
+		return owner
+	}
+	return host
+}
+
+// add creates the proxy of host unless it exists and returns it.
+func (s *proxySet) add(name string) (*proxy.SSHProxy, error) {
+	if name == "" {
+		name = defaultHost
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner, ok := s.shared[name]; ok {
+		name = owner
+	}
+	if p, ok := s.proxies[name]; ok {
+		return p, nil
+	}
+	var cfg *proxy.Config
+	if name == defaultHost {
+		if remoteAddress() == "" {
+			return nil, errors.New("sshproxy.remote is required")
+		}
+		cfg = proxyConfig()
+		if cfg.RemoteUser == "" {
+			return nil, errors.New("sshproxy.user is required")
+		}
+	} else {
+		host, ok := s.hosts[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown host %q", name)
+		}
+		cfg = hostProxyConfig(host)
+		if cfg.RemoteUser == "" {
+			return nil, fmt.Errorf("hosts.%s.user is required, or sshproxy.user", name)
+		}
+	}
+	key := connKeyOf(cfg)
+	if owner, ok := s.owners[key]; ok {
+		logger.Infof("host %s shares the ssh connection of %s (%s)", name, owner, s.addrs[owner])
+		s.shared[name] = owner
+		return s.proxies[owner], nil
+	}
+	s.access.apply(cfg)
+	if s.state != nil && cfg.HostKeyCallback == nil {
+		cfg.HostKeyCallback = s.state.hostKeyCallback()
+	}
+	p, err := proxy.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.WithContext(s.ctx)
+	if s.audit != nil {
+		p.WithAudit(s.audit)
+	}
+	if s.connectLog != nil {
+		p.WithConnectLog(s.connectLog)
+	}
+	if s.session != nil {
+		p.WithSessionStats(s.session)
+	}
+	s.proxies[name] = p
+	s.owners[key] = name
+	s.addrs[name] = cfg.RemoteUser + "@" + cfg.RemoteAddress
+	return p, nil
+}
+
+// ensure returns the proxy of host, creating and connecting it first if
+// needed.
+func (s *proxySet) ensure(name string) (*proxy.SSHProxy, error) {
+	p, err := s.add(name)
+	if err != nil {
+		return nil, err
+	}
+	return p, s.connectHost(s.owner(name), p)
+}
+
+// hold records a forward using the connection of host, keeping it open
+// until a matching release.
+func (s *proxySet) hold(host string) {
+	host = s.owner(host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs[host]++
+}
+
+// release undoes a hold on the connection of host. When its last user is
+// gone the connection is removed from the set, along with the hosts
+// sharing it, and shut down once the connections through it are done. A
+// later ensure connects the host again.
+func (s *proxySet) release(host string) {
+	host = s.owner(host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs[host] == 0 {
+		return
+	}
+	if s.refs[host]--; s.refs[host] > 0 {
+		return
+	}
+	delete(s.refs, host)
+	p, ok := s.proxies[host]
+	if !ok {
+		return
+	}
+	logger.Infof("closing the ssh connection of %s (%s), no forwards use it", host, s.addrs[host])
+	delete(s.proxies, host)
+	delete(s.addrs, host)
+	delete(s.connecting, host)
+	for key, owner := range s.owners {
+		if owner == host {
+			delete(s.owners, key)
+		}
+	}
+	for name, owner := range s.shared {
+		if owner == host {
+			delete(s.shared, name)
+		}
+	}
+	if s.closed {
+		// Shutdown has the proxy already.
+		return
+	}
+	s.retiring[p] = true
+	s.retirers.Add(1)
+	go s.retire(p)
+}
+
+// retire shuts down p once it carries no more connections, or right
+// away when the set is done or shut down.
+func (s *proxySet) retire(p *proxy.SSHProxy) {
+	defer s.retirers.Done()
+	ticker := time.NewTicker(retireInterval)
+	defer ticker.Stop()
+wait:
+	for p.Idle() == 0 && s.ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+		case <-s.stop:
+			break wait
+		}
+	}
+	p.Shutdown()
+	s.mu.Lock()
+	delete(s.retiring, p)
+	s.mu.Unlock()
+}
+
+// retireInterval is how often retire checks a released proxy for open
+// connections.
+var retireInterval = time.Second
+
+// current reports whether p is still the proxy of host, rather than one
+// released since.
+func (s *proxySet) current(host string, p *proxy.SSHProxy) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.proxies[host] == p
+}
+
+// names returns the host names in order, leaving out hosts that share
+// the connection of another.
+func (s *proxySet) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.proxies))
+	for name := range s.proxies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// all returns the proxies of all hosts and those being retired.
+func (s *proxySet) all() []*proxy.SSHProxy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]*proxy.SSHProxy, 0, len(s.proxies)+len(s.retiring))
+	for _, p := range s.proxies {
+		all = append(all, p)
+	}
+	for p := range s.retiring {
+		all = append(all, p)
+	}
+	return all
+}
+
+// get returns the proxy of host, "" meaning the default host.
+func (s *proxySet) get(host string) (*proxy.SSHProxy, error) {
+	host = s.owner(host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.proxies[host]
+	if !ok {
+		return nil, fmt.Errorf("unknown host %q", host)
+	}
+	return p, nil
+}
+
+// Pause pauses the forward name on whichever host has it.
+func (s *proxySet) Pause(name string) error {
+	return s.each(name, (*proxy.SSHProxy).Pause)
+}
+
+// Resume resumes the forward name on whichever host has it.
+func (s *proxySet) Resume(name string) error {
+	return s.each(name, (*proxy.SSHProxy).Resume)
+}
+
+// each calls action on every proxy until one knows the forward name.
+func (s *proxySet) each(name string, action func(*proxy.SSHProxy, string) error) error {
+	var err error
+	for _, host := range s.names() {
+		p, _ := s.get(host)
+		if err = action(p, name); !errors.Is(err, proxy.ErrUnknownForward) {
+			return err
+		}
+	}
+	return err
+}
+
+// Reconnect replaces the ssh connection of host, or of all hosts if it is
+// empty.
+func (s *proxySet) Reconnect(host string) error {
+	hosts := s.names()
+	if host != "" {
+		if _, err := s.get(host); err != nil {
+			return err
+		}
+		hosts = []string{host}
+	}
+	for _, name := range hosts {
+		p, _ := s.get(name)
+		if err := s.dial(name, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resume replaces the ssh connection of every connected host, which is
+// likely dead after sleep or a network change. A host that cannot be
+// reached yet is disconnected, so its forwards park and, with
+// --retry-forever, it is reconnected as soon as possible.
+func (s *proxySet) resume() {
+	for _, name := range s.names() {
+		p, _ := s.get(name)
+		if !p.Connected() {
+			continue
+		}
+		if err := s.dial(name, p); err != nil {
+			logger.Warningf("reconnecting: %s", err)
+			if err := p.Disconnect(); err != nil {
+				logger.Debugf("error closing the ssh connection of %s: %s", name, err)
+			}
+		}
+	}
+}
+
+// forwardStatus is a forward in the output of the control API.
+type forwardStatus struct {
+	proxy.ForwardInfo
+	Host string
+}
+
+// Forwards returns the forwards of all hosts.
+func (s *proxySet) Forwards() []forwardStatus {
+	var statuses []forwardStatus
+	for _, host := range s.names() {
+		p, _ := s.get(host)
+		for _, info := range p.Forwards() {
+			statuses = append(statuses, forwardStatus{ForwardInfo: info, Host: host})
+		}
+	}
+	return statuses
+}
+
+// connect connects all proxies, stopping at the first error.
+func (s *proxySet) connect() error {
+	for _, name := range s.names() {
+		p, _ := s.get(name)
+		if err := s.connectHost(name, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connectHost connects p unless that was done before. With the retry
+// forever policy it keeps connecting in the background instead.
+func (s *proxySet) connectHost(name string, p *proxy.SSHProxy) error {
+	s.mu.Lock()
+	connecting := s.connecting[name]
+	s.connecting[name] = true
+	s.mu.Unlock()
+	if connecting {
+		return nil
+	}
+	switch s.policy {
+	case policyRetryForever:
+		go s.keepConnected(name, p)
+		return nil
+	case policyFailFast:
+		// Subscribe before connecting, so no disconnect is missed.
+		events, unsubscribe := p.Events()
+		go func() {
+			defer unsubscribe()
+			s.exitOnDisconnect(name, p, events)
+		}()
+	}
+	if err := s.dial(name, p); err != nil {
+		s.mu.Lock()
+		delete(s.connecting, name)
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// dial makes the ssh connection of p once.
+func (s *proxySet) dial(name string, p *proxy.SSHProxy) error {
+	s.mu.Lock()
+	addr := s.addrs[name]
+	s.mu.Unlock()
+	logger.Infof("connecting to %s (%s)", name, addr)
+	if err := p.Connect(); err != nil {
+		switch {
+		case errors.Is(err, proxy.ErrAuthFailed):
+			logger.Errorf("check the user and private key of %s in your config, or --user and --identity", name)
+		case errors.Is(err, proxy.ErrHostKeyMismatch):
+			logger.Errorf("the host key of %s was rejected", name)
+		}
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// Shutdown shuts down all proxies, including the released ones still
+// carrying connections, and waits for them.
+func (s *proxySet) Shutdown() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.stop)
+	live := make([]*proxy.SSHProxy, 0, len(s.proxies))
+	for _, p := range s.proxies {
+		live = append(live, p)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range live {
+		wg.Add(1)
+		go func(p *proxy.SSHProxy) {
+			defer wg.Done()
+			p.Shutdown()
+		}(p)
+	}
+	wg.Wait()
+	s.retirers.Wait()
+}
@@ -0,0 +1,267 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"github.com/elliotpeele/sshhttpproxy/proxy/proxytest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConnKey(t *testing.T) {
+	base := func() *proxy.Config {
+		return &proxy.Config{RemoteUser: "user", RemoteAddress: "host:22"}
+	}
+	// Settings that change how the connection is made.
+	for name, change := range map[string]func(*proxy.Config){
+		"user":           func(c *proxy.Config) { c.RemoteUser = "other" },
+		"address":        func(c *proxy.Config) { c.RemoteAddress = "other:22" },
+		"key path":       func(c *proxy.Config) { c.PrivateKeyPath = "/key" },
+		"key":            func(c *proxy.Config) { c.PrivateKey = []byte("key") },
+		"passphrase":     func(c *proxy.Config) { c.Passphrase = "secret" },
+		"password":       func(c *proxy.Config) { c.Password = "secret" },
+		"proxy command":  func(c *proxy.Config) { c.ProxyCommand = "nc %h %p" },
+		"paths":          func(c *proxy.Config) { c.Paths = []string{"wlan0"} },
+		"path mode":      func(c *proxy.Config) { c.PathMode = proxy.PathMode("redundant") },
+		"knock":          func(c *proxy.Config) { c.Knock = []proxy.KnockStep{{Port: 7000}} },
+		"knock delay":    func(c *proxy.Config) { c.Knock = []proxy.KnockStep{{Port: 7000, Delay: time.Second}} },
+		"client version": func(c *proxy.Config) { c.ClientVersion = "SSH-2.0-test" },
+		"family":         func(c *proxy.Config) { c.PreferFamily = proxy.FamilyIPv6 },
+		"keepalive":      func(c *proxy.Config) { c.KeepAliveInterval = time.Minute },
+		"keepalive max":  func(c *proxy.Config) { c.KeepAliveCountMax = 5 },
+		"obfuscate":      func(c *proxy.Config) { c.Obfuscate = proxy.ObfuscatedSSH("keyword") },
+		"gssapi": func(c *proxy.Config) {
+			c.GSSAPI = func() (ssh.GSSAPIClient, error) { return nil, nil }
+		},
+		"gssapi target": func(c *proxy.Config) { c.GSSAPITarget = "host/other" },
+	} {
+		cfg := base()
+		change(cfg)
+		if connKeyOf(cfg) == connKeyOf(base()) {
+			t.Errorf("%s: configs share a connection", name)
+		}
+	}
+
+	// Settings of the forwards alone.
+	cfg := base()
+	cfg.MaxStartups = 10
+	cfg.ParkTimeout = time.Minute
+	cfg.FairScheduling = true
+	if connKeyOf(cfg) != connKeyOf(base()) {
+		t.Error("configs differing in forward settings do not share a connection")
+	}
+}
+
+// hostsProxySet returns an empty set with srv as the sshproxy server and
+// hosts, which default to it.
+func hostsProxySet(t *testing.T, srv *proxytest.Server, hosts map[string]hostConfig) *proxySet {
+	t.Helper()
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	cfg := srv.Config()
+	settings.SSHProxy = sshproxyConfig{
+		User:       cfg.RemoteUser,
+		Remote:     cfg.RemoteAddress,
+		PrivateKey: cfg.PrivateKeyPath,
+	}
+	savedInterval := retireInterval
+	t.Cleanup(func() { retireInterval = savedInterval })
+	retireInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ps := &proxySet{
+		ctx:        ctx,
+		hosts:      hosts,
+		policy:     policyFailFast,
+		fatal:      make(chan error, 1),
+		proxies:    make(map[string]*proxy.SSHProxy),
+		addrs:      make(map[string]string),
+		connecting: make(map[string]bool),
+		owners:     make(map[connKey]string),
+		shared:     make(map[string]string),
+		refs:       make(map[string]int),
+		retiring:   make(map[*proxy.SSHProxy]bool),
+		stop:       make(chan struct{}),
+	}
+	t.Cleanup(func() {
+		cancel()
+		ps.Shutdown()
+	})
+	return ps
+}
+
+func TestProxySetShare(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	ps := hostsProxySet(t, srv, map[string]hostConfig{
+		"alias":   {Remote: srv.Addr},
+		"knocked": {Remote: srv.Addr, Knock: []knockConfig{{Port: 7000}}},
+	})
+
+	p, err := ps.add(defaultHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alias, err := ps.add("alias"); err != nil || alias != p {
+		t.Errorf("alias got %p, %v, want the proxy of %s", alias, err, defaultHost)
+	}
+	if knocked, err := ps.add("knocked"); err != nil || knocked == p {
+		t.Errorf("knocked got %p, %v, want its own proxy", knocked, err)
+	}
+	if got := ps.names(); len(got) != 2 {
+		t.Errorf("got hosts %v, want default and knocked", got)
+	}
+}
+
+// waitDisconnected waits for p to lose its ssh connection.
+func waitDisconnected(t *testing.T, p *proxy.SSHProxy) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("released proxy still connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxySetRelease(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	ps := hostsProxySet(t, srv, map[string]hostConfig{"alias": {Remote: srv.Addr}})
+
+	p, err := ps.ensure(defaultHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ps.ensure("alias"); err != nil {
+		t.Fatal(err)
+	}
+	local, err := p.ForwardWithOptions("echo", backend.Addr, "0", &proxy.ForwardOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.hold(defaultHost)
+	ps.hold("alias")
+
+	// The connection stays while one of its users is left.
+	ps.release("alias")
+	if !ps.current(defaultHost, p) || !p.Connected() {
+		t.Fatal("connection closed with a user left")
+	}
+
+	// The last release removes it, but it stays up for the open
+	// connection through it.
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !echoes(local, "open") {
+		t.Fatal("forward does not work")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Idle() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection through the forward not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ps.release(defaultHost)
+	if _, err := ps.get(defaultHost); err == nil {
+		t.Error("released host still in the set")
+	}
+	if _, err := ps.get("alias"); err == nil {
+		t.Error("host sharing the released connection still in the set")
+	}
+	time.Sleep(10 * retireInterval)
+	if !p.Connected() {
+		t.Fatal("released proxy shut down with a connection open")
+	}
+	if ps.Idle() != 0 {
+		t.Error("open connection of the released proxy not counted as busy")
+	}
+	conn.Close()
+	waitDisconnected(t, p)
+	select {
+	case err := <-ps.fatal:
+		t.Fatalf("closing a released connection is fatal: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Using the host again makes a new connection.
+	again, err := ps.ensure("alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == p || !again.Connected() {
+		t.Error("host not connected again after its release")
+	}
+}
+
+func TestProxySetReleaseUnheld(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	ps := hostsProxySet(t, srv, nil)
+
+	p, err := ps.ensure(defaultHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.release(defaultHost)
+	if !ps.current(defaultHost, p) || !p.Connected() {
+		t.Fatal("release without a hold closed the connection")
+	}
+	ps.hold(defaultHost)
+	ps.release(defaultHost)
+	if ps.current(defaultHost, p) {
+		t.Error("release of the only hold kept the connection")
+	}
+}
+
+func TestProxySetShutdownRetiring(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	ps := hostsProxySet(t, srv, nil)
+
+	p, err := ps.ensure(defaultHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := p.ForwardWithOptions("echo", backend.Addr, "0", &proxy.ForwardOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Idle() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection through the forward not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ps.hold(defaultHost)
+	ps.release(defaultHost)
+	if !p.Connected() {
+		t.Fatal("released proxy shut down with a connection open")
+	}
+
+	// Shutdown returns once the retiring proxy is down too.
+	ps.Shutdown()
+	if p.Connected() {
+		t.Error("Shutdown left a retiring proxy connected")
+	}
+	ps.Shutdown()
+}
@@ -0,0 +1,48 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"time"
+)
+
+// Idle returns how long no forwarded connection has been open on any
+// host, including released ones still carrying connections.
+func (s *proxySet) Idle() time.Duration {
+	var idle time.Duration = -1
+	for _, p := range s.all() {
+		if d := p.Idle(); idle < 0 || d < idle {
+			idle = d
+		}
+	}
+	if idle < 0 {
+		return 0
+	}
+	return idle
+}
+
+// exitOnIdle calls cancel once no forwarded connection has been open for
+// timeout.
+func exitOnIdle(ctx context.Context, cancel func(), ps *proxySet, timeout time.Duration) {
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	} else if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if idle := ps.Idle(); idle >= timeout {
+			logger.Infof("no connections for %s, shutting down", idle.Round(time.Second))
+			cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// importedForward is a forward written by the import commands, in the
+// format of the forwards list of the config.
+type importedForward struct {
+	Name   string `yaml:"name"`
+	Local  string `yaml:"local"`
+	Remote string `yaml:"remote"`
+}
+
+// composeFile is the part of a docker-compose file that publishes ports.
+type composeFile struct {
+	Services map[string]struct {
+		Ports []interface{} `yaml:"ports"`
+	} `yaml:"services"`
+}
+
+// composePort is a port published by a compose service.
+type composePort struct {
+	hostIP    string
+	published int
+}
+
+// parseComposePort parses an entry of the ports of a compose service, in
+// the short "[ip:]published[-end]:target[/protocol]" or the long syntax.
+// Ports that are not TCP or not published on a fixed port return none.
+func parseComposePort(entry interface{}) ([]composePort, error) {
+	if long, ok := entry.(map[interface{}]interface{}); ok {
+		if proto := fmt.Sprint(long["protocol"]); long["protocol"] != nil && proto != "tcp" {
+			return nil, nil
+		}
+		if long["published"] == nil {
+			return nil, nil
+		}
+		published, err := strconv.Atoi(fmt.Sprint(long["published"]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid published port %v", long["published"])
+		}
+		var hostIP string
+		if long["host_ip"] != nil {
+			hostIP = fmt.Sprint(long["host_ip"])
+		}
+		return []composePort{{hostIP: hostIP, published: published}}, nil
+	}
+	spec := fmt.Sprint(entry)
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		if spec[i+1:] != "tcp" {
+			return nil, nil
+		}
+		spec = spec[:i]
+	}
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		// Only the container port, published on a random port.
+		return nil, nil
+	}
+	spec = spec[:i]
+	var hostIP string
+	if j := strings.LastIndex(spec, ":"); j >= 0 {
+		hostIP = strings.Trim(spec[:j], "[]")
+		spec = spec[j+1:]
+	}
+	first, last := spec, spec
+	if j := strings.Index(spec, "-"); j >= 0 {
+		first, last = spec[:j], spec[j+1:]
+	}
+	start, err := strconv.Atoi(first)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", fmt.Sprint(entry))
+	}
+	end, err := strconv.Atoi(last)
+	if err != nil || end < start {
+		return nil, fmt.Errorf("invalid port %q", fmt.Sprint(entry))
+	}
+	var ports []composePort
+	for port := start; port <= end; port++ {
+		ports = append(ports, composePort{hostIP: hostIP, published: port})
+	}
+	return ports, nil
+}
+
+// composeForwards returns a forward for each TCP port published by the
+// services of the compose file in r, to host on the ssh server side or to
+// the address the port is bound to.
+func composeForwards(r io.Reader, host string) ([]importedForward, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var file composeFile
+	if err := yaml.Unmarshal(buf, &file); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(file.Services))
+	for name := range file.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fwds []importedForward
+	for _, name := range names {
+		var ports []composePort
+		for _, entry := range file.Services[name].Ports {
+			p, err := parseComposePort(entry)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %s", name, err)
+			}
+			ports = append(ports, p...)
+		}
+		for _, port := range ports {
+			target := host
+			if port.hostIP != "" && port.hostIP != "0.0.0.0" && port.hostIP != "::" {
+				target = port.hostIP
+			}
+			fwd := importedForward{
+				Name:   name,
+				Local:  strconv.Itoa(port.published),
+				Remote: net.JoinHostPort(target, strconv.Itoa(port.published)),
+			}
+			if len(ports) > 1 {
+				fwd.Name += "-" + fwd.Local
+			}
+			fwds = append(fwds, fwd)
+		}
+	}
+	return fwds, nil
+}
+
+// procfilePort matches commands that listen on the port they are given.
+var procfilePort = regexp.MustCompile(`\$\{?PORT\b`)
+
+// procfileForwards returns a forward for each process of the Procfile in r
+// that listens on $PORT or is named web, on the port foreman gives it:
+// base, plus 100 for each process before it.
+func procfileForwards(r io.Reader, host string, base int) ([]importedForward, error) {
+	var fwds []importedForward
+	s := bufio.NewScanner(r)
+	index := 0
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid Procfile line %q", line)
+		}
+		name, command := line[:i], line[i+1:]
+		port := base + 100*index
+		index++
+		if name != "web" && !procfilePort.MatchString(command) {
+			continue
+		}
+		fwds = append(fwds, importedForward{
+			Name:   name,
+			Local:  strconv.Itoa(port),
+			Remote: net.JoinHostPort(host, strconv.Itoa(port)),
+		})
+	}
+	return fwds, s.Err()
+}
+
+// writeForwards writes fwds as the forwards list of a config file.
+func writeForwards(w io.Writer, fwds []importedForward) error {
+	out, err := yaml.Marshal(struct {
+		Forwards []importedForward `yaml:"forwards"`
+	}{fwds})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// importCmd groups commands that generate forwards from other tools.
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Generate forwards from the config of other tools",
+	Long: `Generate forwards for services that run on the remote side instead of
+locally, printing them as the forwards list of a config file.`,
+}
+
+var importComposeCmd = &cobra.Command{
+	Use:   "compose <docker-compose.yml>",
+	Short: "Generate forwards for the ports published by a docker-compose file",
+	Long: `Generate a forward for each TCP port published by the services of a
+docker-compose file, on the same local port, to --remote-host on the ssh
+server side or the address the port is bound to. Ports published on random
+ports are skipped.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		host, _ := cmd.Flags().GetString("remote-host")
+		fwds, err := composeForwards(f, host)
+		if err != nil {
+			return fmt.Errorf("%s: %s", args[0], err)
+		}
+		return writeForwards(os.Stdout, fwds)
+	},
+}
+
+var importProcfileCmd = &cobra.Command{
+	Use:   "procfile <Procfile>",
+	Short: "Generate forwards for the processes of a Procfile",
+	Long: `Generate a forward for each process of a Procfile that listens on $PORT,
+or is named web, on the port foreman gives it: --base-port plus 100 for each
+process before it.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		host, _ := cmd.Flags().GetString("remote-host")
+		base, _ := cmd.Flags().GetInt("base-port")
+		fwds, err := procfileForwards(f, host, base)
+		if err != nil {
+			return fmt.Errorf("%s: %s", args[0], err)
+		}
+		return writeForwards(os.Stdout, fwds)
+	},
+}
+
+func init() {
+	importCmd.PersistentFlags().String("remote-host", "localhost", "host the services listen on, as seen from the ssh server")
+	importProcfileCmd.Flags().Int("base-port", 5000, "port of the first process, as foreman --port")
+	importCmd.AddCommand(importComposeCmd, importProcfileCmd)
+	rootCmd.AddCommand(importCmd)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// keyAuth returns an auth method trying the keys of the ssh agent and the
+// PKCS#11 token of the config, nil if neither is set. They share one
+// method, as the ssh client tries each method only once, and a source
+// that fails is skipped as long as another has keys.
+func keyAuth(c sshproxyConfig) ssh.AuthMethod {
+	var sources []func() ([]ssh.Signer, error)
+	if c.Agent {
+		sources = append(sources, sshAgent.signers)
+	}
+	if c.PKCS11.Module != "" {
+		sources = append(sources, pkcs11Signers(os.ExpandEnv(c.PKCS11.Module), c.PKCS11.Token, c.PKCS11.PIN))
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		var errs []error
+		for _, source := range sources {
+			s, err := source()
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			signers = append(signers, s...)
+		}
+		if len(signers) == 0 && len(errs) > 0 {
+			return nil, errs[0]
+		}
+		for _, err := range errs {
+			logger.Warningf("%s", err)
+		}
+		return signers, nil
+	})
+}
+
+// sshAgent is the connection to the ssh agent, shared by all connections.
+var sshAgent agentConn
+
+// agentConn is a connection to the ssh agent at SSH_AUTH_SOCK, made on
+// first use and again once it fails.
+type agentConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// signers returns the keys of the agent, which sign through it.
+func (a *agentConn) signers() ([]ssh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for retry := false; ; retry = true {
+		if a.conn == nil {
+			sock := os.Getenv("SSH_AUTH_SOCK")
+			if sock == "" {
+				return nil, errors.New("agent: SSH_AUTH_SOCK is not set")
+			}
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				return nil, fmt.Errorf("agent: %w", err)
+			}
+			a.conn = conn
+		}
+		signers, err := agent.NewClient(a.conn).Signers()
+		if err == nil {
+			return signers, nil
+		}
+		if retry {
+			return nil, fmt.Errorf("agent: %w", err)
+		}
+		a.conn.Close()
+		a.conn = nil
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	mdnsPort = 5353
+	// mdnsTTL is the time to live of the records, in seconds.
+	mdnsTTL = 120
+	// mdnsLegacyTTL is the time to live of answers to plain DNS queries.
+	mdnsLegacyTTL = 10
+	// mdnsServiceType is the DNS-SD service type forwards are advertised
+	// as, so browsers on phones and tablets find them.
+	mdnsServiceType = "_http._tcp.local."
+	// mdnsServices lists the service types for DNS-SD enumeration.
+	mdnsServices = "_services._dns-sd._udp.local."
+
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+	// dnsCacheFlush marks records only this host answers for, and in
+	// questions that a unicast response is wanted.
+	dnsCacheFlush = 0x8000
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// dnsLabel matches names that can be advertised as <name>.local.
+var dnsLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// dnsRecord is a resource record. Queries for name also get the records
+// of related, e.g. the address of the target of an SRV record.
+type dnsRecord struct {
+	name    string
+	typ     uint16
+	unique  bool
+	data    []byte
+	related string
+}
+
+type dnsQuestion struct {
+	name    string
+	typ     uint16
+	unicast bool
+}
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+// readName reads the possibly compressed name at off in msg and returns it
+// with a trailing dot and the offset after it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errDNSMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// parseQuery returns the ID and questions of the query msg. Responses
+// return no questions.
+func parseQuery(msg []byte) (uint16, []dnsQuestion, error) {
+	if len(msg) < 12 {
+		return 0, nil, errDNSMessage
+	}
+	id := binary.BigEndian.Uint16(msg)
+	if msg[2]&0xf8 != 0 {
+		// A response, or not a standard query.
+		return id, nil, nil
+	}
+	count := int(binary.BigEndian.Uint16(msg[4:]))
+	off := 12
+	questions := make([]dnsQuestion, 0, count)
+	for i := 0; i < count; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return 0, nil, err
+		}
+		if next+4 > len(msg) {
+			return 0, nil, errDNSMessage
+		}
+		class := binary.BigEndian.Uint16(msg[next+2:])
+		questions = append(questions, dnsQuestion{
+			name:    name,
+			typ:     binary.BigEndian.Uint16(msg[next:]),
+			unicast: class&dnsCacheFlush != 0,
+		})
+		off = next + 4
+	}
+	return id, questions, nil
+}
+
+// appendName appends name uncompressed.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendRecord(b []byte, r dnsRecord, ttl uint32) []byte {
+	b = appendName(b, r.name)
+	class := uint16(dnsClassIN)
+	if r.unique {
+		class |= dnsCacheFlush
+	}
+	var fixed [10]byte
+	binary.BigEndian.PutUint16(fixed[0:], r.typ)
+	binary.BigEndian.PutUint16(fixed[2:], class)
+	binary.BigEndian.PutUint32(fixed[4:], ttl)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(r.data)))
+	b = append(b, fixed[:]...)
+	return append(b, r.data...)
+}
+
+// dnsResponse builds a response with id, repeating questions for legacy
+// unicast queriers.
+func dnsResponse(id uint16, questions []dnsQuestion, answers, extra []dnsRecord, ttl uint32) []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], id)
+	// An authoritative answer.
+	binary.BigEndian.PutUint16(b[2:], 0x8400)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(extra)))
+	for _, q := range questions {
+		b = appendName(b, q.name)
+		b = append(b, byte(q.typ>>8), byte(q.typ), 0, dnsClassIN)
+	}
+	for _, r := range answers {
+		b = appendRecord(b, r, ttl)
+	}
+	for _, r := range extra {
+		b = appendRecord(b, r, ttl)
+	}
+	return b
+}
+
+// answer returns the records of records answering questions, and those
+// related to them as additional records.
+func answer(questions []dnsQuestion, records []dnsRecord) (answers, extra []dnsRecord) {
+	used := make(map[int]bool)
+	var related []string
+	for _, q := range questions {
+		for i, r := range records {
+			if !used[i] && strings.EqualFold(r.name, q.name) && (q.typ == r.typ || q.typ == dnsTypeANY) {
+				used[i] = true
+				answers = append(answers, r)
+				related = append(related, r.related)
+			}
+		}
+	}
+	// Two levels: the SRV and TXT of a service, then the addresses of its
+	// host.
+	for level := 0; level < 2; level++ {
+		var next []string
+		for _, name := range related {
+			for i, r := range records {
+				if name != "" && !used[i] && strings.EqualFold(r.name, name) {
+					used[i] = true
+					extra = append(extra, r)
+					next = append(next, r.related)
+				}
+			}
+		}
+		related = next
+	}
+	return answers, extra
+}
+
+// advertisedIPs returns the addresses a forward listening on local is
+// reachable on from the LAN: those of all interfaces for a wildcard
+// address, none for loopback.
+func advertisedIPs(local string) []net.IP {
+	host, _, err := net.SplitHostPort(local)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() {
+		return nil
+	}
+	if !ip.IsUnspecified() {
+		return []net.IP{ip}
+	}
+	ifaces, _ := net.Interfaces()
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	return ips
+}
+
+// mdnsRecords returns the records advertising the forwards in locals, by
+// name, as <name>.local and as a DNS-SD service.
+func mdnsRecords(locals map[string]string) []dnsRecord {
+	var records []dnsRecord
+	for name, local := range locals {
+		ips := advertisedIPs(local)
+		_, port, _ := net.SplitHostPort(local)
+		p, err := strconv.Atoi(port)
+		if len(ips) == 0 || err != nil {
+			continue
+		}
+		host := name + ".local."
+		instance := name + "." + mdnsServiceType
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				records = append(records, dnsRecord{name: host, typ: dnsTypeA, unique: true, data: ip4})
+			} else {
+				records = append(records, dnsRecord{name: host, typ: dnsTypeAAAA, unique: true, data: ip.To16()})
+			}
+		}
+		srv := []byte{0, 0, 0, 0, byte(p >> 8), byte(p)}
+		records = append(records,
+			dnsRecord{name: mdnsServiceType, typ: dnsTypePTR, data: appendName(nil, instance), related: instance},
+			dnsRecord{name: instance, typ: dnsTypeSRV, unique: true, data: appendName(srv, host), related: host},
+			// An empty TXT record is a single empty string.
+			dnsRecord{name: instance, typ: dnsTypeTXT, unique: true, data: []byte{0}},
+		)
+	}
+	if len(records) > 0 {
+		records = append(records, dnsRecord{name: mdnsServices, typ: dnsTypePTR, data: appendName(nil, mdnsServiceType)})
+	}
+	return records
+}
+
+// advertised returns the names of the active forwards to advertise over
+// mDNS.
+func (m *forwardManager) advertised() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for _, fwd := range m.forwards {
+		if fwd.MDNS && m.isActive(fwd) {
+			names = append(names, fwd.Name)
+		}
+	}
+	return names
+}
+
+// advertiseForwards answers mDNS queries for the running forwards m
+// advertises until ctx is done, announcing them at the start and saying
+// goodbye at the end.
+func advertiseForwards(ctx context.Context, m *forwardManager) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	records := func() []dnsRecord {
+		locals := make(map[string]string)
+		for _, name := range m.advertised() {
+			locals[name] = ""
+		}
+		for _, status := range m.ps.Forwards() {
+			if _, ok := locals[status.Name]; ok {
+				locals[status.Name] = status.Local
+			}
+		}
+		return mdnsRecords(locals)
+	}
+	announce := func(ttl uint32) {
+		if rs := records(); len(rs) > 0 {
+			if _, err := conn.WriteToUDP(dnsResponse(0, nil, rs, nil, ttl), mdnsGroup); err != nil {
+				logger.Warningf("mdns: %s", err)
+			}
+		}
+	}
+	announce(mdnsTTL)
+	go func() {
+		<-ctx.Done()
+		announce(0)
+		conn.Close()
+	}()
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Errorf("mdns: %s", err)
+				}
+				return
+			}
+			id, questions, err := parseQuery(buf[:n])
+			if err != nil || len(questions) == 0 {
+				continue
+			}
+			answers, extra := answer(questions, records())
+			if len(answers) == 0 {
+				continue
+			}
+			var resp []byte
+			to := mdnsGroup
+			if from.Port != mdnsPort {
+				// A legacy resolver, which wants a plain DNS answer
+				// not to be cached for long.
+				to = from
+				resp = dnsResponse(id, questions, answers, extra, mdnsLegacyTTL)
+			} else {
+				for _, q := range questions {
+					if q.unicast {
+						to = from
+					}
+				}
+				resp = dnsResponse(0, nil, answers, extra, mdnsTTL)
+			}
+			if _, err := conn.WriteToUDP(resp, to); err != nil {
+				logger.Debugf("mdns: %s", err)
+			}
+		}
+	}()
+	logger.Debugf("advertising forwards over mDNS")
+	return nil
+}
@@ -0,0 +1,266 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"github.com/spf13/cobra"
+)
+
+// metricsHandler writes proxy metrics in the Prometheus text format, with
+// one sample per ssh server.
+func metricsHandler(ps *proxySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m := &metricsWriter{w: w, ps: ps}
+		m.write("sshhttpproxy_ssh_connected", "gauge",
+			"Whether the ssh connection is up.",
+			func(p *proxy.SSHProxy) float64 { return boolValue(p.Connected()) })
+		m.write("sshhttpproxy_ssh_last_keepalive_seconds", "gauge",
+			"Seconds since the ssh server last answered a keepalive or handshake.",
+			func(p *proxy.SSHProxy) float64 { return p.ConnStats().KeepAliveAge().Seconds() })
+		m.writePaths("sshhttpproxy_ssh_path_connected",
+			"Whether the ssh connection over a path is up.")
+		m.writeForwardReady("sshhttpproxy_forward_ready",
+			"Whether a forward is bound, not paused, its ssh connection up and its target up if watched.")
+		m.write("sshhttpproxy_ssh_connects_total", "counter",
+			"Number of times the ssh connection was established.",
+			func(p *proxy.SSHProxy) float64 { return float64(p.ConnStats().Connects) })
+		m.write("sshhttpproxy_ssh_reconnects_total", "counter",
+			"Number of times the ssh connection was re-established.",
+			func(p *proxy.SSHProxy) float64 { return float64(p.ConnStats().Reconnects) })
+		m.write("sshhttpproxy_ssh_tunnels_lost_total", "counter",
+			"Number of times the ssh connection was closed for missing keepalives.",
+			func(p *proxy.SSHProxy) float64 { return float64(p.ConnStats().TunnelsLost) })
+		m.write("sshhttpproxy_ssh_connection_age_seconds", "gauge",
+			"Seconds since the ssh connection was last established.",
+			func(p *proxy.SSHProxy) float64 { return p.ConnStats().Age().Seconds() })
+		m.write("sshhttpproxy_ssh_handshake_duration_seconds", "gauge",
+			"Duration of the last ssh handshake.",
+			func(p *proxy.SSHProxy) float64 { return p.ConnStats().HandshakeDuration.Seconds() })
+		m.write("sshhttpproxy_parked_connections", "gauge",
+			"Connections waiting for the ssh connection.",
+			func(p *proxy.SSHProxy) float64 { return float64(p.Parked()) })
+		m.write("sshhttpproxy_reserved_bytes", "gauge",
+			"Memory reserved by open connections against --max-buffered-bytes.",
+			func(p *proxy.SSHProxy) float64 { return float64(p.ReservedBytes()) })
+		m.write("sshhttpproxy_buffered_bytes", "gauge",
+			"Bytes held in connection copy buffers.",
+			func(p *proxy.SSHProxy) float64 { return float64(p.BufferedBytes()) })
+		m.write("sshhttpproxy_slow_dials_total", "counter",
+			"Remote dials slower than the slow threshold.",
+			func(p *proxy.SSHProxy) float64 { return float64(p.ProblemStats().SlowDials) })
+		m.write("sshhttpproxy_slow_responses_total", "counter",
+			"Connections whose first response was slower than the slow threshold.",
+			func(p *proxy.SSHProxy) float64 { return float64(p.ProblemStats().SlowResponses) })
+		m.write("sshhttpproxy_stalls_total", "counter",
+			"Connections that made no progress for the stall threshold.",
+			func(p *proxy.SSHProxy) float64 { return float64(p.ProblemStats().Stalls) })
+		m.writeDialFailures("sshhttpproxy_remote_dial_failures_total",
+			"Failed remote dials by reason.")
+		m.writeLatency("sshhttpproxy_http_request_duration_seconds",
+			"Duration of requests through L7 forwards by route.")
+	}
+}
+
+// metricsWriter writes metrics of all proxies of a set.
+type metricsWriter struct {
+	w  http.ResponseWriter
+	ps *proxySet
+}
+
+func (m *metricsWriter) write(name, kind, help string, value func(*proxy.SSHProxy) float64) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, host := range m.ps.names() {
+		p, _ := m.ps.get(host)
+		fmt.Fprintf(m.w, "%s{host=%q} %g\n", name, host, value(p))
+	}
+}
+
+// writeForwardReady writes whether each forward of all proxies can serve
+// connections, which watched forwards do not while their target is down.
+func (m *metricsWriter) writeForwardReady(name, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, host := range m.ps.names() {
+		p, _ := m.ps.get(host)
+		connected := p.Connected()
+		for _, fwd := range p.Forwards() {
+			fmt.Fprintf(m.w, "%s{host=%q,forward=%q} %g\n", name, host, fwd.Name, boolValue(connected && !fwd.Paused && !fwd.Down))
+		}
+	}
+}
+
+// writePaths writes whether the ssh connection of each path of all
+// proxies is up.
+func (m *metricsWriter) writePaths(name, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, host := range m.ps.names() {
+		p, _ := m.ps.get(host)
+		for _, path := range p.Paths() {
+			fmt.Fprintf(m.w, "%s{host=%q,path=%q} %g\n", name, host, path.Name, boolValue(path.Connected))
+		}
+	}
+}
+
+// writeDialFailures writes the failed remote dials of all proxies, labeled
+// by why they failed.
+func (m *metricsWriter) writeDialFailures(name, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, host := range m.ps.names() {
+		p, _ := m.ps.get(host)
+		f := p.DialFailures()
+		reasons := []struct {
+			name  string
+			count int64
+		}{
+			{"prohibited", f.Prohibited},
+			{"unreachable", f.Unreachable},
+			{"server_busy", f.ServerBusy},
+			{"other", f.Other},
+		}
+		for _, r := range reasons {
+			fmt.Fprintf(m.w, "%s{host=%q,reason=%q} %d\n", name, host, r.name, r.count)
+		}
+	}
+}
+
+// writeLatency writes the HTTP latency histograms of all proxies.
+func (m *metricsWriter) writeLatency(name, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, host := range m.ps.names() {
+		p, _ := m.ps.get(host)
+		for _, h := range p.HTTPLatency() {
+			labels := fmt.Sprintf("host=%q,forward=%q,route=%q", host, h.Forward, h.Route)
+			for i, bound := range proxy.LatencyBuckets {
+				fmt.Fprintf(m.w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, h.Counts[i])
+			}
+			fmt.Fprintf(m.w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.Count)
+			fmt.Fprintf(m.w, "%s_sum{%s} %g\n", name, labels, h.Sum)
+			fmt.Fprintf(m.w, "%s_count{%s} %d\n", name, labels, h.Count)
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// startMetricsServer serves metrics and the health endpoints over tcp if
+// metrics.listen is configured, including the remote health checks of the
+// forwards of m. required returns the forwards that must be bound for the
+// process to be ready.
+func startMetricsServer(ctx context.Context, m *forwardManager, required func() []string) error {
+	ps := m.ps
+	addr := currentSettings().Metrics.Listen
+	if addr == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(ps))
+	mux.HandleFunc("/healthz", healthz)
+	mux.Handle("/readyz", readyzHandler(ps, required))
+	mux.Handle("/health/", remoteHealthHandler(m))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			logger.Errorf("error closing metrics server: %s", err)
+		}
+	}()
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("metrics server error: %s", err)
+		}
+	}()
+	logger.Infof("serving metrics on %s", addr)
+	return nil
+}
+
+// alertRules returns a Prometheus alerting rules file for the metrics,
+// with alerts firing after holding for forDuration and labeled severity.
+// Without keepalives, stale keepalives are not alerted on.
+func alertRules(forDuration time.Duration, severity string, keepAliveInterval time.Duration) string {
+	var b strings.Builder
+	b.WriteString("groups:\n  - name: sshhttpproxy\n    rules:\n")
+	rule := func(alert, expr string, forDuration time.Duration, summary, description string) {
+		fmt.Fprintf(&b, "      - alert: %s\n        expr: %s\n", alert, expr)
+		if forDuration > 0 {
+			fmt.Fprintf(&b, "        for: %s\n", promDuration(forDuration))
+		}
+		fmt.Fprintf(&b, "        labels:\n          severity: %s\n", severity)
+		fmt.Fprintf(&b, "        annotations:\n          summary: %q\n          description: %q\n", summary, description)
+	}
+	rule("SSHTunnelDown", "sshhttpproxy_ssh_connected == 0", forDuration,
+		"ssh connection to {{ $labels.host }} is down",
+		"sshhttpproxy on {{ $labels.instance }} has no ssh connection to {{ $labels.host }}; connections through it fail or wait for it to come back.")
+	if keepAliveInterval > 0 {
+		// Two missed keepalives, before the connection is given up as
+		// lost.
+		rule("SSHKeepAliveStale", fmt.Sprintf("sshhttpproxy_ssh_connected == 1 and sshhttpproxy_ssh_last_keepalive_seconds > %g", (2*keepAliveInterval).Seconds()), 0,
+			"ssh server {{ $labels.host }} stopped answering keepalives",
+			"The ssh server {{ $labels.host }} last answered {{ $value | humanizeDuration }} ago; the connection is about to be closed as lost.")
+	}
+	rule("SSHForwardNotReady", "sshhttpproxy_forward_ready == 0", forDuration,
+		"forward {{ $labels.forward }} is not ready",
+		"The forward {{ $labels.forward }} to {{ $labels.host }} on {{ $labels.instance }} is paused or its ssh connection is down.")
+	rule("SSHTunnelFlapping", "increase(sshhttpproxy_ssh_reconnects_total[15m]) > 3", 0,
+		"ssh connection to {{ $labels.host }} keeps reconnecting",
+		"The ssh connection to {{ $labels.host }} was re-established {{ $value }} times in 15 minutes.")
+	rule("SSHRemoteUnreachable", `increase(sshhttpproxy_remote_dial_failures_total{reason="unreachable"}[5m]) > 0`, forDuration,
+		"remote targets unreachable from {{ $labels.host }}",
+		"The ssh server {{ $labels.host }} could not connect to remote targets {{ $value }} times in 5 minutes.")
+	return b.String()
+}
+
+// promDuration formats d as a Prometheus duration, e.g. 1m30s.
+func promDuration(d time.Duration) string {
+	s := d.String()
+	s = strings.Replace(s, "m0s", "m", 1)
+	return strings.Replace(s, "h0m", "h", 1)
+}
+
+// metricsCmd groups commands about the Prometheus metrics.
+var metricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "Work with the Prometheus metrics",
+}
+
+var metricsRulesCmd = &cobra.Command{
+	Use:   "rules",
+	Short: "Print example Prometheus alerting rules",
+	Long: `Print a Prometheus alerting rules file for the metrics served with --metrics,
+alerting when an ssh connection is down, stops answering keepalives or keeps
+reconnecting, when a forward is not ready and when remote targets are
+unreachable, so tunnel outages page before users notice. The keepalive
+threshold follows --keepalive-interval.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		forDuration, _ := cmd.Flags().GetDuration("for")
+		severity, _ := cmd.Flags().GetString("severity")
+		_, err := io.WriteString(os.Stdout, alertRules(forDuration, severity, currentSettings().SSHProxy.KeepAliveInterval))
+		return err
+	},
+}
+
+func init() {
+	metricsRulesCmd.Flags().Duration("for", 2*time.Minute, "how long a problem lasts before alerting")
+	metricsRulesCmd.Flags().String("severity", "page", "severity label of the alerts")
+	metricsCmd.AddCommand(metricsRulesCmd)
+	rootCmd.AddCommand(metricsCmd)
+}
@@ -0,0 +1,277 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// rawConfigAnnotation marks commands that work on the config files
+// themselves, which run even if the merged config fails the checks.
+const rawConfigAnnotation = "rawconfig"
+
+// renamedKeys are keys of earlier layouts that are spelled differently now
+// beyond case, dashes and underscores, by their path with list indexes and
+// map keys left out.
+var renamedKeys = map[string]string{
+	"sshproxy.identity": "privatekey",
+	"sshproxy.key":      "privatekey",
+	"sshproxy.username": "user",
+}
+
+// scalarSections are sections that used to be a single value, by the key
+// the value belongs under now, e.g. metrics: :9100 for metrics.listen.
+var scalarSections = map[string]string{
+	"metrics":    "listen",
+	"control":    "socket",
+	"connectlog": "file",
+	"audit":      "file",
+	"startup":    "workers",
+	"mdns":       "enabled",
+}
+
+var forwardsType = reflect.TypeOf([]forwardConfig{})
+
+// migrateConfig upgrades doc, a config file, from earlier layouts to the
+// current schema and describes each change it made.
+func migrateConfig(doc yaml.MapSlice) (yaml.MapSlice, []string) {
+	var notes []string
+	v := migrateValue(doc, reflect.TypeOf(fileConfig{}), "", "", &notes)
+	return v.(yaml.MapSlice), notes
+}
+
+// migrateValue migrates v, the value at path in the config, to the type t.
+// schemaPath is path without list indexes and map keys.
+func migrateValue(v interface{}, t reflect.Type, path, schemaPath string, notes *[]string) interface{} {
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(yaml.MapSlice)
+		if !ok {
+			key, ok := scalarSections[schemaPath]
+			if !ok || v == nil {
+				return v
+			}
+			*notes = append(*notes, fmt.Sprintf("%s: moved to %s.%s", path, path, key))
+			m = yaml.MapSlice{{Key: key, Value: v}}
+		}
+		for i := range m {
+			k := fmt.Sprint(m[i].Key)
+			f, ok := schemaField(t, k)
+			if !ok {
+				f, ok = renamedField(t, schemaPath, k)
+				if !ok {
+					continue
+				}
+				m[i].Key = fieldKey(f)
+				*notes = append(*notes, fmt.Sprintf("%s: renamed to %s", joinPath(path, k), joinPath(path, fieldKey(f))))
+			}
+			m[i].Value = migrateValue(m[i].Value, f.Type, joinPath(path, fieldKey(f)), joinPath(schemaPath, fieldKey(f)), notes)
+		}
+		return m
+	case reflect.Map:
+		m, ok := v.(yaml.MapSlice)
+		if !ok {
+			return v
+		}
+		for i := range m {
+			m[i].Value = migrateValue(m[i].Value, t.Elem(), joinPath(path, fmt.Sprint(m[i].Key)), schemaPath, notes)
+		}
+		return m
+	case reflect.Slice:
+		if t == forwardsType {
+			v = migrateForwards(v, path, notes)
+		}
+		items, ok := v.([]interface{})
+		if !ok {
+			return v
+		}
+		for i := range items {
+			items[i] = migrateValue(items[i], t.Elem(), fmt.Sprintf("%s[%d]", path, i), schemaPath, notes)
+		}
+		return items
+	}
+	return v
+}
+
+// renamedField returns the field of the struct type t, at schemaPath in the
+// config, that the key of an earlier layout became.
+func renamedField(t reflect.Type, schemaPath, key string) (reflect.StructField, bool) {
+	if name, ok := renamedKeys[joinPath(schemaPath, strings.ToLower(key))]; ok {
+		return schemaField(t, name)
+	}
+	squash := strings.NewReplacer("_", "", "-", "")
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(squash.Replace(fieldKey(t.Field(i))), squash.Replace(key)) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// migrateForwards converts the earlier layouts of a forwards list: a map
+// of forwards by name, and forwards given as "[local:]host:port" strings
+// like the argument of ssh -L.
+func migrateForwards(v interface{}, path string, notes *[]string) interface{} {
+	if m, ok := v.(yaml.MapSlice); ok {
+		items := make([]interface{}, 0, len(m))
+		for _, item := range m {
+			fwd, ok := item.Value.(yaml.MapSlice)
+			if !ok {
+				fwd = forwardFromString(item.Value)
+			}
+			items = append(items, append(yaml.MapSlice{{Key: "name", Value: item.Key}}, fwd...))
+		}
+		*notes = append(*notes, fmt.Sprintf("%s: converted from a map by name to a list", path))
+		v = items
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return v
+	}
+	for i, item := range items {
+		if s, ok := item.(string); ok {
+			items[i] = forwardFromString(s)
+			*notes = append(*notes, fmt.Sprintf("%s[%d]: converted %q to local and remote", path, i, s))
+		}
+	}
+	return items
+}
+
+// forwardFromString returns the forward of a "[local:]host:port" string.
+// A local part may be a port or an address:port.
+func forwardFromString(v interface{}) yaml.MapSlice {
+	s := fmt.Sprint(v)
+	parts := strings.Split(s, ":")
+	switch len(parts) {
+	case 3:
+		return yaml.MapSlice{{Key: "local", Value: parts[0]}, {Key: "remote", Value: parts[1] + ":" + parts[2]}}
+	case 4:
+		return yaml.MapSlice{{Key: "local", Value: parts[0] + ":" + parts[1]}, {Key: "remote", Value: parts[2] + ":" + parts[3]}}
+	}
+	return yaml.MapSlice{{Key: "remote", Value: s}}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// migrateFile migrates the config file at path, keeping the original next
+// to it with a .bak suffix and the time, unless dryRun is set, in which
+// case the result is only returned. It returns the migrated file and the
+// changes made, none if the file is current.
+func migrateFile(path string, dryRun bool) ([]byte, []string, error) {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+	default:
+		return nil, nil, errors.New("only YAML config files can be migrated")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(orig, &doc); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", path, err)
+	}
+	doc, notes := migrateConfig(doc)
+	if len(notes) == 0 {
+		return orig, nil, nil
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dryRun {
+		return out, notes, nil
+	}
+	backup := path + ".bak-" + time.Now().Format("20060102T150405")
+	if err := ioutil.WriteFile(backup, orig, info.Mode().Perm()); err != nil {
+		return nil, nil, err
+	}
+	if err := writeFileAtomic(path, out, info.Mode().Perm()); err != nil {
+		return nil, nil, err
+	}
+	return out, append(notes, "original kept as "+backup), nil
+}
+
+// configCmd groups commands that work on the config files.
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect and upgrade the config",
+}
+
+var configMigrateCmd = &cobra.Command{
+	Use:   "migrate [file]",
+	Short: "Upgrade a config file from earlier layouts",
+	Long: `Rewrite a config file, --config or the one in the home directory if
+not given, in the current layout, keeping the original next to it as a backup.
+It renames keys spelled like their flags or with other dashes and underscores,
+moves single values such as metrics: :9100 under their section, and converts
+forwards lists given as a map by name or as "[local:]host:port" strings.
+
+Comments are not kept, the backup has them. Keys it does not know are left
+alone and reported.`,
+	Annotations: map[string]string{rawConfigAnnotation: "true"},
+	Args:        cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := cfgFile
+		if len(args) > 0 {
+			path = args[0]
+		}
+		if path == "" {
+			home, err := homedir.Dir()
+			if err != nil {
+				return err
+			}
+			if path = findConfig(home); path == "" {
+				return errors.New("no config file in the home directory")
+			}
+		}
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		out, notes, err := migrateFile(path, dryRun)
+		if err != nil {
+			return err
+		}
+		if len(notes) == 0 {
+			fmt.Fprintf(os.Stderr, "%s is current\n", path)
+		}
+		for _, note := range notes {
+			fmt.Fprintln(os.Stderr, note)
+		}
+		var doc interface{}
+		if err := yaml.Unmarshal(out, &doc); err != nil {
+			return err
+		}
+		for _, msg := range unknownKeys(doc, reflect.TypeOf(fileConfig{}), "") {
+			fmt.Fprintln(os.Stderr, "left alone:", msg)
+		}
+		if dryRun {
+			_, err = os.Stdout.Write(out)
+		}
+		return err
+	},
+}
+
+func init() {
+	configMigrateCmd.Flags().Bool("dry-run", false, "print the migrated file instead of writing it")
+	configCmd.AddCommand(configMigrateCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,174 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		before, after string
+		notes         []string
+	}{
+		{
+			"renamed keys",
+			"sshproxy:\n  identity: ~/.ssh/id\n  username: elliot\n",
+			"sshproxy:\n  privatekey: ~/.ssh/id\n  user: elliot\n",
+			[]string{
+				"sshproxy.identity: renamed to sshproxy.privatekey",
+				"sshproxy.username: renamed to sshproxy.user",
+			},
+		},
+		{
+			"dashes and underscores",
+			"sshproxy:\n  private_key: ~/.ssh/id\n  keep-alive-interval: 30s\n  proxy-command: nc\n",
+			"sshproxy:\n  privatekey: ~/.ssh/id\n  keepaliveinterval: 30s\n  proxy_command: nc\n",
+			[]string{
+				"sshproxy.private_key: renamed to sshproxy.privatekey",
+				"sshproxy.keep-alive-interval: renamed to sshproxy.keepaliveinterval",
+				"sshproxy.proxy-command: renamed to sshproxy.proxy_command",
+			},
+		},
+		{
+			"single values",
+			"metrics: :9100\ncontrol: /tmp/s\nconnectlog: c.log\naudit: a.log\nstartup: 4\nmdns: true\n",
+			"metrics:\n  listen: :9100\ncontrol:\n  socket: /tmp/s\nconnectlog:\n  file: c.log\naudit:\n  file: a.log\nstartup:\n  workers: 4\nmdns:\n  enabled: true\n",
+			[]string{
+				"metrics: moved to metrics.listen",
+				"control: moved to control.socket",
+				"connectlog: moved to connectlog.file",
+				"audit: moved to audit.file",
+				"startup: moved to startup.workers",
+				"mdns: moved to mdns.enabled",
+			},
+		},
+		{
+			"forwards by name",
+			"forwards:\n  db: 5432:db:5432\n  web:\n    remote: web:80\n",
+			"forwards:\n- name: db\n  local: \"5432\"\n  remote: db:5432\n- name: web\n  remote: web:80\n",
+			[]string{"forwards: converted from a map by name to a list"},
+		},
+		{
+			"forward strings",
+			"forwards:\n  - 5432:db:5432\n  - 127.0.0.1:8080:web:80\n  - api:443\n",
+			"forwards:\n- local: \"5432\"\n  remote: db:5432\n- local: 127.0.0.1:8080\n  remote: web:80\n- remote: api:443\n",
+			[]string{
+				`forwards[0]: converted "5432:db:5432" to local and remote`,
+				`forwards[1]: converted "127.0.0.1:8080:web:80" to local and remote`,
+				`forwards[2]: converted "api:443" to local and remote`,
+			},
+		},
+		{
+			"groups and hosts",
+			"groups:\n  dev:\n    - 8080:web:80\nhosts:\n  b:\n    private_key: k\n",
+			"groups:\n  dev:\n  - local: \"8080\"\n    remote: web:80\nhosts:\n  b:\n    privatekey: k\n",
+			[]string{
+				`groups.dev[0]: converted "8080:web:80" to local and remote`,
+				"hosts.b.private_key: renamed to hosts.b.privatekey",
+			},
+		},
+		{
+			"current",
+			"sshproxy:\n  user: elliot\nforwards:\n- name: db\n  remote: db:5432\nreverse:\n- name: r\n  remote: \"80\"\n  local: localhost:8080\n",
+			"sshproxy:\n  user: elliot\nforwards:\n- name: db\n  remote: db:5432\nreverse:\n- name: r\n  remote: \"80\"\n  local: localhost:8080\n",
+			nil,
+		},
+		{
+			"unknown keys are left alone",
+			"sshproxy:\n  colour: blue\n",
+			"sshproxy:\n  colour: blue\n",
+			nil,
+		},
+	} {
+		var doc yaml.MapSlice
+		if err := yaml.Unmarshal([]byte(tt.before), &doc); err != nil {
+			t.Fatal(err)
+		}
+		doc, notes := migrateConfig(doc)
+		out, err := yaml.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tt.after {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, out, tt.after)
+		}
+		if !reflect.DeepEqual(notes, tt.notes) {
+			t.Errorf("%s: got notes %q, want %q", tt.name, notes, tt.notes)
+		}
+	}
+}
+
+func TestMigrateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.yaml")
+	before := "# old layout\nmetrics: :9100\n"
+	after := "metrics:\n  listen: :9100\n"
+	if err := ioutil.WriteFile(path, []byte(before), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, notes, err := migrateFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != after || len(notes) != 1 {
+		t.Fatalf("dry run gave %q, %q", out, notes)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != before {
+		t.Fatalf("dry run changed the file to %q", data)
+	}
+
+	out, notes, err = migrateFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != after {
+		t.Fatalf("migrated to %q", out)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != after {
+		t.Fatalf("file is %q", data)
+	}
+	last := notes[len(notes)-1]
+	if !strings.HasPrefix(last, "original kept as "+path+".bak-") {
+		t.Fatalf("notes %q", notes)
+	}
+	backup := strings.TrimPrefix(last, "original kept as ")
+	data, err := ioutil.ReadFile(backup)
+	if err != nil || string(data) != before {
+		t.Fatalf("backup has %q, %v", data, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("migrated file has mode %o", perm)
+	}
+
+	// A current file is left as it is.
+	out, notes, err = migrateFile(path, false)
+	if err != nil || string(out) != after || len(notes) != 0 {
+		t.Fatalf("migrating again gave %q, %q, %v", out, notes, err)
+	}
+
+	json := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(json, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := migrateFile(json, true); err == nil {
+		t.Fatal("migrated a JSON file")
+	}
+}
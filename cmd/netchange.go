@@ -0,0 +1,119 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// netSettle is how long notifications must stop before the network is
+// looked at, as moving to another network comes with a burst of them.
+const netSettle = time.Second
+
+// netState describes the addresses of the network interfaces that are
+// up, which change when moving between networks or connecting a VPN.
+func netState() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		logger.Debugf("listing network interfaces: %s", err)
+		return ""
+	}
+	var state []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			state = append(state, iface.Name+"="+addr.String())
+		}
+	}
+	sort.Strings(state)
+	return strings.Join(state, " ")
+}
+
+// notifyReads sends on the returned channel whenever a message can be read
+// from r, a socket the system notifies network changes on, until ctx is
+// done or reading fails.
+func notifyReads(ctx context.Context, r io.ReadCloser) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		r.Close()
+	}()
+	go func() {
+		defer close(changes)
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := r.Read(buf); err != nil {
+				if ctx.Err() == nil {
+					logger.Warningf("no longer watching for network changes: %s", err)
+				}
+				return
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes
+}
+
+// reconnectOnNetworkChange replaces the ssh connections of ps when the
+// addresses of the network interfaces change, instead of waiting for
+// keepalives to find the old ones dead.
+func reconnectOnNetworkChange(ctx context.Context, ps *proxySet) {
+	changes, err := watchNetwork(ctx)
+	if err != nil {
+		logger.Warningf("not watching for network changes: %s", err)
+		return
+	}
+	state := netState()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		}
+		if !settle(ctx, changes) {
+			return
+		}
+		if s := netState(); s != state {
+			state = s
+			logger.Infof("network changed, reconnecting")
+			ps.resume()
+		}
+	}
+}
+
+// settle waits until there were no changes for netSettle. It returns false
+// if ctx is done or changes closed first.
+func settle(ctx context.Context, changes <-chan struct{}) bool {
+	timer := time.NewTimer(netSettle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case _, ok := <-changes:
+			if !ok {
+				return false
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(netSettle)
+		case <-timer.C:
+			return true
+		}
+	}
+}
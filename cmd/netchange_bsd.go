@@ -0,0 +1,28 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+// watchNetwork notifies interface, address and route changes from a
+// routing socket.
+func watchNetwork(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	// Non-blocking, so closing the file interrupts a pending read.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	return notifyReads(ctx, os.NewFile(uintptr(fd), "route")), nil
+}
@@ -0,0 +1,38 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package cmd
+
+import (
+	"context"
+	"time"
+)
+
+// netPollInterval is how often the network is looked at without change
+// notifications.
+const netPollInterval = 5 * time.Second
+
+// watchNetwork polls, leaving it to the caller to tell whether the
+// network changed.
+func watchNetwork(ctx context.Context) (<-chan struct{}, error) {
+	changes := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(netPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			select {
+			case changes <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
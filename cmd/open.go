@@ -0,0 +1,142 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// openURL returns the URL of a forward listening on local to remote, with
+// https for the usual TLS ports unless scheme is set, and path.
+func openURL(local, remote, scheme, path string) string {
+	if scheme == "" {
+		scheme = "http"
+		if _, port, _ := net.SplitHostPort(remote); port == "443" || port == "8443" {
+			scheme = "https"
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return scheme + "://" + local + path
+}
+
+// lanURL returns u with the address of a forward listening on local
+// replaced by one it is reachable on from the LAN, or false if it only
+// listens on loopback.
+func lanURL(u, local string) (string, bool) {
+	ips := advertisedIPs(local)
+	if len(ips) == 0 {
+		return "", false
+	}
+	ip := ips[0]
+	for _, i := range ips {
+		if i.To4() != nil {
+			ip = i
+			break
+		}
+	}
+	_, port, _ := net.SplitHostPort(local)
+	return strings.Replace(u, local, net.JoinHostPort(ip.String(), port), 1), true
+}
+
+// openBrowser opens u in the default browser.
+func openBrowser(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+var openCmd = &cobra.Command{
+	Use:   "open <remote> [host]",
+	Short: "Forward a remote web service and print its local URL",
+	Long: `Forward a local port to remote, a host:port on the remote side, print the
+local URL and, with --browser, open it in the default browser, for quick access
+to internal dashboards. The forward lasts until interrupted.
+
+With --qr, a QR code of the URL is printed too, for testing from phones and
+tablets on the LAN. The forward then has to listen on the LAN, e.g. with
+--local 0.0.0.0:8080, and the code uses the address of one of its interfaces.
+
+The ssh connection of host, the default one if not given, is used.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, _ := cmd.InheritedFlags().GetBool("debug")
+		setupLogging(os.Stderr, debug)
+		remote := args[0]
+		if _, _, err := net.SplitHostPort(remote); err != nil {
+			return fmt.Errorf("remote %q is not a host:port", remote)
+		}
+		host := defaultHost
+		if len(args) > 1 {
+			host = args[1]
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go setupSignalHandler(ctx, cancel)
+		defer cancel()
+		ps, err := proxiesFromConfig(ctx, policyOnce)
+		if err != nil {
+			return err
+		}
+		defer ps.Shutdown()
+		p, err := ps.ensure(host)
+		if err != nil {
+			return err
+		}
+		localPort, _ := cmd.InheritedFlags().GetString("local")
+		local, err := p.ForwardWithOptions(remote, remote, localPort, forwardOptions(remote, nil))
+		if err != nil {
+			return err
+		}
+		scheme, _ := cmd.Flags().GetString("scheme")
+		path, _ := cmd.Flags().GetString("path")
+		u := openURL(local, remote, scheme, path)
+		fmt.Println(u)
+		if qr, _ := cmd.Flags().GetBool("qr"); qr {
+			if lan, ok := lanURL(u, local); !ok {
+				logger.Warningf("%s only listens on loopback, not reachable from the LAN", local)
+			} else {
+				code, err := newQRCode(lan)
+				if err != nil {
+					return fmt.Errorf("%s: %s", lan, err)
+				}
+				fmt.Println(lan)
+				code.write(os.Stdout)
+			}
+		}
+		if browser, _ := cmd.Flags().GetBool("browser"); browser {
+			if err := openBrowser(u); err != nil {
+				logger.Warningf("error opening a browser: %s", err)
+			}
+		}
+		<-ctx.Done()
+		return nil
+	},
+}
+
+func init() {
+	openCmd.Flags().BoolP("browser", "b", false, "open the URL in the default browser")
+	openCmd.Flags().String("scheme", "", "URL scheme (default https for ports 443 and 8443, http otherwise)")
+	openCmd.Flags().String("path", "/", "URL path")
+	openCmd.Flags().Bool("qr", false, "print a QR code of the URL on the LAN")
+	rootCmd.AddCommand(openCmd)
+}
@@ -0,0 +1,643 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+//go:build pkcs11 && cgo && !windows
+// +build pkcs11,cgo,!windows
+
+package cmd
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+
+// The parts of the PKCS#11 v2.40 interface the client uses, declared here
+// as distributions rarely ship pkcs11.h. The function list holds every
+// function in the order of the standard, unused ones as plain pointers.
+
+typedef unsigned long CK_ULONG;
+typedef CK_ULONG CK_RV;
+typedef CK_ULONG CK_SLOT_ID;
+typedef CK_ULONG CK_SESSION_HANDLE;
+typedef CK_ULONG CK_OBJECT_HANDLE;
+
+typedef struct {
+	unsigned char major, minor;
+} CK_VERSION;
+
+typedef struct {
+	unsigned char label[32];
+	unsigned char manufacturerID[32];
+	unsigned char model[16];
+	unsigned char serialNumber[16];
+	CK_ULONG flags;
+	CK_ULONG ulMaxSessionCount, ulSessionCount;
+	CK_ULONG ulMaxRwSessionCount, ulRwSessionCount;
+	CK_ULONG ulMaxPinLen, ulMinPinLen;
+	CK_ULONG ulTotalPublicMemory, ulFreePublicMemory;
+	CK_ULONG ulTotalPrivateMemory, ulFreePrivateMemory;
+	CK_VERSION hardwareVersion, firmwareVersion;
+	unsigned char utcTime[16];
+} CK_TOKEN_INFO;
+
+typedef struct {
+	CK_ULONG type;
+	void *pValue;
+	CK_ULONG ulValueLen;
+} CK_ATTRIBUTE;
+
+typedef struct {
+	CK_ULONG mechanism;
+	void *pParameter;
+	CK_ULONG ulParameterLen;
+} CK_MECHANISM;
+
+typedef struct {
+	void *CreateMutex, *DestroyMutex, *LockMutex, *UnlockMutex;
+	CK_ULONG flags;
+	void *pReserved;
+} CK_C_INITIALIZE_ARGS;
+
+typedef struct {
+	CK_VERSION version;
+	CK_RV (*C_Initialize)(void *);
+	void *C_Finalize, *C_GetInfo, *C_GetFunctionList;
+	CK_RV (*C_GetSlotList)(unsigned char, CK_SLOT_ID *, CK_ULONG *);
+	void *C_GetSlotInfo;
+	CK_RV (*C_GetTokenInfo)(CK_SLOT_ID, CK_TOKEN_INFO *);
+	void *C_GetMechanismList, *C_GetMechanismInfo, *C_InitToken, *C_InitPIN, *C_SetPIN;
+	CK_RV (*C_OpenSession)(CK_SLOT_ID, CK_ULONG, void *, void *, CK_SESSION_HANDLE *);
+	CK_RV (*C_CloseSession)(CK_SESSION_HANDLE);
+	void *C_CloseAllSessions, *C_GetSessionInfo, *C_GetOperationState, *C_SetOperationState;
+	CK_RV (*C_Login)(CK_SESSION_HANDLE, CK_ULONG, unsigned char *, CK_ULONG);
+	void *C_Logout, *C_CreateObject, *C_CopyObject, *C_DestroyObject, *C_GetObjectSize;
+	CK_RV (*C_GetAttributeValue)(CK_SESSION_HANDLE, CK_OBJECT_HANDLE, CK_ATTRIBUTE *, CK_ULONG);
+	void *C_SetAttributeValue;
+	CK_RV (*C_FindObjectsInit)(CK_SESSION_HANDLE, CK_ATTRIBUTE *, CK_ULONG);
+	CK_RV (*C_FindObjects)(CK_SESSION_HANDLE, CK_OBJECT_HANDLE *, CK_ULONG, CK_ULONG *);
+	CK_RV (*C_FindObjectsFinal)(CK_SESSION_HANDLE);
+	void *C_EncryptInit, *C_Encrypt, *C_EncryptUpdate, *C_EncryptFinal;
+	void *C_DecryptInit, *C_Decrypt, *C_DecryptUpdate, *C_DecryptFinal;
+	void *C_DigestInit, *C_Digest, *C_DigestUpdate, *C_DigestKey, *C_DigestFinal;
+	CK_RV (*C_SignInit)(CK_SESSION_HANDLE, CK_MECHANISM *, CK_OBJECT_HANDLE);
+	CK_RV (*C_Sign)(CK_SESSION_HANDLE, unsigned char *, CK_ULONG, unsigned char *, CK_ULONG *);
+	void *C_SignUpdate, *C_SignFinal, *C_SignRecoverInit, *C_SignRecover;
+	void *C_VerifyInit, *C_Verify, *C_VerifyUpdate, *C_VerifyFinal, *C_VerifyRecoverInit, *C_VerifyRecover;
+	void *C_DigestEncryptUpdate, *C_DecryptDigestUpdate, *C_SignEncryptUpdate, *C_DecryptVerifyUpdate;
+	void *C_GenerateKey, *C_GenerateKeyPair, *C_WrapKey, *C_UnwrapKey, *C_DeriveKey;
+	void *C_SeedRandom, *C_GenerateRandom, *C_GetFunctionStatus, *C_CancelFunction, *C_WaitForSlotEvent;
+} CK_FUNCTION_LIST;
+
+typedef CK_RV (*get_function_list_t)(CK_FUNCTION_LIST **);
+
+static CK_RV load_module(const char *path, CK_FUNCTION_LIST **f, char **err) {
+	void *lib = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (lib == NULL) {
+		*err = dlerror();
+		return 0;
+	}
+	get_function_list_t get = (get_function_list_t)dlsym(lib, "C_GetFunctionList");
+	if (get == NULL) {
+		*err = dlerror();
+		return 0;
+	}
+	return get(f);
+}
+
+static CK_RV initialize(CK_FUNCTION_LIST *f) {
+	// CKF_OS_LOCKING_OK
+	CK_C_INITIALIZE_ARGS args = {0, 0, 0, 0, 2, 0};
+	return f->C_Initialize(&args);
+}
+
+static CK_RV get_slot_list(CK_FUNCTION_LIST *f, CK_SLOT_ID *slots, CK_ULONG *n) {
+	return f->C_GetSlotList(1, slots, n);
+}
+
+static CK_RV get_token_info(CK_FUNCTION_LIST *f, CK_SLOT_ID slot, CK_TOKEN_INFO *info) {
+	return f->C_GetTokenInfo(slot, info);
+}
+
+static CK_RV open_session(CK_FUNCTION_LIST *f, CK_SLOT_ID slot, CK_SESSION_HANDLE *session) {
+	// CKF_SERIAL_SESSION
+	return f->C_OpenSession(slot, 4, NULL, NULL, session);
+}
+
+static CK_RV close_session(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session) {
+	return f->C_CloseSession(session);
+}
+
+static CK_RV login(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session, unsigned char *pin, CK_ULONG len) {
+	// CKU_USER
+	return f->C_Login(session, 1, pin, len);
+}
+
+static CK_RV find_objects(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session, CK_ULONG class, CK_OBJECT_HANDLE *objects, CK_ULONG max, CK_ULONG *n) {
+	CK_ATTRIBUTE attr = {0, &class, sizeof(class)};
+	CK_RV rv = f->C_FindObjectsInit(session, &attr, 1);
+	if (rv != 0) {
+		return rv;
+	}
+	rv = f->C_FindObjects(session, objects, max, n);
+	f->C_FindObjectsFinal(session);
+	return rv;
+}
+
+static CK_RV get_attribute(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session, CK_OBJECT_HANDLE object, CK_ULONG type, void *value, CK_ULONG *len) {
+	CK_ATTRIBUTE attr = {type, value, *len};
+	CK_RV rv = f->C_GetAttributeValue(session, object, &attr, 1);
+	*len = attr.ulValueLen;
+	return rv;
+}
+
+static CK_RV sign(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session, CK_OBJECT_HANDLE key, CK_ULONG mechanism, unsigned char *data, CK_ULONG len, unsigned char *sig, CK_ULONG *sig_len) {
+	CK_MECHANISM mech = {mechanism, NULL, 0};
+	CK_RV rv = f->C_SignInit(session, &mech, key);
+	if (rv != 0) {
+		return rv;
+	}
+	return f->C_Sign(session, data, len, sig, sig_len);
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// PKCS#11 constants of the standard.
+const (
+	ckrOK                         = 0x000
+	ckrDeviceRemoved              = 0x032
+	ckrPINIncorrect               = 0x0a0
+	ckrPINLocked                  = 0x0a4
+	ckrSessionClosed              = 0x0b0
+	ckrSessionHandleInvalid       = 0x0b3
+	ckrTokenNotPresent            = 0x0e0
+	ckrUserAlreadyLoggedIn        = 0x100
+	ckrCryptokiAlreadyInitialized = 0x191
+
+	ckfLoginRequired     = 0x004
+	ckfProtectedAuthPath = 0x100
+
+	ckoCertificate = 1
+	ckoPublicKey   = 2
+	ckoPrivateKey  = 3
+
+	ckaValue          = 0x011
+	ckaKeyType        = 0x100
+	ckaID             = 0x102
+	ckaModulus        = 0x120
+	ckaPublicExponent = 0x122
+	ckaECParams       = 0x180
+	ckaECPoint        = 0x181
+
+	ckkRSA = 0
+	ckkEC  = 3
+
+	ckmRSAPKCS = 0x001
+	ckmECDSA   = 0x1041
+)
+
+// pkcs11Error is a failed PKCS#11 call.
+type pkcs11Error struct {
+	call string
+	rv   C.CK_RV
+}
+
+func (e pkcs11Error) Error() string {
+	name := map[C.CK_RV]string{
+		ckrDeviceRemoved:        "device removed",
+		ckrPINIncorrect:         "incorrect PIN",
+		ckrPINLocked:            "PIN locked",
+		ckrSessionClosed:        "session closed",
+		ckrSessionHandleInvalid: "invalid session",
+		ckrTokenNotPresent:      "token not present",
+	}[e.rv]
+	if name == "" {
+		name = fmt.Sprintf("error 0x%x", uint64(e.rv))
+	}
+	return fmt.Sprintf("pkcs11: %s: %s", e.call, name)
+}
+
+func ckCall(call string, rv C.CK_RV) error {
+	if rv == ckrOK {
+		return nil
+	}
+	return pkcs11Error{call, rv}
+}
+
+// pkcs11Tokens are the tokens in use by module and label, kept across
+// config reloads so the PIN is not asked for again.
+var pkcs11Tokens = struct {
+	sync.Mutex
+	m map[string]*pkcs11Token
+}{m: make(map[string]*pkcs11Token)}
+
+func pkcs11Signers(module, token, pin string) func() ([]ssh.Signer, error) {
+	pkcs11Tokens.Lock()
+	defer pkcs11Tokens.Unlock()
+	key := module + "\x00" + token
+	t := pkcs11Tokens.m[key]
+	if t == nil {
+		t = &pkcs11Token{module: module, label: token}
+		pkcs11Tokens.m[key] = t
+	}
+	t.mu.Lock()
+	if pin != "" && pin != t.pin {
+		t.pin, t.err = pin, nil
+	}
+	t.mu.Unlock()
+	return t.signers
+}
+
+// pkcs11Token is a token of a PKCS#11 module, logged in to on first use.
+// The session is opened again after the token is removed and reinserted.
+// Calls on the session are serialized, which the standard requires.
+type pkcs11Token struct {
+	module string
+	label  string
+
+	mu      sync.Mutex
+	f       *C.CK_FUNCTION_LIST
+	pin     string
+	session C.CK_SESSION_HANDLE
+	keys    []ssh.Signer
+	// err is returned for good once the PIN of the config was refused,
+	// so reconnects do not lock the token by retrying it.
+	err error
+}
+
+// signers returns the keys of the token, opening a session first if
+// there is none.
+func (t *pkcs11Token) signers() ([]ssh.Signer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.keys == nil {
+		if err := t.open(); err != nil {
+			return nil, err
+		}
+	}
+	return t.keys, nil
+}
+
+// open loads the module if needed, opens a session on the token, logs in
+// and finds the keys.
+func (t *pkcs11Token) open() error {
+	if t.f == nil {
+		cpath := C.CString(t.module)
+		defer C.free(unsafe.Pointer(cpath))
+		var cerr *C.char
+		rv := C.load_module(cpath, &t.f, &cerr)
+		if cerr != nil {
+			return fmt.Errorf("pkcs11: loading %s: %s", t.module, C.GoString(cerr))
+		}
+		if err := ckCall("C_GetFunctionList", rv); err != nil {
+			return err
+		}
+		if rv := C.initialize(t.f); rv != ckrCryptokiAlreadyInitialized {
+			if err := ckCall("C_Initialize", rv); err != nil {
+				t.f = nil
+				return err
+			}
+		}
+	}
+	slot, info, err := t.findToken()
+	if err != nil {
+		return err
+	}
+	if err := ckCall("C_OpenSession", C.open_session(t.f, slot, &t.session)); err != nil {
+		return err
+	}
+	if err := t.login(info); err != nil {
+		t.close()
+		return err
+	}
+	keys, err := t.findKeys()
+	if err != nil {
+		t.close()
+		return err
+	}
+	if len(keys) == 0 {
+		t.close()
+		return fmt.Errorf("pkcs11: token %s has no supported key", tokenLabel(info))
+	}
+	t.keys = keys
+	logger.Infof("using %d key(s) of token %s", len(keys), tokenLabel(info))
+	return nil
+}
+
+// findToken returns the slot and info of the token labelled label, or the
+// first token if label is empty.
+func (t *pkcs11Token) findToken() (C.CK_SLOT_ID, *C.CK_TOKEN_INFO, error) {
+	var n C.CK_ULONG
+	if err := ckCall("C_GetSlotList", C.get_slot_list(t.f, nil, &n)); err != nil {
+		return 0, nil, err
+	}
+	if n == 0 {
+		return 0, nil, errors.New("pkcs11: no token present")
+	}
+	slots := make([]C.CK_SLOT_ID, n)
+	if err := ckCall("C_GetSlotList", C.get_slot_list(t.f, &slots[0], &n)); err != nil {
+		return 0, nil, err
+	}
+	for _, slot := range slots[:n] {
+		var info C.CK_TOKEN_INFO
+		if C.get_token_info(t.f, slot, &info) != ckrOK {
+			continue
+		}
+		if t.label == "" || tokenLabel(&info) == t.label {
+			return slot, &info, nil
+		}
+	}
+	if t.label == "" {
+		return 0, nil, errors.New("pkcs11: no token present")
+	}
+	return 0, nil, fmt.Errorf("pkcs11: no token labelled %s", t.label)
+}
+
+// login logs in to the token if it needs it, with the PIN of the config
+// or one asked for on the terminal. Tokens with a PIN pad take it there.
+func (t *pkcs11Token) login(info *C.CK_TOKEN_INFO) error {
+	if info.flags&ckfLoginRequired == 0 {
+		return nil
+	}
+	var rv C.CK_RV
+	if info.flags&ckfProtectedAuthPath != 0 {
+		logger.Infof("enter the PIN of token %s on its PIN pad", tokenLabel(info))
+		rv = C.login(t.f, t.session, nil, 0)
+	} else {
+		pin, prompted, err := t.readPIN(info)
+		if err != nil {
+			return err
+		}
+		cpin := C.CBytes([]byte(pin))
+		defer C.free(cpin)
+		rv = C.login(t.f, t.session, (*C.uchar)(cpin), C.CK_ULONG(len(pin)))
+		if rv == ckrOK || rv == ckrUserAlreadyLoggedIn {
+			t.pin = pin
+		} else if !prompted && (rv == ckrPINIncorrect || rv == ckrPINLocked) {
+			t.err = ckCall("C_Login", rv)
+		}
+	}
+	if rv == ckrUserAlreadyLoggedIn {
+		return nil
+	}
+	return ckCall("C_Login", rv)
+}
+
+// readPIN returns the PIN of the config or the one given on the terminal
+// if there is none, and whether it was asked for.
+func (t *pkcs11Token) readPIN(info *C.CK_TOKEN_INFO) (string, bool, error) {
+	if t.pin != "" {
+		return t.pin, false, nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return "", false, fmt.Errorf("pkcs11: token %s needs a PIN, set sshproxy.pkcs11.pin", tokenLabel(info))
+	}
+	fmt.Fprintf(os.Stderr, "PIN for token %s: ", tokenLabel(info))
+	pin, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", false, err
+	}
+	return string(pin), true, nil
+}
+
+// close closes the session and forgets the keys, so the next use opens
+// the token again.
+func (t *pkcs11Token) close() {
+	C.close_session(t.f, t.session)
+	t.session, t.keys = 0, nil
+}
+
+// findKeys returns a signer for each RSA or ECDSA private key of the token
+// whose public key it has, as a public key object or a certificate with
+// the same ID.
+func (t *pkcs11Token) findKeys() ([]ssh.Signer, error) {
+	privs, err := t.findObjects(ckoPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.Signer
+	for _, priv := range privs {
+		id, err := t.attribute(priv, ckaID)
+		if err != nil {
+			continue
+		}
+		pub, err := t.publicKey(id)
+		if err != nil {
+			logger.Debugf("pkcs11: skipping key %x: %s", id, err)
+			continue
+		}
+		signer, err := ssh.NewSignerFromSigner(&pkcs11Key{t: t, handle: priv, pub: pub})
+		if err != nil {
+			logger.Debugf("pkcs11: skipping key %x: %s", id, err)
+			continue
+		}
+		keys = append(keys, signer)
+	}
+	return keys, nil
+}
+
+// publicKey returns the public key with the given ID.
+func (t *pkcs11Token) publicKey(id []byte) (crypto.PublicKey, error) {
+	pubs, err := t.findObjects(ckoPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, pub := range pubs {
+		if pid, err := t.attribute(pub, ckaID); err != nil || !bytes.Equal(pid, id) {
+			continue
+		}
+		keyType, err := t.attribute(pub, ckaKeyType)
+		if err != nil {
+			return nil, err
+		}
+		switch ckUlong(keyType) {
+		case ckkRSA:
+			return t.rsaPublicKey(pub)
+		case ckkEC:
+			return t.ecPublicKey(pub)
+		}
+		return nil, errors.New("unsupported key type")
+	}
+	certs, err := t.findObjects(ckoCertificate)
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range certs {
+		if cid, err := t.attribute(cert, ckaID); err != nil || !bytes.Equal(cid, id) {
+			continue
+		}
+		der, err := t.attribute(cert, ckaValue)
+		if err != nil {
+			return nil, err
+		}
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		return c.PublicKey, nil
+	}
+	return nil, errors.New("no public key")
+}
+
+func (t *pkcs11Token) rsaPublicKey(pub C.CK_OBJECT_HANDLE) (crypto.PublicKey, error) {
+	n, err := t.attribute(pub, ckaModulus)
+	if err != nil {
+		return nil, err
+	}
+	e, err := t.attribute(pub, ckaPublicExponent)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+func (t *pkcs11Token) ecPublicKey(pub C.CK_OBJECT_HANDLE) (crypto.PublicKey, error) {
+	params, err := t.attribute(pub, ckaECParams)
+	if err != nil {
+		return nil, err
+	}
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, err
+	}
+	var curve elliptic.Curve
+	switch oid.String() {
+	case "1.2.840.10045.3.1.7":
+		curve = elliptic.P256()
+	case "1.3.132.0.34":
+		curve = elliptic.P384()
+	case "1.3.132.0.35":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %s", oid)
+	}
+	point, err := t.attribute(pub, ckaECPoint)
+	if err != nil {
+		return nil, err
+	}
+	// The point is DER encoded as the standard says, or raw with some
+	// modules.
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err == nil && len(rest) == 0 {
+		point = raw
+	}
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, errors.New("bad EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// findObjects returns the objects of class on the token.
+func (t *pkcs11Token) findObjects(class C.CK_ULONG) ([]C.CK_OBJECT_HANDLE, error) {
+	objects := make([]C.CK_OBJECT_HANDLE, 64)
+	var n C.CK_ULONG
+	if err := ckCall("C_FindObjects", C.find_objects(t.f, t.session, class, &objects[0], C.CK_ULONG(len(objects)), &n)); err != nil {
+		return nil, err
+	}
+	return objects[:n], nil
+}
+
+// attribute returns the value of the attribute typ of object.
+func (t *pkcs11Token) attribute(object C.CK_OBJECT_HANDLE, typ C.CK_ULONG) ([]byte, error) {
+	var n C.CK_ULONG
+	if err := ckCall("C_GetAttributeValue", C.get_attribute(t.f, t.session, object, typ, nil, &n)); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	value := C.malloc(C.size_t(n))
+	defer C.free(value)
+	if err := ckCall("C_GetAttributeValue", C.get_attribute(t.f, t.session, object, typ, value, &n)); err != nil {
+		return nil, err
+	}
+	return C.GoBytes(value, C.int(n)), nil
+}
+
+// ckUlong decodes a CK_ULONG attribute value.
+func ckUlong(b []byte) C.CK_ULONG {
+	var v C.CK_ULONG
+	if len(b) == int(unsafe.Sizeof(v)) {
+		v = *(*C.CK_ULONG)(unsafe.Pointer(&b[0]))
+	}
+	return v
+}
+
+// tokenLabel returns the label of the token, which is padded with spaces.
+func tokenLabel(info *C.CK_TOKEN_INFO) string {
+	label := C.GoBytes(unsafe.Pointer(&info.label[0]), C.int(len(info.label)))
+	return string(bytes.TrimRight(label, " \x00"))
+}
+
+// pkcs11Key is a private key of a token, which signs with it.
+type pkcs11Key struct {
+	t      *pkcs11Token
+	handle C.CK_OBJECT_HANDLE
+	pub    crypto.PublicKey
+}
+
+func (k *pkcs11Key) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign signs digest on the token: with CKM_RSA_PKCS over its DigestInfo
+// for RSA keys, with CKM_ECDSA for ECDSA keys, whose raw signature is
+// returned DER encoded like ecdsa.Sign.
+func (k *pkcs11Key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	mech := C.CK_ULONG(ckmECDSA)
+	data := digest
+	if _, ok := k.pub.(*rsa.PublicKey); ok {
+		var err error
+		if data, err = digestInfo(opts.HashFunc(), digest); err != nil {
+			return nil, err
+		}
+		mech = ckmRSAPKCS
+	}
+	k.t.mu.Lock()
+	defer k.t.mu.Unlock()
+	if k.t.keys == nil {
+		return nil, errors.New("pkcs11: session closed")
+	}
+	cdata := C.CBytes(data)
+	defer C.free(cdata)
+	sig := C.malloc(1024)
+	defer C.free(sig)
+	n := C.CK_ULONG(1024)
+	rv := C.sign(k.t.f, k.t.session, k.handle, mech, (*C.uchar)(cdata), C.CK_ULONG(len(data)), (*C.uchar)(sig), &n)
+	switch rv {
+	case ckrOK:
+	case ckrDeviceRemoved, ckrTokenNotPresent, ckrSessionClosed, ckrSessionHandleInvalid:
+		k.t.close()
+		fallthrough
+	default:
+		return nil, ckCall("C_Sign", rv)
+	}
+	out := C.GoBytes(sig, C.int(n))
+	if mech == ckmRSAPKCS {
+		return out, nil
+	}
+	return ecdsaSignature(out)
+}
@@ -0,0 +1,20 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+//go:build !pkcs11 || !cgo || windows
+// +build !pkcs11 !cgo windows
+
+package cmd
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errPKCS11Unsupported = errors.New("pkcs11: built without pkcs11 support, rebuild with -tags pkcs11")
+
+func pkcs11Signers(module, token, pin string) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		return nil, errPKCS11Unsupported
+	}
+}
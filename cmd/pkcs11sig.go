@@ -0,0 +1,48 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"crypto"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// The encodings around PKCS#11 signatures, kept out of pkcs11.go so they
+// build and are tested without cgo or a token.
+
+// digestInfoPrefixes are the DER prefixes of the PKCS #1 v1.5 DigestInfo
+// of the hashes ssh signs with, as CKM_RSA_PKCS takes the DigestInfo.
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// digestInfo returns the DigestInfo of digest, made with hash.
+func digestInfo(hash crypto.Hash, digest []byte) ([]byte, error) {
+	prefix, ok := digestInfoPrefixes[hash]
+	if !ok {
+		return nil, fmt.Errorf("pkcs11: unsupported hash %v", hash)
+	}
+	if len(digest) != hash.Size() {
+		return nil, fmt.Errorf("pkcs11: %d byte digest for %v", len(digest), hash)
+	}
+	return append(append([]byte(nil), prefix...), digest...), nil
+}
+
+// ecdsaSignature returns the raw r || s signature of CKM_ECDSA DER
+// encoded like ecdsa.Sign.
+func ecdsaSignature(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, errors.New("pkcs11: malformed ECDSA signature")
+	}
+	half := len(raw) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(raw[:half]),
+		new(big.Int).SetBytes(raw[half:]),
+	})
+}
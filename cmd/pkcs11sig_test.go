@@ -0,0 +1,96 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	_ "crypto/sha1"
+	_ "crypto/sha512"
+)
+
+func TestDigestInfo(t *testing.T) {
+	// SHA-256 of "abc" from FIPS 180-2, after the DigestInfo prefix of
+	// RFC 8017 section 9.2.
+	digest := sha256.Sum256([]byte("abc"))
+	want, _ := hex.DecodeString("3031300d060960864801650304020105000420" +
+		"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+	got, err := digestInfo(crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+
+	// CKM_RSA_PKCS pads the DigestInfo and signs it, which must make the
+	// signature of the hash.
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hash := range digestInfoPrefixes {
+		h := hash.New()
+		h.Write([]byte("abc"))
+		digest := h.Sum(nil)
+		info, err := digestInfo(hash, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := rsa.SignPKCS1v15(nil, key, 0, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, hash, digest, raw); err != nil {
+			t.Errorf("%v: %s", hash, err)
+		}
+	}
+
+	if _, err := digestInfo(crypto.MD5, make([]byte, 16)); err == nil {
+		t.Error("no error for MD5")
+	}
+	if _, err := digestInfo(crypto.SHA256, digest[:20]); err == nil {
+		t.Error("no error for a short digest")
+	}
+}
+
+func TestECDSASignature(t *testing.T) {
+	for _, tt := range []struct {
+		raw, want string
+	}{
+		// Leading zeros are dropped and a set high bit gets a zero byte,
+		// so the integers stay positive.
+		{"007f" + "8001", "3008" + "02017f" + "0203008001"},
+		{"0102" + "0304", "3008" + "02020102" + "02020304"},
+		// P-256 sized, with s of zero.
+		{
+			"ff00000000000000000000000000000000000000000000000000000000000001" +
+				"0000000000000000000000000000000000000000000000000000000000000000",
+			"3026" +
+				"022100ff00000000000000000000000000000000000000000000000000000000000001" +
+				"020100",
+		},
+	} {
+		raw, _ := hex.DecodeString(tt.raw)
+		got, err := ecdsaSignature(raw)
+		if err != nil {
+			t.Errorf("%s: %s", tt.raw, err)
+			continue
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("%s: got %x, want %s", tt.raw, got, tt.want)
+		}
+	}
+
+	for _, raw := range [][]byte{nil, {1, 2, 3}} {
+		if _, err := ecdsaSignature(raw); err == nil {
+			t.Errorf("no error for % x", raw)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// accessPolicy is a signed policy file restricting where the forwards of
+// each ssh user may connect to. It has roles, each allowing some users a
+// list of destinations:
+//
+//	roles:
+//	  developers:
+//	    users: [alice, bob]
+//	    allow:
+//	      - host: "*.dev.internal"
+//	        ports: [443, 5432]
+//
+// A user "*" matches everyone. Destinations not allowed by any role of the
+// user are denied.
+type accessPolicy struct {
+	Roles map[string]accessRole `yaml:"roles"`
+}
+
+type accessRole struct {
+	Users []string      `yaml:"users"`
+	Allow []accessAllow `yaml:"allow"`
+}
+
+type accessAllow struct {
+	Host  string `yaml:"host"`
+	Ports []int  `yaml:"ports"`
+}
+
+// policySettings returns the policy file and public key to use. A policy
+// set in the system config at systemConfig wins over the other config
+// files, environment variables and flags, so users cannot lift it.
+func policySettings(systemConfig string) (file, publicKey string, err error) {
+	system := viper.New()
+	system.SetConfigFile(systemConfig)
+	if err := system.ReadInConfig(); err == nil && system.GetString("policy.file") != "" {
+		return os.ExpandEnv(system.GetString("policy.file")), system.GetString("policy.publickey"), nil
+	} else if err == nil && system.IsSet("policy") {
+		return "", "", fmt.Errorf("%s: policy.file is required", systemConfig)
+	}
+	policy := currentSettings().Policy
+	return os.ExpandEnv(policy.File), policy.PublicKey, nil
+}
+
+// loadAccessPolicy reads the policy of the config, nil if there is none,
+// and checks its signature.
+func loadAccessPolicy() (*accessPolicy, error) {
+	file, publicKey, err := policySettings(systemConfigPath())
+	if err != nil || file == "" {
+		return nil, err
+	}
+	return readAccessPolicy(file, publicKey)
+}
+
+// readAccessPolicy reads the policy file and checks its signature, in file
+// with a .sig suffix, against publicKey.
+func readAccessPolicy(file, publicKey string) (*accessPolicy, error) {
+	if publicKey == "" {
+		return nil, errors.New("policy.publickey is required to check the policy")
+	}
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("policy.publickey: not a base64 ed25519 public key")
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := readSignature(file + ".sig")
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), buf, sig) {
+		return nil, fmt.Errorf("%s: bad signature", file)
+	}
+	var policy accessPolicy
+	if err := yaml.UnmarshalStrict(buf, &policy); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return &policy, nil
+}
+
+func readSignature(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%s: not a base64 ed25519 signature", path)
+	}
+	return sig, nil
+}
+
+// rules returns the destination rules of the roles of user, in role name
+// order. A user without a role gets a rule denying everything.
+func (a *accessPolicy) rules(user string) []proxy.DestinationRule {
+	names := make([]string, 0, len(a.Roles))
+	for name := range a.Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var rules []proxy.DestinationRule
+	for _, name := range names {
+		role := a.Roles[name]
+		if !stringInSlice(user, role.Users) && !stringInSlice("*", role.Users) {
+			continue
+		}
+		for _, allow := range role.Allow {
+			rules = append(rules, proxy.DestinationRule{Host: allow.Host, Ports: allow.Ports})
+		}
+	}
+	if len(rules) == 0 {
+		rules = []proxy.DestinationRule{{Deny: true}}
+	}
+	return rules
+}
+
+// apply restricts cfg to the destinations the policy allows its user.
+func (a *accessPolicy) apply(cfg *proxy.Config) {
+	if a != nil {
+		cfg.Policy = a.rules(cfg.RemoteUser)
+	}
+}
+
+// policyCmd groups the commands admins use to make policy files.
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Create keys for and sign destination policies",
+}
+
+var policyKeygenCmd = &cobra.Command{
+	Use:   "keygen <private key file>",
+	Short: "Create a key pair for signing policies",
+	Long: `Create an ed25519 key pair, write the private key to the given file and
+print the public key for policy.publickey.`,
+	Annotations: map[string]string{rawConfigAnnotation: "true"},
+	Args:        cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		buf := base64.StdEncoding.EncodeToString(private.Seed()) + "\n"
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteString(buf); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(public))
+		return nil
+	},
+}
+
+var policySignCmd = &cobra.Command{
+	Use:   "sign <policy file>",
+	Short: "Sign a policy file",
+	Long: `Check a policy file and sign it with the private key from policy keygen,
+writing the signature next to it with a .sig suffix.`,
+	Annotations: map[string]string{rawConfigAnnotation: "true"},
+	Args:        cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyFile, _ := cmd.Flags().GetString("key")
+		if keyFile == "" {
+			return errors.New("--key is required")
+		}
+		buf, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("%s: not a key from policy keygen", keyFile)
+		}
+		policy, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		if err := yaml.UnmarshalStrict(policy, &accessPolicy{}); err != nil {
+			return fmt.Errorf("%s: %s", args[0], err)
+		}
+		sig := ed25519.Sign(ed25519.NewKeyFromSeed(seed), policy)
+		return writeFileAtomic(args[0]+".sig", []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0644)
+	},
+}
+
+func init() {
+	policySignCmd.Flags().String("key", "", "private key file from policy keygen")
+	policyCmd.AddCommand(policyKeygenCmd, policySignCmd)
+	rootCmd.AddCommand(policyCmd)
+}
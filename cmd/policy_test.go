@@ -0,0 +1,200 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+)
+
+const testPolicy = `roles:
+  developers:
+    users: [alice, bob]
+    allow:
+      - host: "*.dev.internal"
+        ports: [443, 5432]
+  everyone:
+    users: ["*"]
+    allow:
+      - host: docs.internal
+  operators:
+    users: [alice]
+    allow:
+      - host: "*.prod.internal"
+        ports: [22]
+`
+
+func policyDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// signPolicy writes doc to path and its signature next to it, and returns
+// the public key as the config takes it.
+func signPolicy(t *testing.T, path, doc string) string {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(doc)))
+	if err := ioutil.WriteFile(path+".sig", []byte(sig+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(public)
+}
+
+func TestReadAccessPolicy(t *testing.T) {
+	dir := policyDir(t)
+	file := filepath.Join(dir, "policy.yaml")
+	key := signPolicy(t, file, testPolicy)
+	policy, err := readAccessPolicy(file, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Roles) != 3 || !reflect.DeepEqual(policy.Roles["operators"].Users, []string{"alice"}) {
+		t.Fatalf("roles %+v", policy.Roles)
+	}
+
+	other := filepath.Join(dir, "other.yaml")
+	otherKey := signPolicy(t, other, testPolicy)
+	if _, err := readAccessPolicy(file, otherKey); err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Errorf("got %v checking with another key", err)
+	}
+	// A policy changed after signing is refused.
+	if err := ioutil.WriteFile(file, []byte(testPolicy+"  admins:\n    users: [mallory]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAccessPolicy(file, key); err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Errorf("got %v reading a changed policy", err)
+	}
+
+	if err := os.Remove(other + ".sig"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAccessPolicy(other, otherKey); !os.IsNotExist(err) {
+		t.Errorf("got %v without a signature file", err)
+	}
+	if err := ioutil.WriteFile(other+".sig", []byte("not a signature\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAccessPolicy(other, otherKey); err == nil || !strings.Contains(err.Error(), "not a base64 ed25519 signature") {
+		t.Errorf("got %v with a malformed signature", err)
+	}
+
+	strict := filepath.Join(dir, "strict.yaml")
+	strictKey := signPolicy(t, strict, "roles:\n  developers:\n    user: [alice]\n")
+	if _, err := readAccessPolicy(strict, strictKey); err == nil || !strings.Contains(err.Error(), "field user not found") {
+		t.Errorf("got %v reading an unknown field", err)
+	}
+
+	for _, publicKey := range []string{"", "not base64", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := readAccessPolicy(strict, publicKey); err == nil || !strings.Contains(err.Error(), "policy.publickey") {
+			t.Errorf("got %v with public key %q", err, publicKey)
+		}
+	}
+	if _, err := readAccessPolicy(filepath.Join(dir, "missing.yaml"), key); !os.IsNotExist(err) {
+		t.Errorf("got %v reading a missing policy", err)
+	}
+}
+
+func TestAccessPolicyRules(t *testing.T) {
+	dir := policyDir(t)
+	file := filepath.Join(dir, "policy.yaml")
+	policy, err := readAccessPolicy(file, signPolicy(t, file, testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		user string
+		want []proxy.DestinationRule
+	}{
+		{"alice", []proxy.DestinationRule{
+			{Host: "*.dev.internal", Ports: []int{443, 5432}},
+			{Host: "docs.internal"},
+			{Host: "*.prod.internal", Ports: []int{22}},
+		}},
+		{"bob", []proxy.DestinationRule{
+			{Host: "*.dev.internal", Ports: []int{443, 5432}},
+			{Host: "docs.internal"},
+		}},
+		// Users without a role of their own get those for everyone.
+		{"carol", []proxy.DestinationRule{{Host: "docs.internal"}}},
+	} {
+		if got := policy.rules(tt.user); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.user, got, tt.want)
+		}
+	}
+
+	delete(policy.Roles, "everyone")
+	if got := policy.rules("carol"); !reflect.DeepEqual(got, []proxy.DestinationRule{{Deny: true}}) {
+		t.Errorf("user without a role got %+v", got)
+	}
+
+	cfg := &proxy.Config{RemoteUser: "bob"}
+	(*accessPolicy)(nil).apply(cfg)
+	if cfg.Policy != nil {
+		t.Errorf("no policy set rules %+v", cfg.Policy)
+	}
+	policy.apply(cfg)
+	if len(cfg.Policy) != 1 || cfg.Policy[0].Host != "*.dev.internal" {
+		t.Errorf("policy applied as %+v", cfg.Policy)
+	}
+}
+
+func TestPolicySettings(t *testing.T) {
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	dir := policyDir(t)
+	setenv(t, "POLICY_DIR", dir)
+	settings.Policy.File = "$POLICY_DIR/user.yaml"
+	settings.Policy.PublicKey = "userkey"
+	system := filepath.Join(dir, "config.yaml")
+
+	for _, tt := range []struct {
+		name   string
+		system string
+		file   string
+		key    string
+		err    string
+	}{
+		{"no system config", "", filepath.Join(dir, "user.yaml"), "userkey", ""},
+		{"system config without a policy", "sshproxy:\n  user: elliot\n", filepath.Join(dir, "user.yaml"), "userkey", ""},
+		{"system config overrides", "policy:\n  file: $POLICY_DIR/system.yaml\n  publickey: systemkey\n", filepath.Join(dir, "system.yaml"), "systemkey", ""},
+		{"system config without a file", "policy:\n  publickey: systemkey\n", "", "", "policy.file is required"},
+	} {
+		os.Remove(system)
+		if tt.system != "" {
+			if err := ioutil.WriteFile(system, []byte(tt.system), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		file, key, err := policySettings(system)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || file != tt.file || key != tt.key {
+			t.Errorf("%s: got %q, %q, %v, want %q, %q", tt.name, file, key, err, tt.file, tt.key)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRSDivisor(t *testing.T) {
+	// The generator polynomials of ISO/IEC 18004 Annex A, as exponents
+	// of alpha without the leading x^n.
+	log := make(map[byte]int)
+	alpha := byte(1)
+	for i := 0; i < 255; i++ {
+		log[alpha] = i
+		alpha = gfMul(alpha, 2)
+	}
+	for degree, want := range map[int][]int{
+		10: {251, 67, 46, 61, 118, 70, 64, 94, 32, 45},
+		16: {120, 104, 107, 109, 102, 161, 76, 3, 91, 191, 147, 169, 182, 194, 225, 120},
+	} {
+		divisor := rsDivisor(degree)
+		got := make([]int, len(divisor))
+		for i, c := range divisor {
+			got[i] = log[c]
+		}
+		if len(got) != len(want) {
+			t.Fatalf("degree %d: got %d coefficients", degree, len(got))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("degree %d: got exponents %v, want %v", degree, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestRSRemainder(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		data, ec []byte
+	}{
+		{
+			// The worked example of ISO/IEC 18004 Annex I, numeric
+			// 01234567 as 1-M.
+			"01234567",
+			[]byte{0x10, 0x20, 0x0c, 0x56, 0x61, 0x80, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11},
+			[]byte{0xa5, 0x24, 0xd4, 0xc1, 0xed, 0x36, 0xc7, 0x87, 0x2c, 0x55},
+		},
+		{
+			// Alphanumeric HELLO WORLD as 1-M.
+			"HELLO WORLD",
+			[]byte{0x20, 0x5b, 0x0b, 0x78, 0xd1, 0x72, 0xdc, 0x4d, 0x43, 0x40, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11},
+			[]byte{0xc4, 0x23, 0x27, 0x77, 0xeb, 0xd7, 0xe7, 0xe2, 0x5d, 0x17},
+		},
+	} {
+		if got := rsRemainder(tt.data, rsDivisor(len(tt.ec))); !bytes.Equal(got, tt.ec) {
+			t.Errorf("%s: got % x, want % x", tt.name, got, tt.ec)
+		}
+	}
+}
+
+// blankQRCode returns a code of version 1 without any modules drawn.
+func blankQRCode() *qrCode {
+	q := &qrCode{size: 21}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for y := range q.modules {
+		q.modules[y] = make([]bool, q.size)
+		q.function[y] = make([]bool, q.size)
+	}
+	return q
+}
+
+func TestQRFormat(t *testing.T) {
+	// The format strings of level M from ISO/IEC 18004 Annex C, by mask.
+	want := []string{
+		"101010000010010",
+		"101000100100101",
+		"101111001111100",
+		"101101101001011",
+		"100010111111001",
+		"100000011001110",
+		"100111110010111",
+		"100101010100000",
+	}
+	// The modules around the top left finder pattern, from bit 14 to 0,
+	// as x, y.
+	pos := [][2]int{
+		{0, 8}, {1, 8}, {2, 8}, {3, 8}, {4, 8}, {5, 8}, {7, 8}, {8, 8},
+		{8, 7}, {8, 5}, {8, 4}, {8, 3}, {8, 2}, {8, 1}, {8, 0},
+	}
+	for mask, format := range want {
+		q := blankQRCode()
+		q.drawFormat(mask)
+		var b strings.Builder
+		for _, p := range pos {
+			if q.modules[p[1]][p[0]] {
+				b.WriteByte('1')
+			} else {
+				b.WriteByte('0')
+			}
+		}
+		if got := b.String(); got != format {
+			t.Errorf("mask %d: got format %s, want %s", mask, got, format)
+		}
+	}
+}
+
+func TestQRCode(t *testing.T) {
+	// Version 2-M with mask 1, read back with an independent decoder.
+	want := []string{
+		"#######.#.#.#.#...#######",
+		"#.....#..##.###.#.#.....#",
+		"#.###.#.###..#..#.#.###.#",
+		"#.###.#..#..###...#.###.#",
+		"#.###.#..#.#..#...#.###.#",
+		"#.....#.##.##.#...#.....#",
+		"#######.#.#.#.#.#.#######",
+		".........#..#.###........",
+		"#.#...##..#####.#..#..#.#",
+		"##.###..######.#.###.#.##",
+		"#..#.###.###...#.#..###.#",
+		".#..##..######..#..#.#...",
+		"...######.#.##.##.##....#",
+		".##.#...###.#..##.##...##",
+		"###.###.#...#######..##.#",
+		".......#.#.##.#.##.###...",
+		"##..#.##.#...##.#####..#.",
+		"........#....##.#...#...#",
+		"#######.#.##....#.#.#...#",
+		"#.....#......#.##...#..##",
+		"#.###.#..#.###.######..##",
+		"#.###.#..#..#....#..#.##.",
+		"#.###.#.##..######.###.##",
+		"#.....#..#.##.#######....",
+		"#######.###..##.#.#..#..#",
+	}
+	q, err := newQRCode("https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.size != len(want) {
+		t.Fatalf("got size %d, want %d", q.size, len(want))
+	}
+	for y, row := range q.modules {
+		var b strings.Builder
+		for _, dark := range row {
+			if dark {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		if got := b.String(); got != want[y] {
+			t.Errorf("row %d: got %s, want %s", y, got, want[y])
+		}
+	}
+
+	if _, err := newQRCode(strings.Repeat("x", 300)); err != errQRTooLong {
+		t.Errorf("got %v encoding 300 bytes", err)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+)
+
+// readyPollInterval is how often forwards are probed while waiting.
+const readyPollInterval = 500 * time.Millisecond
+
+// Probe probes the forward name on whichever host has it.
+func (s *proxySet) Probe(name string) error {
+	return s.each(name, (*proxy.SSHProxy).Probe)
+}
+
+// waitReady probes the forwards in names until all of them reach their
+// targets, logging each change, or fails once timeout expires.
+func waitReady(ctx context.Context, ps *proxySet, names []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	pending := make(map[string]string)
+	for _, name := range names {
+		pending[name] = ""
+	}
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	var mu sync.Mutex
+	for {
+		// Forwards are probed concurrently, so a slow target does not
+		// hold up the others.
+		parallel(startupWorkers(), len(names), func(i int) error {
+			name := names[i]
+			mu.Lock()
+			last, ok := pending[name]
+			mu.Unlock()
+			if !ok {
+				return nil
+			}
+			err := ps.Probe(name)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if msg := err.Error(); msg != last {
+					logger.Infof("waiting for %s: %s", name, msg)
+					pending[name] = msg
+				}
+				return nil
+			}
+			logger.Infof("%s is ready", name)
+			delete(pending, name)
+			return nil
+		})
+		if len(pending) == 0 {
+			logger.Infof("all forwards are ready")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			var waiting []string
+			for _, name := range names {
+				if _, ok := pending[name]; ok {
+					waiting = append(waiting, name)
+				}
+			}
+			return fmt.Errorf("forwards not ready after %s: %s", timeout, strings.Join(waiting, ", "))
+		case <-ticker.C:
+		}
+	}
+}
+
+// readyInfo is the JSON written by --ready-fd and --ready-file once the
+// forwards are up.
+type readyInfo struct {
+	PID      int                     `json:"pid"`
+	Forwards map[string]readyForward `json:"forwards"`
+}
+
+// readyForward is a forward in readyInfo.
+type readyForward struct {
+	Host   string `json:"host"`
+	Local  string `json:"local"`
+	Remote string `json:"remote,omitempty"`
+	Mode   string `json:"mode"`
+}
+
+// readyJSON returns the readyInfo of ps.
+func readyJSON(ps *proxySet) ([]byte, error) {
+	info := readyInfo{PID: os.Getpid(), Forwards: make(map[string]readyForward)}
+	for _, status := range ps.Forwards() {
+		mode := status.Mode
+		if status.Reverse {
+			mode = "reverse"
+		}
+		info.Forwards[status.Name] = readyForward{
+			Host:   status.Host,
+			Local:  status.Local,
+			Remote: status.Remote,
+			Mode:   mode,
+		}
+	}
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+// notifyReady writes the addresses of the forwards of ps to the file
+// descriptor fd, unless it is negative, and to the file path, unless it is
+// empty, for parent processes that need the ports picked at random. The
+// file is replaced atomically, so readers never see it half written.
+func notifyReady(ps *proxySet, fd int, path string) error {
+	if fd < 0 && path == "" {
+		return nil
+	}
+	buf, err := readyJSON(ps)
+	if err != nil {
+		return err
+	}
+	if fd >= 0 {
+		f := os.NewFile(uintptr(fd), "ready")
+		_, err := f.Write(buf)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("ready fd %d: %w", fd, err)
+		}
+	}
+	if path != "" {
+		tmp, err := ioutil.TempFile(filepath.Dir(path), ".ready")
+		if err != nil {
+			return err
+		}
+		if _, err := tmp.Write(buf); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// flagBindings are the flags that override config keys, so they can be
+// bound again when the config is reloaded.
+var flagBindings = make(map[string]*pflag.Flag)
+
+// bindFlag makes flag override the config key.
+func bindFlag(key string, flag *pflag.Flag) {
+	flagBindings[key] = flag
+	viper.BindPFlag(key, flag)
+}
+
+// configMu guards the loaded config: settings, the viper instance they
+// were decoded from, configFiles, mergedConfig and secretPaths, which
+// reloadConfig replaces together while forwards run.
+var configMu sync.RWMutex
+
+// loadedViper holds the config if it was reloaded, nil while that is the
+// global viper instance.
+var loadedViper *viper.Viper
+
+// conf returns the viper instance holding the loaded config.
+func conf() *viper.Viper {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if loadedViper == nil {
+		return viper.GetViper()
+	}
+	return loadedViper
+}
+
+// currentSettings returns the loaded config.
+func currentSettings() fileConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return settings
+}
+
+// applyConfig makes l the loaded config. settings are only replaced if l
+// was decoded.
+func applyConfig(l *loadedConfig) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	loadedViper = l.v
+	if l.v == viper.GetViper() {
+		loadedViper = nil
+	}
+	configFiles = l.files
+	mergedConfig = l.merged
+	secretPaths = l.secretPaths
+	if l.decoded {
+		settings = l.settings
+	}
+}
+
+// reloadConfig reads the config files again from scratch into a new viper
+// instance. Flags keep overriding them. The loaded config is replaced only
+// if the new one is read and valid, otherwise it stays as it was.
+func reloadConfig() error {
+	v := viper.New()
+	for key, flag := range flagBindings {
+		v.BindPFlag(key, flag)
+	}
+	l, err := readConfig(v)
+	if err != nil {
+		return err
+	}
+	applyConfig(l)
+	return nil
+}
+
+// reloadOnHangup reloads the config and applies it to the forwards of m
+// whenever the process receives SIGHUP, until ctx is done.
+func reloadOnHangup(ctx context.Context, m *forwardManager) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				logger.Infof("reloading config")
+				if err := m.reload(); err != nil {
+					logger.Errorf("reloading config: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// reload reads the config again and applies its forwards: forwards that
+// kept their host, local port and mode are reconfigured in place, so their
+// open connections carry on under the old settings while new connections
+// use the new ones. Others are closed and started again, removed forwards
+// are closed and new ones started. Connection settings, hosts and reverse
+// forwards need a restart.
+func (m *forwardManager) reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := reloadConfig(); err != nil {
+		return err
+	}
+	forwards, err := forwardsFromConfig()
+	if err != nil {
+		return err
+	}
+	reverse, err := reverseFromConfig()
+	if err != nil {
+		return err
+	}
+	if err := checkForwardNames(forwards, reverse); err != nil {
+		return err
+	}
+
+	running := make(map[string]forwardConfig)
+	for _, fwd := range m.forwards {
+		if m.isActive(fwd) {
+			running[fwd.Name] = fwd
+		}
+	}
+	forwards = m.withServed(forwards)
+	m.forwards = forwards
+	for _, group := range m.groups() {
+		if _, ok := m.enabled[group]; !ok {
+			m.enabled[group] = m.allGroups
+		}
+	}
+
+	failed := 0
+	for _, fwd := range forwards {
+		if !m.isActive(fwd) {
+			continue
+		}
+		old, ok := running[fwd.Name]
+		delete(running, fwd.Name)
+		switch {
+		case ok && reflect.DeepEqual(old, fwd):
+			continue
+		case ok && old.Host == fwd.Host && old.Local == fwd.Local && old.Mode == fwd.Mode:
+			err = m.reconfigureForward(fwd)
+		default:
+			if ok {
+				// Keep the connection of old while fwd replaces it.
+				m.ps.hold(old.Host)
+				m.closeForwards([]forwardConfig{old})
+			}
+			err = m.startForward(fwd)
+			if ok {
+				m.ps.release(old.Host)
+			}
+		}
+		if err != nil {
+			logger.Errorf("forward %s: %s", fwd.Name, err)
+			failed++
+		}
+	}
+	for _, fwd := range running {
+		m.closeForwards([]forwardConfig{fwd})
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d forwards failed to apply", failed)
+	}
+	logger.Infof("config reloaded")
+	if m.state != nil {
+		if err := m.state.saveConfig(); err != nil {
+			logger.Warningf("saving config: %s", err)
+		}
+	}
+	return nil
+}
+
+// reconfigureForward applies the settings of fwd to the running forward of
+// the same name.
+func (m *forwardManager) reconfigureForward(fwd forwardConfig) error {
+	p, err := m.ps.get(fwd.Host)
+	if err != nil {
+		return err
+	}
+	opts, err := m.options(fwd)
+	if err != nil {
+		return err
+	}
+	fwd.Log.apply(fwd.Name)
+	return p.Reconfigure(fwd.Name, fwd.Remote, opts)
+}
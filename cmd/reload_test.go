@@ -0,0 +1,117 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// useConfigFile makes path the config file loaded instead of those of the
+// user, and restores the loaded config after the test.
+func useConfigFile(t *testing.T, path string) {
+	t.Helper()
+	savedFile, savedURL := cfgFile, configURL
+	cfgFile, configURL = path, ""
+	viper.Reset()
+	configMu.Lock()
+	saved := &loadedConfig{
+		v:           loadedViper,
+		settings:    settings,
+		decoded:     true,
+		files:       configFiles,
+		merged:      mergedConfig,
+		secretPaths: secretPaths,
+	}
+	configMu.Unlock()
+	t.Cleanup(func() {
+		cfgFile, configURL = savedFile, savedURL
+		viper.Reset()
+		if saved.v == nil {
+			saved.v = viper.GetViper()
+		}
+		applyConfig(saved)
+	})
+}
+
+func writeConfig(t *testing.T, path, doc string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(doc), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	useConfigFile(t, path)
+
+	writeConfig(t, path, "sshproxy:\n  user: first\n  remote: bastion:22\n")
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentSettings().SSHProxy.User; got != "first" {
+		t.Fatalf("got user %q", got)
+	}
+	if got := conf().GetString("sshproxy.user"); got != "first" {
+		t.Fatalf("got user %q from viper", got)
+	}
+	if viper.GetString("sshproxy.user") != "" {
+		t.Error("reload changed the global viper instance")
+	}
+
+	// A config that fails to load or to check leaves the loaded one
+	// alone.
+	for _, doc := range []string{
+		"sshproxy:\n  user: [broken\n",
+		"sshproxy:\n  user: second\n  uesr: typo\n",
+	} {
+		writeConfig(t, path, doc)
+		if err := reloadConfig(); err == nil {
+			t.Errorf("%q: no error", doc)
+		}
+		if got := currentSettings().SSHProxy.User; got != "first" {
+			t.Errorf("%q: got user %q after a failed reload", doc, got)
+		}
+		if got := conf().GetString("sshproxy.user"); got != "first" {
+			t.Errorf("%q: got user %q from viper after a failed reload", doc, got)
+		}
+	}
+
+	// Forwards read the settings while the config is reloaded.
+	writeConfig(t, path, "sshproxy:\n  user: second\n  remote: bastion:22\n  acceptrate: 5\n")
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				forwardOptions("api", nil)
+				forwardsFromConfig()
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := reloadConfig(); err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if got := forwardOptions("api", nil).AcceptRate; got != 5 {
+		t.Errorf("got accept rate %v", got)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"github.com/spf13/cobra"
+)
+
+// harFile is the part of an HTTP Archive needed to replay its requests.
+type harFile struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+// harEntry is a recorded request and the status and time of its response.
+type harEntry struct {
+	// Time is the total time of the request in milliseconds.
+	Time    float64 `json:"time"`
+	Request struct {
+		Method   string      `json:"method"`
+		URL      string      `json:"url"`
+		Headers  []harHeader `json:"headers"`
+		PostData *struct {
+			MimeType string `json:"mimeType"`
+			Text     string `json:"text"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+	} `json:"response"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// replaySkipHeaders are recorded headers that belong to the recorded
+// connection rather than the request.
+var replaySkipHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// readHAR returns the entries of the HTTP Archive in r with an http or
+// https URL.
+func readHAR(r io.Reader) ([]harEntry, error) {
+	var har harFile
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, err
+	}
+	var entries []harEntry
+	for _, e := range har.Log.Entries {
+		if strings.HasPrefix(e.Request.URL, "http://") || strings.HasPrefix(e.Request.URL, "https://") {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// harRequest builds the request recorded in e.
+func harRequest(ctx context.Context, e harEntry) (*http.Request, error) {
+	var body io.Reader
+	if e.Request.PostData != nil {
+		body = strings.NewReader(e.Request.PostData.Text)
+	}
+	req, err := http.NewRequest(e.Request.Method, e.Request.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range e.Request.Headers {
+		name := http.CanonicalHeaderKey(h.Name)
+		switch {
+		case strings.HasPrefix(name, ":"):
+			// HTTP/2 pseudo-headers.
+		case name == "Host":
+			req.Host = h.Value
+		case !replaySkipHeaders[name]:
+			req.Header.Add(name, h.Value)
+		}
+	}
+	if e.Request.PostData != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", e.Request.PostData.MimeType)
+	}
+	return req.WithContext(ctx), nil
+}
+
+// replayResult is the outcome of replaying an entry.
+type replayResult struct {
+	entry   harEntry
+	status  int
+	latency time.Duration
+	err     error
+}
+
+// changed reports whether the status differs from the recorded one.
+// Entries recorded without a response never count as changed.
+func (r replayResult) changed() bool {
+	return r.err != nil || (r.entry.Response.Status != 0 && r.status != r.entry.Response.Status)
+}
+
+// replayEntries sends the requests of entries with client, up to
+// concurrency at a time and at most rate per second if rate is set, and
+// returns the results in the order of entries.
+func replayEntries(ctx context.Context, client *http.Client, entries []harEntry, concurrency int, rate float64) []replayResult {
+	results := make([]replayResult, len(entries))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = replayEntry(ctx, client, entries[i])
+			}
+		}()
+	}
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for i := range entries {
+		if i > 0 && tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			results[i] = replayResult{entry: entries[i], err: ctx.Err()}
+			continue
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// replayEntry sends the request of e and times it until the response body
+// was read, like the recorded time.
+func replayEntry(ctx context.Context, client *http.Client, e harEntry) replayResult {
+	result := replayResult{entry: e}
+	req, err := harRequest(ctx, e)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	result.latency = time.Since(start)
+	result.status = resp.StatusCode
+	result.err = err
+	return result
+}
+
+// writeReplayReport writes the status and latency of each result next to
+// the recorded ones and returns the number of changed statuses.
+func writeReplayReport(out io.Writer, results []replayResult) (int, error) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tURL\tSTATUS\tLATENCY\tDIFF")
+	changed := 0
+	var recorded, replayed time.Duration
+	for _, r := range results {
+		was := time.Duration(r.entry.Time * float64(time.Millisecond)).Round(time.Millisecond)
+		status := fmt.Sprintf("%d", r.status)
+		if r.err != nil {
+			status = "error: " + r.err.Error()
+		}
+		if r.changed() {
+			changed++
+			status = fmt.Sprintf("%d -> %s", r.entry.Response.Status, status)
+		}
+		latency, diff := "-", "-"
+		if r.err == nil {
+			now := r.latency.Round(time.Millisecond)
+			latency = fmt.Sprintf("%s -> %s", was, now)
+			diff = fmt.Sprintf("%+d%%", percentChange(was, now))
+			recorded += was
+			replayed += now
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.entry.Request.Method, r.entry.Request.URL, status, latency, diff)
+	}
+	if err := w.Flush(); err != nil {
+		return changed, err
+	}
+	_, err := fmt.Fprintf(out, "\n%d requests, %d with a changed status, total latency %s -> %s\n",
+		len(results), changed, recorded, replayed)
+	return changed, err
+}
+
+// percentChange returns the change from was to now in percent.
+func percentChange(was, now time.Duration) int {
+	if was == 0 {
+		return 0
+	}
+	return int((now - was) * 100 / was)
+}
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <capture.har> [host]",
+	Short: "Replay the requests of a HAR file through the tunnel",
+	Long: `Send the requests recorded in an HTTP Archive (HAR), as saved by browser
+developer tools, again through the ssh connection of host, the default one if
+not given, and report how the status and latency of each response compare to
+the recording. Redirects are not followed, as captures record each request.
+
+It fails if any status changed, for regression testing internal APIs that are
+only reachable from the remote side.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, _ := cmd.InheritedFlags().GetBool("debug")
+		setupLogging(os.Stderr, debug)
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		entries, err := readHAR(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", args[0], err)
+		}
+		host := defaultHost
+		if len(args) > 1 {
+			host = args[1]
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go setupSignalHandler(ctx, cancel)
+		defer cancel()
+		ps, err := proxiesFromConfig(ctx, policyOnce)
+		if err != nil {
+			return err
+		}
+		defer ps.Shutdown()
+		p, err := ps.ensure(host)
+		if err != nil {
+			return err
+		}
+		// Requests go through a CONNECT forward, which tunnels https and
+		// passes on plain http requests.
+		local, err := p.ForwardWithOptions("replay", "", "0", &proxy.ForwardOptions{Connect: true})
+		if err != nil {
+			return err
+		}
+		insecure, _ := cmd.Flags().GetBool("insecure")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		client := &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: local}),
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			Timeout: timeout,
+		}
+		concurrency, _ := cmd.Flags().GetInt("concurrency")
+		rate, _ := cmd.Flags().GetFloat64("rate")
+		results := replayEntries(ctx, client, entries, concurrency, rate)
+		changed, err := writeReplayReport(os.Stdout, results)
+		if err != nil {
+			return err
+		}
+		if changed > 0 {
+			return fmt.Errorf("%d of %d responses differ from the capture", changed, len(results))
+		}
+		return nil
+	},
+}
+
+func init() {
+	replayCmd.Flags().IntP("concurrency", "c", 1, "requests sent at the same time")
+	replayCmd.Flags().Float64("rate", 0, "requests started per second, 0 for no limit")
+	replayCmd.Flags().Duration("timeout", 30*time.Second, "timeout of each request")
+	replayCmd.Flags().BoolP("insecure", "k", false, "skip verifying the certificates of https URLs")
+	rootCmd.AddCommand(replayCmd)
+}
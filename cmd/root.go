@@ -25,11 +25,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"time"
 
-	homedir "github.com/mitchellh/go-homedir"
+	"github.com/elliotpeele/sshhttpproxy/proxy"
 	logging "github.com/op/go-logging"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var cfgFile string
@@ -43,12 +46,28 @@ var rootCmd = &cobra.Command{
 	Long: `Port forward HTTP connections over an SSH tunnel automatically using the
 HTTP proxy protocol`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		debug, _ := cmd.InheritedFlags().GetBool("debug")
+		debug, _ := cmd.Flags().GetBool("debug")
 		setupLogging(os.Stderr, debug)
+		quiet, _ := cmd.Flags().GetBool("quiet")
+		if quiet {
+			logging.SetLevel(logging.ERROR, "")
+		}
 		logger.Debugf("debug logging enabled")
+		started := time.Now()
 		ctx, cancel := context.WithCancel(context.Background())
 		go setupSignalHandler(ctx, cancel)
 		defer cancel()
+		if err := inheritListeners(); err != nil {
+			return err
+		}
+		st, err := openProfileState()
+		if err != nil {
+			return err
+		}
+		defer st.close()
+		if st.crashed {
+			logger.Warningf("the last run did not exit cleanly, restoring its state from %s", st.dir)
+		}
 		remotes, err := cmd.PersistentFlags().GetStringSlice("remote")
 		if err != nil {
 			return err
@@ -57,34 +76,250 @@ HTTP proxy protocol`,
 		if err != nil {
 			return err
 		}
-		p, err := ProxyFromConfig()
+		forwards, err := forwardsFromConfig()
+		if err != nil {
+			return err
+		}
+		reverse, err := reverseFromConfig()
+		if err != nil {
+			return err
+		}
+		if err := checkForwardNames(forwards, reverse); err != nil {
+			return err
+		}
+		groups, err := cmd.Flags().GetStringSlice("group")
+		if err != nil {
+			return err
+		}
+		dumpSpecs, err := cmd.PersistentFlags().GetStringSlice("dump")
+		if err != nil {
+			return err
+		}
+		dumps, closeDumps, err := openDumps(dumpSpecs)
+		if err != nil {
+			return err
+		}
+		defer closeDumps()
+		failFast, _ := cmd.Flags().GetBool("fail-fast")
+		retryForever, _ := cmd.Flags().GetBool("retry-forever")
+		policy, err := startupPolicyFromFlags(failFast, retryForever)
+		if err != nil {
+			return err
+		}
+		audit, closeAudit, err := openAudit()
+		if err != nil {
+			return err
+		}
+		defer closeAudit()
+		connectLog, closeConnectLog, err := openConnectLog()
+		if err != nil {
+			return err
+		}
+		defer closeConnectLog()
+		ps, err := proxiesFromConfig(ctx, policy)
+		if err != nil {
+			return err
+		}
+		ps.audit = audit
+		ps.connectLog = connectLog
+		ps.state = st
+		ps.session = proxy.NewSessionStats()
+		// Set once up, so a failed start prints no summary. It is
+		// reported after ps is shut down, with all connections ended.
+		ready := false
+		defer func() {
+			if ready {
+				reportSession(ps, started, quiet)
+			}
+		}()
+		defer ps.Shutdown()
+		m, err := newForwardManager(ps, dumps, forwards, groups)
 		if err != nil {
 			return err
 		}
-		p.WithContext(ctx)
-		logger.Infof("connecting to %s@%s",
-			viper.GetString("sshproxy.user"),
-			viper.GetString("sshproxy.remote"))
-		if err := p.Connect(); err != nil {
+		m.state = st
+		if st.crashed && len(groups) == 0 {
+			st.restoreGroups(m)
+		}
+		used := m.hosts()
+		if len(remotes) > 0 {
+			used = append(used, defaultHost)
+		}
+		for _, fwd := range reverse {
+			used = append(used, fwd.Host)
+		}
+		for _, host := range used {
+			if _, err := ps.add(host); err != nil {
+				return err
+			}
+		}
+		if err := startControlServer(ctx, cancel, m); err != nil {
+			logger.Warningf("control API disabled: %s", err)
+		}
+		required := func() []string {
+			names := append(append([]string(nil), remotes...), m.active()...)
+			for _, fwd := range reverse {
+				names = append(names, fwd.Name)
+			}
+			return names
+		}
+		if err := startMetricsServer(ctx, m, required); err != nil {
 			return err
 		}
+		c := currentSettings().SSHProxy
+		listenEarly := c.ListenEarly
+		if listenEarly && c.ParkTimeout <= 0 {
+			logger.Warningf("--listen-early without --park-timeout fails connections until the ssh connection is up")
+		}
+		if !listenEarly {
+			if err := ps.connect(); err != nil {
+				return err
+			}
+		}
+		var jobs []startJob
 		for _, remote := range remotes {
-			local, err := p.Forward(remote, localPort)
+			remote := remote
+			jobs = append(jobs, startJob{"forward " + remote, func() error {
+				p, _ := ps.get(defaultHost)
+				opts := forwardOptions(remote, dumps)
+				opts.Listener = takeListener(remote)
+				local, err := p.ForwardWithOptions(remote, remote, localPort, opts)
+				if err != nil {
+					return err
+				}
+				ps.hold(defaultHost)
+				logger.Debugf("%s -> %s", remote, local)
+				return nil
+			}})
+		}
+		if err := ps.startAll(jobs); err != nil {
+			return err
+		}
+		if err := m.start(); err != nil {
+			return err
+		}
+		if listenEarly {
+			// Connections accepted until now are parked and go through
+			// once this is done.
+			if err := ps.connect(); err != nil {
+				return err
+			}
+		}
+		if err := startServerForwards(ps, m); err != nil {
+			return err
+		}
+		if st.crashed {
+			st.restorePaused(ps)
+		}
+		reloadOnHangup(ctx, m)
+		if refresh, _ := cmd.Flags().GetDuration("config-url-refresh"); configURL != "" && refresh > 0 {
+			go refreshConfigURL(ctx, m, refresh)
+		}
+		jobs = nil
+		for _, fwd := range reverse {
+			fwd := fwd
+			fwd.Log.apply(fwd.Name)
+			jobs = append(jobs, startJob{"reverse forward " + fwd.Name, func() error {
+				if err := startReverse(ps, fwd, dumps); err != nil {
+					return err
+				}
+				// Reverse forwards keep their connection for good, also
+				// while an upgrade closes and restarts them.
+				ps.hold(fwd.Host)
+				return nil
+			}})
+		}
+		if err := ps.startAll(jobs); err != nil {
+			return err
+		}
+		if wait, _ := cmd.Flags().GetDuration("wait-ready"); wait > 0 {
+			if err := waitReady(ctx, ps, required(), wait); err != nil {
+				return err
+			}
+		}
+		if !quiet {
+			if err := printSummary(os.Stderr, ps, required()); err != nil {
+				return err
+			}
+		}
+		ready = true
+		closeInherited()
+		notifyUpgraded()
+		readyFd, _ := cmd.Flags().GetInt("ready-fd")
+		readyFile, _ := cmd.Flags().GetString("ready-file")
+		if err := notifyReady(ps, readyFd, readyFile); err != nil {
+			return err
+		}
+		if readyFile != "" {
+			defer os.Remove(readyFile)
+		}
+		if err := sdNotify("READY=1"); err != nil {
+			logger.Warningf("error notifying systemd: %s", err)
+		}
+		if err := st.record(m); err != nil {
+			logger.Warningf("recording state: %s", err)
+		}
+		if err := st.saveConfig(); err != nil {
+			logger.Warningf("saving config: %s", err)
+		}
+		go st.recordEvery(ctx, m)
+		startWatchdog(ctx)
+		if set, _ := cmd.Flags().GetBool("set-system-proxy"); set {
+			restore, err := setSystemProxy(ps)
 			if err != nil {
 				return err
 			}
-			logger.Infof("%s -> %s", remote, local)
+			defer restore()
 		}
-		// TODO: wait for ctl-c and shutdown
-		if ctx.Err() == context.Canceled {
-			fmt.Fprintln(os.Stderr, "Mirror interrupted by signal")
-			os.Exit(1)
+		drainTimeout, _ := cmd.Flags().GetDuration("drain-timeout")
+		upgradeOnSignal(ctx, cancel, ps, reverse, dumps, drainTimeout)
+		if idle, _ := cmd.Flags().GetDuration("exit-on-idle"); idle > 0 {
+			go exitOnIdle(ctx, cancel, ps, idle)
+		}
+		if threshold, _ := cmd.Flags().GetDuration("wake-threshold"); threshold > 0 {
+			go reconnectOnWake(ctx, ps, threshold)
+		}
+		if mdns, _ := cmd.Flags().GetBool("mdns"); mdns {
+			if err := advertiseForwards(ctx, m); err != nil {
+				logger.Warningf("mDNS advertisement disabled: %s", err)
+			}
+		}
+		if watch, _ := cmd.Flags().GetBool("watch-network"); watch {
+			go reconnectOnNetworkChange(ctx, ps)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-ps.fatal:
+			return err
 		}
-		select {}
-		return nil
 	},
 }
 
+// startReverse sets up the reverse forward fwd. The log levels of fwd
+// are left to the caller.
+func startReverse(ps *proxySet, fwd reverseConfig, dumps map[string]*proxy.PcapWriter) error {
+	opts := forwardOptions(fwd.Name, dumps)
+	opts.Public = fwd.Public
+	opts.Origins = destinationRules(fwd.Origins)
+	if len(fwd.ACME.Domains) > 0 {
+		var err error
+		if opts.TLS, err = acmeTLS(fwd); err != nil {
+			return err
+		}
+	}
+	p, err := ps.get(fwd.Host)
+	if err != nil {
+		return err
+	}
+	remote, err := p.ReverseForward(fwd.Name, fwd.Remote, fwd.Local, opts)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("%s <- %s", fwd.Local, remote)
+	return nil
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -96,36 +331,240 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.sshhttpproxy.yaml)")
-	rootCmd.Flags().BoolP("debug", "d", false, "enable debug level logging")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file, replaces $HOME/.sshhttpproxy.yaml and the project config")
+	rootCmd.PersistentFlags().StringVar(&configURL, "config-url", "", "shared config to fetch over https, which the local config files override")
+	rootCmd.Flags().Duration("config-url-refresh", 5*time.Minute, "how often to check --config-url for changes and reload (0 to disable)")
+	rootCmd.PersistentFlags().BoolP("debug", "d", false, "enable debug level logging")
+	rootCmd.Flags().BoolP("quiet", "q", false, "only log errors and leave out the startup summary")
+	rootCmd.PersistentFlags().String("profile", "", "profile name, available to templates in the config as {{ .Profile }}")
+	bindFlag("profile", rootCmd.PersistentFlags().Lookup("profile"))
 	rootCmd.PersistentFlags().StringSliceP("remote", "r", nil, "remote server and port")
 	rootCmd.PersistentFlags().String("local", "0", "set local port")
+	rootCmd.PersistentFlags().String("user", "", "ssh user, overrides sshproxy.user")
+	bindFlag("sshproxy.user", rootCmd.PersistentFlags().Lookup("user"))
+	rootCmd.PersistentFlags().String("host", "", "ssh server host, overrides the host of sshproxy.remote")
+	bindFlag("sshproxy.host", rootCmd.PersistentFlags().Lookup("host"))
+	rootCmd.PersistentFlags().Int("port", 0, "ssh server port, overrides the port of sshproxy.remote")
+	bindFlag("sshproxy.port", rootCmd.PersistentFlags().Lookup("port"))
+	rootCmd.PersistentFlags().Bool("sidecar", false, "take the config from the environment only, skipping config file discovery")
+	bindFlag("sidecar", rootCmd.PersistentFlags().Lookup("sidecar"))
+	rootCmd.PersistentFlags().StringP("identity", "i", "", "private key file, overrides sshproxy.privatekey")
+	bindFlag("sshproxy.privatekey", rootCmd.PersistentFlags().Lookup("identity"))
+	rootCmd.Flags().Bool("fail-fast", false, "exit non-zero if connecting or binding a forward fails, or a connection is lost")
+	rootCmd.Flags().Bool("retry-forever", false, "keep retrying connects and binds in the background and reconnect lost connections")
+	rootCmd.Flags().Duration("wait-ready", 0, "wait until all forwards reach their targets, exiting non-zero if that takes longer")
+	rootCmd.Flags().Lookup("wait-ready").NoOptDefVal = "30s"
+	rootCmd.Flags().Int("ready-fd", -1, "write the local addresses of the forwards as JSON to this file descriptor once they are up")
+	rootCmd.Flags().String("ready-file", "", "write the local addresses of the forwards as JSON to this file once they are up, removing it on shutdown")
+	rootCmd.Flags().Duration("exit-on-idle", 0, "shut down after no forwarded connection was open for this long (0 to disable)")
+	rootCmd.Flags().Duration("wake-threshold", 30*time.Second, "reconnect after the system was asleep for this long (0 to disable)")
+	rootCmd.Flags().Bool("mdns", false, "advertise forwards with mdns: true on the LAN as <name>.local")
+	bindFlag("mdns.enabled", rootCmd.Flags().Lookup("mdns"))
+	rootCmd.Flags().Bool("watch-network", true, "reconnect when the addresses of the network interfaces change")
+	rootCmd.Flags().Duration("drain-timeout", 30*time.Second, "on SIGUSR2, how long to let open connections finish after handing the listeners to a new process")
+	rootCmd.Flags().Bool("set-system-proxy", false, "point the proxy settings of the system at the connect and socks forwards until shutdown")
+	rootCmd.Flags().Int("startup-workers", defaultStartupWorkers, "how many forwards are set up or probed at once")
+	bindFlag("startup.workers", rootCmd.Flags().Lookup("startup-workers"))
+	rootCmd.Flags().StringSlice("group", nil, "only start forwards of these groups (default all)")
+	rootCmd.PersistentFlags().StringSlice("dump", nil, "write the traffic of a forward to a pcap file, as <forward>:<file.pcap>")
+	rootCmd.Flags().String("audit", "", "append a hash-chained record of every connection to this file")
+	bindFlag("audit.file", rootCmd.Flags().Lookup("audit"))
+	rootCmd.Flags().Bool("audit-digests", false, "include SHA-256 digests of the payload in audit records")
+	bindFlag("audit.digests", rootCmd.Flags().Lookup("audit-digests"))
+	rootCmd.Flags().String("summary-file", "", "write a JSON summary of the session to this file on exit")
+	bindFlag("summary.file", rootCmd.Flags().Lookup("summary-file"))
+	rootCmd.Flags().String("connect-log", "", "append a record of every destination asked for in connect and socks mode to this file")
+	bindFlag("connectlog.file", rootCmd.Flags().Lookup("connect-log"))
+	rootCmd.PersistentFlags().String("control", "", "control socket path (default is $HOME/.sshhttpproxy.sock)")
+	bindFlag("control.socket", rootCmd.PersistentFlags().Lookup("control"))
+	rootCmd.PersistentFlags().String("metrics", "", "serve prometheus metrics on this address")
+	bindFlag("metrics.listen", rootCmd.PersistentFlags().Lookup("metrics"))
+	rootCmd.PersistentFlags().Int("max-startups", 0, "maximum number of remote connections being opened at once (0 for unlimited)")
+	bindFlag("sshproxy.maxstartups", rootCmd.PersistentFlags().Lookup("max-startups"))
+	rootCmd.PersistentFlags().Int64("max-buffered-bytes", 0, "maximum memory held by connections, about 2MB each, before new connections are shed (0 for unlimited)")
+	bindFlag("sshproxy.maxbufferedbytes", rootCmd.PersistentFlags().Lookup("max-buffered-bytes"))
+	rootCmd.PersistentFlags().Bool("fair-scheduling", false, "interleave the writes of connections over the ssh connection by forward priority")
+	bindFlag("sshproxy.fairscheduling", rootCmd.PersistentFlags().Lookup("fair-scheduling"))
+	rootCmd.PersistentFlags().Duration("slow-threshold", 5*time.Second, "log connections whose dial or first response takes longer than this (0 to disable)")
+	bindFlag("sshproxy.slowthreshold", rootCmd.PersistentFlags().Lookup("slow-threshold"))
+	rootCmd.PersistentFlags().Duration("park-timeout", 10*time.Second, "how long new connections wait for a lost or replaced ssh connection to come back (0 to fail them at once)")
+	bindFlag("sshproxy.parktimeout", rootCmd.PersistentFlags().Lookup("park-timeout"))
+	rootCmd.PersistentFlags().Int("park-queue", 128, "maximum number of connections waiting for the ssh connection per host, beyond which they fail at once (0 for unlimited)")
+	bindFlag("sshproxy.parkqueue", rootCmd.PersistentFlags().Lookup("park-queue"))
+	rootCmd.Flags().Bool("listen-early", false, "bind the local forwards before the ssh connection is up, holding connections for up to --park-timeout")
+	bindFlag("sshproxy.listenearly", rootCmd.Flags().Lookup("listen-early"))
+	rootCmd.PersistentFlags().Duration("keepalive-interval", 15*time.Second, "how often to check that the ssh server is alive (0 to disable)")
+	bindFlag("sshproxy.keepaliveinterval", rootCmd.PersistentFlags().Lookup("keepalive-interval"))
+	rootCmd.PersistentFlags().Int("keepalive-count-max", 3, "unanswered keepalives in a row after which the ssh connection is closed as lost")
+	bindFlag("sshproxy.keepalivecountmax", rootCmd.PersistentFlags().Lookup("keepalive-count-max"))
+	rootCmd.PersistentFlags().Duration("stall-threshold", 30*time.Second, "log connections that make no progress for this long (0 to disable)")
+	bindFlag("sshproxy.stallthreshold", rootCmd.PersistentFlags().Lookup("stall-threshold"))
+	rootCmd.PersistentFlags().Bool("happy-eyeballs", false, "resolve remote targets locally and race their IPv6 and IPv4 addresses")
+	bindFlag("sshproxy.happyeyeballs", rootCmd.PersistentFlags().Lookup("happy-eyeballs"))
+	rootCmd.PersistentFlags().String("prefer-family", "auto", "address family to try first for the ssh server and remote targets: ipv4, ipv6 or auto")
+	bindFlag("sshproxy.prefer_family", rootCmd.PersistentFlags().Lookup("prefer-family"))
+	rootCmd.PersistentFlags().Duration("resolve-cache-ttl", 0, "resolve remote target names locally and cache them and srv: and consul: lookups for this long (0 to disable)")
+	bindFlag("sshproxy.resolvecachettl", rootCmd.PersistentFlags().Lookup("resolve-cache-ttl"))
+	rootCmd.PersistentFlags().String("dns-server", "", "look up remote target names with this DNS server on the remote network, through the ssh connection")
+	bindFlag("sshproxy.dns_server", rootCmd.PersistentFlags().Lookup("dns-server"))
+	rootCmd.PersistentFlags().StringSlice("path", nil, "experimental: also keep an ssh connection over this local interface or address and spread connections over all of them")
+	bindFlag("sshproxy.paths", rootCmd.PersistentFlags().Lookup("path"))
+	rootCmd.PersistentFlags().String("path-mode", "stripe", "how connections use the --path connections: stripe or failover")
+	bindFlag("sshproxy.path_mode", rootCmd.PersistentFlags().Lookup("path-mode"))
+	rootCmd.PersistentFlags().String("client-version", "", "ssh version string to send instead of the one of the Go ssh library, e.g. SSH-2.0-OpenSSH_9.6")
+	bindFlag("sshproxy.client_version", rootCmd.PersistentFlags().Lookup("client-version"))
+	rootCmd.PersistentFlags().Bool("gssapi", false, "authenticate with the Kerberos ticket of the user (gssapi-with-mic)")
+	bindFlag("sshproxy.gssapi", rootCmd.PersistentFlags().Lookup("gssapi"))
+	rootCmd.PersistentFlags().Bool("agent", false, "authenticate with the keys of the ssh agent at SSH_AUTH_SOCK")
+	bindFlag("sshproxy.agent", rootCmd.PersistentFlags().Lookup("agent"))
+	rootCmd.PersistentFlags().String("pkcs11", "", "authenticate with a smartcard key through this PKCS#11 module")
+	bindFlag("sshproxy.pkcs11.module", rootCmd.PersistentFlags().Lookup("pkcs11"))
+	rootCmd.PersistentFlags().String("proxy-command", "", "reach the ssh server through the stdin and stdout of this command, with %h, %p and %r replaced like in OpenSSH")
+	bindFlag("sshproxy.proxy_command", rootCmd.PersistentFlags().Lookup("proxy-command"))
+	rootCmd.PersistentFlags().Float64("accept-rate", 0, "maximum new connections per second per forward (0 for unlimited)")
+	bindFlag("sshproxy.acceptrate", rootCmd.PersistentFlags().Lookup("accept-rate"))
+	rootCmd.PersistentFlags().Int("accept-burst", 1, "connections accepted in a burst above --accept-rate")
+	bindFlag("sshproxy.acceptburst", rootCmd.PersistentFlags().Lookup("accept-burst"))
 }
 
-// initConfig reads in config file and ENV variables if set.
+// initConfig reads in config files and ENV variables if set.
 func initConfig() {
-	if cfgFile != "" {
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
-		// Find home directory.
-		home, err := homedir.Dir()
-		if err != nil {
+	if err := loadConfig(); err != nil {
+		switch _, ok := err.(configErrors); {
+		case ok && runsOnRawConfig():
+			fmt.Fprintln(os.Stderr, err)
+		case commandToRun() == rootCmd && crashedBefore():
+			// Come back up after a crash even if the config was broken
+			// since, with the config that last worked.
+			path, lastErr := loadLastGoodConfig()
+			if lastErr != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, "Using last known good config:", path)
+		default:
 			fmt.Println(err)
 			os.Exit(1)
 		}
+	}
+	if quiet, _ := rootCmd.Flags().GetBool("quiet"); quiet {
+		return
+	}
+	// Keep stdout for the output of commands.
+	for _, path := range configFiles {
+		fmt.Fprintln(os.Stderr, "Using config file:", path)
+	}
+}
+
+// runsOnRawConfig reports whether the command being run works on the
+// config files themselves, so it can fix a config that fails the checks.
+func runsOnRawConfig() bool {
+	cmd := commandToRun()
+	return cmd != nil && cmd.Annotations[rawConfigAnnotation] == "true"
+}
 
-		// Search config in home directory with name ".sshhttpproxy" (without extension).
-		viper.AddConfigPath(home)
-		viper.SetConfigName(".sshhttpproxy")
+// commandToRun returns the command the arguments select, or nil.
+func commandToRun() *cobra.Command {
+	cmd, _, err := rootCmd.Find(os.Args[1:])
+	if err != nil {
+		return nil
 	}
+	return cmd
+}
+
+// loadConfig merges the config files, environment variables, templates and
+// secrets into viper and decodes the result into settings. What was read
+// before an error is kept, for the commands that work on the raw config.
+func loadConfig() error {
+	l, err := readConfig(viper.GetViper())
+	applyConfig(l)
+	return err
+}
+
+// loadedConfig is a config read by readConfig, which applyConfig makes
+// the loaded one.
+type loadedConfig struct {
+	v        *viper.Viper
+	settings fileConfig
+	// decoded is set if settings hold the config, which is then valid.
+	decoded bool
+	files   []string
+	// merged are the files as merged, before templates and secrets
+	// rewrite the values in place, to save as the last known good config.
+	merged      []byte
+	secretPaths map[string]bool
+}
+
+// readConfig merges the config files, environment variables, templates and
+// secrets into v and decodes the result. On an error, the config returned
+// has what was read until then.
+func readConfig(v *viper.Viper) (*loadedConfig, error) {
+	l := &loadedConfig{v: v}
+	// Environment variables override the config files, with the key
+	// upper cased, dots replaced by underscores and the SSHHTTPPROXY_
+	// prefix, e.g. SSHHTTPPROXY_SSHPROXY_REMOTE for sshproxy.remote.
+	v.SetEnvPrefix("sshhttpproxy")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	bindSchemaEnv(v)
 
-	viper.AutomaticEnv() // read in environment variables that match
+	// Sidecars are configured from the environment and only read a
+	// config file if it is given explicitly.
+	var layers []string
+	if v.GetBool("sidecar") {
+		if cfgFile != "" {
+			layers = append(layers, cfgFile)
+		}
+	} else {
+		var err error
+		if layers, err = configLayers(cfgFile); err != nil {
+			return l, err
+		}
+	}
+	if configURL != "" {
+		// The shared config goes below the files of the user and project,
+		// which override it, but above the system file.
+		shared, _, err := syncConfigURL(configURL)
+		if err != nil {
+			return l, err
+		}
+		i := 0
+		if len(layers) > 0 && layers[0] == systemConfigPath() {
+			i = 1
+		}
+		layers = append(layers[:i], append([]string{shared}, layers[i:]...)...)
+	}
+	files := viper.New()
+	for _, path := range layers {
+		if err := mergeConfigFile(files, path, map[string]bool{}, &l.files); err != nil {
+			return l, err
+		}
+	}
+	merged := files.AllSettings()
+	if err := v.MergeConfigMap(merged); err != nil {
+		return l, err
+	}
+	delete(merged, "include")
+	var err error
+	if l.merged, err = yaml.Marshal(merged); err != nil {
+		return l, err
+	}
+	if err := loadEnvConfig(v); err != nil {
+		return l, err
+	}
 
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	if err := expandTemplates(v); err != nil {
+		return l, err
+	}
+	if l.secretPaths, err = resolveSecrets(v); err != nil {
+		return l, err
+	}
+	if l.settings, err = decodeConfig(v); err != nil {
+		return l, err
 	}
+	l.decoded = true
+	return l, nil
 }
 
 func setupLogging(out io.Writer, debug bool) {
@@ -135,10 +574,11 @@ func setupLogging(out io.Writer, debug bool) {
 			logging.MustStringFormatter("%{color}%{time:15:04:05.000} %{shortfunc} ▶ %{level:.8s} %{id:03x}%{color:reset} %{message}"),
 		),
 	)
+	// SetBackend replaces the levels, so they are set on the backend.
 	if debug {
-		logging.SetLevel(logging.DEBUG, "")
+		backend.SetLevel(logging.DEBUG, "")
 	} else {
-		logging.SetLevel(logging.INFO, "")
+		backend.SetLevel(logging.INFO, "")
 	}
 	logging.SetBackend(backend)
 }
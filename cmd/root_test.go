@@ -0,0 +1,54 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestConnectionFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	useConfigFile(t, path)
+	for key, flag := range flagBindings {
+		viper.BindPFlag(key, flag)
+	}
+	writeConfig(t, path, `
+sshproxy:
+  user: file
+  remote: file.example.com:22
+  privatekey: ~/.ssh/file
+`)
+	setFlag(t, "user", "oneoff")
+	setFlag(t, "host", "other.example.com")
+	setFlag(t, "port", "2222")
+	setFlag(t, "identity", "/keys/oneoff")
+
+	for _, step := range []struct {
+		name string
+		load func() error
+	}{
+		{"load", loadConfig},
+		{"reload", reloadConfig},
+	} {
+		if err := step.load(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		s := currentSettings().SSHProxy
+		if s.User != "oneoff" || s.Host != "other.example.com" || s.Port != 2222 || s.PrivateKey != "/keys/oneoff" {
+			t.Errorf("%s: got user %q, host %q, port %d, private key %q", step.name, s.User, s.Host, s.Port, s.PrivateKey)
+		}
+		if s.Remote != "file.example.com:22" {
+			t.Errorf("%s: got remote %q", step.name, s.Remote)
+		}
+	}
+}
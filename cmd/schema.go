@@ -0,0 +1,412 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+// fileConfig is the schema of the config, once the config files,
+// environment variables, flags, templates and secrets are merged. Keys
+// match field names case-insensitively, as viper lower cases them, unless
+// a field has a mapstructure tag.
+type fileConfig struct {
+	Include  []string
+	Profile  string
+	Profiles map[string]interface{}
+	Sidecar  bool
+
+	SSHProxy sshproxyConfig
+	Hosts    map[string]hostConfig
+	Forwards []forwardConfig
+	Groups   map[string][]forwardConfig
+	Reverse  []reverseConfig
+
+	Metrics struct {
+		// Listen is the address prometheus metrics are served on.
+		Listen string
+	}
+	Control struct {
+		// Socket is the path of the control socket.
+		Socket string
+	}
+	ConnectLog struct {
+		File string
+	}
+	Audit struct {
+		File    string
+		Digests bool
+	}
+	Summary struct {
+		// File receives the session summary as JSON on exit.
+		File string
+	}
+	ACME struct {
+		// CacheDir holds ACME accounts and certificates.
+		CacheDir string
+	}
+	TLS struct {
+		// CADir holds the local CA.
+		CADir string
+	}
+	Startup struct {
+		// Workers is how many forwards are set up or probed at once.
+		Workers int
+	}
+	MDNS struct {
+		Enabled bool
+	}
+	State struct {
+		// Dir holds the state directories of the profiles.
+		Dir string
+	}
+	Policy struct {
+		// File is the signed policy restricting the destinations of
+		// the forwards.
+		File string
+		// PublicKey is the base64 ed25519 key File is signed with.
+		PublicKey string
+	}
+}
+
+// sshproxyConfig describes the default ssh server and the connection
+// settings shared by all hosts.
+type sshproxyConfig struct {
+	User string
+	// Remote is the host:port of the ssh server, the port defaults to 22.
+	Remote string
+	// Host and Port replace the host and port of Remote.
+	Host string
+	Port int
+
+	Password       string
+	Passphrase     string
+	PrivateKey     string
+	PrivateKeyData string
+
+	ProxyCommand  string       `mapstructure:"proxy_command"`
+	PreferFamily  proxy.Family `mapstructure:"prefer_family"`
+	HappyEyeballs bool
+	DNSServer     string `mapstructure:"dns_server"`
+	ConsulAddress string `mapstructure:"consul_address"`
+	ConsulToken   string `mapstructure:"consul_token"`
+	// ForwardsCommand, if set, is run on the ssh server to print forwards
+	// to start besides those of the config.
+	ForwardsCommand string `mapstructure:"forwards_command"`
+	// Paths are local interfaces to keep extra ssh connections over, see
+	// proxy.Config.Paths.
+	Paths    []string
+	PathMode proxy.PathMode `mapstructure:"path_mode"`
+	// Knock is sent to the ssh server before connecting to it.
+	Knock []knockConfig
+	// ClientVersion replaces the ssh banner of the Go ssh library.
+	ClientVersion string `mapstructure:"client_version"`
+	// ObfuscationKeyword, if set, obfuscates the connections to the ssh
+	// servers with obfuscated-openssh and this keyword. It may refer to
+	// environment variables.
+	ObfuscationKeyword string `mapstructure:"obfuscation_keyword"`
+	// GSSAPI authenticates with the Kerberos ticket of the user, see
+	// proxy.Config.GSSAPI. It needs a build with the gssapi tag.
+	GSSAPI       bool
+	GSSAPITarget string `mapstructure:"gssapi_target"`
+	// Agent authenticates with the keys of the ssh agent at
+	// SSH_AUTH_SOCK, e.g. smartcard keys added with ssh-add -s.
+	Agent bool
+	// PKCS11 authenticates with a key on a smartcard or token, signing
+	// through its PKCS#11 module. It needs a build with the pkcs11 tag.
+	PKCS11 struct {
+		// Module is the path of the PKCS#11 library, e.g.
+		// opensc-pkcs11.so or libykcs11.so.
+		Module string
+		// Token, if set, is the label of the token to use, the first
+		// token with a key otherwise.
+		Token string
+		// PIN logs in to the token; it is asked for on the terminal if
+		// empty and the token needs one.
+		PIN string
+	}
+
+	KeepAliveInterval time.Duration
+	KeepAliveCountMax int
+	MaxStartups       int
+	MaxBufferedBytes  int64
+	FairScheduling    bool
+	AcceptRate        float64
+	AcceptBurst       int
+	SlowThreshold     time.Duration
+	StallThreshold    time.Duration
+	ParkTimeout       time.Duration
+	ParkQueue         int
+	ListenEarly       bool
+	ResolveCacheTTL   time.Duration
+}
+
+// settings is the config last loaded by loadConfig or reloadConfig. It is
+// guarded by configMu, read it with currentSettings while forwards run.
+var settings fileConfig
+
+// bindSchemaEnv binds the environment variables of all keys of the
+// schema that hold a single value in v, so it reports them as set even if
+// no config file mentions them.
+func bindSchemaEnv(v *viper.Viper) {
+	for _, key := range schemaKeys(reflect.TypeOf(fileConfig{}), "") {
+		v.BindEnv(key)
+	}
+}
+
+// schemaKeys returns the keys of the single value fields of the struct
+// type t, prefixed with prefix.
+func schemaKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + fieldKey(f)
+		switch f.Type.Kind() {
+		case reflect.Struct:
+			keys = append(keys, schemaKeys(f.Type, key+".")...)
+		case reflect.Slice, reflect.Map:
+		default:
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// fieldKey returns the config key of the struct field f.
+func fieldKey(f reflect.StructField) string {
+	if tag := f.Tag.Get("mapstructure"); tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+// configErrors are the problems found in the config, one per key.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+// decodeConfig decodes the merged config in v into a fileConfig and checks
+// it, reporting unknown keys and values of the wrong type or format by
+// their path in the config file.
+func decodeConfig(v *viper.Viper) (fileConfig, error) {
+	var cfg fileConfig
+	var errs configErrors
+	err := v.Unmarshal(&cfg)
+	if err, ok := err.(*mapstructure.Error); ok {
+		for _, msg := range err.Errors {
+			errs = append(errs, decodeError(msg))
+		}
+	} else if err != nil {
+		return cfg, err
+	}
+	errs = append(errs, unknownKeys(v.AllSettings(), reflect.TypeOf(cfg), "")...)
+	errs = append(errs, cfg.SSHProxy.check()...)
+	if cfg.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Metrics.Listen); err != nil {
+			errs = append(errs, fmt.Sprintf("metrics.listen: %s", err))
+		}
+	}
+	if cfg.Startup.Workers < 0 {
+		errs = append(errs, "startup.workers: must not be negative")
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// check validates the formats of the sshproxy settings.
+func (c *sshproxyConfig) check() []string {
+	var errs []string
+	if c.Remote != "" {
+		if _, port, err := net.SplitHostPort(c.Remote); err == nil {
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				errs = append(errs, fmt.Sprintf("sshproxy.remote: invalid port %q", port))
+			}
+		}
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("sshproxy.port: invalid port %d", c.Port))
+	}
+	switch c.PreferFamily {
+	case "", proxy.FamilyAuto, proxy.FamilyIPv4, proxy.FamilyIPv6:
+	default:
+		errs = append(errs, fmt.Sprintf("sshproxy.prefer_family: must be ipv4, ipv6 or auto, not %q", c.PreferFamily))
+	}
+	if c.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(c.DNSServer); err != nil {
+			errs = append(errs, fmt.Sprintf("sshproxy.dns_server: %s", err))
+		}
+	}
+	for _, v := range []struct {
+		key string
+		n   float64
+	}{
+		{"keepaliveinterval", float64(c.KeepAliveInterval)},
+		{"keepalivecountmax", float64(c.KeepAliveCountMax)},
+		{"maxstartups", float64(c.MaxStartups)},
+		{"maxbufferedbytes", float64(c.MaxBufferedBytes)},
+		{"acceptrate", c.AcceptRate},
+		{"acceptburst", float64(c.AcceptBurst)},
+		{"slowthreshold", float64(c.SlowThreshold)},
+		{"stallthreshold", float64(c.StallThreshold)},
+		{"parktimeout", float64(c.ParkTimeout)},
+		{"parkqueue", float64(c.ParkQueue)},
+		{"resolvecachettl", float64(c.ResolveCacheTTL)},
+	} {
+		if v.n < 0 {
+			errs = append(errs, fmt.Sprintf("sshproxy.%s: must not be negative", v.key))
+		}
+	}
+	return errs
+}
+
+// quotedPath matches the key path mapstructure quotes in its errors.
+var quotedPath = regexp.MustCompile(`'([^']*)' ?`)
+
+// decodeError rewrites a mapstructure error to start with the config path
+// of the key it is about.
+func decodeError(msg string) string {
+	msg = strings.TrimPrefix(msg, "error decoding ")
+	m := quotedPath.FindStringSubmatchIndex(msg)
+	if m == nil {
+		return msg
+	}
+	rest := strings.TrimPrefix(msg[:m[0]]+msg[m[1]:], ": ")
+	return configPath(msg[m[2]:m[3]]) + ": " + rest
+}
+
+// mapKey matches a map key in a mapstructure key path, as opposed to a
+// list index.
+var mapKey = regexp.MustCompile(`\[([^\]0-9][^\]]*)\]`)
+
+// configPath returns the mapstructure key path key, which uses Go field
+// names and brackets for map keys, as a path of the config file such as
+// groups.web[0].remote.
+func configPath(key string) string {
+	return strings.ToLower(mapKey.ReplaceAllString(key, ".$1"))
+}
+
+// unknownKeys reports the keys of v, the value at path in the config, that
+// the type t has no field for, with the known key closest in spelling if
+// there is one. Values of the wrong type are left to the decoder.
+func unknownKeys(v interface{}, t reflect.Type, path string) []string {
+	var errs []string
+	switch t.Kind() {
+	case reflect.Struct:
+		for k, item := range stringMap(v) {
+			key := strings.TrimPrefix(path+"."+k, ".")
+			f, ok := schemaField(t, k)
+			if !ok {
+				msg := key + ": unknown key"
+				if s := suggestKey(t, k); s != "" {
+					msg += fmt.Sprintf(", did you mean %s?", strings.TrimPrefix(path+"."+s, "."))
+				}
+				errs = append(errs, msg)
+				continue
+			}
+			errs = append(errs, unknownKeys(item, f.Type, key)...)
+		}
+	case reflect.Map:
+		for k, item := range stringMap(v) {
+			errs = append(errs, unknownKeys(item, t.Elem(), path+"."+k)...)
+		}
+	case reflect.Slice:
+		items, _ := v.([]interface{})
+		for i, item := range items {
+			errs = append(errs, unknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return errs
+}
+
+// stringMap returns the map v with string keys, as maps in lists keep the
+// keys YAML decoded them with, or nil if v is no map.
+func stringMap(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = item
+		}
+		return m
+	}
+	return nil
+}
+
+// schemaField returns the field of the struct type t for the config key,
+// which matches case-insensitively like in the decoder.
+func schemaField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(fieldKey(t.Field(i)), key) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// suggestKey returns the key of the struct type t closest in spelling to
+// the unknown key, or "" if none is close.
+func suggestKey(t reflect.Type, key string) string {
+	key = strings.ToLower(key)
+	best, bestDist := "", len(key)/3+1
+	for i := 0; i < t.NumField(); i++ {
+		name := fieldKey(t.Field(i))
+		if d := editDistance(key, name); d <= bestDist {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the number of single character insertions,
+// deletions, substitutions and swaps of neighbours that turn a into b.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,160 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestDecodeConfig(t *testing.T) {
+	readTestConfig(t, `
+sshproxy:
+  user: elliot
+  remote: bastion:2222
+  keepaliveinterval: 30s
+  prefer_family: ipv6
+forwards:
+  - name: db
+    remote: db.internal:5432
+    local: "5432"
+startup:
+  workers: 4
+`)
+	cfg, err := decodeConfig(viper.GetViper())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SSHProxy.User != "elliot" || cfg.SSHProxy.Remote != "bastion:2222" {
+		t.Errorf("sshproxy %+v", cfg.SSHProxy)
+	}
+	if cfg.SSHProxy.KeepAliveInterval != 30*time.Second {
+		t.Errorf("keepaliveinterval %s", cfg.SSHProxy.KeepAliveInterval)
+	}
+	if len(cfg.Forwards) != 1 || cfg.Forwards[0].Remote != "db.internal:5432" {
+		t.Errorf("forwards %+v", cfg.Forwards)
+	}
+	if cfg.Startup.Workers != 4 {
+		t.Errorf("startup.workers %d", cfg.Startup.Workers)
+	}
+}
+
+func TestDecodeConfigErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		doc  string
+		// want are the beginnings of the errors, in order.
+		want []string
+	}{
+		{
+			"typo",
+			"sshproxy:\n  uesr: elliot\n",
+			[]string{"sshproxy.uesr: unknown key, did you mean sshproxy.user?"},
+		},
+		{
+			"unknown top level key",
+			"frowards: []\n",
+			[]string{"frowards: unknown key, did you mean forwards?"},
+		},
+		{
+			"unknown key without suggestion",
+			"sshproxy:\n  colour: blue\n",
+			[]string{"sshproxy.colour: unknown key"},
+		},
+		{
+			"typo in a list",
+			"forwards:\n  - name: a\n    remtoe: x:1\n",
+			[]string{"forwards[0].remtoe: unknown key, did you mean forwards[0].remote?"},
+		},
+		{
+			"typo in a map of lists",
+			"groups:\n  web:\n    - name: a\n      locl: \"1\"\n",
+			[]string{"groups.web[0].locl: unknown key, did you mean groups.web[0].local?"},
+		},
+		{
+			"typo in a map",
+			"hosts:\n  b:\n    remote: x\n    usr: y\n",
+			[]string{"hosts.b.usr: unknown key, did you mean hosts.b.user?"},
+		},
+		{
+			"not a number",
+			"startup:\n  workers: lots\n",
+			[]string{"startup.workers: cannot parse as int"},
+		},
+		{
+			"not a duration and not a scalar",
+			"sshproxy:\n  keepaliveinterval: soon\n  port: [1]\n",
+			[]string{
+				"sshproxy.keepaliveinterval: time: invalid duration",
+				"sshproxy.port: expected type 'int'",
+			},
+		},
+		{
+			"not a map",
+			"metrics: 5\n",
+			[]string{"metrics: expected a map"},
+		},
+		{
+			"bad formats",
+			`
+sshproxy:
+  remote: h:99999
+  port: 70000
+  prefer_family: ipv5
+  dns_server: nope
+  parkqueue: -1
+metrics:
+  listen: nope
+startup:
+  workers: -1
+`,
+			[]string{
+				"metrics.listen: address nope: missing port in address",
+				"sshproxy.dns_server: address nope: missing port in address",
+				"sshproxy.parkqueue: must not be negative",
+				"sshproxy.port: invalid port 70000",
+				`sshproxy.prefer_family: must be ipv4, ipv6 or auto, not "ipv5"`,
+				`sshproxy.remote: invalid port "99999"`,
+				"startup.workers: must not be negative",
+			},
+		},
+	} {
+		readTestConfig(t, tt.doc)
+		_, err := decodeConfig(viper.GetViper())
+		errs, ok := err.(configErrors)
+		if !ok {
+			t.Errorf("%s: got %v", tt.name, err)
+			continue
+		}
+		if len(errs) != len(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, []string(errs), tt.want)
+			continue
+		}
+		for i, want := range tt.want {
+			if !strings.HasPrefix(errs[i], want) {
+				t.Errorf("%s: got %q, want %q", tt.name, errs[i], want)
+			}
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"user", "user", 0},
+		{"uesr", "user", 1},
+		{"usr", "user", 1},
+		{"remtoe", "remote", 1},
+		{"host", "port", 2},
+		{"", "abc", 3},
+	} {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
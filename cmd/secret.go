@@ -0,0 +1,119 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/elliotpeele/sshhttpproxy/secrets"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// secretCmd groups commands that manage encrypted config values.
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Manage encrypted config values",
+}
+
+var secretInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create the key encrypted config values are decrypted with",
+	Long: `Create a random key and store it in the keyring of the operating system.
+Values encrypted with it can only be decrypted on machines that have the same
+key, copy it with the SSHHTTPPROXY_SECRET_KEY environment variable.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		force, _ := cmd.Flags().GetBool("force")
+		if _, err := secrets.LoadKey(); err == nil && !force {
+			return errors.New("a secret key already exists, use --force to replace it")
+		}
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			return err
+		}
+		if err := secrets.StoreKey(key); err != nil {
+			return err
+		}
+		fmt.Println("stored a new secret key in the keyring")
+		return nil
+	},
+}
+
+var secretEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt a value read from stdin for use in the config file",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := secrets.LoadKey()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "enter the value to encrypt:")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		value, err := secrets.Encrypt(key, strings.TrimRight(line, "\r\n"))
+		if err != nil {
+			return err
+		}
+		fmt.Println(value)
+		return nil
+	},
+}
+
+// secretResolver replaces encrypted config values and references to
+// external secret managers with their plain text. The key is only loaded
+// once a value needs it.
+type secretResolver struct {
+	key []byte
+}
+
+func (r *secretResolver) resolveString(s string) (string, error) {
+	if secrets.IsReference(s) {
+		return secrets.Resolve(s)
+	}
+	if !secrets.IsEncrypted(s) {
+		return s, nil
+	}
+	if r.key == nil {
+		key, err := secrets.LoadKey()
+		if err != nil {
+			return "", err
+		}
+		r.key = key
+	}
+	return secrets.Decrypt(r.key, s)
+}
+
+// secretPaths are the paths of the values of the loaded config that held
+// secrets, which config show redacts whatever their keys. Like settings,
+// it is guarded by configMu.
+var secretPaths map[string]bool
+
+// resolveSecrets replaces secrets anywhere in the config in v with their
+// plain text values and returns the paths of the values it replaced.
+func resolveSecrets(v *viper.Viper) (map[string]bool, error) {
+	r := &secretResolver{}
+	paths := make(map[string]bool)
+	err := rewriteConfig(v, func(path, s string) (string, error) {
+		plain, err := r.resolveString(s)
+		if plain != s {
+			paths[path] = true
+		}
+		return plain, err
+	})
+	return paths, err
+}
+
+func init() {
+	secretInitCmd.Flags().Bool("force", false, "replace an existing key")
+	secretCmd.AddCommand(secretInitCmd)
+	secretCmd.AddCommand(secretEncryptCmd)
+	rootCmd.AddCommand(secretCmd)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"encoding/hex"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/elliotpeele/sshhttpproxy/secrets"
+	"github.com/spf13/viper"
+)
+
+// setenv sets the environment variable name to value for the rest of the
+// test.
+func setenv(t *testing.T, name, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// readTestConfig replaces the config with the YAML document doc for the
+// rest of the test.
+func readTestConfig(t *testing.T, doc string) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	// Read the config from the global instance, even after a reload.
+	configMu.Lock()
+	loadedViper = nil
+	configMu.Unlock()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(doc)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testSecretKey stores a new key in the environment and returns it.
+func testSecretKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, secrets.KeyEnv, hex.EncodeToString(key))
+	return key
+}
+
+func encrypt(t *testing.T, key []byte, plaintext string) string {
+	t.Helper()
+	value, err := secrets.Encrypt(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestResolveSecrets(t *testing.T) {
+	key := testSecretKey(t)
+	readTestConfig(t, `
+sshproxy:
+  user: elliot
+  passphrase: `+encrypt(t, key, "top secret")+`
+forwards:
+  - name: api
+    headers:
+      request:
+        - set: Authorization
+          value: `+encrypt(t, key, "Bearer abc")+`
+    hosts: [`+encrypt(t, key, "a.internal")+`, b.internal]
+`)
+	if _, err := resolveSecrets(viper.GetViper()); err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("sshproxy.passphrase"); got != "top secret" {
+		t.Errorf("passphrase %q", got)
+	}
+	if got := viper.GetString("sshproxy.user"); got != "elliot" {
+		t.Errorf("plain value changed to %q", got)
+	}
+	forwards, ok := viper.Get("forwards").([]interface{})
+	if !ok || len(forwards) != 1 {
+		t.Fatalf("forwards %#v", viper.Get("forwards"))
+	}
+	fwd, ok := forwards[0].(map[interface{}]interface{})
+	if !ok {
+		t.Fatalf("forward %#v", forwards[0])
+	}
+	if hosts := fwd["hosts"]; !reflect.DeepEqual(hosts, []interface{}{"a.internal", "b.internal"}) {
+		t.Errorf("hosts %#v", hosts)
+	}
+	rule := fwd["headers"].(map[interface{}]interface{})["request"].([]interface{})[0].(map[interface{}]interface{})
+	if rule["value"] != "Bearer abc" {
+		t.Errorf("header value %#v", rule["value"])
+	}
+}
+
+func TestResolveSecretsErrors(t *testing.T) {
+	testSecretKey(t)
+	other, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		doc  string
+		want string
+	}{
+		{"sshproxy:\n  passphrase: " + encrypt(t, other, "x") + "\n", "sshproxy.passphrase: decrypting value failed"},
+		{"forwards:\n  - name: api\n    token: enc:!!!\n", "forwards.0: token: malformed encrypted value"},
+	} {
+		readTestConfig(t, tt.doc)
+		_, err := resolveSecrets(viper.GetViper())
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("got %v, want %q", err, tt.want)
+		}
+	}
+}
+
+func TestResolveSecretsLoadsKeyOnDemand(t *testing.T) {
+	setenv(t, secrets.KeyEnv, "not a key")
+	readTestConfig(t, "sshproxy:\n  user: elliot\n")
+	// Configs without encrypted values do not need a key.
+	if _, err := resolveSecrets(viper.GetViper()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"github.com/spf13/viper"
+)
+
+// serverForwardsDoc is what a forwards command prints, a config file with
+// only a forwards list.
+type serverForwardsDoc struct {
+	Forwards []forwardConfig
+}
+
+// forwardsCommands returns the forwards commands of the default host and
+// the hosts map by host.
+func forwardsCommands(ps *proxySet) map[string]string {
+	commands := make(map[string]string)
+	if command := currentSettings().SSHProxy.ForwardsCommand; command != "" {
+		commands[defaultHost] = command
+	}
+	for name, host := range ps.hosts {
+		if host.ForwardsCommand != "" {
+			commands[name] = host.ForwardsCommand
+		}
+	}
+	return commands
+}
+
+// startServerForwards runs the forwards command of every host that has one
+// on its ssh server and starts the forwards it prints.
+func startServerForwards(ps *proxySet, m *forwardManager) error {
+	commands := forwardsCommands(ps)
+	hosts := make([]string, 0, len(commands))
+	for host := range commands {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var jobs []startJob
+	for _, host := range hosts {
+		host, command := host, commands[host]
+		jobs = append(jobs, startJob{"forwards of " + host, func() error {
+			p, err := ps.ensure(host)
+			if err != nil {
+				return err
+			}
+			forwards, err := fetchServerForwards(p, host, command)
+			if err != nil {
+				return fmt.Errorf("forwards of %s: %w", host, err)
+			}
+			return m.addServerForwards(host, forwards)
+		}})
+	}
+	return ps.startAll(jobs)
+}
+
+// fetchServerForwards runs command on the ssh server of p and returns the
+// forwards it prints, through host.
+func fetchServerForwards(p *proxy.SSHProxy, host, command string) ([]forwardConfig, error) {
+	client, err := p.WaitClient()
+	if err != nil {
+		return nil, err
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	out, err := sess.Output(command)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%s: %s", err, msg)
+		}
+		return nil, fmt.Errorf("running %s: %s", command, err)
+	}
+	return parseServerForwards(out, host)
+}
+
+// parseServerForwards parses the output of a forwards command, a YAML or
+// JSON document with a forwards list like the config file.
+func parseServerForwards(out []byte, host string) ([]forwardConfig, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(out)); err != nil {
+		return nil, err
+	}
+	if msgs := unknownKeys(v.AllSettings(), reflect.TypeOf(serverForwardsDoc{}), ""); len(msgs) > 0 {
+		return nil, errors.New(strings.Join(msgs, "; "))
+	}
+	var doc serverForwardsDoc
+	if err := v.Unmarshal(&doc); err != nil {
+		return nil, err
+	}
+	for i := range doc.Forwards {
+		fwd := &doc.Forwards[i]
+		if err := checkServerForward(*fwd); err != nil {
+			return nil, fmt.Errorf("forwards[%d]: %s", i, err)
+		}
+		if host != defaultHost {
+			fwd.Host = host
+		}
+		if err := checkForward(fwd); err != nil {
+			return nil, fmt.Errorf("forwards[%d]: %s", i, err)
+		}
+	}
+	return doc.Forwards, nil
+}
+
+// checkServerForward checks that fwd, from a forwards command, only sets
+// what cannot reach beyond the forward itself: nothing that runs local
+// commands, reads local files or listens elsewhere than on loopback.
+func checkServerForward(fwd forwardConfig) error {
+	allowed := forwardConfig{
+		Name:     fwd.Name,
+		Local:    fwd.Local,
+		Remote:   fwd.Remote,
+		Mode:     fwd.Mode,
+		SNI:      fwd.SNI,
+		Routes:   fwd.Routes,
+		Headers:  fwd.Headers,
+		Timeouts: fwd.Timeouts,
+		Priority: fwd.Priority,
+		Watch:    fwd.Watch,
+	}
+	if !reflect.DeepEqual(allowed, fwd) {
+		return errors.New("only name, local, remote, mode, sni, routes, headers, timeouts, priority and watch can be set by the server")
+	}
+	if strings.Contains(fwd.Local, ":") {
+		return errors.New("local: must be a port, forwards of the server listen on loopback")
+	}
+	if fwd.Mode == "transparent" {
+		return errors.New("mode: transparent cannot be set by the server")
+	}
+	return nil
+}
+
+// addServerForwards starts the forwards a forwards command of host printed.
+// Forwards named like one in the config are left to the config, and those
+// already started are skipped, so it can be retried.
+func (m *forwardManager) addServerForwards(host string, forwards []forwardConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make(map[string]bool)
+	for _, fwd := range m.forwards {
+		names[fwd.Name] = true
+	}
+	for _, fwd := range forwards {
+		if names[fwd.Name] {
+			if !m.isServed(fwd.Name) {
+				logger.Warningf("forward %s of %s is also in the config, using the config", fwd.Name, host)
+			}
+			continue
+		}
+		if err := m.startForward(fwd); err != nil {
+			return fmt.Errorf("%s: %w", fwd.Name, err)
+		}
+		names[fwd.Name] = true
+		m.forwards = append(m.forwards, fwd)
+		m.served = append(m.served, fwd)
+		logger.Infof("forward %s added by %s", fwd.Name, host)
+	}
+	return nil
+}
+
+// isServed reports whether the forward name came from a forwards command.
+func (m *forwardManager) isServed(name string) bool {
+	for _, fwd := range m.served {
+		if fwd.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withServed returns forwards, from the config, with the forwards from
+// forwards commands that are not named like one of them.
+func (m *forwardManager) withServed(forwards []forwardConfig) []forwardConfig {
+	names := make(map[string]bool)
+	for _, fwd := range forwards {
+		names[fwd.Name] = true
+	}
+	for _, fwd := range m.served {
+		if !names[fwd.Name] {
+			forwards = append(forwards, fwd)
+		}
+	}
+	return forwards
+}
@@ -0,0 +1,185 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+)
+
+// launchdLabel is the label of the launchd job, suffixed with the profile
+// if there is one.
+const launchdLabel = "net.bentlogic.sshhttpproxy"
+
+// systemdUnit is a unit of Type=notify: the process reports when its
+// forwards are up and pings the watchdog. NotifyAccess=all lets a process
+// started by an upgrade report as well.
+var systemdUnit = template.Must(template.New("systemd").Funcs(template.FuncMap{
+	"quote": systemdQuote,
+}).Parse(`[Unit]
+Description=SSH HTTP proxy{{ if .Profile }} ({{ .Profile }}){{ end }}
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=all
+ExecStart={{ range $i, $arg := .Args }}{{ if $i }} {{ end }}{{ quote $arg }}{{ end }}
+ExecReload=/bin/kill -HUP $MAINPID
+WorkingDirectory={{ quote .Dir }}
+Restart=on-failure
+RestartSec=5
+WatchdogSec=30
+
+[Install]
+WantedBy=default.target
+`))
+
+// launchdPlist is a job started at login and restarted if it fails.
+var launchdPlist = template.Must(template.New("launchd").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{ html .Label }}</string>
+	<key>ProgramArguments</key>
+	<array>
+{{- range .Args }}
+		<string>{{ html . }}</string>
+{{- end }}
+	</array>
+	<key>WorkingDirectory</key>
+	<string>{{ html .Dir }}</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer>5</integer>
+	<key>StandardErrorPath</key>
+	<string>{{ html .Log }}</string>
+</dict>
+</plist>
+`))
+
+// serviceData describes the service to generate.
+type serviceData struct {
+	Profile string
+	Label   string
+	// Args is the command line, starting with the binary.
+	Args []string
+	Dir  string
+	Log  string
+}
+
+// systemdQuote quotes s for a systemd unit file if needed, see
+// systemd.syntax(7). Specifiers and variables are escaped as well.
+func systemdQuote(s string) string {
+	s = strings.Replace(s, "%", "%%", -1)
+	s = strings.Replace(s, "$", "$$", -1)
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// newServiceData describes a service running the current binary with the
+// current profile and config file, in the working directory so the same
+// project config is found.
+func newServiceData() (*serviceData, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return nil, err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return nil, err
+	}
+	data := &serviceData{
+		Profile: currentSettings().Profile,
+		Label:   launchdLabel,
+		Args:    []string{exe},
+		Dir:     dir,
+		Log:     filepath.Join(home, "Library", "Logs", "sshhttpproxy.log"),
+	}
+	if cfgFile != "" {
+		path, err := filepath.Abs(cfgFile)
+		if err != nil {
+			return nil, err
+		}
+		data.Args = append(data.Args, "--config", path)
+	}
+	if configURL != "" {
+		data.Args = append(data.Args, "--config-url", configURL)
+	}
+	if data.Profile != "" {
+		data.Args = append(data.Args, "--profile", data.Profile)
+		data.Label += "." + data.Profile
+		data.Log = filepath.Join(home, "Library", "Logs", "sshhttpproxy-"+data.Profile+".log")
+	}
+	return data, nil
+}
+
+// serviceCmd groups commands that run the proxy as a service.
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Run the proxy as a system service",
+}
+
+var serviceGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Print a systemd unit or launchd plist running the proxy",
+	Long: `Print a systemd unit or launchd plist that runs this binary with the current
+profile and config file, restarting it if it fails. The default is launchd on
+macOS and systemd elsewhere.
+
+  sshhttpproxy service generate --systemd > ~/.config/systemd/user/sshhttpproxy.service
+  systemctl --user enable --now sshhttpproxy
+
+  sshhttpproxy service generate --launchd > ~/Library/LaunchAgents/net.bentlogic.sshhttpproxy.plist
+  launchctl load ~/Library/LaunchAgents/net.bentlogic.sshhttpproxy.plist`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		systemd, _ := cmd.Flags().GetBool("systemd")
+		launchd, _ := cmd.Flags().GetBool("launchd")
+		if systemd && launchd {
+			return errors.New("--systemd and --launchd are exclusive")
+		}
+		if !systemd && !launchd {
+			launchd = runtime.GOOS == "darwin"
+		}
+		data, err := newServiceData()
+		if err != nil {
+			return err
+		}
+		if launchd {
+			return launchdPlist.Execute(os.Stdout, data)
+		}
+		return systemdUnit.Execute(os.Stdout, data)
+	},
+}
+
+func init() {
+	serviceGenerateCmd.Flags().Bool("systemd", false, "generate a systemd unit")
+	serviceGenerateCmd.Flags().Bool("launchd", false, "generate a launchd plist")
+	serviceCmd.AddCommand(serviceGenerateCmd)
+	rootCmd.AddCommand(serviceCmd)
+}
@@ -0,0 +1,138 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// redacted replaces secrets in the output of config show.
+const redacted = "<redacted>"
+
+// secretKeys are the keys whose values are secrets, wherever they are.
+var secretKeys = map[string]bool{
+	"password":       true,
+	"passphrase":     true,
+	"privatekeydata": true,
+	"consul_token":   true,
+}
+
+// secretFields are keys whose values are secrets only under a parent key,
+// as parent.key: the pin of a PKCS#11 token is, the certificate pin of
+// remotetls is not.
+var secretFields = map[string]bool{
+	"pkcs11.pin": true,
+}
+
+// secretHeaders are the headers whose values header rules must not show.
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Api-Key":           true,
+}
+
+// redactConfig returns a copy of v with the non-empty values of
+// secretKeys and secretFields, the values of header rules for
+// secretHeaders, and the values at the resolved paths, where secrets were
+// decrypted or looked up, replaced with redacted. v itself, which may be
+// shared with viper, is left alone.
+func redactConfig(v interface{}, resolved map[string]bool) interface{} {
+	return redactPath("", "", v, resolved)
+}
+
+// redactPath redacts v, found under key at path.
+func redactPath(path, key string, v interface{}, resolved map[string]bool) interface{} {
+	if v != nil && fmt.Sprint(v) != "" && isSecret(path, key, resolved) {
+		return redacted
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = redactPath(joinPath(path, k), k, item, resolved)
+		}
+		if name, ok := out["name"].(string); ok && secretHeaders[http.CanonicalHeaderKey(name)] && out["value"] != nil {
+			out["value"] = redacted
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(v))
+		for k, item := range v {
+			name := fmt.Sprint(k)
+			out[k] = redactPath(joinPath(path, name), name, item, resolved)
+		}
+		if name, ok := out["name"].(string); ok && secretHeaders[http.CanonicalHeaderKey(name)] && out["value"] != nil {
+			out["value"] = redacted
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redactPath(joinPath(path, strconv.Itoa(i)), key, item, resolved)
+		}
+		return out
+	}
+	return v
+}
+
+// isSecret reports whether the value under key at path is a secret.
+func isSecret(path, key string, resolved map[string]bool) bool {
+	if resolved[path] || secretKeys[strings.ToLower(key)] {
+		return true
+	}
+	parts := strings.Split(strings.ToLower(path), ".")
+	return len(parts) >= 2 && secretFields[strings.Join(parts[len(parts)-2:], ".")]
+}
+
+// writeEffectiveConfig writes the merged config as YAML, after the list of
+// files it was merged from.
+func writeEffectiveConfig(w io.Writer, redact bool) error {
+	configMu.RLock()
+	files, paths := configFiles, secretPaths
+	configMu.RUnlock()
+	var all interface{} = conf().AllSettings()
+	if redact {
+		all = redactConfig(all, paths)
+	}
+	out, err := yaml.Marshal(all)
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		if _, err := fmt.Fprintf(w, "# merged from %s\n", path); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the effective config",
+	Long: `Print the config as it is used: the config files merged, with environment
+variables, flags, templates and secrets applied, including the defaults of
+the flags. Passwords, passphrases, private keys, tokens, credentials in
+header rules and all values that were encrypted or referenced a secret
+manager are redacted unless --redact=false is given.`,
+	Annotations: map[string]string{rawConfigAnnotation: "true"},
+	Args:        cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		redact, _ := cmd.Flags().GetBool("redact")
+		return writeEffectiveConfig(os.Stdout, redact)
+	},
+}
+
+func init() {
+	configShowCmd.Flags().Bool("redact", true, "hide secrets")
+	configCmd.AddCommand(configShowCmd)
+}
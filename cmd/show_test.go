@@ -0,0 +1,123 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestRedactConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		doc      string
+		resolved []string
+		want     string
+	}{
+		{
+			name: "secret keys",
+			doc:  "sshproxy:\n  user: elliot\n  password: hunter2\n  passphrase: \"\"\n  consul_token: abc\n",
+			want: "sshproxy:\n  user: elliot\n  password: <redacted>\n  passphrase: \"\"\n  consul_token: <redacted>\n",
+		},
+		{
+			name: "nested maps",
+			doc:  "hosts:\n  prod:\n    remote: prod:22\n    password: hunter2\n",
+			want: "hosts:\n  prod:\n    remote: prod:22\n    password: <redacted>\n",
+		},
+		{
+			name: "lists",
+			doc:  "forwards:\n- name: api\n  upstream:\n    username: bob\n    password: hunter2\n",
+			want: "forwards:\n- name: api\n  upstream:\n    username: bob\n    password: <redacted>\n",
+		},
+		{
+			name: "header rules",
+			doc: "forwards:\n- headers:\n    request:\n    - action: set\n      name: authorization\n      value: Bearer abc\n" +
+				"    - action: set\n      name: X-Trace\n      value: \"1\"\n",
+			want: "forwards:\n- headers:\n    request:\n    - action: set\n      name: authorization\n      value: <redacted>\n" +
+				"    - action: set\n      name: X-Trace\n      value: \"1\"\n",
+		},
+		{
+			name: "pins",
+			doc:  "sshproxy:\n  pkcs11:\n    pin: \"1234\"\nforwards:\n- remotetls:\n    pin: sha256/abc\n",
+			want: "sshproxy:\n  pkcs11:\n    pin: <redacted>\nforwards:\n- remotetls:\n    pin: sha256/abc\n",
+		},
+		{
+			name: "decrypted values",
+			doc: "forwards:\n- name: api\n  upstream:\n    username: bob\n  headers:\n    request:\n" +
+				"    - action: set\n      name: X-Auth-Token\n      value: s3cret\n",
+			resolved: []string{"forwards.0.upstream.username", "forwards.0.headers.request.0.value"},
+			want: "forwards:\n- name: api\n  upstream:\n    username: <redacted>\n  headers:\n    request:\n" +
+				"    - action: set\n      name: X-Auth-Token\n      value: <redacted>\n",
+		},
+	} {
+		var got map[string]interface{}
+		if err := yaml.Unmarshal([]byte(tt.doc), &got); err != nil {
+			t.Fatal(err)
+		}
+		resolved := make(map[string]bool)
+		for _, path := range tt.resolved {
+			resolved[path] = true
+		}
+		orig := fmt.Sprint(got)
+		redacted := redactConfig(got, resolved)
+		if fmt.Sprint(got) != orig {
+			t.Errorf("%s: config changed in place", tt.name)
+		}
+		var want map[string]interface{}
+		if err := yaml.Unmarshal([]byte(tt.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(redacted, want) {
+			out, _ := yaml.Marshal(redacted)
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, out, tt.want)
+		}
+	}
+}
+
+func TestShowRedactsSecrets(t *testing.T) {
+	key := testSecretKey(t)
+	readTestConfig(t, `
+forwards:
+  - name: api
+    upstream:
+      username: `+encrypt(t, key, "upstream-user")+`
+    headers:
+      request:
+        - action: set
+          name: X-Auth-Token
+          value: `+encrypt(t, key, "token-value")+`
+`)
+	paths, err := resolveSecrets(viper.GetViper())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := secretPaths
+	t.Cleanup(func() { secretPaths = saved })
+	secretPaths = paths
+	var buf bytes.Buffer
+	if err := writeEffectiveConfig(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"upstream-user", "token-value"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("config show prints %q:\n%s", secret, buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), "X-Auth-Token") {
+		t.Errorf("header name redacted:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := writeEffectiveConfig(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "token-value") {
+		t.Errorf("--redact=false hides decrypted values:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal makes the process hand its listeners to a new one.
+var upgradeSignal os.Signal = syscall.SIGUSR2
+
+// processAlive reports whether the process pid exists, by sending it
+// signal 0.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,20 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import "os"
+
+// upgradeSignal is not available on Windows, which cannot pass listening
+// sockets to another process this way.
+var upgradeSignal os.Signal
+
+// processAlive reports whether the process pid exists, which FindProcess
+// opens on Windows.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
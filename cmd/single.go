@@ -6,11 +6,13 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
 func setupSignalHandler(ctx context.Context, cancel context.CancelFunc) {
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
+	// Service managers stop services with SIGTERM.
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	select {
 	case s := <-ch:
 		logger.Infof("Received signal %s; aborting", s)
@@ -0,0 +1,174 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+)
+
+// startupPolicy decides what happens when connecting or binding a forward
+// fails.
+type startupPolicy int
+
+const (
+	// policyOnce tries everything once and exits on the first error.
+	policyOnce startupPolicy = iota
+	// policyFailFast is policyOnce, but also exits when an ssh connection
+	// is lost later on.
+	policyFailFast
+	// policyRetryForever retries failed connects and binds in the
+	// background and reconnects lost connections.
+	policyRetryForever
+)
+
+const (
+	retryMinBackoff = time.Second
+	retryMaxBackoff = time.Minute
+)
+
+// defaultStartupWorkers is how many forwards are set up or probed at once
+// unless startup.workers says otherwise.
+const defaultStartupWorkers = 8
+
+// startupPolicyFromFlags returns the policy selected on the command line.
+func startupPolicyFromFlags(failFast, retryForever bool) (startupPolicy, error) {
+	switch {
+	case failFast && retryForever:
+		return 0, errors.New("--fail-fast and --retry-forever are mutually exclusive")
+	case failFast:
+		return policyFailFast, nil
+	case retryForever:
+		return policyRetryForever, nil
+	}
+	return policyOnce, nil
+}
+
+// retry calls fn until it succeeds or ctx is done, backing off
+// exponentially between attempts.
+func retry(ctx context.Context, what string, fn func() error) {
+	backoff := retryMinBackoff
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		logger.Warningf("%s failed, retrying in %s: %s", what, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// start runs fn, in the background with retries if the policy asks for
+// it.
+func (s *proxySet) start(what string, fn func() error) error {
+	if s.policy != policyRetryForever {
+		return fn()
+	}
+	go retry(s.ctx, what, fn)
+	return nil
+}
+
+// startupWorkers returns how many forwards are set up or probed at once.
+func startupWorkers() int {
+	if n := currentSettings().Startup.Workers; n > 0 {
+		return n
+	}
+	return defaultStartupWorkers
+}
+
+// parallel calls fn for every i below count, on up to workers goroutines
+// at a time, and returns the first error. No calls are started after one
+// failed.
+func parallel(workers, count int, fn func(i int) error) error {
+	sem := make(chan struct{}, workers)
+	errc := make(chan error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		sem <- struct{}{}
+		if len(errc) > 0 {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := fn(i); err != nil {
+				errc <- err
+			}
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	return <-errc
+}
+
+// startJob is a forward to set up with start.
+type startJob struct {
+	what string
+	fn   func() error
+}
+
+// startAll starts jobs concurrently, see start, and returns the first
+// error.
+func (s *proxySet) startAll(jobs []startJob) error {
+	return parallel(startupWorkers(), len(jobs), func(i int) error {
+		return s.start(jobs[i].what, jobs[i].fn)
+	})
+}
+
+// keepConnected connects p and reconnects it whenever the connection is
+// lost, until the context of s is done or p is released.
+func (s *proxySet) keepConnected(name string, p *proxy.SSHProxy) {
+	events, unsubscribe := p.Events()
+	defer unsubscribe()
+	for {
+		retry(s.ctx, "connecting to "+name, func() error {
+			if !s.current(name, p) {
+				return nil
+			}
+			return s.dial(name, p)
+		})
+		ev, ok := waitEvent(events, proxy.EventDisconnected)
+		if !ok || s.ctx.Err() != nil || !s.current(name, p) {
+			return
+		}
+		logger.Warningf("lost connection to %s: %v", name, ev.Err)
+	}
+}
+
+// waitEvent waits for an event of type t. It returns false if events is
+// closed first.
+func waitEvent(events <-chan proxy.Event, t proxy.EventType) (proxy.Event, bool) {
+	for ev := range events {
+		if ev.Type == t {
+			return ev, true
+		}
+	}
+	return proxy.Event{}, false
+}
+
+// exitOnDisconnect reports the first lost connection in events as fatal.
+// A connection closed by release is not lost.
+func (s *proxySet) exitOnDisconnect(name string, p *proxy.SSHProxy, events <-chan proxy.Event) {
+	ev, ok := waitEvent(events, proxy.EventDisconnected)
+	if !ok || s.ctx.Err() != nil || !s.current(name, p) {
+		return
+	}
+	select {
+	case s.fatal <- fmt.Errorf("lost connection to %s: %v", name, ev.Err):
+	default:
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStartupWorkers(t *testing.T) {
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.Startup.Workers = 0
+	if n := startupWorkers(); n != defaultStartupWorkers {
+		t.Errorf("got %d workers without a setting, want %d", n, defaultStartupWorkers)
+	}
+	settings.Startup.Workers = 3
+	if n := startupWorkers(); n != 3 {
+		t.Errorf("got %d workers, want 3", n)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	var running, most int32
+	var mu sync.Mutex
+	done := make(map[int]bool)
+	err := parallel(4, 20, func(i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		mu.Lock()
+		if n > most {
+			most = n
+		}
+		done[i] = true
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 20 {
+		t.Errorf("ran %d of 20 calls", len(done))
+	}
+	if most < 2 || most > 4 {
+		t.Errorf("ran %d calls at once, want up to 4", most)
+	}
+
+	failed := errors.New("failed")
+	var calls int32
+	err = parallel(1, 10, func(i int) error {
+		atomic.AddInt32(&calls, 1)
+		if i == 2 {
+			return failed
+		}
+		return nil
+	})
+	if err != failed {
+		t.Errorf("got %v, want %v", err, failed)
+	}
+	if calls != 3 {
+		t.Errorf("made %d calls, want none after the failed one", calls)
+	}
+}
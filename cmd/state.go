@@ -0,0 +1,314 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// stateInterval is how often the state of the forwards is recorded.
+const stateInterval = 10 * time.Second
+
+// mergedConfig is the last config loaded, as merged from the config files
+// before templates and secrets were applied. Like settings, it is guarded
+// by configMu.
+var mergedConfig []byte
+
+// profileState is the state directory of a profile, which lets a restarted
+// process carry on where the last one left off. It holds:
+//
+//	running      the pid of the process using it, removed on a clean exit
+//	state.json   the local addresses, enabled groups and paused forwards
+//	known_hosts  the host keys of the ssh servers, accepted on first use
+//	config.yaml  the last config that started or reloaded successfully
+type profileState struct {
+	dir string
+	// crashed is set if the last process to use the directory did not
+	// exit cleanly.
+	crashed bool
+	saved   savedState
+
+	mu sync.Mutex
+}
+
+// savedState is the content of state.json.
+type savedState struct {
+	// Ports are the local addresses of the forwards by name.
+	Ports map[string]string `json:"ports"`
+	// Groups are the groups of forwards that were enabled or disabled.
+	Groups map[string]bool `json:"groups,omitempty"`
+	// Paused are the names of the paused forwards.
+	Paused []string `json:"paused,omitempty"`
+}
+
+// profileStateDir returns the state directory of the profile. It reads
+// viper directly, as it is also needed when the config fails to load.
+func profileStateDir() (string, error) {
+	v := conf()
+	dir := os.ExpandEnv(v.GetString("state.dir"))
+	if dir == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".sshhttpproxy", "state")
+	}
+	profile := strings.ToLower(v.GetString("profile"))
+	if profile == "" {
+		profile = "default"
+	}
+	return filepath.Join(dir, profile), nil
+}
+
+// crashedBefore reports whether the last process using the state directory
+// of the profile did not exit cleanly.
+func crashedBefore() bool {
+	dir, err := profileStateDir()
+	if err != nil {
+		return false
+	}
+	return leftRunning(dir)
+}
+
+// leftRunning reports whether the running file in dir was left by a
+// process that is gone. A process still alive, such as another instance
+// of the profile, did not crash.
+func leftRunning(dir string) bool {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "running"))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return true
+	}
+	return pid != os.Getpid() && !processAlive(pid)
+}
+
+// openProfileState opens the state directory of the profile, creating it if
+// needed, and marks it as in use. A process started by an upgrade takes
+// over from one that is still running, which did not crash.
+func openProfileState() (*profileState, error) {
+	dir, err := profileStateDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	st := &profileState{dir: dir, saved: savedState{Ports: make(map[string]string)}}
+	if leftRunning(dir) && os.Getenv(upgradeFdEnv) == "" {
+		st.crashed = true
+	}
+	buf, err := ioutil.ReadFile(st.path("state.json"))
+	if err == nil {
+		if err := json.Unmarshal(buf, &st.saved); err != nil {
+			logger.Warningf("%s: %s", st.path("state.json"), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if st.saved.Ports == nil {
+		st.saved.Ports = make(map[string]string)
+	}
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	if err := ioutil.WriteFile(st.path("running"), pid, 0600); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *profileState) path(name string) string {
+	return filepath.Join(st.dir, name)
+}
+
+// close marks the state directory as cleanly left, unless another process
+// took it over in an upgrade.
+func (st *profileState) close() {
+	buf, err := ioutil.ReadFile(st.path("running"))
+	if err == nil && strings.TrimSpace(string(buf)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(st.path("running"))
+	}
+}
+
+// port returns the local address the forward name had last time if it
+// listened on a random port then, or "".
+func (st *profileState) port(name string) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.saved.Ports[name]
+}
+
+// record saves the local addresses of the forwards of m, the groups it has
+// enabled and the forwards that are paused.
+func (st *profileState) record(m *forwardManager) error {
+	saved := savedState{Ports: make(map[string]string), Groups: make(map[string]bool)}
+	for _, status := range m.ps.Forwards() {
+		if status.Reverse {
+			continue
+		}
+		saved.Ports[status.Name] = status.Local
+		if status.Paused {
+			saved.Paused = append(saved.Paused, status.Name)
+		}
+	}
+	for _, group := range m.Groups() {
+		saved.Groups[group.Name] = group.Enabled
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	// Keep the ports of forwards that are not running, such as those of
+	// disabled groups, for when they start again.
+	for name, addr := range st.saved.Ports {
+		if _, ok := saved.Ports[name]; !ok {
+			saved.Ports[name] = addr
+		}
+	}
+	st.saved = saved
+	buf, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(st.path("state.json"), append(buf, '\n'), 0600)
+}
+
+// recordEvery records the state of m every stateInterval until ctx is
+// done.
+func (st *profileState) recordEvery(ctx context.Context, m *forwardManager) {
+	ticker := time.NewTicker(stateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := st.record(m); err != nil {
+			logger.Warningf("recording state: %s", err)
+		}
+	}
+}
+
+// restoreGroups enables and disables the groups of m as recorded, after a
+// crash, before the forwards are started.
+func (st *profileState) restoreGroups(m *forwardManager) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for group, enabled := range st.saved.Groups {
+		if _, ok := m.enabled[group]; ok {
+			m.enabled[group] = enabled
+		}
+	}
+}
+
+// restorePaused pauses the forwards recorded as paused, after a crash,
+// once the forwards are started.
+func (st *profileState) restorePaused(ps *proxySet) {
+	st.mu.Lock()
+	paused := st.saved.Paused
+	st.mu.Unlock()
+	for _, name := range paused {
+		if err := ps.Pause(name); err != nil {
+			logger.Warningf("pausing %s again: %s", name, err)
+		}
+	}
+}
+
+// saveConfig keeps the config last loaded as the last known good one.
+func (st *profileState) saveConfig() error {
+	configMu.RLock()
+	merged := mergedConfig
+	configMu.RUnlock()
+	if merged == nil {
+		return nil
+	}
+	return writeFileAtomic(st.path("config.yaml"), merged, 0600)
+}
+
+// loadLastGoodConfig loads the config saved by saveConfig instead of the
+// config files.
+func loadLastGoodConfig() (string, error) {
+	dir, err := profileStateDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	explicit := cfgFile
+	defer func() { cfgFile = explicit }()
+	cfgFile = path
+	return path, reloadConfig()
+}
+
+// hostKeyCallback accepts the host key of an ssh server the first time it
+// is seen and adds it to known_hosts, and from then on only that key.
+func (st *profileState) hostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		path := st.path("known_hosts")
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		check, err := knownhosts.New(path)
+		if err != nil {
+			return err
+		}
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("%w; if the server key changed on purpose, remove it from %s", err, path)
+		}
+		line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+		if _, err := fmt.Fprintln(f, line); err != nil {
+			return err
+		}
+		logger.Infof("accepted %s host key %s of %s", key.Type(), ssh.FingerprintSHA256(key), hostname)
+		return nil
+	}
+}
+
+// writeFileAtomic replaces the file at path with buf, so readers and a
+// crash never leave it half written.
+func writeFileAtomic(path string, buf []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
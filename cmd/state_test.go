@@ -0,0 +1,156 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testStateDir makes a new directory the state directory of the default
+// profile for the rest of the test, and returns the directory of the
+// profile.
+func testStateDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	readTestConfig(t, "state:\n  dir: "+dir+"\n")
+	return filepath.Join(dir, "default")
+}
+
+// exitedPid returns the pid of a process that has exited.
+func exitedPid(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestProfileStateCrashed(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		running string
+		crashed bool
+	}{
+		{name: "clean exit"},
+		{name: "exited", running: strconv.Itoa(exitedPid(t)) + "\n", crashed: true},
+		{name: "still running", running: strconv.Itoa(os.Getppid()) + "\n"},
+		{name: "corrupt", running: "not a pid\n", crashed: true},
+	} {
+		dir := testStateDir(t)
+		if tt.running != "" {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "running"), []byte(tt.running), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := crashedBefore(); got != tt.crashed {
+			t.Errorf("%s: crashedBefore got %v, want %v", tt.name, got, tt.crashed)
+		}
+		st, err := openProfileState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.crashed != tt.crashed {
+			t.Errorf("%s: crashed got %v, want %v", tt.name, st.crashed, tt.crashed)
+		}
+		st.close()
+		if _, err := os.Stat(filepath.Join(dir, "running")); !os.IsNotExist(err) {
+			t.Errorf("%s: running left after close: %v", tt.name, err)
+		}
+	}
+}
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := &profileState{dir: dir}
+	check := st.hostKeyCallback()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	key, other := newHostKey(t), newHostKey(t)
+
+	// The first key of a server is recorded.
+	if err := check("bastion:22", remote, key); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	buf, err := ioutil.ReadFile(st.path("known_hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := knownhosts.Line([]string{"bastion"}, key); strings.TrimSpace(string(buf)) != want {
+		t.Errorf("got known_hosts %q, want %q", buf, want)
+	}
+
+	// It is accepted again, without recording it twice.
+	if err := check("bastion:22", remote, key); err != nil {
+		t.Errorf("known key: %v", err)
+	}
+	// Another server gets its own key.
+	if err := check("other:2222", remote, other); err != nil {
+		t.Errorf("second server: %v", err)
+	}
+	after, err := ioutil.ReadFile(st.path("known_hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(after), "\n"); n != 2 {
+		t.Errorf("got %d known hosts, want 2:\n%s", n, after)
+	}
+
+	// A changed key is rejected and not recorded.
+	err = check("bastion:22", remote, other)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		t.Errorf("changed key got %v, want a key mismatch", err)
+	}
+	if buf, _ := ioutil.ReadFile(st.path("known_hosts")); string(buf) != string(after) {
+		t.Errorf("changed key recorded:\n%s", buf)
+	}
+
+	// A corrupt file rejects every key and is left as it is.
+	corrupt := []byte("bastion ssh-ed25519 not-base64!\n")
+	if err := ioutil.WriteFile(st.path("known_hosts"), corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := check("bastion:22", remote, key); err == nil {
+		t.Error("corrupt known_hosts accepted a key")
+	}
+	if buf, _ := ioutil.ReadFile(st.path("known_hosts")); string(buf) != string(corrupt) {
+		t.Errorf("corrupt known_hosts changed:\n%s", buf)
+	}
+}
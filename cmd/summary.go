@@ -0,0 +1,168 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+)
+
+// printSummary writes a table of the forwards of ps and the proxy
+// endpoints clients can be pointed at. Forwards in names that are not set
+// up yet, e.g. still retried in the background, are listed as pending.
+func printSummary(out io.Writer, ps *proxySet, names []string) error {
+	statuses := ps.Forwards()
+	started := make(map[string]bool)
+	for _, status := range statuses {
+		started[status.Name] = true
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tHOST\tLOCAL\tREMOTE\tMODE\tSTATE")
+	var endpoints []string
+	for _, status := range statuses {
+		mode, state, remote := status.Mode, "active", status.Remote
+		if remote == "" {
+			// Clients choose the destinations.
+			remote = "-"
+		}
+		if status.Reverse {
+			mode = "reverse"
+		}
+		if p, err := ps.get(status.Host); err == nil && !p.Connected() {
+			state = "disconnected"
+		}
+		if status.Down {
+			state = "target down"
+		}
+		if status.Paused {
+			state = "paused"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", status.Name, status.Host, status.Local, remote, mode, state)
+		switch status.Mode {
+		case "connect":
+			endpoints = append(endpoints, fmt.Sprintf("HTTP proxy:  http://%s (%s)", status.Local, status.Name))
+		case "socks":
+			endpoints = append(endpoints, fmt.Sprintf("SOCKS proxy: socks5h://%s (%s)", status.Local, status.Name))
+		}
+	}
+	for _, name := range names {
+		if !started[name] {
+			fmt.Fprintf(w, "%s\t\t\t\t\tpending\n", name)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		fmt.Fprintln(out, endpoint)
+	}
+	return nil
+}
+
+// topDestinations is how many destinations the session summary lists.
+const topDestinations = 10
+
+// sessionSummary is the summary of a session printed on exit.
+type sessionSummary struct {
+	Started      time.Time                 `json:"started"`
+	Uptime       float64                   `json:"uptime_seconds"`
+	Reconnects   int                       `json:"reconnects"`
+	TunnelsLost  int                       `json:"tunnels_lost"`
+	Forwards     []proxy.ForwardTotals     `json:"forwards"`
+	Destinations []proxy.DestinationTotals `json:"top_destinations"`
+}
+
+// summarizeSession returns the summary of the session of ps, started at
+// started.
+func summarizeSession(ps *proxySet, started time.Time) sessionSummary {
+	summary := sessionSummary{
+		Started:      started.UTC(),
+		Uptime:       time.Since(started).Seconds(),
+		Forwards:     ps.session.Forwards(),
+		Destinations: ps.session.TopDestinations(topDestinations),
+	}
+	for _, name := range ps.names() {
+		p, err := ps.get(name)
+		if err != nil {
+			continue
+		}
+		stats := p.ConnStats()
+		summary.Reconnects += stats.Reconnects
+		summary.TunnelsLost += stats.TunnelsLost
+	}
+	return summary
+}
+
+// printSessionSummary writes summary as tables of the forwards and the top
+// destinations.
+func printSessionSummary(out io.Writer, summary sessionSummary) error {
+	uptime := time.Duration(summary.Uptime * float64(time.Second)).Round(time.Second)
+	fmt.Fprintf(out, "Session: up %s, %d reconnects, %d tunnels lost\n", uptime, summary.Reconnects, summary.TunnelsLost)
+	if len(summary.Forwards) == 0 {
+		fmt.Fprintln(out, "No connections.")
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FORWARD\tCONNECTIONS\tERRORS\tSENT\tRECEIVED")
+	for _, fwd := range summary.Forwards {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", fwd.Forward, fwd.Connections, fwd.Errors, formatBytes(fwd.BytesUp), formatBytes(fwd.BytesDown))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(summary.Destinations) == 0 {
+		return nil
+	}
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DESTINATION\tCONNECTIONS\tBYTES")
+	for _, dest := range summary.Destinations {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", dest.Destination, dest.Connections, formatBytes(dest.Bytes))
+	}
+	return w.Flush()
+}
+
+// writeSessionSummary writes summary as JSON to path.
+func writeSessionSummary(path string, summary sessionSummary) error {
+	buf, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(buf, '\n'), 0600)
+}
+
+// formatBytes returns n in B, KiB, MiB or GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 2; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMG"[exp])
+}
+
+// reportSession prints the summary of the session of ps on exit, unless
+// quiet, and writes it to summary.file if set.
+func reportSession(ps *proxySet, started time.Time, quiet bool) {
+	summary := summarizeSession(ps, started)
+	if !quiet {
+		if err := printSessionSummary(os.Stderr, summary); err != nil {
+			logger.Warningf("printing the session summary: %s", err)
+		}
+	}
+	if path := os.ExpandEnv(currentSettings().Summary.File); path != "" {
+		if err := writeSessionSummary(path, summary); err != nil {
+			logger.Errorf("writing the session summary: %s", err)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// systemProxy changes the proxy settings of the operating system and puts
+// the previous ones back.
+type systemProxy interface {
+	// set points the system at the HTTP proxy addr and the SOCKS proxy
+	// socks, either of which may be empty.
+	set(addr, socks string) error
+	// restore puts back the settings saved by set.
+	restore() error
+}
+
+// systemProxyEnv passes the settings saved by the system proxy of a process
+// to the process that takes over from it in an upgrade, which restores them
+// when it exits instead.
+const systemProxyEnv = "SSHHTTPPROXY_SYSTEM_PROXY"
+
+// activeSystemProxy is the system proxy this process has to restore, if
+// any. It is cleared when an upgrade hands it over.
+var activeSystemProxy systemProxy
+
+// newSystemProxy returns the systemProxy of the running platform: the
+// network services of macOS, the WinINET settings of Windows or the GNOME
+// proxy settings elsewhere.
+func newSystemProxy() (systemProxy, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return &macProxy{}, nil
+	case "windows":
+		return &winProxy{}, nil
+	}
+	if _, err := exec.LookPath("gsettings"); err != nil {
+		return nil, errors.New("system proxy settings are only supported on macOS, Windows and GNOME")
+	}
+	return &gnomeProxy{}, nil
+}
+
+// setSystemProxy points the system proxy settings at the first connect
+// and socks forwards of ps and returns a function restoring them.
+func setSystemProxy(ps *proxySet) (func(), error) {
+	var addr, socks string
+	for _, fwd := range ps.Forwards() {
+		switch {
+		case fwd.Mode == "connect" && addr == "":
+			addr = fwd.Local
+		case fwd.Mode == "socks" && socks == "":
+			socks = fwd.Local
+		}
+	}
+	if addr == "" && socks == "" {
+		return nil, errors.New("--set-system-proxy needs a connect or socks forward")
+	}
+	sp, err := newSystemProxy()
+	if err != nil {
+		return nil, err
+	}
+	if saved := os.Getenv(systemProxyEnv); saved != "" {
+		// The settings already point at the listeners inherited from
+		// the upgraded process.
+		os.Unsetenv(systemProxyEnv)
+		if err := json.Unmarshal([]byte(saved), sp); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := sp.set(addr, socks); err != nil {
+			if err := sp.restore(); err != nil {
+				logger.Errorf("error restoring the system proxy settings: %s", err)
+			}
+			return nil, err
+		}
+		logger.Infof("system proxy set to %s", strings.Trim(addr+" "+socks, " "))
+	}
+	activeSystemProxy = sp
+	return func() {
+		if activeSystemProxy == nil {
+			return
+		}
+		if err := sp.restore(); err != nil {
+			logger.Errorf("error restoring the system proxy settings: %s", err)
+			return
+		}
+		logger.Infof("system proxy settings restored")
+	}, nil
+}
+
+// run runs a command and returns its standard output.
+func run(name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %s: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// splitAddr splits a proxy address into host and port.
+func splitAddr(addr string) (string, string) {
+	host, port, _ := net.SplitHostPort(addr)
+	return host, port
+}
+
+// macProxyKinds are the proxies of a macOS network service, by the name
+// networksetup uses for them.
+var macProxyKinds = []string{"webproxy", "securewebproxy", "socksfirewallproxy"}
+
+// macProxy sets the proxies of all enabled network services of macOS.
+type macProxy struct {
+	// Saved are the previous settings by service and kind.
+	Saved []macProxySetting
+}
+
+type macProxySetting struct {
+	Service, Kind string
+	Enabled       bool
+	Server, Port  string
+}
+
+func (m *macProxy) set(addr, socks string) error {
+	out, err := run("networksetup", "-listallnetworkservices")
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	for _, service := range lines[1:] {
+		// Disabled services are marked with an asterisk.
+		if strings.HasPrefix(service, "*") {
+			continue
+		}
+		for _, kind := range macProxyKinds {
+			out, err := run("networksetup", "-get"+kind, service)
+			if err != nil {
+				return err
+			}
+			setting := macProxySetting{Service: service, Kind: kind}
+			for _, line := range strings.Split(out, "\n") {
+				key, value := splitField(line)
+				switch key {
+				case "Enabled":
+					setting.Enabled = value == "Yes"
+				case "Server":
+					setting.Server = value
+				case "Port":
+					setting.Port = value
+				}
+			}
+			m.Saved = append(m.Saved, setting)
+			to := addr
+			if kind == "socksfirewallproxy" {
+				to = socks
+			}
+			if to == "" {
+				continue
+			}
+			host, port := splitAddr(to)
+			if _, err := run("networksetup", "-set"+kind, service, host, port); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *macProxy) restore() error {
+	var firstErr error
+	for _, s := range m.Saved {
+		var err error
+		if s.Enabled {
+			_, err = run("networksetup", "-set"+s.Kind, s.Service, s.Server, s.Port)
+		} else {
+			_, err = run("networksetup", "-set"+s.Kind+"state", s.Service, "off")
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// splitField splits a "key: value" line.
+func splitField(line string) (string, string) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return "", ""
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+}
+
+// gnomeProxy sets the GNOME proxy settings with gsettings.
+type gnomeProxy struct {
+	// Saved are the previous values in GVariant text format, in the order
+	// they were changed.
+	Saved []gnomeSetting
+}
+
+type gnomeSetting struct {
+	Schema, Key, Value string
+}
+
+func (g *gnomeProxy) change(schema, key, value string) error {
+	old, err := run("gsettings", "get", schema, key)
+	if err != nil {
+		return err
+	}
+	g.Saved = append(g.Saved, gnomeSetting{schema, key, strings.TrimSpace(old)})
+	_, err = run("gsettings", "set", schema, key, value)
+	return err
+}
+
+func (g *gnomeProxy) set(addr, socks string) error {
+	for schema, to := range map[string]string{
+		"org.gnome.system.proxy.http":  addr,
+		"org.gnome.system.proxy.https": addr,
+		"org.gnome.system.proxy.socks": socks,
+	} {
+		if to == "" {
+			continue
+		}
+		host, port := splitAddr(to)
+		if err := g.change(schema, "host", "'"+host+"'"); err != nil {
+			return err
+		}
+		if err := g.change(schema, "port", port); err != nil {
+			return err
+		}
+	}
+	return g.change("org.gnome.system.proxy", "mode", "'manual'")
+}
+
+func (g *gnomeProxy) restore() error {
+	var firstErr error
+	for i := len(g.Saved) - 1; i >= 0; i-- {
+		s := g.Saved[i]
+		if _, err := run("gsettings", "set", s.Schema, s.Key, s.Value); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// winInternetSettings is the registry key of the WinINET proxy settings.
+const winInternetSettings = `HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// winProxy sets the WinINET proxy settings of the current user. Programs
+// pick them up for new connections.
+type winProxy struct {
+	Saved []winSetting
+}
+
+type winSetting struct {
+	Name, Kind, Value string
+	// Exists is false if the value was not set before.
+	Exists bool
+}
+
+func (w *winProxy) change(name, kind, value string) error {
+	setting := winSetting{Name: name, Kind: kind}
+	if out, err := run("reg", "query", winInternetSettings, "/v", name); err == nil {
+		scanner := bufio.NewScanner(strings.NewReader(out))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == name && fields[1] == kind {
+				setting.Exists = true
+				setting.Value = strings.Join(fields[2:], " ")
+			}
+		}
+	}
+	w.Saved = append(w.Saved, setting)
+	_, err := run("reg", "add", winInternetSettings, "/v", name, "/t", kind, "/d", value, "/f")
+	return err
+}
+
+func (w *winProxy) set(addr, socks string) error {
+	var servers []string
+	if addr != "" {
+		servers = append(servers, "http="+addr, "https="+addr)
+	}
+	if socks != "" {
+		servers = append(servers, "socks="+socks)
+	}
+	if err := w.change("ProxyServer", "REG_SZ", strings.Join(servers, ";")); err != nil {
+		return err
+	}
+	if err := w.change("ProxyOverride", "REG_SZ", "<local>"); err != nil {
+		return err
+	}
+	return w.change("ProxyEnable", "REG_DWORD", "1")
+}
+
+func (w *winProxy) restore() error {
+	var firstErr error
+	for i := len(w.Saved) - 1; i >= 0; i-- {
+		s := w.Saved[i]
+		var err error
+		if s.Exists {
+			_, err = run("reg", "add", winInternetSettings, "/v", s.Name, "/t", s.Kind, "/d", s.Value, "/f")
+		} else {
+			_, err = run("reg", "delete", winInternetSettings, "/v", s.Name, "/f")
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// templateData is available to templates in config values.
+type templateData struct {
+	// Profile is the profile selected with --profile.
+	Profile string
+	// Vars are the variables of the profile in the profiles section of the
+	// config, by lower case name.
+	Vars map[string]string
+}
+
+// templateFuncs are the functions available to templates in config values.
+var templateFuncs = template.FuncMap{
+	"env": os.Getenv,
+	// default returns value, or def if value is empty:
+	// {{ env "STAGE" | default "dev" }}
+	"default": func(def, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+// profileVars returns the variables of profile from the profiles section
+// of the config in v, those of the default profile without one.
+func profileVars(v *viper.Viper, profile string) (map[string]string, error) {
+	profiles := v.GetStringMap("profiles")
+	if len(profiles) == 0 {
+		return nil, nil
+	}
+	name := strings.ToLower(profile)
+	if name == "" {
+		name = "default"
+	}
+	vars, ok := profiles[name]
+	if !ok {
+		if profile == "" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unknown profile %q", profile)
+	}
+	m, ok := vars.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("profile %q: not a map of variables", profile)
+	}
+	strs := make(map[string]string, len(m))
+	for k, v := range m {
+		strs[k] = fmt.Sprint(v)
+	}
+	return strs, nil
+}
+
+// expandTemplates evaluates Go templates in all values of the config in
+// v, so values like "db.{{ .Profile }}.internal" or "{{ .Vars.db }}:5432"
+// can depend on the profile or the environment.
+func expandTemplates(v *viper.Viper) error {
+	profile := v.GetString("profile")
+	vars, err := profileVars(v, profile)
+	if err != nil {
+		return err
+	}
+	data := templateData{Profile: profile, Vars: vars}
+	return rewriteConfig(v, func(path, s string) (string, error) {
+		if !strings.Contains(s, "{{") {
+			return s, nil
+		}
+		tmpl, err := template.New("").Funcs(templateFuncs).Option("missingkey=error").Parse(s)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestExpandTemplates(t *testing.T) {
+	setenv(t, "TEMPLATE_TEST_STAGE", "prod")
+	setenv(t, "TEMPLATE_TEST_EMPTY", "")
+	const profiles = `
+profiles:
+  default:
+    db: db-dev
+  staging:
+    db: db-staging
+    Port: 5432
+`
+	for _, tt := range []struct {
+		name string
+		doc  string
+		key  string
+		want string
+	}{
+		{
+			name: "profile variables",
+			doc:  "profile: staging\nsshproxy:\n  remote: '{{ .Vars.db }}:{{ .Vars.port }}'\n" + profiles,
+			key:  "sshproxy.remote",
+			want: "db-staging:5432",
+		},
+		{
+			name: "default profile",
+			doc:  "sshproxy:\n  remote: '{{ .Vars.db }}:22'\n" + profiles,
+			key:  "sshproxy.remote",
+			want: "db-dev:22",
+		},
+		{
+			name: "profile name",
+			doc:  "profile: Staging\nsshproxy:\n  remote: 'bastion.{{ .Profile }}.internal'\n" + profiles,
+			key:  "sshproxy.remote",
+			want: "bastion.Staging.internal",
+		},
+		{
+			name: "environment",
+			doc:  "sshproxy:\n  user: '{{ env \"TEMPLATE_TEST_STAGE\" | default \"dev\" }}'\n",
+			key:  "sshproxy.user",
+			want: "prod",
+		},
+		{
+			name: "default",
+			doc:  "sshproxy:\n  user: '{{ env \"TEMPLATE_TEST_EMPTY\" | default \"dev\" }}'\n",
+			key:  "sshproxy.user",
+			want: "dev",
+		},
+		{
+			name: "lists",
+			doc:  "profile: staging\nforwards:\n- name: db\n  remote: '{{ .Vars.db }}:5432'\n" + profiles,
+			key:  "forwards",
+			want: "db-staging:5432",
+		},
+		{
+			name: "plain values",
+			doc:  "sshproxy:\n  password: 'a {b} c'\n",
+			key:  "sshproxy.password",
+			want: "a {b} c",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			readTestConfig(t, tt.doc)
+			if err := expandTemplates(viper.GetViper()); err != nil {
+				t.Fatal(err)
+			}
+			// Lists are checked for the value in them.
+			if got := fmt.Sprint(viper.Get(tt.key)); !strings.Contains(got, tt.want) || strings.Contains(got, "{{") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandTemplatesErrors(t *testing.T) {
+	const profiles = "profiles:\n  staging:\n    db: db-staging\n"
+	for _, tt := range []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{
+			name: "unknown variable",
+			doc:  "profile: staging\nsshproxy:\n  remote: '{{ .Vars.dbhost }}:22'\n" + profiles,
+			want: "dbhost",
+		},
+		{
+			name: "variables of another profile",
+			doc:  "sshproxy:\n  remote: '{{ .Vars.db }}:22'\n" + profiles,
+			want: "sshproxy.remote",
+		},
+		{
+			name: "unknown field",
+			doc:  "sshproxy:\n  remote: '{{ .Stage }}'\n",
+			want: "Stage",
+		},
+		{
+			name: "unknown function",
+			doc:  "sshproxy:\n  remote: '{{ lookup \"db\" }}'\n",
+			want: "lookup",
+		},
+		{
+			name: "syntax",
+			doc:  "sshproxy:\n  remote: '{{ .Profile'\n",
+			want: "sshproxy.remote",
+		},
+		{
+			name: "unknown profile",
+			doc:  "profile: prod\n" + profiles,
+			want: `unknown profile "prod"`,
+		},
+		{
+			name: "profile not a map",
+			doc:  "profile: staging\nprofiles:\n  staging: db\n",
+			want: "not a map",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			readTestConfig(t, tt.doc)
+			err := expandTemplates(viper.GetViper())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
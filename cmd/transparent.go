@@ -0,0 +1,186 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// firewallChain names the iptables chain and nftables table of the rules.
+const firewallChain = "sshhttpproxy"
+
+// transparentPort returns the local port of the transparent forward name of
+// a running instance, or of the first one if name is empty.
+func transparentPort(name string) (string, error) {
+	infos, err := runningForwards()
+	if err != nil {
+		return "", err
+	}
+	for _, info := range infos {
+		if name != "" && info.Name != name {
+			continue
+		}
+		if info.Mode != "transparent" {
+			if name != "" {
+				return "", fmt.Errorf("forward %s is not a transparent forward", name)
+			}
+			continue
+		}
+		_, port, err := net.SplitHostPort(info.Local)
+		return port, err
+	}
+	if name != "" {
+		return "", fmt.Errorf("no forward named %s", name)
+	}
+	return "", errors.New("no transparent forward is running")
+}
+
+// sshServers returns the IPv4 addresses and ports of the configured ssh
+// servers, whose connections must not be redirected.
+func sshServers() ([]string, error) {
+	remotes := []string{remoteAddress()}
+	hosts, err := hostsFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		remotes = append(remotes, host.Remote)
+	}
+	seen := make(map[string]bool)
+	var servers []string
+	for _, remote := range remotes {
+		if remote == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(remote)
+		if err != nil {
+			host, port = remote, "22"
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if ip.To4() == nil {
+				continue
+			}
+			server := net.JoinHostPort(ip.String(), port)
+			if !seen[server] {
+				seen[server] = true
+				servers = append(servers, server)
+			}
+		}
+	}
+	sort.Strings(servers)
+	return servers, nil
+}
+
+// iptablesRules returns iptables commands redirecting connections to subnets
+// to port, or removing them again.
+func iptablesRules(port string, subnets, servers []string, remove bool) []string {
+	nat := "iptables -t nat "
+	chain := strings.ToUpper(firewallChain)
+	jump := fmt.Sprintf("OUTPUT -p tcp -j %s", chain)
+	if remove {
+		return []string{
+			nat + "-D " + jump,
+			nat + "-F " + chain,
+			nat + "-X " + chain,
+		}
+	}
+	rules := []string{
+		nat + "-N " + chain,
+		nat + "-A " + chain + " -d 127.0.0.0/8 -j RETURN",
+	}
+	for _, server := range servers {
+		host, p, _ := net.SplitHostPort(server)
+		rules = append(rules, fmt.Sprintf("%s-A %s -d %s -p tcp --dport %s -j RETURN", nat, chain, host, p))
+	}
+	for _, subnet := range subnets {
+		rules = append(rules, fmt.Sprintf("%s-A %s -d %s -p tcp -j REDIRECT --to-ports %s", nat, chain, subnet, port))
+	}
+	return append(rules, nat+"-A "+jump)
+}
+
+// nftRules returns an nftables ruleset redirecting connections to subnets
+// to port, or a command removing it again.
+func nftRules(port string, subnets, servers []string, remove bool) []string {
+	if remove {
+		return []string{"nft delete table ip " + firewallChain}
+	}
+	rules := []string{
+		"table ip " + firewallChain + " {",
+		"\tchain output {",
+		"\t\ttype nat hook output priority -100; policy accept;",
+		"\t\tip daddr 127.0.0.0/8 return",
+	}
+	for _, server := range servers {
+		host, p, _ := net.SplitHostPort(server)
+		rules = append(rules, fmt.Sprintf("\t\tip daddr %s tcp dport %s return", host, p))
+	}
+	for _, subnet := range subnets {
+		rules = append(rules, fmt.Sprintf("\t\tip daddr %s meta l4proto tcp redirect to :%s", subnet, port))
+	}
+	return append(rules, "\t}", "}")
+}
+
+var firewallRulesCmd = &cobra.Command{
+	Use:   "firewall-rules",
+	Short: "Print firewall rules redirecting connections to a transparent forward",
+	Long: `Print the firewall rules that redirect outgoing TCP connections of this
+machine to the transparent forward of the running proxy, leaving out
+loopback and the ssh servers of the config:
+
+  sshhttpproxy firewall-rules --subnet 10.0.0.0/8 | sudo sh
+  sshhttpproxy firewall-rules --nft | sudo nft -f -
+
+With --delete the rules remove them again.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		nft, _ := cmd.Flags().GetBool("nft")
+		remove, _ := cmd.Flags().GetBool("delete")
+		if remove {
+			rules := iptablesRules("", nil, nil, true)
+			if nft {
+				rules = nftRules("", nil, nil, true)
+			}
+			fmt.Println(strings.Join(rules, "\n"))
+			return nil
+		}
+		subnets, _ := cmd.Flags().GetStringSlice("subnet")
+		for _, subnet := range subnets {
+			if _, ipnet, err := net.ParseCIDR(subnet); err != nil || ipnet.IP.To4() == nil {
+				return fmt.Errorf("subnet %s: not an IPv4 CIDR", subnet)
+			}
+		}
+		name, _ := cmd.Flags().GetString("forward")
+		port, err := transparentPort(name)
+		if err != nil {
+			return err
+		}
+		servers, err := sshServers()
+		if err != nil {
+			return err
+		}
+		rules := iptablesRules(port, subnets, servers, false)
+		if nft {
+			rules = nftRules(port, subnets, servers, false)
+		}
+		fmt.Println(strings.Join(rules, "\n"))
+		return nil
+	},
+}
+
+func init() {
+	firewallRulesCmd.Flags().String("forward", "", "use this transparent forward instead of the first one")
+	firewallRulesCmd.Flags().StringSlice("subnet", []string{"0.0.0.0/0"}, "IPv4 subnets to redirect")
+	firewallRulesCmd.Flags().Bool("nft", false, "print an nftables ruleset instead of iptables commands")
+	firewallRulesCmd.Flags().Bool("delete", false, "print rules removing the redirect instead")
+	rootCmd.AddCommand(firewallRulesCmd)
+}
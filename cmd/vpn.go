@@ -0,0 +1,173 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"github.com/spf13/cobra"
+)
+
+// parseTunUnit parses the --unit flag, a device number or any.
+func parseTunUnit(unit string) (uint32, error) {
+	if unit == "any" {
+		return proxy.TunAny, nil
+	}
+	n, err := strconv.ParseUint(unit, 10, 32)
+	if err != nil || n >= proxy.TunAny {
+		return 0, fmt.Errorf("invalid tun unit %q", unit)
+	}
+	return uint32(n), nil
+}
+
+// checkVPNRoutes returns an error if a subnet is not a CIDR or contains an
+// ssh server, whose connection would then be routed into itself.
+func checkVPNRoutes(subnets, servers []string) error {
+	for _, subnet := range subnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("route %s: not a CIDR", subnet)
+		}
+		for _, server := range servers {
+			host, _, _ := net.SplitHostPort(server)
+			if ipnet.Contains(net.ParseIP(host)) {
+				return fmt.Errorf("route %s contains the ssh server %s", subnet, host)
+			}
+		}
+	}
+	return nil
+}
+
+// relayTun copies packets between the local device dev and the tunnel
+// until ctx is done or either side fails.
+func relayTun(ctx context.Context, dev io.ReadWriteCloser, tun *proxy.TunChannel) error {
+	errc := make(chan error, 2)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := dev.Read(buf)
+			if err != nil {
+				errc <- err
+				return
+			}
+			if err := tun.WritePacket(buf[:n]); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			pkt, err := tun.ReadPacket()
+			if err != nil {
+				errc <- err
+				return
+			}
+			if _, err := dev.Write(pkt); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errc:
+		if errors.Is(err, io.EOF) {
+			return errors.New("tunnel closed by the ssh server")
+		}
+		return err
+	}
+}
+
+var vpnCmd = &cobra.Command{
+	Use:   "vpn [host]",
+	Short: "Route whole subnets through the ssh connection",
+	Long: `Create a tun device and route the --route subnets through a tunnel to
+a tun device on the ssh server, like ssh -w, for access to every port of
+a network without listing forwards. This needs root (or CAP_NET_ADMIN)
+locally and on the server PermitTunnel in sshd_config and the other end
+set up, e.g. for the default addresses:
+
+  ip addr add 10.254.0.1 peer 10.254.0.2 dev tun0 && ip link set tun0 up
+  sysctl -w net.ipv4.ip_forward=1
+  iptables -t nat -A POSTROUTING -s 10.254.0.2 -j MASQUERADE
+
+The ssh connection of host, the default one if not given, is used.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, _ := cmd.InheritedFlags().GetBool("debug")
+		setupLogging(os.Stderr, debug)
+		subnets, _ := cmd.Flags().GetStringSlice("route")
+		if len(subnets) == 0 {
+			return errors.New("at least one --route is required")
+		}
+		servers, err := sshServers()
+		if err != nil {
+			return err
+		}
+		if err := checkVPNRoutes(subnets, servers); err != nil {
+			return err
+		}
+		unitFlag, _ := cmd.Flags().GetString("unit")
+		unit, err := parseTunUnit(unitFlag)
+		if err != nil {
+			return err
+		}
+		host := defaultHost
+		if len(args) > 0 {
+			host = args[0]
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go setupSignalHandler(ctx, cancel)
+		defer cancel()
+		ps, err := proxiesFromConfig(ctx, policyOnce)
+		if err != nil {
+			return err
+		}
+		defer ps.Shutdown()
+		p, err := ps.ensure(host)
+		if err != nil {
+			return err
+		}
+		tun, err := p.OpenTun(unit)
+		if err != nil {
+			if errors.Is(err, proxy.ErrForwardingProhibited) {
+				logger.Errorf("the ssh server does not allow tunnels, see PermitTunnel in its sshd_config")
+			}
+			return err
+		}
+		defer tun.Close()
+		name, _ := cmd.Flags().GetString("device")
+		dev, name, err := openTun(name)
+		if err != nil {
+			return err
+		}
+		defer dev.Close()
+		local, _ := cmd.Flags().GetString("address")
+		peer, _ := cmd.Flags().GetString("peer")
+		mtu, _ := cmd.Flags().GetInt("mtu")
+		if err := configureTun(name, local, peer, mtu, subnets); err != nil {
+			return err
+		}
+		logger.Infof("routing %v through %s", subnets, name)
+		return relayTun(ctx, dev, tun)
+	},
+}
+
+func init() {
+	vpnCmd.Flags().StringSlice("route", nil, "subnets to route through the tunnel")
+	vpnCmd.Flags().String("device", "sshvpn%d", "name of the local tun device, %d picks a free number")
+	vpnCmd.Flags().String("unit", "any", "tun device number on the ssh server, or any")
+	vpnCmd.Flags().String("address", "10.254.0.2", "address of the local end of the tunnel")
+	vpnCmd.Flags().String("peer", "10.254.0.1", "address of the server end of the tunnel")
+	vpnCmd.Flags().Int("mtu", 1400, "MTU of the tun device")
+	rootCmd.AddCommand(vpnCmd)
+}
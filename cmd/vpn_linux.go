@@ -0,0 +1,69 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+//go:build linux
+// +build linux
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tunSetIff = 0x400454ca
+	iffTun    = 0x0001
+	iffNoPI   = 0x1000
+)
+
+// ifReq is the struct ifreq of the TUNSETIFF ioctl.
+type ifReq struct {
+	Name  [16]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// openTun creates a tun device from the name template, e.g. sshvpn%d, and
+// returns it with its name. Every read and write is one IP packet.
+func openTun(name string) (io.ReadWriteCloser, string, error) {
+	// Opened non-blocking, so reads are handled by the runtime poller
+	// and end when the device is closed.
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", fmt.Errorf("open /dev/net/tun: %w", err)
+	}
+	var req ifReq
+	copy(req.Name[:len(req.Name)-1], name)
+	req.Flags = iffTun | iffNoPI
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		syscall.Close(fd)
+		return nil, "", fmt.Errorf("create tun device: %w", errno)
+	}
+	name = strings.TrimRight(string(req.Name[:]), "\x00")
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), name, nil
+}
+
+// configureTun gives the device name the point to point addresses local
+// and peer, brings it up and routes subnets through it.
+func configureTun(name, local, peer string, mtu int, subnets []string) error {
+	cmds := [][]string{
+		{"addr", "add", local, "peer", peer, "dev", name},
+		{"link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up"},
+	}
+	for _, subnet := range subnets {
+		cmds = append(cmds, []string{"route", "add", subnet, "dev", name})
+	}
+	for _, args := range cmds {
+		logger.Debugf("ip %s", strings.Join(args, " "))
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("ip %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
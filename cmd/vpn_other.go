@@ -0,0 +1,21 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+//go:build !linux
+// +build !linux
+
+package cmd
+
+import (
+	"errors"
+	"io"
+)
+
+var errVPNUnsupported = errors.New("vpn is only supported on Linux")
+
+func openTun(name string) (io.ReadWriteCloser, string, error) {
+	return nil, "", errVPNUnsupported
+}
+
+func configureTun(name, local, peer string, mtu int, subnets []string) error {
+	return errVPNUnsupported
+}
@@ -0,0 +1,41 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package cmd
+
+import (
+	"context"
+	"time"
+)
+
+// wakeCheckInterval is how often the clocks are compared to notice that
+// the system slept.
+const wakeCheckInterval = 5 * time.Second
+
+// reconnectOnWake replaces the ssh connections of ps whenever the system
+// seems to have been asleep for at least threshold: the wall clock moved
+// on further than the monotonic one, which stops during sleep on most
+// systems, or a check came that much late. The old connections are almost
+// certainly dead but would take keepalives minutes to notice.
+func reconnectOnWake(ctx context.Context, ps *proxySet, threshold time.Duration) {
+	ticker := time.NewTicker(wakeCheckInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		slept := now.Round(0).Sub(last.Round(0)) - wakeCheckInterval
+		if late := now.Sub(last) - wakeCheckInterval; late > slept {
+			slept = late
+		}
+		last = now
+		if slept < threshold {
+			continue
+		}
+		logger.Infof("system was asleep for about %s, reconnecting", slept.Round(time.Second))
+		ps.resume()
+	}
+}
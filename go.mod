@@ -1,11 +1,15 @@
 module github.com/elliotpeele/sshhttpproxy
 
-go 1.13
+go 1.14
 
 require (
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/mitchellh/mapstructure v1.1.2
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.5.0
 	golang.org/x/crypto v0.0.0-20191029031824-8986dd9e96cf
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -0,0 +1,253 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+// Package localca manages a local development certificate authority and
+// the leaf certificates it issues for forwards that terminate TLS locally.
+package localca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+
+	caLifetime   = 10 * 365 * 24 * time.Hour
+	leafLifetime = 825 * 24 * time.Hour
+	// renewBefore is how long before expiry a leaf certificate is reissued.
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// CA is a certificate authority stored in a directory.
+type CA struct {
+	dir  string
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// CertPath returns the path of the CA certificate, e.g. for adding it to a
+// trust store.
+func (ca *CA) CertPath() string {
+	return filepath.Join(ca.dir, caCertFile)
+}
+
+// Init creates a new CA in dir. It fails if dir already holds a CA.
+func Init(dir string) (*CA, error) {
+	if _, err := os.Stat(filepath.Join(dir, caCertFile)); err == nil {
+		return nil, fmt.Errorf("%s already holds a CA", dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"sshhttpproxy local CA"},
+			CommonName:   fmt.Sprintf("sshhttpproxy %s", hostname),
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePair(dir, caCertFile, caKeyFile, der, key); err != nil {
+		return nil, err
+	}
+	return Load(dir)
+}
+
+// Load reads the CA stored in dir.
+func Load(dir string) (*CA, error) {
+	cert, key, err := readPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no CA in %s, run \"sshhttpproxy cert init\" first", dir)
+		}
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", filepath.Join(dir, caCertFile))
+	}
+	return &CA{dir: dir, cert: cert, key: key}, nil
+}
+
+// Leaf returns the certificate for the named forward covering hosts. A
+// stored certificate is reused if it covers the same hosts and is not about
+// to expire, otherwise a new one is issued and stored.
+func (ca *CA) Leaf(name string, hosts []string) (tls.Certificate, error) {
+	certPath := filepath.Join(ca.dir, leafFile(name, ".pem"))
+	keyPath := filepath.Join(ca.dir, leafFile(name, "-key.pem"))
+	if cert, _, err := readPair(certPath, keyPath); err == nil && ca.reusable(cert, hosts) {
+		return tls.LoadX509KeyPair(certPath, keyPath)
+	}
+	der, key, err := ca.issue(hosts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writePair(ca.dir, leafFile(name, ".pem"), leafFile(name, "-key.pem"), der, key); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+func (ca *CA) reusable(cert *x509.Certificate, hosts []string) bool {
+	if time.Until(cert.NotAfter) < renewBefore {
+		return false
+	}
+	if err := cert.CheckSignatureFrom(ca.cert); err != nil {
+		return false
+	}
+	var names []string
+	names = append(names, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return equalSets(names, hosts)
+}
+
+func (ca *CA) issue(hosts []string) ([]byte, crypto.Signer, error) {
+	if len(hosts) == 0 {
+		return nil, nil, errors.New("at least one host is required")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"sshhttpproxy"},
+			CommonName:   hosts[0],
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(leafLifetime),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return der, key, nil
+}
+
+// leafFile returns the file name for a leaf certificate of the named
+// forward, replacing characters that are unsafe in file names.
+func leafFile(name, suffix string) string {
+	safe := []rune(name)
+	for i, r := range safe {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+		default:
+			safe[i] = '_'
+		}
+	}
+	return "forward-" + string(safe) + suffix
+}
+
+func writePair(dir, certFile, keyFile string, der []byte, key crypto.Signer) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, keyFile), keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, certFile), certPEM, 0644)
+}
+
+func readPair(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("%s: no certificate found", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("%s: no private key found", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: unsupported key type", keyPath)
+	}
+	return cert, signer, nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func equalSets(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
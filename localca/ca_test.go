@@ -0,0 +1,214 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package localca_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elliotpeele/sshhttpproxy/localca"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "localca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "ca")
+}
+
+// roots returns a pool holding the certificate of ca.
+func roots(t *testing.T, ca *localca.CA) *x509.CertPool {
+	t.Helper()
+	data, err := ioutil.ReadFile(ca.CertPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		t.Fatalf("no certificate in %s", ca.CertPath())
+	}
+	return pool
+}
+
+func leaf(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestInit(t *testing.T) {
+	dir := tempDir(t)
+	ca, err := localca.Init(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(ca.CertPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		t.Fatal("CA certificate is not PEM")
+	}
+	info, err := os.Stat(filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("CA key has mode %o", perm)
+	}
+	if _, err := localca.Init(dir); err == nil {
+		t.Fatal("Init overwrote an existing CA")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := tempDir(t)
+	if _, err := localca.Load(dir); err == nil || !strings.Contains(err.Error(), "cert init") {
+		t.Fatalf("got %v loading a missing CA", err)
+	}
+	ca, err := localca.Init(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.Leaf("app", []string{"app.corp.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := localca.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reloaded CA reuses the stored leaf and issues under the same
+	// root.
+	again, err := loaded.Leaf("app", []string{"app.corp.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf(t, again).SerialNumber.Cmp(leaf(t, cert).SerialNumber) != 0 {
+		t.Error("reloaded CA reissued an unchanged leaf")
+	}
+	other, err := loaded.Leaf("other", []string{"other.corp.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := x509.VerifyOptions{Roots: roots(t, ca), DNSName: "other.corp.localhost"}
+	if _, err := leaf(t, other).Verify(opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaf(t *testing.T) {
+	ca, err := localca.Init(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.Leaf("none", nil); err == nil {
+		t.Fatal("issued a certificate without hosts")
+	}
+	cert, err := ca.Leaf("app", []string{"app.corp.localhost", "*.app.corp.localhost", "127.0.0.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := leaf(t, cert)
+	if got := strings.Join(parsed.DNSNames, ","); got != "app.corp.localhost,*.app.corp.localhost" {
+		t.Errorf("DNS names %s", got)
+	}
+	if len(parsed.IPAddresses) != 2 || !parsed.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) || !parsed.IPAddresses[1].Equal(net.ParseIP("::1")) {
+		t.Errorf("IP addresses %v", parsed.IPAddresses)
+	}
+	if parsed.Subject.CommonName != "app.corp.localhost" {
+		t.Errorf("common name %q", parsed.Subject.CommonName)
+	}
+	for _, name := range []string{"app.corp.localhost", "api.app.corp.localhost", "127.0.0.1", "::1"} {
+		opts := x509.VerifyOptions{
+			Roots:     roots(t, ca),
+			DNSName:   name,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		if _, err := parsed.Verify(opts); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	opts := x509.VerifyOptions{Roots: roots(t, ca), DNSName: "other.corp.localhost"}
+	if _, err := parsed.Verify(opts); err == nil {
+		t.Error("certificate valid for a host it was not issued for")
+	}
+}
+
+func TestLeafReissue(t *testing.T) {
+	dir := tempDir(t)
+	ca, err := localca.Init(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := ca.Leaf("web/app", []string{"a.localhost", "b.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unsafe characters in forward names do not escape the directory.
+	if _, err := os.Stat(filepath.Join(dir, "forward-web_app.pem")); err != nil {
+		t.Fatal(err)
+	}
+	same, err := ca.Leaf("web/app", []string{"b.localhost", "a.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf(t, same).SerialNumber.Cmp(leaf(t, first).SerialNumber) != 0 {
+		t.Error("leaf reissued for the same hosts in another order")
+	}
+	changed, err := ca.Leaf("web/app", []string{"a.localhost", "c.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := leaf(t, changed)
+	if parsed.SerialNumber.Cmp(leaf(t, first).SerialNumber) == 0 {
+		t.Fatal("leaf not reissued for other hosts")
+	}
+	if got := strings.Join(parsed.DNSNames, ","); got != "a.localhost,c.localhost" {
+		t.Errorf("DNS names %s", got)
+	}
+
+	// A leaf signed by another CA is replaced.
+	other, err := localca.Init(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := other.Leaf("web/app", []string{"a.localhost", "c.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDir := filepath.Dir(other.CertPath())
+	for _, file := range []string{"forward-web_app.pem", "forward-web_app-key.pem"} {
+		data, err := ioutil.ReadFile(filepath.Join(otherDir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replaced, err := ca.Leaf("web/app", []string{"a.localhost", "c.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf(t, replaced).SerialNumber.Cmp(leaf(t, foreign).SerialNumber) == 0 {
+		t.Fatal("leaf of another CA reused")
+	}
+	if _, err := leaf(t, replaced).Verify(x509.VerifyOptions{Roots: roots(t, ca), DNSName: "c.localhost"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package localca
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// linuxAnchorDir is where update-ca-certificates picks up extra CAs.
+const linuxAnchorDir = "/usr/local/share/ca-certificates"
+
+// Trust adds the CA certificate to the trust store of the operating
+// system. It usually needs administrator privileges and may prompt for
+// them. Browsers with their own trust store, like Firefox, are not covered.
+func (ca *CA) Trust() error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "add-trusted-cert", "-d", "-r", "trustRoot",
+			"-k", "/Library/Keychains/System.keychain", ca.CertPath())
+	case "windows":
+		cmd = exec.Command("certutil", "-addstore", "-f", "ROOT", ca.CertPath())
+	case "linux":
+		buf, err := ioutil.ReadFile(ca.CertPath())
+		if err != nil {
+			return err
+		}
+		anchor := filepath.Join(linuxAnchorDir, "sshhttpproxy-local-ca.crt")
+		if err := ioutil.WriteFile(anchor, buf, 0644); err != nil {
+			return fmt.Errorf("installing CA (try again as root): %w", err)
+		}
+		cmd = exec.Command("update-ca-certificates")
+	default:
+		return fmt.Errorf("trusting the CA is not supported on %s, add %s manually",
+			runtime.GOOS, ca.CertPath())
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", cmd.Path, err)
+	}
+	return nil
+}
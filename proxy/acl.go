@@ -0,0 +1,119 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DestinationRule allows or denies destinations chosen by clients in proxy
+// modes, where the forward has no fixed remote.
+type DestinationRule struct {
+	// Deny rejects matching destinations instead of allowing them.
+	Deny bool
+	// Host is a host pattern as on Route, or a CIDR like "10.0.0.0/8"
+	// matching destinations given as IP addresses. Host names are not
+	// resolved, so CIDRs never match them. An empty Host matches any host.
+	Host string
+	// Ports limits the rule to these ports, empty matches any port.
+	Ports []int
+}
+
+// destinationACL checks destinations against compiled rules. The first
+// matching rule decides; destinations matching no rule are allowed only if
+// there are no allow rules.
+type destinationACL struct {
+	rules        []compiledDestinationRule
+	defaultAllow bool
+}
+
+type compiledDestinationRule struct {
+	DestinationRule
+	network *net.IPNet
+}
+
+func compileDestinationRules(rules []DestinationRule) (*destinationACL, error) {
+	acl := &destinationACL{defaultAllow: true}
+	for _, rule := range rules {
+		c := compiledDestinationRule{DestinationRule: rule}
+		if strings.Contains(rule.Host, "/") {
+			_, network, err := net.ParseCIDR(rule.Host)
+			if err != nil {
+				return nil, fmt.Errorf("destination rule %s: %w", rule.Host, err)
+			}
+			c.network = network
+		}
+		if !rule.Deny {
+			acl.defaultAllow = false
+		}
+		acl.rules = append(acl.rules, c)
+	}
+	return acl, nil
+}
+
+// check returns an ErrDenied error unless the rules allow addr, a
+// host:port destination.
+func (a *destinationACL) check(addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return wrapError(ErrDenied, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return wrapError(ErrDenied, fmt.Errorf("%s: bad port", addr))
+	}
+	for _, rule := range a.rules {
+		if rule.matches(host, port) {
+			if rule.Deny {
+				return wrapError(ErrDenied, fmt.Errorf("%s", addr))
+			}
+			return nil
+		}
+	}
+	if !a.defaultAllow {
+		return wrapError(ErrDenied, fmt.Errorf("%s", addr))
+	}
+	return nil
+}
+
+// denies reports whether the first rule matching addr, a host:port
+// destination, is a deny rule.
+func (a *destinationACL) denies(addr string) bool {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return true
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return true
+	}
+	for _, rule := range a.rules {
+		if rule.matches(host, port) {
+			return rule.Deny
+		}
+	}
+	return false
+}
+
+func (r *compiledDestinationRule) matches(host string, port int) bool {
+	if len(r.Ports) > 0 {
+		found := false
+		for _, p := range r.Ports {
+			if p == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.network.Contains(ip)
+	}
+	return matchHost(r.Host, host)
+}
@@ -0,0 +1,44 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// activity tracks the forwarded connections that are open.
+type activity struct {
+	mu     sync.Mutex
+	open   int
+	change time.Time
+}
+
+// connOpened records a client connection opened through fwd.
+func (p *SSHProxy) connOpened(fwd, addr string) {
+	p.activity.mu.Lock()
+	p.activity.open++
+	p.activity.change = time.Now()
+	p.activity.mu.Unlock()
+	p.emit(Event{Type: EventConnOpen, Forward: fwd, Addr: addr})
+}
+
+// connClosed records a client connection through fwd being closed.
+func (p *SSHProxy) connClosed(fwd, addr string) {
+	p.activity.mu.Lock()
+	p.activity.open--
+	p.activity.change = time.Now()
+	p.activity.mu.Unlock()
+	p.emit(Event{Type: EventConnClose, Forward: fwd, Addr: addr})
+}
+
+// Idle returns how long no forwarded connection has been open, counting
+// from New if there never was one. It is 0 while connections are open.
+func (p *SSHProxy) Idle() time.Duration {
+	p.activity.mu.Lock()
+	defer p.activity.mu.Unlock()
+	if p.activity.open > 0 {
+		return 0
+	}
+	return time.Since(p.activity.change)
+}
@@ -0,0 +1,266 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes one tunneled connection in an audit log.
+type AuditRecord struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds"`
+	Forward  string    `json:"forward"`
+	Client   string    `json:"client"`
+	Target   string    `json:"target,omitempty"`
+	// BytesUp is sent by the client, BytesDown by the target.
+	BytesUp   int64  `json:"bytes_up"`
+	BytesDown int64  `json:"bytes_down"`
+	DigestUp  string `json:"sha256_up,omitempty"`
+	// DigestDown is the SHA-256 of the payload sent by the target.
+	DigestDown string `json:"sha256_down,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Prev is the hash of the previous record, Hash the hash of this one
+	// including Prev, which chains the records together.
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// sum returns the hash of r, computed with Hash empty.
+func (r AuditRecord) sum() (string, error) {
+	r.Hash = ""
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(buf)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// AuditLog appends a hash-chained JSON record for every tunneled
+// connection to a writer. Records cannot be changed, removed or reordered
+// without breaking the chain, see VerifyAuditLog. It is safe for
+// concurrent use.
+type AuditLog struct {
+	// Digests records SHA-256 digests of the payload in each direction.
+	Digests bool
+
+	mu   sync.Mutex
+	w    io.Writer
+	seq  uint64
+	last string
+}
+
+// NewAuditLog returns an AuditLog writing to w that continues the chain of
+// the existing log r, which may be nil for a new log. r is verified first.
+func NewAuditLog(w io.Writer, r io.Reader) (*AuditLog, error) {
+	a := &AuditLog{w: w}
+	if r != nil {
+		last, err := verifyAuditLog(r)
+		if err != nil {
+			return nil, err
+		}
+		a.seq, a.last = last.Seq, last.Hash
+	}
+	return a, nil
+}
+
+// VerifyAuditLog checks the hash chain of the log in r and returns the
+// number of records.
+func VerifyAuditLog(r io.Reader) (uint64, error) {
+	last, err := verifyAuditLog(r)
+	return last.Seq, err
+}
+
+func verifyAuditLog(r io.Reader) (AuditRecord, error) {
+	var last AuditRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return last, fmt.Errorf("record %d: %w", last.Seq+1, err)
+		}
+		if rec.Seq != last.Seq+1 || rec.Prev != last.Hash {
+			return last, fmt.Errorf("record %d: chain broken after record %d", rec.Seq, last.Seq)
+		}
+		sum, err := rec.sum()
+		if err != nil {
+			return last, err
+		}
+		if sum != rec.Hash {
+			return last, fmt.Errorf("record %d: hash mismatch", rec.Seq)
+		}
+		last = rec
+	}
+	return last, scanner.Err()
+}
+
+// write chains rec to the log and appends it.
+func (a *AuditLog) write(rec AuditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rec.Seq = a.seq + 1
+	rec.Prev = a.last
+	sum, err := rec.sum()
+	if err != nil {
+		logger.Errorf("audit: %s", err)
+		return
+	}
+	rec.Hash = sum
+	buf, _ := json.Marshal(rec)
+	if _, err := a.w.Write(append(buf, '\n')); err != nil {
+		logger.Errorf("audit: %s", err)
+		return
+	}
+	a.seq, a.last = rec.Seq, rec.Hash
+}
+
+// WithAudit records every connection through the forwards of p in a. It
+// must be called before forwards are set up.
+func (p *SSHProxy) WithAudit(a *AuditLog) {
+	p.audit = a
+}
+
+// auditConn collects the audit record of one connection, for the audit
+// log and the session stats, either of which may be nil.
+type auditConn struct {
+	a       *AuditLog
+	session *SessionStats
+	rec     AuditRecord
+	start   time.Time
+
+	up, down auditCounter
+	err      error
+}
+
+// fail records err as the outcome of the connection.
+func (c *auditConn) fail(err error) {
+	if c != nil {
+		c.err = err
+	}
+}
+
+// auditKey is the request context key holding the audit record of an
+// HTTP request.
+type auditKey struct{}
+
+// auditWriter counts and hashes a response body.
+type auditWriter struct {
+	http.ResponseWriter
+	c *auditConn
+}
+
+func (w auditWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.c.down.add(b[:n])
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// auditRequest starts the record of an HTTP request to target. The
+// returned request and writer count the bodies.
+func (p *SSHProxy) auditRequest(fwd *forward, w http.ResponseWriter, r *http.Request, target string) (*auditConn, http.ResponseWriter, *http.Request) {
+	c := p.auditStart(fwd, r.RemoteAddr, target)
+	if c == nil {
+		return nil, w, r
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		c.up.Reader = r.Body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{&c.up, r.Body}
+	}
+	r = r.WithContext(context.WithValue(r.Context(), auditKey{}, c))
+	return c, auditWriter{w, c}, r
+}
+
+// auditCounter counts bytes read through it, and hashes them if sum is set.
+type auditCounter struct {
+	io.Reader
+	n   int64
+	sum hash.Hash
+}
+
+func (c *auditCounter) Read(b []byte) (int, error) {
+	n, err := c.Reader.Read(b)
+	c.add(b[:n])
+	return n, err
+}
+
+func (c *auditCounter) add(b []byte) {
+	c.n += int64(len(b))
+	if c.sum != nil {
+		c.sum.Write(b)
+	}
+}
+
+// auditStart starts the record of a connection, returning nil if neither
+// auditing nor session stats are on.
+func (p *SSHProxy) auditStart(fwd *forward, client, target string) *auditConn {
+	if p.audit == nil && p.session == nil {
+		return nil
+	}
+	c := &auditConn{
+		a:       p.audit,
+		session: p.session,
+		start:   time.Now(),
+		rec:     AuditRecord{Forward: fwd.name, Client: client, Target: target},
+	}
+	if p.audit != nil && p.audit.Digests {
+		c.up.sum, c.down.sum = sha256.New(), sha256.New()
+	}
+	return c
+}
+
+// readers wraps the readers of both directions to count and hash them.
+func (c *auditConn) readers(up, down io.Reader) (io.Reader, io.Reader) {
+	if c == nil {
+		return up, down
+	}
+	c.up.Reader, c.down.Reader = up, down
+	return &c.up, &c.down
+}
+
+// finish writes the record of the connection. An error set with fail
+// takes precedence over err.
+func (c *auditConn) finish(err error) {
+	if c == nil {
+		return
+	}
+	if c.err != nil {
+		err = c.err
+	}
+	c.rec.Time = c.start.UTC()
+	c.rec.Duration = time.Since(c.start).Seconds()
+	c.rec.BytesUp, c.rec.BytesDown = c.up.n, c.down.n
+	if c.up.sum != nil {
+		c.rec.DigestUp = hex.EncodeToString(c.up.sum.Sum(nil))
+		c.rec.DigestDown = hex.EncodeToString(c.down.sum.Sum(nil))
+	}
+	if err != nil {
+		c.rec.Error = err.Error()
+	}
+	if c.a != nil {
+		c.a.write(c.rec)
+	}
+	if c.session != nil {
+		c.session.record(c.rec)
+	}
+}
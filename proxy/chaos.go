@@ -0,0 +1,95 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// Chaos injects faults into a forward, to test how clients cope with a
+// degraded remote.
+type Chaos struct {
+	// Latency delays each connection, or each request in L7 mode, before
+	// it is sent to the remote.
+	Latency time.Duration
+	// DropPercent is the share of connections, from 0 to 100, closed as
+	// soon as they are accepted.
+	DropPercent float64
+	// TruncatePercent is the share of connections, or of responses in L7
+	// mode, cut off after TruncateAfter bytes from the remote.
+	TruncatePercent float64
+	TruncateAfter   int64
+}
+
+var errTruncated = errors.New("response truncated by chaos")
+
+func checkChaos(c *Chaos) error {
+	if c.Latency < 0 || c.TruncateAfter < 0 {
+		return errors.New("chaos latency and truncation must not be negative")
+	}
+	if c.DropPercent < 0 || c.DropPercent > 100 || c.TruncatePercent < 0 || c.TruncatePercent > 100 {
+		return errors.New("chaos percentages must be between 0 and 100")
+	}
+	return nil
+}
+
+// chance reports true for percent out of 100 calls.
+func chance(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// drop reports whether to close a newly accepted connection. A nil Chaos
+// injects nothing.
+func (c *Chaos) drop() bool {
+	return c != nil && chance(c.DropPercent)
+}
+
+// delay waits for the injected latency, or until done is closed.
+func (c *Chaos) delay(done <-chan struct{}) {
+	if c == nil || c.Latency <= 0 {
+		return
+	}
+	t := time.NewTimer(c.Latency)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-done:
+	}
+}
+
+// truncate returns r cut off after TruncateAfter bytes for the share of
+// calls set by TruncatePercent, and r itself otherwise.
+func (c *Chaos) truncate(r io.Reader) io.Reader {
+	if c == nil || !chance(c.TruncatePercent) {
+		return r
+	}
+	return &truncatedReader{r: r, n: c.TruncateAfter}
+}
+
+// truncatedReader reads up to n bytes from r, then fails.
+type truncatedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (t *truncatedReader) Read(b []byte) (int, error) {
+	if t.n <= 0 {
+		return 0, errTruncated
+	}
+	if int64(len(b)) > t.n {
+		b = b[:t.n]
+	}
+	n, err := t.r.Read(b)
+	t.n -= int64(n)
+	return n, err
+}
+
+// truncatedBody is a response body cut off by chaos that still closes the
+// original.
+type truncatedBody struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,195 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connectTimeout bounds how long a client may take to ask for a
+// destination.
+const connectTimeout = 30 * time.Second
+
+// errBadConnect means a client sent something other than a CONNECT request
+// for a host:port destination.
+var errBadConnect = errors.New("bad CONNECT request")
+
+// proxyProtocol is the protocol of a proxy mode, in which clients choose
+// the destination of each connection.
+type proxyProtocol interface {
+	// request reads the destination of a client and returns it with a
+	// reader for the rest of the client stream.
+	request(conn net.Conn) (string, io.Reader, error)
+	// reply tells the client whether its destination was reached; err is
+	// nil on success.
+	reply(conn net.Conn, err error) error
+}
+
+// handleProxy serves a client of a forward in a proxy mode: it reads the
+// destination with proto, checks it against the destination rules of the
+// forward and splices the client to it. Host names are passed to the ssh
+// server as they are, so they are resolved on the remote side. settings
+// are those of fwd when the client was accepted.
+func (p *SSHProxy) handleProxy(local net.Conn, fwd *forward, settings *forwardSettings, proto proxyProtocol) {
+	if !p.memory.acquire(settings.priority) {
+		err := wrapError(ErrOverloaded, nil)
+		fwd.log.conns.Warningf("shedding connection to %s: %s", fwd.name, err)
+		proto.reply(local, err)
+		p.rejectClient(local, fwd, "", err)
+		return
+	}
+	client := local.RemoteAddr().String()
+	reject := func(target, outcome string, err error) {
+		logForwardError(fwd, err)
+		p.logConnect(fwd, client, target, outcome, err)
+		proto.reply(local, err)
+		p.rejectClient(local, fwd, target, err)
+		p.memory.release()
+	}
+	if err := local.SetReadDeadline(time.Now().Add(orDefault(settings.acceptTimeout, connectTimeout))); err != nil {
+		reject("", ConnectFailed, err)
+		return
+	}
+	target, r, err := proto.request(local)
+	if err != nil {
+		reject("", ConnectFailed, err)
+		return
+	}
+	if err := local.SetReadDeadline(time.Time{}); err != nil {
+		reject(target, ConnectFailed, err)
+		return
+	}
+	if err := settings.acl.check(target); err != nil {
+		reject(target, ConnectDenied, err)
+		return
+	}
+	if err := p.checkPolicy(target); err != nil {
+		reject(target, ConnectDenied, err)
+		return
+	}
+	settings.chaos.delay(p.done)
+	start := time.Now()
+	remote, err := dialContext(p.ctx, settings.dialTimeout, target, func() (net.Conn, error) {
+		if d, ok := proto.(destinationDialer); ok {
+			return d.dial(p, target, settings.priority)
+		}
+		return p.dialDestination(target, settings.priority)
+	})
+	if err != nil {
+		reject(target, ConnectFailed, err)
+		return
+	}
+	p.checkDial(fwd, target, time.Since(start))
+	if err := proto.reply(local, nil); err != nil {
+		remote.Close()
+		p.logConnect(fwd, client, target, ConnectFailed, err)
+		p.rejectClient(local, fwd, target, err)
+		p.memory.release()
+		return
+	}
+	p.logConnect(fwd, client, target, ConnectConnected, nil)
+	p.splice(fwd, settings, local, r, remote, target)
+}
+
+// connectProtocol is the HTTP CONNECT method. Plain HTTP requests for an
+// absolute http URL, which clients send to an HTTP_PROXY, are forwarded as
+// well, one per connection.
+type connectProtocol struct {
+	// plain is set if the client sent a plain HTTP request, which is
+	// passed on instead of answered.
+	plain bool
+	// upstream, if set, is the proxy requests are passed on to.
+	upstream *Upstream
+}
+
+func (c *connectProtocol) request(conn net.Conn) (string, io.Reader, error) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %s", errBadConnect, err)
+	}
+	if req.Method != http.MethodConnect {
+		return c.plainRequest(req, r)
+	}
+	_, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %s", errBadConnect, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", nil, fmt.Errorf("%w: port %q", errBadConnect, port)
+	}
+	return req.Host, r, nil
+}
+
+// plainRequest returns the destination of req, a plain HTTP request, and
+// a reader replaying it in origin form, or in absolute form with the
+// credentials of the upstream proxy if there is one, followed by its body
+// from r. The
+// request asks the server to close the connection, so later requests of
+// the client, which may be for other hosts, come in on a new one.
+func (c *connectProtocol) plainRequest(req *http.Request, r *bufio.Reader) (string, io.Reader, error) {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return "", nil, fmt.Errorf("%w: method %s", errBadConnect, req.Method)
+	}
+	c.plain = true
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	target := req.URL.RequestURI()
+	if c.upstream != nil {
+		target = req.URL.String()
+		if auth := c.upstream.authorization(); auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
+	}
+	req.Header.Set("Connection", "close")
+	// ReadRequest moves the framing of the body out of the header.
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	} else if req.ContentLength > 0 {
+		req.Header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, target, req.Host)
+	req.Header.Write(&head)
+	head.WriteString("\r\n")
+	return addr, io.MultiReader(&head, r), nil
+}
+
+// reply writes a bodyless HTTP response. Only errors close the connection.
+// Plain HTTP requests are answered by the destination on success.
+func (c *connectProtocol) reply(conn net.Conn, err error) error {
+	if err == nil && c.plain {
+		return nil
+	}
+	status := http.StatusOK
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrDenied):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrOverloaded), errors.Is(err, ErrServerBusy):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, errBadConnect):
+		status = http.StatusBadRequest
+	default:
+		status = http.StatusBadGateway
+	}
+	header := ""
+	if status != http.StatusOK {
+		header = "Content-Length: 0\r\nConnection: close\r\n"
+	}
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%s\r\n", status, http.StatusText(status), header)
+	return err
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Outcomes of a destination asked for in a proxy mode.
+const (
+	// ConnectConnected means the destination was dialed and the client
+	// tunneled to it.
+	ConnectConnected = "connected"
+	// ConnectDenied means the destination rules of the forward rejected
+	// the destination.
+	ConnectDenied = "denied"
+	// ConnectFailed means the request was malformed or the destination
+	// could not be dialed.
+	ConnectFailed = "failed"
+)
+
+// ConnectRecord describes one destination asked for in a proxy mode.
+type ConnectRecord struct {
+	Time    time.Time `json:"time"`
+	Forward string    `json:"forward"`
+	// Client is the address of the client.
+	Client string `json:"client"`
+	// Destination is empty if the request could not be read.
+	Destination string `json:"destination,omitempty"`
+	Outcome     string `json:"outcome"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ConnectLog writes a JSON record for every destination asked for in
+// a proxy mode, keeping an account of where clients went separate from
+// operational logging. It is safe for concurrent use.
+type ConnectLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewConnectLog returns a ConnectLog appending records to w.
+func NewConnectLog(w io.Writer) *ConnectLog {
+	return &ConnectLog{w: w}
+}
+
+// WithConnectLog records the destinations of all proxy mode forwards of
+// p in l. It must be called before forwards are set up.
+func (p *SSHProxy) WithConnectLog(l *ConnectLog) {
+	p.connectLog = l
+}
+
+// logConnect writes a record for a destination of a client of fwd, if a
+// connect log is set. err is the reason for the outcome, if any.
+func (p *SSHProxy) logConnect(fwd *forward, client, destination, outcome string, err error) {
+	l := p.connectLog
+	if l == nil {
+		return
+	}
+	rec := ConnectRecord{
+		Time:        time.Now().UTC(),
+		Forward:     fwd.name,
+		Client:      client,
+		Destination: destination,
+		Outcome:     outcome,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	buf, _ := json.Marshal(rec)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(buf, '\n')); err != nil {
+		logger.Errorf("connect log: %s", err)
+	}
+}
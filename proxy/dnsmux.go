@@ -0,0 +1,311 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var errDNSMuxClosed = errors.New("dns: channel to the server closed")
+
+// dnsTimeout is returned by the reads of a dnsConn past its deadline.
+type dnsTimeout struct{}
+
+func (dnsTimeout) Error() string   { return "dns: i/o timeout" }
+func (dnsTimeout) Timeout() bool   { return true }
+func (dnsTimeout) Temporary() bool { return true }
+
+// dnsMux carries the queries of the resolver to the DNS server over one
+// channel, pipelined as DNS over TCP allows, rather than opening a channel
+// per query. Queries are given IDs unique on the channel and answers are
+// matched back to them, so lookups do not wait for a channel open under
+// load. The channel is opened again when the server closes it.
+type dnsMux struct {
+	p      *SSHProxy
+	server string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	dialing *dnsDial
+	pending map[uint16]chan []byte
+	nextID  uint16
+
+	// wmu orders the writes of queries on the channel, which are made
+	// without mu held so a slow write does not stall the answers.
+	wmu sync.Mutex
+}
+
+// dnsDial is an open of the channel to the server in progress, which the
+// queries arriving meanwhile wait for rather than opening their own.
+type dnsDial struct {
+	done chan struct{}
+	conn net.Conn
+	err  error
+}
+
+func newDNSMux(p *SSHProxy, server string) *dnsMux {
+	return &dnsMux{p: p, server: server, pending: make(map[uint16]chan []byte)}
+}
+
+// query sends msg, a DNS message, and returns the ID it was sent with and
+// the channel its answer arrives on, closed if the channel to the server
+// fails first.
+func (m *dnsMux) query(msg []byte) (uint16, <-chan []byte, error) {
+	if len(msg) < 2 {
+		return 0, nil, errors.New("dns: short query")
+	}
+	conn, err := m.channel()
+	if err != nil {
+		return 0, nil, err
+	}
+	m.mu.Lock()
+	if m.conn != conn {
+		m.mu.Unlock()
+		return 0, nil, errDNSMuxClosed
+	}
+	for {
+		m.nextID++
+		if _, ok := m.pending[m.nextID]; !ok {
+			break
+		}
+	}
+	id := m.nextID
+	answer := make(chan []byte, 1)
+	m.pending[id] = answer
+	m.mu.Unlock()
+
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	binary.BigEndian.PutUint16(frame[2:], id)
+	m.wmu.Lock()
+	_, err = conn.Write(frame)
+	m.wmu.Unlock()
+	if err != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.pending[id] == answer {
+			delete(m.pending, id)
+		}
+		m.failLocked(conn)
+		return 0, nil, err
+	}
+	return id, answer, nil
+}
+
+// channel returns the channel to the server, opening it if there is none.
+// The queries arriving while it is opened wait for that open.
+func (m *dnsMux) channel() (net.Conn, error) {
+	m.mu.Lock()
+	if m.conn != nil {
+		conn := m.conn
+		m.mu.Unlock()
+		return conn, nil
+	}
+	if d := m.dialing; d != nil {
+		m.mu.Unlock()
+		<-d.done
+		return d.conn, d.err
+	}
+	d := &dnsDial{done: make(chan struct{})}
+	m.dialing = d
+	m.mu.Unlock()
+
+	d.conn, d.err = m.p.dialChannel(m.server, PriorityNormal)
+	m.mu.Lock()
+	m.dialing = nil
+	if d.err == nil {
+		m.conn = d.conn
+		go m.readAnswers(d.conn)
+	}
+	m.mu.Unlock()
+	close(d.done)
+	return d.conn, d.err
+}
+
+// cancel forgets the query id, whose answer is no longer waited for.
+func (m *dnsMux) cancel(id uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pending, id)
+}
+
+// readAnswers hands the answers read from conn to their queries until it
+// fails.
+func (m *dnsMux) readAnswers(conn net.Conn) {
+	var size [2]byte
+	for {
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			break
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil || len(msg) < 2 {
+			break
+		}
+		id := binary.BigEndian.Uint16(msg)
+		m.mu.Lock()
+		answer, ok := m.pending[id]
+		delete(m.pending, id)
+		m.mu.Unlock()
+		if ok {
+			answer <- msg
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failLocked(conn)
+}
+
+// failLocked closes conn and, if it is still the channel in use, fails the
+// queries waiting on it.
+func (m *dnsMux) failLocked(conn net.Conn) {
+	conn.Close()
+	if m.conn != conn {
+		return
+	}
+	m.conn = nil
+	for id, answer := range m.pending {
+		close(answer)
+		delete(m.pending, id)
+	}
+}
+
+// dial returns a connection for the resolver, which speaks DNS over TCP
+// on it, carrying its queries over the shared channel.
+func (m *dnsMux) dial() net.Conn {
+	return &dnsConn{mux: m, done: make(chan struct{})}
+}
+
+// dnsConn is the connection of one lookup of the resolver. It takes
+// length prefixed queries, sends them through the mux and gives back the
+// answers with the IDs of the queries.
+type dnsConn struct {
+	mux  *dnsMux
+	done chan struct{}
+
+	mu       sync.Mutex
+	wbuf     []byte
+	rbuf     []byte
+	queries  []dnsQuery
+	deadline time.Time
+	closed   bool
+}
+
+// dnsQuery is a query of a dnsConn waiting for its answer.
+type dnsQuery struct {
+	origID uint16
+	id     uint16
+	answer <-chan []byte
+}
+
+func (c *dnsConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, errDNSMuxClosed
+	}
+	c.wbuf = append(c.wbuf, b...)
+	for len(c.wbuf) >= 2 {
+		n := int(binary.BigEndian.Uint16(c.wbuf))
+		if len(c.wbuf) < 2+n {
+			break
+		}
+		msg := c.wbuf[2 : 2+n]
+		c.wbuf = c.wbuf[2+n:]
+		if n < 2 {
+			continue
+		}
+		id, answer, err := c.mux.query(msg)
+		if err != nil {
+			return 0, err
+		}
+		c.queries = append(c.queries, dnsQuery{origID: binary.BigEndian.Uint16(msg), id: id, answer: answer})
+	}
+	return len(b), nil
+}
+
+func (c *dnsConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.rbuf) == 0 && len(c.queries) > 0 {
+		q, deadline := c.queries[0], c.deadline
+		c.mu.Unlock()
+		msg, err := c.wait(q, deadline)
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		c.queries = c.queries[1:]
+		c.rbuf = make([]byte, 2+len(msg))
+		binary.BigEndian.PutUint16(c.rbuf, uint16(len(msg)))
+		copy(c.rbuf[2:], msg)
+		binary.BigEndian.PutUint16(c.rbuf[2:], q.origID)
+	}
+	defer c.mu.Unlock()
+	if len(c.rbuf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// wait waits for the answer of q until deadline, if set.
+func (c *dnsConn) wait(q dnsQuery, deadline time.Time) ([]byte, error) {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case msg, ok := <-q.answer:
+		if !ok {
+			return nil, errDNSMuxClosed
+		}
+		return msg, nil
+	case <-expired:
+		return nil, dnsTimeout{}
+	case <-c.done:
+		return nil, errDNSMuxClosed
+	}
+}
+
+// Close forgets the queries still waiting for an answer.
+func (c *dnsConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	for _, q := range c.queries {
+		c.mux.cancel(q.id)
+	}
+	c.queries = nil
+	return nil
+}
+
+func (c *dnsConn) LocalAddr() net.Addr  { return dnsMuxAddr(c.mux.server) }
+func (c *dnsConn) RemoteAddr() net.Addr { return dnsMuxAddr(c.mux.server) }
+
+func (c *dnsConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *dnsConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *dnsConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// dnsMuxAddr is the address of a dnsConn, the DNS server it queries.
+type dnsMuxAddr string
+
+func (a dnsMuxAddr) Network() string { return "tcp" }
+func (a dnsMuxAddr) String() string  { return string(a) }
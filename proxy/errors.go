@@ -0,0 +1,153 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Failure classes returned by the proxy. Use errors.Is to check for them.
+var (
+	// ErrAuthFailed means the ssh server rejected all authentication methods.
+	ErrAuthFailed = errors.New("ssh authentication failed")
+	// ErrHostKeyMismatch means the host key presented by the ssh server was rejected.
+	ErrHostKeyMismatch = errors.New("ssh host key mismatch")
+	// ErrRemoteDial means the remote address could not be reached over the ssh connection.
+	ErrRemoteDial = errors.New("remote dial failed")
+	// ErrForwardingProhibited means the ssh server refused to open a
+	// channel to the remote address by policy, e.g. AllowTcpForwarding or
+	// PermitOpen. It comes wrapped in ErrRemoteDial.
+	ErrForwardingProhibited = errors.New("ssh server prohibits forwarding")
+	// ErrTargetUnreachable means the ssh server could not connect to the
+	// remote address, which is down or unreachable from there. It comes
+	// wrapped in ErrRemoteDial.
+	ErrTargetUnreachable = errors.New("target unreachable from the ssh server")
+	// ErrServerBusy means the ssh server was out of resources to open a
+	// channel. It comes wrapped in ErrRemoteDial.
+	ErrServerBusy = errors.New("ssh server out of resources")
+	// ErrNotConnected means an operation needed an ssh connection but there is none.
+	ErrNotConnected = errors.New("not connected")
+	// ErrOverloaded means a connection was shed because the proxy is at capacity.
+	ErrOverloaded = errors.New("proxy overloaded")
+	// ErrNoRoute means no remote address could be chosen for a connection.
+	ErrNoRoute = errors.New("no route")
+	// ErrDenied means the destination rules of a forward or the policy
+	// rejected a destination.
+	ErrDenied = errors.New("destination denied")
+	// ErrUnknownForward means no forward exists with the given name.
+	ErrUnknownForward = errors.New("unknown forward")
+)
+
+// Error wraps an underlying error with one of the failure classes above.
+type Error struct {
+	// Kind is the failure class, e.g. ErrAuthFailed.
+	Kind error
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the failure class of e.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func wrapError(kind, err error) error {
+	return &Error{Kind: kind, Err: err}
+}
+
+// classifyChannelError maps the reason the ssh server gave for refusing to
+// open a channel to a failure class.
+func classifyChannelError(err error) error {
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) {
+		return err
+	}
+	switch openErr.Reason {
+	case ssh.Prohibited:
+		return wrapError(ErrForwardingProhibited, err)
+	case ssh.ConnectionFailed:
+		return wrapError(ErrTargetUnreachable, err)
+	case ssh.ResourceShortage:
+		return wrapError(ErrServerBusy, err)
+	}
+	return err
+}
+
+// DialFailures counts failed remote dials by failure class.
+type DialFailures struct {
+	// Prohibited counts dials the ssh server refused by policy.
+	Prohibited int64
+	// Unreachable counts dials to targets the ssh server could not reach.
+	Unreachable int64
+	// ServerBusy counts dials the ssh server had no resources for.
+	ServerBusy int64
+	// Other counts all other failed dials, e.g. for lack of a connection.
+	Other int64
+}
+
+// DialFailures returns the counts of failed remote dials.
+func (p *SSHProxy) DialFailures() DialFailures {
+	return DialFailures{
+		Prohibited:  atomic.LoadInt64(&p.dialFailures.Prohibited),
+		Unreachable: atomic.LoadInt64(&p.dialFailures.Unreachable),
+		ServerBusy:  atomic.LoadInt64(&p.dialFailures.ServerBusy),
+		Other:       atomic.LoadInt64(&p.dialFailures.Other),
+	}
+}
+
+// countDialFailure counts err in the failure class it belongs to.
+func (p *SSHProxy) countDialFailure(err error) {
+	switch {
+	case errors.Is(err, ErrForwardingProhibited):
+		atomic.AddInt64(&p.dialFailures.Prohibited, 1)
+	case errors.Is(err, ErrTargetUnreachable):
+		atomic.AddInt64(&p.dialFailures.Unreachable, 1)
+	case errors.Is(err, ErrServerBusy):
+		atomic.AddInt64(&p.dialFailures.ServerBusy, 1)
+	default:
+		atomic.AddInt64(&p.dialFailures.Other, 1)
+	}
+}
+
+// logForwardError logs err of a connection through fwd, with a hint at the
+// cause for remote dial failures.
+func logForwardError(fwd *forward, err error) {
+	switch {
+	case errors.Is(err, ErrForwardingProhibited):
+		fwd.log.conns.Errorf("forward %s: the ssh server does not allow forwarding to this target, check AllowTcpForwarding and PermitOpen there: %s", fwd.name, err)
+	case errors.Is(err, ErrTargetUnreachable):
+		fwd.log.conns.Errorf("forward %s: the target is down or unreachable from the ssh server: %s", fwd.name, err)
+	case errors.Is(err, ErrServerBusy):
+		fwd.log.conns.Errorf("forward %s: the ssh server is out of resources: %s", fwd.name, err)
+	default:
+		fwd.log.conns.Errorf("forward %s: %s", fwd.name, err)
+	}
+}
+
+// classifyDialError maps an error from dialing the ssh server to a failure class.
+func classifyDialError(err, hostKeyErr error) error {
+	switch {
+	case hostKeyErr != nil:
+		return wrapError(ErrHostKeyMismatch, err)
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		// x/crypto/ssh does not export an error value for this.
+		return wrapError(ErrAuthFailed, err)
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import "time"
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+// Event types sent on the channels returned by SSHProxy.Events.
+const (
+	// EventConnected is sent when the ssh connection is established.
+	EventConnected EventType = iota
+	// EventDisconnected is sent when the ssh connection goes away.
+	EventDisconnected
+	// EventForwardUp is sent when a forward starts listening.
+	EventForwardUp
+	// EventForwardPaused is sent when a forward is paused.
+	EventForwardPaused
+	// EventForwardResumed is sent when a forward is resumed.
+	EventForwardResumed
+	// EventForwardError is sent when a forward fails to accept or dial a connection.
+	EventForwardError
+	// EventConnOpen is sent when a client connection is opened through a forward.
+	EventConnOpen
+	// EventConnClose is sent when a client connection is closed.
+	EventConnClose
+	// EventForwardDown is sent when a forward is closed.
+	EventForwardDown
+	// EventTunnelLost is sent when the ssh server stops answering
+	// keepalives, before the connection is closed and EventDisconnected
+	// is sent.
+	EventTunnelLost
+	// EventTargetUp is sent when the targets of a watched forward start
+	// listening, and it accepts connections again.
+	EventTargetUp
+	// EventTargetDown is sent when a target of a watched forward stops
+	// listening, and it refuses connections until it is back.
+	EventTargetDown
+)
+
+var eventTypeNames = map[EventType]string{
+	EventConnected:      "connected",
+	EventDisconnected:   "disconnected",
+	EventForwardUp:      "forward-up",
+	EventForwardPaused:  "forward-paused",
+	EventForwardResumed: "forward-resumed",
+	EventForwardError:   "forward-error",
+	EventConnOpen:       "conn-open",
+	EventConnClose:      "conn-close",
+	EventForwardDown:    "forward-down",
+	EventTunnelLost:     "tunnel-lost",
+	EventTargetUp:       "target-up",
+	EventTargetDown:     "target-down",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Event describes a change in the state of the proxy.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Forward is the name of the forward the event belongs to, if any.
+	Forward string
+	// Addr is the ssh server address for connection events, the local
+	// address for forward events and the client address for conn events.
+	Addr string
+	// Err is set for disconnect and error events.
+	Err error
+}
+
+// eventBuffer is the number of events buffered per subscriber. Events are
+// dropped for subscribers that fall behind.
+const eventBuffer = 64
+
+// Events returns a new channel that receives proxy events and a func that
+// unsubscribes from them and closes the channel. The channel is also
+// closed on Shutdown. Slow readers miss events rather than block the proxy.
+func (p *SSHProxy) Events() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	p.evmu.Lock()
+	defer p.evmu.Unlock()
+	if p.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	p.subscribers = append(p.subscribers, ch)
+	return ch, func() { p.unsubscribe(ch) }
+}
+
+// unsubscribe removes ch from the subscribers and closes it, unless
+// Shutdown or an earlier call did.
+func (p *SSHProxy) unsubscribe(ch chan Event) {
+	p.evmu.Lock()
+	defer p.evmu.Unlock()
+	for i, sub := range p.subscribers {
+		if sub == ch {
+			p.subscribers = append(p.subscribers[:i], p.subscribers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+func (p *SSHProxy) emit(ev Event) {
+	ev.Time = time.Now()
+	p.evmu.Lock()
+	defer p.evmu.Unlock()
+	for _, ch := range p.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (p *SSHProxy) closeSubscribers() {
+	p.evmu.Lock()
+	defer p.evmu.Unlock()
+	p.closed = true
+	for _, ch := range p.subscribers {
+		close(ch)
+	}
+	p.subscribers = nil
+}
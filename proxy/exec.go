@@ -0,0 +1,138 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// execPrefix marks a remote that is a command run on the ssh server, whose
+// stdin and stdout are the connection, e.g. exec:psql-proxy --stdio.
+const execPrefix = "exec:"
+
+// isExec reports whether remote is a command rather than an address.
+func isExec(remote string) bool {
+	return strings.HasPrefix(remote, execPrefix)
+}
+
+// dialTarget opens a connection to remote, running it in an ssh session if
+// it is a command or looking it up first if it is a service. Only remotes
+// from the configuration may be commands or services, never destinations
+// chosen by clients.
+func (p *SSHProxy) dialTarget(remote string, prio Priority) (net.Conn, error) {
+	if isExec(remote) {
+		if err := p.checkPolicyRemotes(remote); err != nil {
+			return nil, err
+		}
+		conn, err := p.dialExec(strings.TrimPrefix(remote, execPrefix), prio)
+		if err != nil {
+			p.countDialFailure(err)
+		}
+		return conn, err
+	}
+	if isService(remote) {
+		targets, err := p.lookupService(remote)
+		if err != nil {
+			return nil, err
+		}
+		if targets, err = p.allowedTargets(remote, targets); err != nil {
+			return nil, err
+		}
+		conn, err := p.race(remote, targets, 0, prio)
+		if err != nil {
+			p.countDialFailure(err)
+		}
+		return conn, err
+	}
+	return p.dial(remote, prio)
+}
+
+// dialExec runs command in a new session on the ssh server and returns a
+// connection over its stdin and stdout for a forward of priority prio. Its
+// stderr is logged. With MaxStartups, it waits for a slot like dialChannel.
+func (p *SSHProxy) dialExec(command string, prio Priority) (net.Conn, error) {
+	conn, err := p.parkedClient()
+	if err != nil {
+		return nil, err
+	}
+	if p.startups != nil {
+		if !p.startups.acquire(prio, p.done) {
+			return nil, wrapError(ErrNotConnected, nil)
+		}
+		defer p.startups.release()
+	}
+	sess, err := conn.NewSession()
+	if err != nil {
+		return nil, wrapError(ErrRemoteDial, fmt.Errorf("exec %s: %w", command, classifyChannelError(err)))
+	}
+	w, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	r, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	stderr, err := sess.StderrPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	if err := sess.Start(command); err != nil {
+		sess.Close()
+		return nil, wrapError(ErrRemoteDial, fmt.Errorf("exec %s: %w", command, err))
+	}
+	go func() {
+		s := bufio.NewScanner(stderr)
+		for s.Scan() {
+			logger.Infof("%s: %s", command, s.Text())
+		}
+	}()
+	logger.Debugf("started remote command %q", command)
+	c := &execConn{sess: sess, r: r, w: w, addr: commandAddr(command)}
+	return p.tunneled(conn, c, prio), nil
+}
+
+var errExecDeadline = errors.New("exec: deadline not supported")
+
+// execConn is a connection to the stdin and stdout of a command running in
+// an ssh session.
+type execConn struct {
+	sess *ssh.Session
+	r    io.Reader
+	w    io.WriteCloser
+	addr commandAddr
+}
+
+func (c *execConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *execConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// CloseWrite closes the stdin of the command.
+func (c *execConn) CloseWrite() error { return c.w.Close() }
+
+// Close ends the session, which stops the command on most servers.
+func (c *execConn) Close() error {
+	err := c.sess.Close()
+	if err == io.EOF {
+		// The command already exited.
+		err = nil
+	}
+	return err
+}
+
+func (c *execConn) LocalAddr() net.Addr  { return c.addr }
+func (c *execConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *execConn) SetDeadline(t time.Time) error      { return errExecDeadline }
+func (c *execConn) SetReadDeadline(t time.Time) error  { return errExecDeadline }
+func (c *execConn) SetWriteDeadline(t time.Time) error { return errExecDeadline }
@@ -0,0 +1,178 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// attemptDelay is how long a channel open gets before the next
+	// address is tried alongside it with HappyEyeballs, see RFC 8305.
+	attemptDelay = 250 * time.Millisecond
+	// resolveTimeout bounds the local lookup of a target name.
+	resolveTimeout = 5 * time.Second
+)
+
+// preferFamily returns the configured family preference.
+func (p *SSHProxy) preferFamily() Family {
+	if p.cfg.PreferFamily == "" {
+		return FamilyAuto
+	}
+	return p.cfg.PreferFamily
+}
+
+// dialServer connects to the ssh server with the dialer or the proxy
+// command, or directly trying the preferred address family first, or to
+// the address knocked on with Knock.
+func (p *SSHProxy) dialServer() (net.Conn, error) {
+	if p.dialer != nil {
+		return p.dialer(p.ctx, "tcp", p.cfg.RemoteAddress)
+	}
+	if p.cfg.ProxyCommand != "" {
+		return p.dialCommand()
+	}
+	if len(p.cfg.Knock) > 0 {
+		return p.dialFrom(nil)
+	}
+	addr := p.cfg.RemoteAddress
+	networks := []string{"tcp"}
+	switch p.preferFamily() {
+	case FamilyIPv4:
+		networks = []string{"tcp4", "tcp6"}
+	case FamilyIPv6:
+		networks = []string{"tcp6", "tcp4"}
+	}
+	var firstErr error
+	for _, network := range networks {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		logger.Debugf("%s over %s: %s", addr, network, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// dialResolved opens a channel to addr like dialChannel, but resolves its
+// host locally, or with the DNS server of the config, and tries its
+// addresses in order of preference if there is more than one. Addresses
+// the policy denies are skipped, so a name cannot lead to them.
+func (p *SSHProxy) dialResolved(addr string, prio Priority) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return p.dialChannel(addr, prio)
+	}
+	ips := p.lookupHost(host)
+	if len(ips) > 0 {
+		if ips = p.policyAddrs(ips, port); len(ips) == 0 {
+			return nil, wrapError(ErrDenied, fmt.Errorf("%s: resolves to addresses not allowed by the policy", addr))
+		}
+	}
+	switch len(ips) {
+	case 0:
+		return p.dialChannel(addr, prio)
+	case 1:
+		return p.dialChannel(net.JoinHostPort(ips[0].String(), port), prio)
+	}
+	var delay time.Duration
+	if p.cfg.HappyEyeballs {
+		delay = attemptDelay
+	}
+	var targets []string
+	for _, ip := range orderAddrs(ips, p.preferFamily()) {
+		targets = append(targets, net.JoinHostPort(ip.String(), port))
+	}
+	return p.race(addr, targets, delay, prio)
+}
+
+// orderAddrs orders ips by family: the preferred family first, or
+// alternating between IPv6 and IPv4 for FamilyAuto.
+func orderAddrs(ips []net.IP, family Family) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch family {
+	case FamilyIPv4:
+		return append(v4, v6...)
+	case FamilyIPv6:
+		return append(v6, v4...)
+	}
+	ordered := make([]net.IP, 0, len(ips))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			ordered, v6 = append(ordered, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			ordered, v4 = append(ordered, v4[0]), v4[1:]
+		}
+	}
+	return ordered
+}
+
+// race opens channels to the targets of addr in order, starting the next
+// one whenever the previous fails or, if delay is not 0, delay passes, and
+// returns the first to succeed. The others are closed once they open.
+func (p *SSHProxy) race(addr string, targets []string, delay time.Duration, prio Priority) (net.Conn, error) {
+	type result struct {
+		conn   net.Conn
+		target string
+		err    error
+	}
+	results := make(chan result)
+	pending, next := 0, 0
+	var timer <-chan time.Time
+	start := func() {
+		target := targets[next]
+		next++
+		pending++
+		go func() {
+			conn, err := p.dialChannel(target, prio)
+			results <- result{conn, target, err}
+		}()
+		if delay > 0 {
+			timer = time.After(delay)
+		}
+	}
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				logger.Debugf("%s: connected to %s", addr, r.target)
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.err == nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			logger.Debugf("%s: %s", addr, r.err)
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(targets) {
+				start()
+			}
+		case <-timer:
+			if next < len(targets) {
+				start()
+			}
+		}
+	}
+	return nil, firstErr
+}
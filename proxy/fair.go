@@ -0,0 +1,203 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// fairQuantum is the most a connection writes to its channel in one
+	// turn.
+	fairQuantum = 16 * 1024
+	// fairSlice is how long a turn may last before the next writer is let
+	// in as well, as the one holding it is then most likely waiting for
+	// window on its own channel rather than using the transport.
+	fairSlice = 5 * time.Millisecond
+)
+
+// weight returns the share of the transport writes of priority pr get
+// when several connections write at once.
+func (pr Priority) weight() int64 {
+	return 1 << uint(pr.rank())
+}
+
+// fairScheduler interleaves the writes of the connections sharing the ssh
+// transport, one quantum at a time, so a bulk stream cannot hold it while
+// interactive connections wait. It is a start-time fair queue: each write
+// is tagged with the virtual time its connection has used so far, scaled
+// down by the weight of its priority, and the waiting write with the
+// smallest tag goes next.
+type fairScheduler struct {
+	mu sync.Mutex
+	// busy is set while a turn is in progress.
+	busy bool
+	// turn counts the turns handed out, so a holder whose turn lapsed
+	// does not end the next one.
+	turn uint64
+	// vtime is the tag of the current turn.
+	vtime int64
+	// lapse, if set, lets the next waiting write in once the current turn
+	// has lasted fairSlice. It is only armed while writes wait.
+	lapse   *time.Timer
+	waiting []*fairWait
+}
+
+type fairWait struct {
+	tag   int64
+	turn  uint64
+	ready chan struct{}
+}
+
+// fairFlow is the share of the scheduler of one connection.
+type fairFlow struct {
+	s      *fairScheduler
+	weight int64
+	// finish is the virtual time the flow has used up to.
+	finish int64
+}
+
+func (s *fairScheduler) flow(prio Priority) *fairFlow {
+	return &fairFlow{s: s, weight: prio.weight()}
+}
+
+// acquire waits for the turn of a write of n bytes by f and returns it,
+// or false if done was closed first. If f holds a turn, held, from its
+// previous write, that turn ends once this write is queued, so f stays
+// backlogged and keeps the share of its weight instead of arriving anew
+// after the turn was handed to another flow.
+func (f *fairFlow) acquire(n int, held uint64, done <-chan struct{}) (uint64, bool) {
+	s := f.s
+	s.mu.Lock()
+	tag := f.finish
+	if tag < s.vtime {
+		tag = s.vtime
+	}
+	f.finish = tag + int64(n)*4/f.weight
+	if !s.busy {
+		s.busy = true
+		turn := s.startLocked(tag)
+		s.mu.Unlock()
+		return turn, true
+	}
+	w := &fairWait{tag: tag, ready: make(chan struct{})}
+	s.waiting = append(s.waiting, w)
+	if held != 0 {
+		s.nextLocked(held)
+	}
+	if s.lapse == nil && len(s.waiting) > 0 {
+		s.armLocked()
+	}
+	s.mu.Unlock()
+	select {
+	case <-w.ready:
+		return w.turn, true
+	case <-done:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, other := range s.waiting {
+		if other == w {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return 0, false
+		}
+	}
+	// The turn was handed over while giving up, pass it on.
+	s.nextLocked(w.turn)
+	return 0, false
+}
+
+// release ends turn, handing the transport to the next waiting write.
+func (s *fairScheduler) release(turn uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextLocked(turn)
+}
+
+// startLocked starts a turn with tag and returns it.
+func (s *fairScheduler) startLocked(tag int64) uint64 {
+	s.turn++
+	s.vtime = tag
+	s.stopLapseLocked()
+	if len(s.waiting) > 0 {
+		s.armLocked()
+	}
+	return s.turn
+}
+
+// armLocked starts the lapse timer of the current turn.
+func (s *fairScheduler) armLocked() {
+	turn := s.turn
+	s.lapse = time.AfterFunc(fairSlice, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if turn != s.turn {
+			return
+		}
+		s.lapse = nil
+		if len(s.waiting) > 0 {
+			s.nextLocked(turn)
+		}
+	})
+}
+
+func (s *fairScheduler) stopLapseLocked() {
+	if s.lapse != nil {
+		s.lapse.Stop()
+		s.lapse = nil
+	}
+}
+
+// nextLocked ends turn unless it already ended and starts the turn of the
+// waiting write with the smallest tag.
+func (s *fairScheduler) nextLocked(turn uint64) {
+	if turn != s.turn {
+		return
+	}
+	if len(s.waiting) == 0 {
+		s.busy = false
+		s.stopLapseLocked()
+		return
+	}
+	next := 0
+	for i, w := range s.waiting {
+		if w.tag < s.waiting[next].tag {
+			next = i
+		}
+	}
+	w := s.waiting[next]
+	s.waiting = append(s.waiting[:next], s.waiting[next+1:]...)
+	w.turn = s.startLocked(w.tag)
+	close(w.ready)
+}
+
+// write writes b to w a quantum per turn of f, giving up with
+// io.ErrClosedPipe if done is closed while waiting.
+func (f *fairFlow) write(w io.Writer, b []byte, done <-chan struct{}) (int, error) {
+	var written int
+	var turn uint64
+	for len(b) > 0 {
+		n := len(b)
+		if n > fairQuantum {
+			n = fairQuantum
+		}
+		var ok bool
+		turn, ok = f.acquire(n, turn, done)
+		if !ok {
+			return written, io.ErrClosedPipe
+		}
+		m, err := w.Write(b[:n])
+		written += m
+		if err != nil {
+			f.s.release(turn)
+			return written, err
+		}
+		b = b[n:]
+	}
+	if turn != 0 {
+		f.s.release(turn)
+	}
+	return written, nil
+}
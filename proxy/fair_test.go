@@ -0,0 +1,159 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// transport stands in for the ssh transport, taking a while for every
+// write and recording whose it was.
+type transport struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (t *transport) writer(name string) *transportWriter {
+	return &transportWriter{t: t, name: name}
+}
+
+func (t *transport) log() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.writes...)
+}
+
+type transportWriter struct {
+	t    *transport
+	name string
+}
+
+func (w *transportWriter) Write(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	w.t.mu.Lock()
+	w.t.writes = append(w.t.writes, w.name)
+	w.t.mu.Unlock()
+	return len(b), nil
+}
+
+func TestFairSchedulerPriority(t *testing.T) {
+	s := &fairScheduler{}
+	tr := &transport{}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	// Low priority flows saturating the transport.
+	const lows = 4
+	for i := 0; i < lows; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f := s.flow(PriorityLow)
+			w := tr.writer("low")
+			buf := make([]byte, fairQuantum)
+			for {
+				if _, err := f.write(w, buf, done); err != nil {
+					return
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	for len(tr.log()) < 4*lows {
+		time.Sleep(time.Millisecond)
+	}
+
+	const quanta = 8
+	start := len(tr.log())
+	if _, err := s.flow(PriorityHigh).write(tr.writer("high"), make([]byte, quanta*fairQuantum), done); err != nil {
+		t.Fatal(err)
+	}
+	log := tr.log()[start:]
+	end := 0
+	for i, name := range log {
+		if name == "high" {
+			end = i + 1
+		}
+	}
+	high := 0
+	for _, name := range log[:end] {
+		if name == "high" {
+			high++
+		}
+	}
+	if high != quanta {
+		t.Fatalf("high priority flow wrote %d quanta, want %d", high, quanta)
+	}
+	// Taking turns with every waiting low priority flow would let through
+	// lows*quanta low priority writes. With four times their weight, the
+	// high priority flow gets about as many turns as all of them together.
+	if low := end - high; low > 2*quanta {
+		t.Errorf("%d low priority writes went through while %d high priority ones waited", low, quanta)
+	}
+}
+
+func TestFairSchedulerLapse(t *testing.T) {
+	s := &fairScheduler{}
+	a, b := s.flow(PriorityNormal), s.flow(PriorityNormal)
+	done := make(chan struct{})
+	defer close(done)
+
+	turn, _ := a.acquire(fairQuantum, 0, done)
+	s.mu.Lock()
+	armed := s.lapse != nil
+	s.mu.Unlock()
+	if armed {
+		t.Fatal("lapse timer armed without waiting writes")
+	}
+	s.release(turn)
+
+	// A turn held past fairSlice is handed to the waiting write, and
+	// releasing it late does not end the next one.
+	turn, _ = a.acquire(fairQuantum, 0, done)
+	started := time.Now()
+	next, ok := b.acquire(fairQuantum, 0, done)
+	if !ok {
+		t.Fatal("waiting write gave up")
+	}
+	if waited := time.Since(started); waited < fairSlice {
+		t.Fatalf("turn handed over after %s", waited)
+	}
+	s.release(turn)
+	s.mu.Lock()
+	busy, current, armed := s.busy, s.turn, s.lapse != nil
+	s.mu.Unlock()
+	if !busy || current != next {
+		t.Fatal("late release ended the next turn")
+	}
+	if armed {
+		t.Fatal("lapse timer armed after the last waiting write got its turn")
+	}
+	s.release(next)
+	s.mu.Lock()
+	busy = s.busy
+	s.mu.Unlock()
+	if busy {
+		t.Fatal("scheduler busy after all turns ended")
+	}
+}
+
+func TestFairFlowWrite(t *testing.T) {
+	s := &fairScheduler{}
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("x"), 3*fairQuantum+1)
+	n, err := s.flow(PriorityLow).write(&buf, data, nil)
+	if err != nil || n != len(data) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+}
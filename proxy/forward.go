@@ -0,0 +1,178 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// forward tracks a listener and the settings connections accepted on it
+// are handled with. For reverse forwards the listener is on the ssh server
+// and the remote of the settings is the local target.
+type forward struct {
+	name     string
+	reverse  bool
+	mode     forwardMode
+	listener net.Listener
+	paused   int32
+	closed   int32
+	// down is set while a watched forward's targets are not listening,
+	// and watching while watchTarget runs for it.
+	down     int32
+	watching int32
+	// settings holds the current *forwardSettings.
+	settings atomic.Value
+	log      forwardLoggers
+}
+
+// forwardMode is how connections of a forward are handled. It cannot be
+// changed by Reconfigure.
+type forwardMode int
+
+const (
+	modeTCP forwardMode = iota
+	modeHTTP
+	modeConnect
+	modeSOCKS
+	modeTransparent
+)
+
+func (m forwardMode) String() string {
+	switch m {
+	case modeHTTP:
+		return "http"
+	case modeConnect:
+		return "connect"
+	case modeSOCKS:
+		return "socks"
+	case modeTransparent:
+		return "transparent"
+	}
+	return "tcp"
+}
+
+// forwardSettings are the parts of a forward that Reconfigure replaces.
+// Connections keep the settings that were current when they were accepted.
+type forwardSettings struct {
+	remote  string
+	limiter *rateLimiter
+	dump    *PcapWriter
+	tls     *tls.Config
+	origin  *tls.Config
+	route   router
+	acl     *destinationACL
+	http    *httpForward
+	// origins, if set, check the originators of reverse forwards.
+	origins *destinationACL
+	// upstream is the proxy CONNECT mode chains to, if any.
+	upstream *Upstream
+	// probes are the addresses Probe checks.
+	probes []string
+
+	acceptTimeout time.Duration
+	dialTimeout   time.Duration
+	maxLifetime   time.Duration
+	priority      Priority
+	chaos         *Chaos
+	watch         time.Duration
+}
+
+func (f *forward) current() *forwardSettings {
+	return f.settings.Load().(*forwardSettings)
+}
+
+func (f *forward) isPaused() bool {
+	return atomic.LoadInt32(&f.paused) == 1
+}
+
+func (f *forward) setPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&f.paused, v)
+}
+
+func (f *forward) isClosed() bool {
+	return atomic.LoadInt32(&f.closed) == 1
+}
+
+// ForwardInfo describes a forward for status output.
+type ForwardInfo struct {
+	Name string
+	// Local is the local listen address, or the local target of reverse
+	// forwards.
+	Local string
+	// Remote is the remote target, or the address the ssh server listens
+	// on for reverse forwards. Servers with GatewayPorts disabled bind
+	// loopback whatever the requested address is.
+	Remote  string
+	Reverse bool
+	Paused  bool
+	// Down is set while the targets of a watched forward are not
+	// listening.
+	Down bool
+	// Mode is how connections are handled: tcp, http, connect, socks or
+	// transparent.
+	Mode string
+}
+
+// Forwards returns the forwards of p sorted by name.
+func (p *SSHProxy) Forwards() []ForwardInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	infos := make([]ForwardInfo, 0, len(p.forwards))
+	for _, fwd := range p.forwards {
+		info := ForwardInfo{
+			Name:    fwd.name,
+			Local:   fwd.listener.Addr().String(),
+			Remote:  fwd.current().remote,
+			Reverse: fwd.reverse,
+			Paused:  fwd.isPaused(),
+			Down:    fwd.isTargetDown(),
+			Mode:    fwd.mode.String(),
+		}
+		if fwd.reverse {
+			info.Local, info.Remote = info.Remote, info.Local
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// ListenerFiles returns duplicates of the local listening sockets of all
+// forwards by name, to hand them over to another process. Reverse
+// forwards, which listen on the ssh server, are left out. The caller
+// closes the files.
+func (p *SSHProxy) ListenerFiles() (map[string]*os.File, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	files := make(map[string]*os.File)
+	for name, fwd := range p.forwards {
+		if fwd.reverse {
+			continue
+		}
+		var f *os.File
+		l, ok := fwd.listener.(interface{ File() (*os.File, error) })
+		err := errors.New("listener cannot be handed over")
+		if ok {
+			f, err = l.File()
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("forward %s: %w", name, err)
+		}
+		files[name] = f
+	}
+	return files, nil
+}
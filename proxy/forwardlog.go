@@ -0,0 +1,51 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	logging "github.com/op/go-logging"
+)
+
+// LogCategory is a kind of message logged about a forward. The messages of
+// each category of each forward are logged with their own module,
+// ForwardLogModule, so logging.SetLevel can make one forward more verbose
+// than the rest, or quiet a chatty one, e.g. leaving out the copy debug
+// messages of a busy forward but not its connections.
+type LogCategory string
+
+// Log categories.
+const (
+	// LogForward is the forward itself: reconfigured, paused, resumed,
+	// closed, its listener failing and its targets going down or up.
+	LogForward LogCategory = "forward"
+	// LogConnections is the connections of the forward: accepted,
+	// rejected, failing to dial, slow and closed.
+	LogConnections LogCategory = "connections"
+	// LogCopy is the copying of the data of connections.
+	LogCopy LogCategory = "copy"
+)
+
+// LogCategories are all the categories of messages about forwards.
+var LogCategories = []LogCategory{LogForward, LogConnections, LogCopy}
+
+// ForwardLogModule returns the logging module of the messages of category
+// about the forward name. Modules without a level of their own use the
+// default level, like the rest of the proxy.
+func ForwardLogModule(name string, category LogCategory) string {
+	return "sshhttpproxy.forward." + name + "." + string(category)
+}
+
+// forwardLoggers log the messages about a forward, one per category.
+type forwardLoggers struct {
+	forward *logging.Logger
+	conns   *logging.Logger
+	copy    *logging.Logger
+}
+
+func newForwardLoggers(name string) forwardLoggers {
+	return forwardLoggers{
+		forward: logging.MustGetLogger(ForwardLogModule(name, LogForward)),
+		conns:   logging.MustGetLogger(ForwardLogModule(name, LogConnections)),
+		copy:    logging.MustGetLogger(ForwardLogModule(name, LogCopy)),
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// HeaderAction is what a HeaderRule does to a header.
+type HeaderAction string
+
+// Header actions.
+const (
+	// HeaderAdd adds a value, keeping existing values.
+	HeaderAdd HeaderAction = "add"
+	// HeaderSet replaces all values with a single value.
+	HeaderSet HeaderAction = "set"
+	// HeaderRemove deletes the header.
+	HeaderRemove HeaderAction = "remove"
+	// HeaderReplace rewrites existing values, replacing matches of the
+	// regular expression Match with Value. Value may refer to submatches
+	// as in regexp.Regexp.ReplaceAllString.
+	HeaderReplace HeaderAction = "replace"
+)
+
+// HeaderRule changes a request or response header in L7 mode.
+type HeaderRule struct {
+	Action HeaderAction
+	// Name is the header name.
+	Name string
+	// Value is the value to add or set, or the replacement for HeaderReplace.
+	Value string
+	// Match is the regular expression used by HeaderReplace.
+	Match string
+}
+
+// headerRules are compiled header rules applied in order.
+type headerRules []compiledHeaderRule
+
+type compiledHeaderRule struct {
+	HeaderRule
+	re *regexp.Regexp
+}
+
+func compileHeaderRules(rules []HeaderRule) (headerRules, error) {
+	compiled := make(headerRules, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("header rule %q: name is required", rule.Action)
+		}
+		c := compiledHeaderRule{HeaderRule: rule}
+		switch rule.Action {
+		case HeaderAdd, HeaderSet, HeaderRemove:
+		case HeaderReplace:
+			re, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("header rule %s %s: %w", rule.Action, rule.Name, err)
+			}
+			c.re = re
+		default:
+			return nil, fmt.Errorf("header rule %s: unknown action %q", rule.Name, rule.Action)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func (rules headerRules) apply(h http.Header) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case HeaderAdd:
+			h.Add(rule.Name, rule.Value)
+		case HeaderSet:
+			h.Set(rule.Name, rule.Value)
+		case HeaderRemove:
+			h.Del(rule.Name)
+		case HeaderReplace:
+			values := h.Values(rule.Name)
+			for i, value := range values {
+				values[i] = rule.re.ReplaceAllString(value, rule.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// CheckHealth requests path with GET from the default remote of forward
+// name through the ssh connection, over TLS if the forward originates it,
+// and returns the response, so local load balancers can follow the state
+// of the remote service rather than that of the tunnel. The caller closes
+// the body of the response.
+func (p *SSHProxy) CheckHealth(ctx context.Context, name, path string) (*http.Response, error) {
+	fwd, err := p.lookupForward(name)
+	if err != nil {
+		return nil, err
+	}
+	settings := fwd.current()
+	if fwd.reverse || settings.remote == "" || isExec(settings.remote) || isService(settings.remote) {
+		return nil, errors.New("health checks need a host:port remote")
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("health check path must start with /")
+	}
+	scheme := "http"
+	if settings.origin != nil {
+		scheme = "https"
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialContext(ctx, settings.dialTimeout, settings.remote, func() (net.Conn, error) {
+				return p.dialTarget(settings.remote, settings.priority)
+			})
+		},
+		TLSClientConfig:   settings.origin,
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+settings.remote+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
@@ -0,0 +1,50 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import "net"
+
+// Hooks are callbacks invoked on lifecycle changes of an SSHProxy. Any of them
+// may be nil. Callbacks are run synchronously, so they should return quickly.
+type Hooks struct {
+	// OnConnect is called when the ssh connection to addr is established.
+	OnConnect func(addr string)
+	// OnDisconnect is called when the ssh connection goes away.
+	OnDisconnect func(err error)
+	// OnForwardUp is called when a forward starts listening on local.
+	OnForwardUp func(name, local, remote string)
+	// OnForwardError is called when a forward fails to accept or dial a connection.
+	OnForwardError func(name string, err error)
+	// OnClientAccepted is called when a forward accepts a local client.
+	OnClientAccepted func(name string, client net.Addr)
+}
+
+func (h *Hooks) connect(addr string) {
+	if h != nil && h.OnConnect != nil {
+		h.OnConnect(addr)
+	}
+}
+
+func (h *Hooks) disconnect(err error) {
+	if h != nil && h.OnDisconnect != nil {
+		h.OnDisconnect(err)
+	}
+}
+
+func (h *Hooks) forwardUp(name, local, remote string) {
+	if h != nil && h.OnForwardUp != nil {
+		h.OnForwardUp(name, local, remote)
+	}
+}
+
+func (h *Hooks) forwardError(name string, err error) {
+	if h != nil && h.OnForwardError != nil {
+		h.OnForwardError(name, err)
+	}
+}
+
+func (h *Hooks) clientAccepted(name string, client net.Addr) {
+	if h != nil && h.OnClientAccepted != nil {
+		h.OnClientAccepted(name, client)
+	}
+}
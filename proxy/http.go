@@ -0,0 +1,234 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+// httpForward serves a forward as an HTTP reverse proxy (L7 mode), choosing
+// the remote for each request instead of for each connection.
+type httpForward struct {
+	p         *SSHProxy
+	fwd       *forward
+	remote    string
+	routes    []Route
+	request   headerRules
+	response  headerRules
+	token     TokenSource
+	mirror    *mirror
+	chaos     *Chaos
+	scheme    string
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+}
+
+// routeKey is the request context key holding the chosen route.
+type routeKey struct{}
+
+func (p *SSHProxy) newHTTPForward(fwd *forward, remote string, opts *ForwardOptions) (*httpForward, error) {
+	request, err := compileHeaderRules(opts.RequestHeaders)
+	if err != nil {
+		return nil, err
+	}
+	response, err := compileHeaderRules(opts.ResponseHeaders)
+	if err != nil {
+		return nil, err
+	}
+	h := &httpForward{
+		p:        p,
+		fwd:      fwd,
+		remote:   remote,
+		routes:   opts.HTTPRoutes,
+		request:  request,
+		response: response,
+		token:    opts.BearerToken,
+		scheme:   "http",
+		chaos:    opts.Chaos,
+	}
+	if opts.RemoteTLS != nil {
+		h.scheme = "https"
+	}
+	if opts.Mirror != nil {
+		if h.mirror, err = newMirror(h, opts.Mirror); err != nil {
+			return nil, err
+		}
+	}
+	h.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialContext(ctx, opts.DialTimeout, addr, func() (net.Conn, error) {
+				return p.dial(addr, opts.Priority)
+			})
+		},
+		TLSClientConfig:     opts.RemoteTLS,
+		MaxIdleConnsPerHost: 8,
+		// Lets connections still in use when Reconfigure replaced the
+		// forward close eventually.
+		IdleConnTimeout: 90 * time.Second,
+	}
+	h.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			route := r.Context().Value(routeKey{}).(*Route)
+			r.URL.Scheme = h.scheme
+			r.URL.Host = route.Remote
+			if route.StripPrefix {
+				r.URL.Path = stripPath(route.Path, r.URL.Path)
+				r.URL.RawPath = ""
+			}
+			h.request.apply(r.Header)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			h.response.apply(resp.Header)
+			if body := h.chaos.truncate(resp.Body); body != resp.Body {
+				resp.Body = truncatedBody{body, resp.Body}
+			}
+			return nil
+		},
+		Transport:    h.transport,
+		ErrorHandler: h.error,
+	}
+	if opts.Chaos != nil && opts.Chaos.TruncatePercent > 0 {
+		// Truncated responses are aborted, flush so the part before the
+		// cut reaches the client.
+		h.proxy.FlushInterval = -1
+	}
+	return h, nil
+}
+
+// route picks the route for a request by matching its Host header, path
+// and headers, falling back to the default remote of the forward.
+func (h *httpForward) route(r *http.Request) (*Route, bool) {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if route, ok := matchRoute(h.routes, host, r.URL.Path, r.Header); ok {
+		return route, true
+	}
+	return &Route{Remote: h.remote}, h.remote != ""
+}
+
+// closeIdleConnections closes the idle remote connections of h once it was
+// replaced by Reconfigure.
+func (h *httpForward) closeIdleConnections() {
+	h.transport.CloseIdleConnections()
+}
+
+func (h *httpForward) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	route, ok := h.route(r)
+	defer func() {
+		h.p.latency.observe(h.fwd.name, routeLabel(route), time.Since(start))
+	}()
+	audit, w, r := h.p.auditRequest(h.fwd, w, r, route.Remote)
+	defer audit.finish(nil)
+	if !ok {
+		h.error(w, r, wrapError(ErrNoRoute, fmt.Errorf("%s%s", r.Host, r.URL.Path)))
+		return
+	}
+	if h.token != nil {
+		token, err := h.token.Token()
+		if err != nil {
+			h.error(w, r, fmt.Errorf("bearer token: %w", err))
+			return
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if h.mirror != nil && h.mirror.sample() {
+		if body, ok := readBody(r); ok {
+			h.mirror.send(r, body, h.scheme)
+		}
+	}
+	h.chaos.delay(r.Context().Done())
+	ctx := context.WithValue(r.Context(), routeKey{}, route)
+	h.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (h *httpForward) error(w http.ResponseWriter, r *http.Request, err error) {
+	h.fwd.log.conns.Errorf("forward %s: %s %s: %s", h.fwd.name, r.Method, r.URL, err)
+	if audit, ok := r.Context().Value(auditKey{}).(*auditConn); ok {
+		audit.fail(err)
+	}
+	h.p.hooks.forwardError(h.fwd.name, err)
+	h.p.emit(Event{Type: EventForwardError, Forward: h.fwd.name, Err: err})
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// serveHTTP runs an HTTP server on connections accepted by fwd until the
+// listener is closed. Requests are handled with the current settings of
+// fwd.
+func (p *SSHProxy) serveHTTP(fwd *forward, l *connListener) {
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fwd.current().http.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: fwd.current().acceptTimeout,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				p.connOpened(fwd.name, conn.RemoteAddr().String())
+			case http.StateClosed, http.StateHijacked:
+				p.connClosed(fwd.name, conn.RemoteAddr().String())
+			}
+		},
+	}
+	if err := srv.Serve(l); err != nil && !errors.Is(err, errListenerClosed) {
+		fwd.log.forward.Errorf("forward %s: http server error: %s", fwd.name, err)
+	}
+	if err := srv.Close(); err != nil {
+		fwd.log.forward.Errorf("forward %s: error closing http server: %s", fwd.name, err)
+	}
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+// connListener is a net.Listener fed with connections accepted elsewhere,
+// so HTTP forwards share the accept loop of plain forwards.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// push hands conn to Accept, closing it if the listener is closed.
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,151 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultKeepAliveCountMax is the number of unanswered keepalives after
+// which the ssh connection is considered dead, as in OpenSSH.
+const defaultKeepAliveCountMax = 3
+
+// keepAlive sends keepalive requests over conn every keepalive interval
+// until gone is closed. If the server stops answering, conn is closed as
+// lost, which tears down all connections through it.
+func (p *SSHProxy) keepAlive(conn *ssh.Client, gone <-chan struct{}) {
+	answered := func(time.Duration) {
+		p.mu.Lock()
+		p.stats.LastKeepAlive = time.Now()
+		p.mu.Unlock()
+	}
+	lost := func(err error) {
+		logger.Warningf("ssh connection to %s lost: %s", p.cfg.RemoteAddress, err)
+		p.mu.Lock()
+		p.stats.TunnelsLost++
+		p.mu.Unlock()
+		p.emit(Event{Type: EventTunnelLost, Addr: p.cfg.RemoteAddress, Err: err})
+	}
+	p.sendKeepAlives(conn, gone, answered, lost)
+}
+
+// sendKeepAlives sends the keepalives of keepAlive over conn, calling
+// answered with the round trip time of each answered one and lost before
+// closing conn.
+func (p *SSHProxy) sendKeepAlives(conn *ssh.Client, gone <-chan struct{}, answered func(time.Duration), lost func(error)) {
+	interval := p.cfg.KeepAliveInterval
+	countMax := p.cfg.KeepAliveCountMax
+	if countMax <= 0 {
+		countMax = defaultKeepAliveCountMax
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-gone:
+			return
+		}
+		reply := make(chan error, 1)
+		sent := time.Now()
+		go func() {
+			// Servers answer unknown requests with a failure, which
+			// proves they are alive just as well.
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		timer := time.NewTimer(interval)
+		select {
+		case err := <-reply:
+			timer.Stop()
+			if err != nil {
+				// The connection is already closed.
+				return
+			}
+			missed = 0
+			answered(time.Since(sent))
+			continue
+		case <-timer.C:
+			missed++
+		case <-gone:
+			timer.Stop()
+			return
+		}
+		if missed < countMax {
+			logger.Debugf("keepalive %d of %d to %s unanswered", missed, countMax, p.cfg.RemoteAddress)
+			continue
+		}
+		lost(fmt.Errorf("%d keepalives unanswered", missed))
+		if err := conn.Close(); err != nil {
+			logger.Debugf("error closing dead connection: %s", err)
+		}
+		return
+	}
+}
+
+// tunnelConn is a channel opened over an ssh connection, which knows when
+// that connection goes away.
+type tunnelConn struct {
+	net.Conn
+	// gone is closed when the ssh connection ends.
+	gone <-chan struct{}
+	// flow, if set, takes turns writing with FairScheduling.
+	flow *fairFlow
+}
+
+// Write writes b to the channel, in turns with the other channels if they
+// are scheduled fairly.
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	if c.flow == nil {
+		return c.Conn.Write(b)
+	}
+	return c.flow.write(c.Conn, b, c.gone)
+}
+
+// CloseWrite half-closes the channel, see closeWriter.
+func (c *tunnelConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// tunneled wraps the channel ch opened over conn for a forward of priority
+// prio in a tunnelConn.
+func (p *SSHProxy) tunneled(conn *ssh.Client, ch net.Conn, prio Priority) net.Conn {
+	p.mu.Lock()
+	gone, ok := p.gone[conn]
+	p.mu.Unlock()
+	if !ok {
+		// conn ended while the channel was opened.
+		closed := make(chan struct{})
+		close(closed)
+		gone = closed
+	}
+	c := &tunnelConn{Conn: ch, gone: gone}
+	if p.fair != nil {
+		c.flow = p.fair.flow(prio)
+	}
+	return c
+}
+
+// closeOnTunnelLoss closes client once the ssh connection target was
+// opened over goes away, instead of leaving it to hang until the client
+// sends something, or until done.
+func closeOnTunnelLoss(fwd *forward, client net.Conn, target net.Conn, done <-chan struct{}) {
+	t, ok := target.(*tunnelConn)
+	if !ok {
+		return
+	}
+	select {
+	case <-t.gone:
+		fwd.log.conns.Debugf("forward %s: ssh connection gone, closing %s", fwd.name, client.RemoteAddr())
+		client.Close()
+	case <-done:
+	}
+}
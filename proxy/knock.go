@@ -0,0 +1,137 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultKnockDelay is waited after each knock without a delay, so the
+	// knocks arrive in order.
+	defaultKnockDelay = 100 * time.Millisecond
+	// knockTimeout bounds a tcp knock, which only needs its SYN sent: the
+	// port is normally closed or filtered.
+	knockTimeout = 200 * time.Millisecond
+)
+
+// KnockStep is a packet of the port knocking sequence of Config.Knock.
+type KnockStep struct {
+	Port int
+	// Protocol is "tcp", the default, or "udp".
+	Protocol string
+	// Delay is waited after the packet, before the next one or the ssh
+	// connection, 100ms if 0.
+	Delay time.Duration
+}
+
+func checkKnock(steps []KnockStep) error {
+	for _, step := range steps {
+		if step.Port < 1 || step.Port > 65535 {
+			return fmt.Errorf("knock: bad port %d", step.Port)
+		}
+		switch step.Protocol {
+		case "", "tcp", "udp":
+		default:
+			return fmt.Errorf("knock: unknown protocol %q", step.Protocol)
+		}
+		if step.Delay < 0 {
+			return errors.New("knock: negative delay")
+		}
+	}
+	return nil
+}
+
+// dialFrom connects to the ssh server from local if it is set, knocking
+// first with Knock. The knocks and the connection go to the same address
+// of the server, so the server opens up for the address that connects.
+func (p *SSHProxy) dialFrom(local net.IP) (net.Conn, error) {
+	d := net.Dialer{}
+	network := "tcp"
+	if local != nil {
+		d.LocalAddr = &net.TCPAddr{IP: local}
+		d.Timeout = pathDialTimeout
+		network = "tcp6"
+		if local.To4() != nil {
+			network = "tcp4"
+		}
+	}
+	addr := p.cfg.RemoteAddress
+	if len(p.cfg.Knock) > 0 {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ip, err := p.knockTarget(host, local)
+		if err != nil {
+			return nil, err
+		}
+		p.knock(ip, local)
+		addr = net.JoinHostPort(ip.String(), port)
+	}
+	return d.Dial(network, addr)
+}
+
+// knockTarget resolves host, the ssh server, to the address to knock on:
+// one of the family of local if set, or of the preferred family.
+func (p *SSHProxy) knockTarget(host string, local net.IP) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(p.ctx, resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if local == nil || (local.To4() != nil) == (addr.IP.To4() != nil) {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if family := p.preferFamily(); family != FamilyAuto {
+		ips = orderAddrs(ips, family)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s has no address to knock on from %s", host, local)
+	}
+	return ips[0], nil
+}
+
+// knock sends the knock sequence to ip from local, if set. Knocks are fire
+// and forget, their errors are only logged.
+func (p *SSHProxy) knock(ip, local net.IP) {
+	logger.Debugf("knocking on %s", ip)
+	for _, step := range p.cfg.Knock {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(step.Port))
+		d := net.Dialer{Timeout: knockTimeout}
+		if step.Protocol == "udp" {
+			if local != nil {
+				d.LocalAddr = &net.UDPAddr{IP: local}
+			}
+			conn, err := d.Dial("udp", addr)
+			if err == nil {
+				_, err = conn.Write([]byte{0})
+				conn.Close()
+			}
+			if err != nil {
+				logger.Debugf("knock on %s/udp: %s", addr, err)
+			}
+		} else {
+			if local != nil {
+				d.LocalAddr = &net.TCPAddr{IP: local}
+			}
+			if conn, err := d.Dial("tcp", addr); err == nil {
+				conn.Close()
+			}
+		}
+		delay := step.Delay
+		if delay == 0 {
+			delay = defaultKnockDelay
+		}
+		time.Sleep(delay)
+	}
+}
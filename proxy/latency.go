@@ -0,0 +1,99 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds in seconds of the HTTP request
+// duration histograms.
+var LatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// LatencyHistogram is the distribution of request durations of one route
+// of an L7 forward.
+type LatencyHistogram struct {
+	Forward string
+	// Route is the host, path and headers of the matched route, or
+	// "default".
+	Route string
+	// Counts are cumulative: Counts[i] requests took at most
+	// LatencyBuckets[i] seconds.
+	Counts []uint64
+	// Count is the number of requests and Sum their total duration in
+	// seconds.
+	Count uint64
+	Sum   float64
+}
+
+type latencyKey struct {
+	forward, route string
+}
+
+// latencyStats collects request durations per forward and route.
+type latencyStats struct {
+	mu         sync.Mutex
+	histograms map[latencyKey]*LatencyHistogram
+}
+
+func (s *latencyStats) observe(forward, route string, d time.Duration) {
+	secs := d.Seconds()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := latencyKey{forward, route}
+	h, ok := s.histograms[key]
+	if !ok {
+		if s.histograms == nil {
+			s.histograms = make(map[latencyKey]*LatencyHistogram)
+		}
+		h = &LatencyHistogram{Forward: forward, Route: route, Counts: make([]uint64, len(LatencyBuckets))}
+		s.histograms[key] = h
+	}
+	for i, bound := range LatencyBuckets {
+		if secs <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += secs
+}
+
+// HTTPLatency returns request duration histograms of all L7 forwards,
+// sorted by forward and route.
+func (p *SSHProxy) HTTPLatency() []LatencyHistogram {
+	p.latency.mu.Lock()
+	defer p.latency.mu.Unlock()
+	hs := make([]LatencyHistogram, 0, len(p.latency.histograms))
+	for _, h := range p.latency.histograms {
+		c := *h
+		c.Counts = append([]uint64(nil), h.Counts...)
+		hs = append(hs, c)
+	}
+	sort.Slice(hs, func(i, j int) bool {
+		if hs[i].Forward != hs[j].Forward {
+			return hs[i].Forward < hs[j].Forward
+		}
+		return hs[i].Route < hs[j].Route
+	})
+	return hs
+}
+
+// routeLabel names route in latency histograms.
+func routeLabel(route *Route) string {
+	if route.Host == "" && route.Path == "" && len(route.Headers) == 0 {
+		return "default"
+	}
+	label := route.Host + route.Path
+	names := make([]string, 0, len(route.Headers))
+	for name := range route.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		label += fmt.Sprintf("[%s=%s]", name, route.Headers[name])
+	}
+	return label
+}
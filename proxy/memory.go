@@ -0,0 +1,98 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// copyBufferSize is the size of the buffer used for each copy direction of
+// a connection. A copy only reads more once the previous read has been
+// written, so a slow side stops reads from the fast side.
+const copyBufferSize = 32 * 1024
+
+// channelWindowSize is the receive window golang.org/x/crypto/ssh gives
+// every channel: the data the peer may send on a connection before it is
+// read, held by the ssh library.
+const channelWindowSize = 64 * 32 * 1024
+
+// connMemory is the most memory a connection can hold: the window of its
+// ssh channel and its two copy buffers.
+const connMemory = channelWindowSize + 2*copyBufferSize
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, copyBufferSize)
+	},
+}
+
+// memoryBudget accounts for the memory of open connections. Each
+// connection reserves connMemory, the most it can hold, as the data in the
+// ssh channel window cannot be seen until it is read; a limit of 0 means
+// unlimited. The bytes the copies actually hold are counted apart.
+type memoryBudget struct {
+	limit    int64
+	reserved int64
+	buffered int64
+}
+
+// acquire reserves the memory of a connection of priority prio and
+// reports whether it fits within the limit, or its low priority share.
+func (b *memoryBudget) acquire(prio Priority) bool {
+	limit := b.limit
+	if prio == PriorityLow {
+		limit = limit * lowPriorityShare / 4
+	}
+	reserved := atomic.AddInt64(&b.reserved, connMemory)
+	if b.limit > 0 && reserved > limit {
+		atomic.AddInt64(&b.reserved, -connMemory)
+		return false
+	}
+	return true
+}
+
+// release frees the memory reserved by acquire.
+func (b *memoryBudget) release() {
+	atomic.AddInt64(&b.reserved, -connMemory)
+}
+
+// copy copies src to dst through buf, counting the bytes read into buf
+// until they are written. Unlike io.CopyBuffer it never bypasses buf
+// through ReadFrom or WriteTo, which would allocate buffers of their own.
+func (b *memoryBudget) copy(dst io.Writer, src io.Reader, buf []byte) error {
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.AddInt64(&b.buffered, int64(n))
+			w, werr := dst.Write(buf[:n])
+			atomic.AddInt64(&b.buffered, -int64(n))
+			if werr == nil && w < n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReservedBytes returns the memory reserved by open connections, which
+// counts against MaxBufferedBytes.
+func (p *SSHProxy) ReservedBytes() int64 {
+	return atomic.LoadInt64(&p.memory.reserved)
+}
+
+// BufferedBytes returns the number of bytes the copy buffers of open
+// connections hold at the moment, read from one side and not yet written
+// to the other.
+func (p *SSHProxy) BufferedBytes() int64 {
+	return atomic.LoadInt64(&p.memory.buffered)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	// mirrorMaxBody is the largest request body that is mirrored, larger
+	// requests are only sent to their remote.
+	mirrorMaxBody = 1 << 20
+	// mirrorMaxInFlight bounds the mirrored requests waiting for a
+	// response, further ones are dropped so a slow mirror cannot pile
+	// them up.
+	mirrorMaxInFlight = 16
+	// mirrorTimeout bounds a mirrored request including its response.
+	mirrorTimeout = 30 * time.Second
+)
+
+// Mirror copies a share of the requests of an L7 forward to a second
+// remote, e.g. a new version of a service being shadow-tested. Mirrored
+// requests are sent in the background and their responses discarded.
+type Mirror struct {
+	// Remote is the address mirrored requests are sent to.
+	Remote string
+	// Percent is the share of requests mirrored, from 0 to 100.
+	Percent float64
+}
+
+// mirror sends copies of requests to the remote of a Mirror.
+type mirror struct {
+	h       *httpForward
+	remote  string
+	percent float64
+	slots   chan struct{}
+}
+
+func newMirror(h *httpForward, m *Mirror) (*mirror, error) {
+	if m.Remote == "" {
+		return nil, errors.New("a mirror requires a remote")
+	}
+	if m.Percent < 0 || m.Percent > 100 {
+		return nil, errors.New("the mirrored percentage must be between 0 and 100")
+	}
+	return &mirror{
+		h:       h,
+		remote:  m.Remote,
+		percent: m.Percent,
+		slots:   make(chan struct{}, mirrorMaxInFlight),
+	}, nil
+}
+
+// sample reports whether a request is to be mirrored.
+func (m *mirror) sample() bool {
+	return rand.Float64()*100 < m.percent
+}
+
+// readBody reads the body of r so it can be sent twice, leaving r to read
+// it again. It returns false if the body is too large to mirror.
+func readBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > mirrorMaxBody {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, mirrorMaxBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	return body, err == nil && len(body) <= mirrorMaxBody
+}
+
+// send mirrors r with body in the background, unless too many mirrored
+// requests are still waiting for a response.
+func (m *mirror) send(r *http.Request, body []byte, scheme string) {
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.h.fwd.log.conns.Debugf("forward %s: too many mirrored requests, dropping one", m.h.fwd.name)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	req := r.Clone(ctx)
+	req.RequestURI = ""
+	req.URL.Scheme = scheme
+	req.URL.Host = m.remote
+	req.Body = http.NoBody
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	m.h.request.apply(req.Header)
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+		resp, err := m.h.transport.RoundTrip(req)
+		if err != nil {
+			m.h.fwd.log.conns.Debugf("forward %s: mirroring %s %s: %s", m.h.fwd.name, req.Method, req.URL, err)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
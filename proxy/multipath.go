@@ -0,0 +1,288 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PathMode decides how new connections are spread over the ssh
+// connections of Paths.
+type PathMode string
+
+// Path modes.
+const (
+	// PathStripe opens each new connection over the next ssh connection
+	// that is up, round robin. It is the default.
+	PathStripe PathMode = "stripe"
+	// PathFailover opens new connections over the main ssh connection
+	// while it is up, and over the first path that is up otherwise.
+	PathFailover PathMode = "failover"
+)
+
+const (
+	// pathDialTimeout bounds connecting to the ssh server over a path.
+	pathDialTimeout = 10 * time.Second
+	// pathMaxBackoff caps the delay between attempts to connect a path.
+	pathMaxBackoff = 30 * time.Second
+)
+
+// PathInfo describes an ssh connection of Paths.
+type PathInfo struct {
+	// Name is the path as configured, an interface name or address.
+	Name string
+	// Local is the local address of the connection while it is up.
+	Local     string
+	Connected bool
+	// Since is when the connection was last established or lost.
+	Since time.Time
+	// RTT is the round trip time of the last answered keepalive.
+	RTT time.Duration
+}
+
+// pathSet keeps an ssh connection to the server over each of the paths of
+// the config, besides the main connection of the proxy.
+type pathSet struct {
+	p     *SSHProxy
+	mode  PathMode
+	paths []*path
+	// next picks the connection of the next stream with PathStripe.
+	next uint32
+}
+
+// path is one ssh connection of a pathSet.
+type path struct {
+	name string
+
+	mu    sync.Mutex
+	conn  *ssh.Client
+	local string
+	since time.Time
+	rtt   time.Duration
+}
+
+func newPathSet(p *SSHProxy, names []string, mode PathMode) (*pathSet, error) {
+	switch mode {
+	case "":
+		mode = PathStripe
+	case PathStripe, PathFailover:
+	default:
+		return nil, fmt.Errorf("unknown path mode %q", mode)
+	}
+	s := &pathSet{p: p, mode: mode}
+	for _, name := range names {
+		s.paths = append(s.paths, &path{name: name})
+	}
+	return s, nil
+}
+
+// start keeps the path connections up in the background until the proxy
+// shuts down.
+func (s *pathSet) start() {
+	for _, pa := range s.paths {
+		s.p.wg.Add(1)
+		go s.run(pa)
+	}
+}
+
+// run connects pa, waits for its connection to end and connects it
+// again, backing off while that fails.
+func (s *pathSet) run(pa *path) {
+	defer s.p.wg.Done()
+	backoff := time.Second
+	for {
+		conn, gone, err := s.connect(pa)
+		if err != nil {
+			logger.Warningf("ssh connection over path %s failed: %s", pa.name, err)
+			select {
+			case <-s.p.done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > pathMaxBackoff {
+				backoff = pathMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		select {
+		case <-gone:
+			logger.Warningf("ssh connection over path %s lost", pa.name)
+		case <-s.p.done:
+			conn.Close()
+			<-gone
+			return
+		}
+	}
+}
+
+// connect makes the ssh connection of pa and returns it with a channel
+// closed once it ends.
+func (s *pathSet) connect(pa *path) (*ssh.Client, <-chan struct{}, error) {
+	p := s.p
+	cfg, err := p.makeConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	nc, err := p.dialPath(pa.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if nc, err = p.obfuscate(nc); err != nil {
+		return nil, nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(nc, p.cfg.RemoteAddress, cfg)
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	conn := ssh.NewClient(c, chans, reqs)
+	gone := make(chan struct{})
+	p.mu.Lock()
+	p.gone[conn] = gone
+	p.mu.Unlock()
+	pa.mu.Lock()
+	pa.conn, pa.local, pa.since, pa.rtt = conn, nc.LocalAddr().String(), time.Now(), 0
+	pa.mu.Unlock()
+	logger.Infof("ssh connection over path %s (%s) up", pa.name, nc.LocalAddr())
+	go func() {
+		conn.Wait()
+		pa.mu.Lock()
+		pa.conn, pa.since = nil, time.Now()
+		pa.mu.Unlock()
+		p.mu.Lock()
+		delete(p.gone, conn)
+		p.mu.Unlock()
+		close(gone)
+	}()
+	if p.cfg.KeepAliveInterval > 0 {
+		answered := func(rtt time.Duration) {
+			pa.mu.Lock()
+			pa.rtt = rtt
+			pa.mu.Unlock()
+		}
+		lost := func(err error) {
+			logger.Warningf("ssh connection over path %s lost: %s", pa.name, err)
+		}
+		go p.sendKeepAlives(conn, gone, answered, lost)
+	}
+	return conn, gone, nil
+}
+
+// dialPath connects to the ssh server from the addresses of path, an
+// interface name or a local address, trying each address of the interface
+// until one works.
+func (p *SSHProxy) dialPath(path string) (net.Conn, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(path); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		iface, err := net.InterfaceByName(path)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("interface %s has no address", path)
+		}
+	}
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := p.dialFrom(ip)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// clients returns the path connections that are up, in the order of the
+// config.
+func (s *pathSet) clients() []*ssh.Client {
+	var conns []*ssh.Client
+	for _, pa := range s.paths {
+		pa.mu.Lock()
+		if pa.conn != nil {
+			conns = append(conns, pa.conn)
+		}
+		pa.mu.Unlock()
+	}
+	return conns
+}
+
+// has reports whether conn is the current connection of a path.
+func (s *pathSet) has(conn *ssh.Client) bool {
+	if s == nil {
+		return false
+	}
+	for _, c := range s.clients() {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// streamClient returns the ssh connection to open a new channel over:
+// with Paths, one of the main connection and the paths that are up as
+// PathMode says, otherwise the main connection, waiting for it like
+// parkedClient if no connection is up.
+func (p *SSHProxy) streamClient() (*ssh.Client, error) {
+	if p.paths == nil {
+		return p.parkedClient()
+	}
+	var conns []*ssh.Client
+	if conn := p.client(); conn != nil {
+		conns = append(conns, conn)
+	}
+	conns = append(conns, p.paths.clients()...)
+	switch {
+	case len(conns) == 0:
+		return p.parkedClient()
+	case p.paths.mode == PathFailover:
+		return conns[0], nil
+	}
+	n := atomic.AddUint32(&p.paths.next, 1)
+	return conns[int(n)%len(conns)], nil
+}
+
+// usable reports whether new channels are still opened over conn.
+func (p *SSHProxy) usable(conn *ssh.Client) bool {
+	return conn == p.client() || p.paths.has(conn)
+}
+
+// Paths returns the state of the ssh connections of Paths, nil without
+// Paths.
+func (p *SSHProxy) Paths() []PathInfo {
+	if p.paths == nil {
+		return nil
+	}
+	var infos []PathInfo
+	for _, pa := range p.paths.paths {
+		pa.mu.Lock()
+		info := PathInfo{Name: pa.name, Connected: pa.conn != nil, Since: pa.since, RTT: pa.rtt}
+		if info.Connected {
+			info.Local = pa.local
+		}
+		pa.mu.Unlock()
+		infos = append(infos, info)
+	}
+	return infos
+}
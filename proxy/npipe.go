@@ -0,0 +1,24 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import "strings"
+
+// pipePrefix marks a local address as a Windows named pipe, in the form
+// Docker uses: npipe:////./pipe/docker_engine.
+const pipePrefix = "npipe:"
+
+// isPipe reports whether local is a named pipe instead of a port.
+func isPipe(local string) bool {
+	return strings.HasPrefix(local, pipePrefix)
+}
+
+// pipePath returns the path of the named pipe local, e.g.
+// \\.\pipe\docker_engine.
+func pipePath(local string) string {
+	path := strings.TrimPrefix(local, pipePrefix)
+	if strings.HasPrefix(path, "////") {
+		path = path[2:]
+	}
+	return strings.Replace(path, "/", `\`, -1)
+}
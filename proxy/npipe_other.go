@@ -0,0 +1,15 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+func listenPipe(path string) (net.Listener, error) {
+	return nil, errors.New("named pipes are only supported on Windows")
+}
@@ -0,0 +1,350 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modkernel32          = windows.NewLazySystemDLL("kernel32.dll")
+	procCreateNamedPipeW = modkernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe = modkernel32.NewProc("ConnectNamedPipe")
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	fileFlagFirstPipeInstance = 0x80000
+	pipeRejectRemoteClients   = 0x8
+	pipeUnlimitedInstances    = 255
+	pipeBufferSize            = 64 * 1024
+)
+
+var errPipeClosed = errors.New("use of closed named pipe")
+
+// pipeTimeout is returned by operations on a pipe past its deadline.
+type pipeTimeout struct{}
+
+func (pipeTimeout) Error() string   { return "named pipe i/o timeout" }
+func (pipeTimeout) Timeout() bool   { return true }
+func (pipeTimeout) Temporary() bool { return true }
+
+// createPipe creates an instance of the named pipe path for overlapped I/O.
+// The first instance fails if another process already owns the name.
+func createPipe(path string, first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	flags := uint32(pipeAccessDuplex | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		flags |= fileFlagFirstPipeInstance
+	}
+	r, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(name)), uintptr(flags),
+		pipeRejectRemoteClients, pipeUnlimitedInstances, pipeBufferSize, pipeBufferSize, 0, 0)
+	if windows.Handle(r) == windows.InvalidHandle {
+		return 0, err
+	}
+	return windows.Handle(r), nil
+}
+
+// pipeDeadline is the deadline of one direction of a pipe. Changing it wakes
+// up a pending operation so it sees the new deadline.
+type pipeDeadline struct {
+	mu   sync.Mutex
+	t    time.Time
+	wake windows.Handle
+}
+
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	d.t = t
+	d.mu.Unlock()
+	windows.SetEvent(d.wake)
+}
+
+// timeout returns how many milliseconds are left until the deadline, and
+// whether it has passed.
+func (d *pipeDeadline) timeout() (uint32, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.t.IsZero() {
+		return windows.INFINITE, false
+	}
+	left := time.Until(d.t)
+	if left <= 0 {
+		return 0, true
+	}
+	return uint32((left + time.Millisecond - 1) / time.Millisecond), false
+}
+
+// overlappedIO runs the operation start begins on h and waits for it,
+// cancelling it when the closed event is set or the deadline d, if any,
+// passes.
+func overlappedIO(h, closed windows.Handle, d *pipeDeadline, start func(*windows.Overlapped) error) (uint32, error) {
+	if d != nil {
+		if _, expired := d.timeout(); expired {
+			return 0, pipeTimeout{}
+		}
+	}
+	ev, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(ev)
+	o := &windows.Overlapped{HEvent: ev}
+	switch err := start(o); err {
+	case nil, windows.ERROR_IO_PENDING:
+	case windows.ERROR_PIPE_CONNECTED:
+		// A client connected before we started waiting for one.
+		return 0, nil
+	default:
+		return 0, err
+	}
+	var cause error
+wait:
+	for {
+		handles := []windows.Handle{ev, closed}
+		timeout := uint32(windows.INFINITE)
+		if d != nil {
+			handles = append(handles, d.wake)
+			var expired bool
+			if timeout, expired = d.timeout(); expired {
+				cause = pipeTimeout{}
+				break
+			}
+		}
+		r, err := windows.WaitForMultipleObjects(handles, false, timeout)
+		switch {
+		case err != nil:
+			cause = err
+			break wait
+		case r == windows.WAIT_OBJECT_0:
+			break wait
+		case r == windows.WAIT_OBJECT_0+1:
+			cause = errPipeClosed
+			break wait
+		case r == uint32(windows.WAIT_TIMEOUT):
+			cause = pipeTimeout{}
+			break wait
+		}
+	}
+	if cause != nil {
+		windows.CancelIoEx(h, o)
+	}
+	var n uint32
+	err = windows.GetOverlappedResult(h, o, &n, true)
+	if err == windows.ERROR_OPERATION_ABORTED && cause != nil {
+		err = cause
+	}
+	return n, err
+}
+
+// pipeAddr is the path of a named pipe.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeListener accepts clients on a named pipe. An instance of the pipe is
+// always waiting for the next client.
+type pipeListener struct {
+	addr   pipeAddr
+	closed windows.Handle
+
+	mu   sync.Mutex
+	next windows.Handle
+	done bool
+	wg   sync.WaitGroup
+}
+
+// listenPipe listens on the named pipe path.
+func listenPipe(path string) (net.Listener, error) {
+	h, err := createPipe(path, true)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "pipe", Addr: pipeAddr(path), Err: err}
+	}
+	closed, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	return &pipeListener{addr: pipeAddr(path), closed: closed, next: h}, nil
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.done {
+		l.mu.Unlock()
+		return nil, errPipeClosed
+	}
+	l.wg.Add(1)
+	l.mu.Unlock()
+	defer l.wg.Done()
+	for {
+		h := l.next
+		_, err := overlappedIO(h, l.closed, nil, func(o *windows.Overlapped) error {
+			r, _, err := procConnectNamedPipe.Call(uintptr(h), uintptr(unsafe.Pointer(o)))
+			if r != 0 {
+				return nil
+			}
+			return err
+		})
+		if err != nil && err != windows.ERROR_NO_DATA {
+			return nil, err
+		}
+		next, nerr := createPipe(string(l.addr), false)
+		if nerr != nil {
+			return nil, nerr
+		}
+		l.mu.Lock()
+		l.next = next
+		l.mu.Unlock()
+		if err == windows.ERROR_NO_DATA {
+			// The client went away before it was accepted.
+			windows.CloseHandle(h)
+			continue
+		}
+		return newPipeConn(h, l.addr)
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	if l.done {
+		l.mu.Unlock()
+		return nil
+	}
+	l.done = true
+	l.mu.Unlock()
+	windows.SetEvent(l.closed)
+	l.wg.Wait()
+	windows.CloseHandle(l.next)
+	return windows.CloseHandle(l.closed)
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// pipeConn is a client connected to a pipeListener.
+type pipeConn struct {
+	h      windows.Handle
+	addr   pipeAddr
+	closed windows.Handle
+	read   pipeDeadline
+	write  pipeDeadline
+
+	mu   sync.Mutex
+	done bool
+	wg   sync.WaitGroup
+}
+
+func newPipeConn(h windows.Handle, addr pipeAddr) (*pipeConn, error) {
+	c := &pipeConn{h: h, addr: addr}
+	events := []*windows.Handle{&c.closed, &c.read.wake, &c.write.wake}
+	for i, ev := range events {
+		var err error
+		// The wake up events reset once a waiter saw them.
+		if *ev, err = windows.CreateEvent(nil, boolToUint32(i == 0), 0, nil); err != nil {
+			for _, ev := range events[:i] {
+				windows.CloseHandle(*ev)
+			}
+			windows.CloseHandle(h)
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// begin registers an operation unless c is closed.
+func (c *pipeConn) begin() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return errPipeClosed
+	}
+	c.wg.Add(1)
+	return nil
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	if err := c.begin(); err != nil {
+		return 0, err
+	}
+	defer c.wg.Done()
+	n, err := overlappedIO(c.h, c.closed, &c.read, func(o *windows.Overlapped) error {
+		return windows.ReadFile(c.h, b, nil, o)
+	})
+	if err == windows.ERROR_BROKEN_PIPE {
+		err = io.EOF
+	}
+	return int(n), err
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	if err := c.begin(); err != nil {
+		return 0, err
+	}
+	defer c.wg.Done()
+	written := 0
+	for written < len(b) {
+		n, err := overlappedIO(c.h, c.closed, &c.write, func(o *windows.Overlapped) error {
+			return windows.WriteFile(c.h, b[written:], nil, o)
+		})
+		written += int(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *pipeConn) Close() error {
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		return nil
+	}
+	c.done = true
+	c.mu.Unlock()
+	windows.SetEvent(c.closed)
+	c.wg.Wait()
+	for _, ev := range []windows.Handle{c.closed, c.read.wake, c.write.wake} {
+		windows.CloseHandle(ev)
+	}
+	return windows.CloseHandle(c.h)
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.read.set(t)
+	c.write.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.read.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.write.set(t)
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// Parameters of the obfuscated-openssh protocol.
+const (
+	obfuscateSeedLength     = 16
+	obfuscateKeyLength      = 16
+	obfuscateHashIterations = 6000
+	obfuscateMaxPadding     = 8192
+	obfuscateMagic          = 0x0BF5CA7E
+)
+
+// ObfuscatedSSH returns an Obfuscate function for the obfuscated-openssh
+// protocol, supported by patched ssh servers and by relays in front of
+// them: the client sends a random seed and a random amount of padding,
+// and all traffic after it, the ssh banner included, is encrypted with
+// RC4 keys derived from the seed and keyword, shared with the server. It
+// hides the banner and the shape of the handshake from fingerprinting,
+// but is no protection against an observer who knows the keyword.
+func ObfuscatedSSH(keyword string) func(net.Conn) (net.Conn, error) {
+	return func(conn net.Conn) (net.Conn, error) {
+		seed := make([]byte, obfuscateSeedLength)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(obfuscateMaxPadding+1))
+		if err != nil {
+			return nil, err
+		}
+		padding := int(n.Int64())
+		out, err := rc4.NewCipher(obfuscateKey(seed, keyword, "client_to_server"))
+		if err != nil {
+			return nil, err
+		}
+		in, err := rc4.NewCipher(obfuscateKey(seed, keyword, "server_to_client"))
+		if err != nil {
+			return nil, err
+		}
+		msg := make([]byte, obfuscateSeedLength+8+padding)
+		copy(msg, seed)
+		body := msg[obfuscateSeedLength:]
+		binary.BigEndian.PutUint32(body, obfuscateMagic)
+		binary.BigEndian.PutUint32(body[4:], uint32(padding))
+		if _, err := rand.Read(body[8:]); err != nil {
+			return nil, err
+		}
+		out.XORKeyStream(body, body)
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		return &obfuscatedConn{Conn: conn, in: in, out: out}, nil
+	}
+}
+
+// obfuscate wraps nc, a new connection to the ssh server, with Obfuscate
+// if it is set, closing it if that fails.
+func (p *SSHProxy) obfuscate(nc net.Conn) (net.Conn, error) {
+	if p.cfg.Obfuscate == nil {
+		return nc, nil
+	}
+	conn, err := p.cfg.Obfuscate(nc)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("obfuscating the connection to %s: %w", p.cfg.RemoteAddress, err)
+	}
+	return conn, nil
+}
+
+// obfuscateKey derives the key of one direction from the seed and
+// keyword by iterated SHA-1.
+func obfuscateKey(seed []byte, keyword, direction string) []byte {
+	h := sha1.New()
+	h.Write(seed)
+	h.Write([]byte(keyword))
+	h.Write([]byte(direction))
+	sum := h.Sum(nil)
+	for i := 0; i < obfuscateHashIterations; i++ {
+		next := sha1.Sum(sum)
+		sum = next[:]
+	}
+	return sum[:obfuscateKeyLength]
+}
+
+// obfuscatedConn encrypts what is written to and decrypts what is read
+// from the connection to the ssh server. The ssh client reads and writes
+// from one goroutine each, so the ciphers need no locking.
+type obfuscatedConn struct {
+	net.Conn
+	in, out *rc4.Cipher
+}
+
+func (c *obfuscatedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func (c *obfuscatedConn) Write(b []byte) (int, error) {
+	buf := make([]byte, len(b))
+	c.out.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
@@ -0,0 +1,35 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// originTLSConfig returns cfg with the host of addr as the server name if
+// it has none.
+func originTLSConfig(cfg *tls.Config, addr string) *tls.Config {
+	if cfg.ServerName != "" {
+		return cfg
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return cfg
+	}
+	cfg = cfg.Clone()
+	cfg.ServerName = host
+	return cfg
+}
+
+// originateTLS makes a TLS client connection over conn to the target at
+// addr and completes the handshake, closing conn if it fails.
+func originateTLS(conn net.Conn, cfg *tls.Config, addr string) (net.Conn, error) {
+	tc := tls.Client(conn, originTLSConfig(cfg, addr))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, wrapError(ErrRemoteDial, fmt.Errorf("%s: %w", addr, err))
+	}
+	return tc, nil
+}
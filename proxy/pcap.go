@@ -0,0 +1,203 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapLinkRawIP  = 101
+	pcapSnapLen    = 65535
+	pcapMaxSegment = 16384
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// PcapWriter writes the cleartext streams of forwarded connections to a
+// pcap file as synthesized IPv4/TCP packets, so they can be inspected with
+// tools like Wireshark. It is safe for concurrent use.
+type PcapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewPcapWriter writes a pcap file header to w and returns a PcapWriter.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkRawIP)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// pcapStream synthesizes a tcp connection between client and server.
+type pcapStream struct {
+	w      *PcapWriter
+	client *net.TCPAddr
+	server *net.TCPAddr
+
+	mu  sync.Mutex
+	seq [2]uint32 // next sequence number sent by client and server
+}
+
+// stream starts a new synthesized connection with a three way handshake.
+func (w *PcapWriter) stream(client, server net.Addr) *pcapStream {
+	s := &pcapStream{
+		w:      w,
+		client: pcapAddr(client),
+		server: pcapAddr(server),
+		seq:    [2]uint32{1000, 5000},
+	}
+	s.packet(true, tcpFlagSYN, nil)
+	s.seq[0]++
+	s.packet(false, tcpFlagSYN|tcpFlagACK, nil)
+	s.seq[1]++
+	s.packet(true, tcpFlagACK, nil)
+	return s
+}
+
+// write records data sent by the client or the server.
+func (s *pcapStream) write(fromClient bool, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := 1
+	if fromClient {
+		dir = 0
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > pcapMaxSegment {
+			n = pcapMaxSegment
+		}
+		s.packet(fromClient, tcpFlagPSH|tcpFlagACK, data[:n])
+		s.seq[dir] += uint32(n)
+		data = data[n:]
+	}
+}
+
+// close records a FIN sent by the client or the server.
+func (s *pcapStream) close(fromClient bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packet(fromClient, tcpFlagFIN|tcpFlagACK, nil)
+	if fromClient {
+		s.seq[0]++
+	} else {
+		s.seq[1]++
+	}
+}
+
+func (s *pcapStream) packet(fromClient bool, flags byte, payload []byte) {
+	src, dst := s.client, s.server
+	seq, ack := s.seq[0], s.seq[1]
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+	pkt := make([]byte, 40+len(payload))
+	ip, tcp := pkt[:20], pkt[20:]
+
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], src.IP)
+	copy(ip[16:20], dst.IP)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	// The pseudo header sums source, destination, protocol and length.
+	pseudo := uint32(6) + uint32(len(tcp))
+	for i := 12; i < 20; i += 2 {
+		pseudo += uint32(binary.BigEndian.Uint16(ip[i:]))
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+
+	s.w.writePacket(pkt)
+}
+
+func (w *PcapWriter) writePacket(pkt []byte) {
+	now := time.Now()
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(pkt)))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.w.Write(hdr); err != nil {
+		logger.Errorf("error writing pcap: %s", err)
+		return
+	}
+	if _, err := w.w.Write(pkt); err != nil {
+		logger.Errorf("error writing pcap: %s", err)
+	}
+}
+
+// pcapAddr returns addr as an IPv4 tcp address, substituting loopback for
+// addresses that cannot be represented.
+func pcapAddr(addr net.Addr) *net.TCPAddr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := tcp.IP.To4(); ip4 != nil {
+			return &net.TCPAddr{IP: ip4, Port: tcp.Port}
+		}
+		return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: tcp.Port}
+	}
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1).To4()}
+}
+
+// checksum computes the internet checksum of b, starting from sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// dumpReader records everything read from the wrapped reader in a stream.
+type dumpReader struct {
+	io.Reader
+	stream     *pcapStream
+	fromClient bool
+}
+
+func (r dumpReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.stream.write(r.fromClient, b[:n])
+	}
+	if err == io.EOF {
+		r.stream.close(r.fromClient)
+	}
+	return n, err
+}
@@ -0,0 +1,95 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// errPolicyExec is returned for exec remotes and tun devices under a
+// policy, which give access beyond the destinations it lists.
+var errPolicyExec = errors.New("not allowed by the policy")
+
+// compilePolicy compiles the policy rules of cfg, nil if there are none.
+// Unlike the destination rules of a forward, destinations matching no rule
+// are always denied.
+func compilePolicy(rules []DestinationRule) (*destinationACL, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	acl, err := compileDestinationRules(rules)
+	if err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+	acl.defaultAllow = false
+	return acl, nil
+}
+
+// checkPolicy returns an ErrDenied error unless the policy of p, if any,
+// allows addr.
+func (p *SSHProxy) checkPolicy(addr string) error {
+	if p.policy == nil {
+		return nil
+	}
+	if err := p.policy.check(addr); err != nil {
+		return wrapError(ErrDenied, fmt.Errorf("%s: not allowed by the policy", addr))
+	}
+	return nil
+}
+
+// policyAddrs returns the addresses in ips a name allowed by the policy
+// may be reached at on port: those no deny rule of the policy matches.
+// Addresses only left unlisted by its allow rules are kept, as the name
+// was allowed.
+func (p *SSHProxy) policyAddrs(ips []net.IP, port string) []net.IP {
+	if p.policy == nil {
+		return ips
+	}
+	var allowed []net.IP
+	for _, ip := range ips {
+		if !p.policy.denies(net.JoinHostPort(ip.String(), port)) {
+			allowed = append(allowed, ip)
+		}
+	}
+	return allowed
+}
+
+// checkPolicyRemotes checks the remotes of a forward against the policy
+// when it is added. Services are checked once they are looked up.
+func (p *SSHProxy) checkPolicyRemotes(remotes ...string) error {
+	if p.policy == nil {
+		return nil
+	}
+	for _, remote := range remotes {
+		switch {
+		case remote == "" || isService(remote):
+		case isExec(remote):
+			return wrapError(ErrDenied, fmt.Errorf("%s: %w", remote, errPolicyExec))
+		default:
+			if err := p.checkPolicy(remote); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// allowedTargets returns the targets of a service the policy allows, or
+// an ErrDenied error if it allows none of them.
+func (p *SSHProxy) allowedTargets(service string, targets []string) ([]string, error) {
+	if p.policy == nil {
+		return targets, nil
+	}
+	var allowed []string
+	for _, target := range targets {
+		if p.checkPolicy(target) == nil {
+			allowed = append(allowed, target)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, wrapError(ErrDenied, fmt.Errorf("%s: no instance allowed by the policy", service))
+	}
+	return allowed, nil
+}
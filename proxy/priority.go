@@ -0,0 +1,98 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import "sync"
+
+// Priority is the class of a forward when capacity is short.
+type Priority string
+
+// Forward priorities.
+const (
+	// PriorityHigh forwards, e.g. ssh or database admin sessions, get
+	// free channel open slots before the others.
+	PriorityHigh Priority = "high"
+	// PriorityNormal is the default.
+	PriorityNormal Priority = "normal"
+	// PriorityLow forwards, e.g. bulk transfers, get channel open slots
+	// last and are shed once connections hold lowPriorityShare of
+	// MaxBufferedBytes, keeping the rest for the others.
+	PriorityLow Priority = "low"
+)
+
+// lowPriorityShare is the part of MaxBufferedBytes low priority
+// connections may use, in quarters.
+const lowPriorityShare = 3
+
+// rank orders priorities from 0 for low to 2 for high.
+func (pr Priority) rank() int {
+	switch pr {
+	case PriorityHigh:
+		return 2
+	case PriorityLow:
+		return 0
+	}
+	return 1
+}
+
+// startupQueue limits the number of remote channel opens in flight. Free
+// slots go to waiting opens of the highest priority first and, within a
+// priority, in the order they started waiting.
+type startupQueue struct {
+	mu      sync.Mutex
+	free    int
+	waiting [3][]chan struct{}
+}
+
+func newStartupQueue(slots int) *startupQueue {
+	return &startupQueue{free: slots}
+}
+
+// acquire waits for a slot for an open of priority prio and reports
+// whether it got one before done was closed.
+func (q *startupQueue) acquire(prio Priority, done <-chan struct{}) bool {
+	q.mu.Lock()
+	if q.free > 0 {
+		q.free--
+		q.mu.Unlock()
+		return true
+	}
+	r := prio.rank()
+	ready := make(chan struct{})
+	q.waiting[r] = append(q.waiting[r], ready)
+	q.mu.Unlock()
+	select {
+	case <-ready:
+		return true
+	case <-done:
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, w := range q.waiting[r] {
+		if w == ready {
+			q.waiting[r] = append(q.waiting[r][:i], q.waiting[r][i+1:]...)
+			return false
+		}
+	}
+	// The slot was handed over while giving up, pass it on.
+	q.releaseLocked()
+	return false
+}
+
+// release frees a slot, handing it to the next waiting open if any.
+func (q *startupQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked()
+}
+
+func (q *startupQueue) releaseLocked() {
+	for r := len(q.waiting) - 1; r >= 0; r-- {
+		if len(q.waiting[r]) > 0 {
+			close(q.waiting[r][0])
+			q.waiting[r] = q.waiting[r][1:]
+			return
+		}
+	}
+	q.free++
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"net"
+)
+
+// Probe checks that forward name can reach its targets by opening and
+// closing a connection to each of them: the default remote and the
+// remotes of all routes through the ssh connection, or the local target
+// of reverse forwards.
+func (p *SSHProxy) Probe(name string) error {
+	fwd, err := p.lookupForward(name)
+	if err != nil {
+		return err
+	}
+	return p.probe(fwd)
+}
+
+func (p *SSHProxy) probe(fwd *forward) error {
+	settings := fwd.current()
+	if fwd.reverse {
+		conn, err := net.DialTimeout("tcp", settings.remote, localDialTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	for _, addr := range settings.probes {
+		conn, err := p.dialTarget(addr, settings.priority)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// routeRemotes returns remote and the remotes of all routes without
+// duplicates.
+func routeRemotes(remote string, routes ...[]Route) []string {
+	seen := make(map[string]bool)
+	var remotes []string
+	add := func(addr string) {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			remotes = append(remotes, addr)
+		}
+	}
+	add(remote)
+	for _, rs := range routes {
+		for _, r := range rs {
+			add(r.Remote)
+		}
+	}
+	return remotes
+}
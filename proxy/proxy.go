@@ -4,11 +4,16 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/op/go-logging"
 	"golang.org/x/crypto/ssh"
@@ -23,23 +28,367 @@ type SSHProxy struct {
 	ctx  context.Context
 	wg   *sync.WaitGroup
 	done chan struct{}
+
+	// up is closed while there is an ssh connection, and replaced when
+	// it is lost. Guarded by mu like conn.
+	up chan struct{}
+	// started is set by the first Connect.
+	started bool
+	// parked counts the connections waiting in parkedClient.
+	parked int32
+	// dialer, if set, makes the connections to the ssh server.
+	dialer DialFunc
+	// gone holds a channel per ssh connection that is closed when it
+	// ends. Guarded by mu.
+	gone map[*ssh.Client]chan struct{}
+
+	// startups limits the number of remote channel opens in flight.
+	startups *startupQueue
+	// fair interleaves channel writes with FairScheduling.
+	fair *fairScheduler
+	// memory accounts for the memory of open connections.
+	memory memoryBudget
+	// cache holds the results of target lookups.
+	cache *resolveCache
+	// dns carries the queries to the DNS server of the config.
+	dns *dnsMux
+	// paths keeps the ssh connections of Paths if set.
+	paths *pathSet
+	// problems counts slow and stalled connections.
+	problems ProblemStats
+	// dialFailures counts failed remote dials.
+	dialFailures DialFailures
+	// activity tracks open connections for Idle.
+	activity activity
+	// audit records connections if set.
+	audit *AuditLog
+	// session totals connections if set.
+	session *SessionStats
+	// connectLog records CONNECT mode destinations if set.
+	connectLog *ConnectLog
+	// policy restricts all destinations if set.
+	policy *destinationACL
+	// latency collects HTTP request durations of L7 forwards.
+	latency latencyStats
+
+	mu       sync.Mutex
+	forwards map[string]*forward
+	stats    ConnStats
+	hooks    *Hooks
+
+	evmu        sync.Mutex
+	subscribers []chan Event
+	closed      bool
 }
 
 // Config is used to store configuraiton information for the SSH Proxy
 type Config struct {
 	PrivateKeyPath string
-	RemoteUser     string
-	RemoteAddress  string
+	// PrivateKey is a PEM encoded private key used instead of reading
+	// PrivateKeyPath, e.g. one passed in the environment.
+	PrivateKey []byte
+	// Passphrase decrypts the private key if it is encrypted.
+	Passphrase string
+	// Password, if set, is tried after public key authentication.
+	Password      string
+	RemoteUser    string
+	RemoteAddress string
+	// MaxStartups caps the number of remote channel opens in flight at
+	// once, 0 means unlimited. Further connections wait for a free slot,
+	// which goes to the forwards of the highest Priority first.
+	MaxStartups int
+	// MaxBufferedBytes caps the memory connections can hold, 0 means
+	// unlimited. Each connection counts the receive window of its ssh
+	// channel, 2MB, and its copy buffers. Connections that would exceed
+	// the cap, or a part of it for PriorityLow forwards, are shed.
+	MaxBufferedBytes int64
+	// FairScheduling interleaves the writes of connections to their
+	// channels in small turns, weighted by the Priority of their forwards,
+	// so a bulk stream cannot monopolize the ssh transport while
+	// interactive connections wait.
+	FairScheduling bool
+	// SlowThreshold is the remote dial and first response latency above
+	// which a connection is logged as slow, 0 disables the check.
+	SlowThreshold time.Duration
+	// StallThreshold is how long a connection waiting for a response may
+	// make no progress before it is logged as stalled, 0 disables the check.
+	StallThreshold time.Duration
+	// HappyEyeballs resolves remote target names locally and, if they
+	// have several addresses, races channel opens to them in the order of
+	// PreferFamily, using the first to succeed. Names that do not resolve
+	// locally are left to the ssh server, as are the destinations clients
+	// of proxy modes ask for. Addresses a deny rule of Policy matches are
+	// skipped.
+	HappyEyeballs bool
+	// PreferFamily is the address family tried first when dialing the ssh
+	// server and remote targets. Other than FamilyAuto, it makes remote
+	// target names resolve locally like HappyEyeballs, but without racing
+	// the addresses unless HappyEyeballs is set.
+	PreferFamily Family
+	// ResolveCacheTTL, if set, resolves remote target names locally like
+	// PreferFamily and caches the addresses, and the results of srv: and
+	// consul: lookups, for this long. Expired entries are still used while
+	// they are looked up again in the background.
+	ResolveCacheTTL time.Duration
+	// DNSServer, if set, is a DNS server on the remote network that
+	// target names and srv: remotes are looked up with, over TCP through
+	// the ssh connection, instead of the local resolver. Unlike the local
+	// resolver it is also used for the destinations of proxy modes.
+	// Queries are pipelined over a single channel to it.
+	DNSServer string
+	// ConsulAddress is the host:port of the HTTP API of a Consul agent,
+	// reached through the ssh connection, that consul: remotes are looked
+	// up with. ConsulToken is sent as its ACL token if set.
+	ConsulAddress string
+	ConsulToken   string
+	// AuthMethods are tried before the private key and password, e.g. an
+	// ssh agent or keyboard-interactive. With AuthMethods set, the default
+	// private key is not loaded when neither a key nor a password is set.
+	AuthMethods []ssh.AuthMethod
+	// HostKeyCallback checks the host key of the ssh server. If it is nil
+	// every host key is accepted.
+	HostKeyCallback ssh.HostKeyCallback
+	// ClientConfig, if set, is called with the final client config before
+	// each connection and may change any of it.
+	ClientConfig func(*ssh.ClientConfig) error
+	// ProxyCommand, if set, is run with the system shell to reach the ssh
+	// server over its stdin and stdout instead of dialing RemoteAddress,
+	// like the ProxyCommand of OpenSSH. %h, %p and %r are replaced with
+	// the host and port of RemoteAddress and RemoteUser.
+	ProxyCommand string
+	// KeepAliveInterval is how often a keepalive is sent to the ssh server,
+	// 0 disables them. A keepalive not answered within the interval is
+	// missed.
+	KeepAliveInterval time.Duration
+	// KeepAliveCountMax is the number of keepalives in a row the server
+	// may miss before the connection is closed as lost, along with all
+	// connections through it. It defaults to 3.
+	KeepAliveCountMax int
+	// ParkTimeout is how long a connection that needs the ssh connection
+	// while it is down or being replaced waits for a new one, 0 fails it
+	// at once. The local listeners stay bound either way, and forwards
+	// may be added before the first Connect, so connections accepted
+	// before it park as well.
+	ParkTimeout time.Duration
+	// ParkQueue bounds how many connections may be parked at once;
+	// connections beyond it fail at once. 0 means unlimited.
+	ParkQueue int
+	// Policy, if set, restricts the destinations of all forwards and
+	// modes like the destination rules of a forward, except that
+	// destinations matching no rule are denied. Forwards with remotes it
+	// denies cannot be added, connections to denied destinations fail
+	// with ErrDenied, and exec remotes and tun devices are refused.
+	// Reverse forwards are not affected.
+	Policy []DestinationRule
+	// Paths, if set, are local interfaces, by name or address, to keep an
+	// extra ssh connection to the server over each besides the main one,
+	// e.g. Wi-Fi and LTE, so a flaky link only loses the connections over
+	// it. New remote connections are spread over the ssh connections that
+	// are up as PathMode says; each stays on the one it was opened over.
+	// The system must route by source address for the links to differ.
+	// Paths cannot be combined with ProxyCommand or WithDialer, and
+	// reverse forwards, sessions and Client only use the main connection.
+	// This is experimental.
+	Paths []string
+	// PathMode is PathStripe, the default, or PathFailover.
+	PathMode PathMode
+	// Knock, if set, is a port knocking sequence sent to the ssh server
+	// before each connection to it, including reconnects and the
+	// connections of Paths, for servers guarded by knockd. It is not sent
+	// with ProxyCommand or WithDialer.
+	Knock []KnockStep
+	// ClientVersion, if set, is the version string sent to the ssh server
+	// instead of the one of the Go ssh library, e.g. SSH-2.0-OpenSSH_9.6.
+	// It must start with SSH-2.0-.
+	ClientVersion string
+	// Obfuscate, if set, wraps every connection to the ssh server before
+	// the ssh handshake, e.g. in padding or encryption the server side
+	// undoes, for networks that fingerprint and block ssh. ObfuscatedSSH
+	// returns one for the obfuscated-openssh protocol.
+	Obfuscate func(net.Conn) (net.Conn, error)
+	// GSSAPI, if set, authenticates with gssapi-with-mic, e.g. with the
+	// Kerberos ticket of the user against an AD-integrated server. It is
+	// called for a new GSSAPI client for each connection and tried after
+	// AuthMethods; like them it keeps the default private key from being
+	// loaded.
+	GSSAPI func() (ssh.GSSAPIClient, error)
+	// GSSAPITarget is the host name of the service principal of the ssh
+	// server, host/<GSSAPITarget>. It defaults to the host of
+	// RemoteAddress.
+	GSSAPITarget string
+}
+
+// Family is an address family preference.
+type Family string
+
+// Address family preferences.
+const (
+	// FamilyAuto leaves the order to the resolver for the ssh server and
+	// to the ssh server for remote targets, or alternates IPv6 and IPv4
+	// with HappyEyeballs. It is the default.
+	FamilyAuto Family = "auto"
+	// FamilyIPv4 tries IPv4 addresses first.
+	FamilyIPv4 Family = "ipv4"
+	// FamilyIPv6 tries IPv6 addresses first.
+	FamilyIPv6 Family = "ipv6"
+)
+
+// ForwardOptions tune the behavior of a single forward.
+type ForwardOptions struct {
+	// AcceptRate limits how many connections per second are accepted,
+	// 0 means unlimited.
+	AcceptRate float64
+	// AcceptBurst is the number of connections accepted in a burst above
+	// AcceptRate.
+	AcceptBurst int
+	// Dump, if set, records the traffic of every connection.
+	Dump *PcapWriter
+	// SNIRoutes route TLS connections by the server name of their
+	// ClientHello, without terminating TLS. Connections without a
+	// matching route go to the default remote, or are rejected if it is
+	// empty.
+	SNIRoutes []Route
+	// HTTP serves the forward as an HTTP reverse proxy (L7 mode) instead
+	// of forwarding raw connections.
+	HTTP bool
+	// HTTPRoutes route requests by their Host header, path and other
+	// headers in L7 mode. The first matching route is used. Requests
+	// without a matching route go to the default remote, or fail if it is
+	// empty. Setting HTTPRoutes implies HTTP.
+	HTTPRoutes []Route
+	// RequestHeaders are applied in order to requests in L7 mode.
+	RequestHeaders []HeaderRule
+	// ResponseHeaders are applied in order to responses in L7 mode.
+	ResponseHeaders []HeaderRule
+	// BearerToken, if set, supplies a token sent as
+	// "Authorization: Bearer <token>" with every request in L7 mode.
+	BearerToken TokenSource
+	// Mirror, if set, copies a share of the requests to a second remote
+	// in L7 mode.
+	Mirror *Mirror
+	// TLS, if set, terminates TLS on the local listener with this config.
+	// It cannot be combined with SNIRoutes.
+	TLS *tls.Config
+	// RemoteTLS, if set, originates TLS to the remote target with this
+	// config: plain forwards wrap each connection and L7 forwards send
+	// requests over https. Its ServerName, which defaults to the host of
+	// the remote, can differ from the address connected to, and its
+	// Certificates are presented to remotes that require a client
+	// certificate. It cannot be combined with SNIRoutes or the proxy modes.
+	RemoteTLS *tls.Config
+	// Connect serves the forward as an HTTP CONNECT proxy: clients choose
+	// the destination of each connection and the remote of the forward is
+	// unused.
+	Connect bool
+	// SOCKS serves the forward as a SOCKS5 proxy like Connect. Clients
+	// may send domain names, which are resolved on the remote side.
+	SOCKS bool
+	// Transparent serves connections redirected to the forward by the
+	// firewall, with iptables REDIRECT or TPROXY, tunneling each to the
+	// destination it was originally for. The remote of the forward is
+	// unused. It is only supported on Linux and for IPv4.
+	Transparent bool
+	// Destinations are checked in order against the destinations clients
+	// ask for in CONNECT, SOCKS and transparent modes, before anything is
+	// dialed. The first matching rule decides; destinations matching no
+	// rule are allowed only if there are no allow rules.
+	Destinations []DestinationRule
+	// Listener, if set, is served instead of binding the local port, e.g.
+	// a socket inherited from systemd or from a process being upgraded.
+	// Reconfigure ignores it.
+	Listener net.Listener
+	// Upstream, if set, chains a CONNECT mode forward to an HTTP proxy on
+	// the remote network: CONNECT requests are passed on to it and plain
+	// HTTP requests sent to it in absolute form.
+	Upstream *Upstream
+	// AcceptTimeout bounds how long a client may take to send what picks
+	// its target: the request in CONNECT and SOCKS modes, the ClientHello
+	// for SNI routing or the request headers in L7 mode, and the TLS
+	// handshake of reverse forwards with TLS. 0 keeps the defaults of 30s,
+	// 10s, none and 10s.
+	AcceptTimeout time.Duration
+	// DialTimeout bounds opening the connection to the target through the
+	// ssh connection, including waiting for a lost one to come back. 0
+	// leaves it to the ssh server and the park timeout.
+	DialTimeout time.Duration
+	// MaxLifetime, if set, closes forwarded connections that have been
+	// open this long. It does not apply to L7 mode.
+	MaxLifetime time.Duration
+	// Priority decides which connections get capacity first under
+	// MaxStartups and MaxBufferedBytes. It defaults to PriorityNormal.
+	Priority Priority
+	// Chaos, if set, injects faults into the connections of the forward
+	// for resilience testing.
+	Chaos *Chaos
+	// Watch, if set, probes the targets of the forward this often and
+	// refuses connections while any of them is not listening, starting
+	// from when the forward is added until the first probe succeeds.
+	// EventTargetUp and EventTargetDown report the changes. It needs a
+	// remote and is not supported for reverse forwards.
+	Watch time.Duration
+	// Public makes reverse forwards whose remote address has no host
+	// listen on all interfaces of the ssh server instead of loopback. The
+	// server only honours this with GatewayPorts enabled.
+	Public bool
+	// Origins are checked in order against the originator address the ssh
+	// server reports for each connection of a reverse forward, which is
+	// closed unless they allow it, like Destinations. Rules match the
+	// address only, they cannot have ports.
+	Origins []DestinationRule
 }
 
 // New creates an instance of an SSHProxy
 func New(cfg *Config) (*SSHProxy, error) {
-	return &SSHProxy{
+	switch cfg.PreferFamily {
+	case "", FamilyAuto, FamilyIPv4, FamilyIPv6:
+	default:
+		return nil, fmt.Errorf("unknown address family %q", cfg.PreferFamily)
+	}
+	p := &SSHProxy{
 		cfg:  cfg,
 		ctx:  context.Background(),
 		wg:   new(sync.WaitGroup),
 		done: make(chan struct{}),
-	}, nil
+		up:   make(chan struct{}),
+		gone: make(map[*ssh.Client]chan struct{}),
+
+		forwards: make(map[string]*forward),
+		memory:   memoryBudget{limit: cfg.MaxBufferedBytes},
+		cache:    &resolveCache{ttl: cfg.ResolveCacheTTL, entries: make(map[string]*resolveEntry)},
+		activity: activity{change: time.Now()},
+	}
+	if cfg.MaxStartups > 0 {
+		p.startups = newStartupQueue(cfg.MaxStartups)
+	}
+	if cfg.FairScheduling {
+		p.fair = &fairScheduler{}
+	}
+	if cfg.DNSServer != "" {
+		server := cfg.DNSServer
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		p.dns = newDNSMux(p, server)
+	}
+	if err := checkKnock(cfg.Knock); err != nil {
+		return nil, err
+	}
+	if cfg.ClientVersion != "" && !strings.HasPrefix(cfg.ClientVersion, "SSH-2.0-") {
+		return nil, errors.New("the client version must start with SSH-2.0-")
+	}
+	var err error
+	if p.policy, err = compilePolicy(cfg.Policy); err != nil {
+		return nil, err
+	}
+	if len(cfg.Paths) > 0 {
+		if cfg.ProxyCommand != "" {
+			return nil, errors.New("paths cannot be combined with a proxy command")
+		}
+		if p.paths, err = newPathSet(p, cfg.Paths, cfg.PathMode); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
 }
 
 // WithContext sets the current context value
@@ -47,126 +396,857 @@ func (p *SSHProxy) WithContext(ctx context.Context) {
 	p.ctx = ctx
 }
 
-// Shutdown waits for all connections to stop
+// DialFunc makes a connection to addr on network, like net.Dialer's
+// DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// WithDialer makes p connect to the ssh server with dial instead of dialing
+// TCP or running the proxy command, e.g. to reach it through a VPN socket or
+// an in-memory pipe. It must be called before Connect, which fails if
+// Config.Paths is set as well.
+func (p *SSHProxy) WithDialer(dial DialFunc) {
+	p.dialer = dial
+}
+
+// WithHooks sets the callbacks invoked on lifecycle changes. It must be
+// called before Connect.
+func (p *SSHProxy) WithHooks(hooks *Hooks) {
+	p.hooks = hooks
+}
+
+// Shutdown closes all listeners and waits for all connections to stop
 func (p *SSHProxy) Shutdown() {
 	close(p.done)
+	p.mu.Lock()
+	for _, fwd := range p.forwards {
+		if err := fwd.listener.Close(); err != nil {
+			logger.Errorf("error shutting down listener: %s", err)
+		}
+	}
+	p.mu.Unlock()
 	p.wg.Wait()
+	p.closeSubscribers()
 }
 
-// Connect makes the ssh connection to the remote host
+// Connect makes the ssh connection to the remote host. Calling Connect again
+// replaces the existing connection, which counts as a reconnect: new remote
+// connections use the new one, while those already open over the old one
+// are closed with it.
 func (p *SSHProxy) Connect() error {
+	if p.paths != nil && p.dialer != nil {
+		return errors.New("paths cannot be combined with a dialer")
+	}
 	cfg, err := p.makeConfig()
 	if err != nil {
 		return err
 	}
-	conn, err := ssh.Dial("tcp", p.cfg.RemoteAddress, cfg)
+	// Record host key failures so they can be told apart from other
+	// handshake errors, which x/crypto/ssh flattens into strings.
+	var hostKeyErr error
+	hostKeyCallback := cfg.HostKeyCallback
+	cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKeyErr = hostKeyCallback(hostname, remote, key)
+		return hostKeyErr
+	}
+	start := time.Now()
+	nc, err := p.dialServer()
 	if err != nil {
 		return err
 	}
+	if nc, err = p.obfuscate(nc); err != nil {
+		return err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(nc, p.cfg.RemoteAddress, cfg)
+	if err != nil {
+		nc.Close()
+		return classifyDialError(err, hostKeyErr)
+	}
+	conn := ssh.NewClient(c, chans, reqs)
+	handshake := time.Since(start)
+	gone := make(chan struct{})
+	p.mu.Lock()
+	old, started := p.conn, p.started
+	p.conn, p.started = conn, true
+	p.gone[conn] = gone
+	if old == nil {
+		close(p.up)
+	}
+	p.stats.connected(start, handshake)
+	p.mu.Unlock()
+	logger.Debugf("ssh handshake took %s", handshake)
+	p.hooks.connect(p.cfg.RemoteAddress)
+	p.emit(Event{Type: EventConnected, Addr: p.cfg.RemoteAddress})
+	go func() {
+		err := conn.Wait()
+		p.mu.Lock()
+		lost := p.conn == conn
+		if lost {
+			p.conn = nil
+			p.up = make(chan struct{})
+		}
+		delete(p.gone, conn)
+		close(gone)
+		p.mu.Unlock()
+		// A replaced connection was not lost.
+		if lost {
+			p.hooks.disconnect(err)
+			p.emit(Event{Type: EventDisconnected, Addr: p.cfg.RemoteAddress, Err: err})
+		}
+	}()
+	if p.cfg.KeepAliveInterval > 0 {
+		go p.keepAlive(conn, gone)
+	}
+	if old != nil {
+		logger.Infof("replacing ssh connection")
+		if err := old.Close(); err != nil {
+			logger.Debugf("error closing old connection: %s", err)
+		}
+	}
+	if started {
+		p.rebindReverse(conn)
+		return nil
+	}
+	if p.paths != nil {
+		p.paths.start()
+	}
 	p.wg.Add(1)
 	go func() {
 		<-p.done
-		if err := conn.Close(); err != nil {
-			logger.Errorf("error closing connection: %s", err)
+		if conn := p.client(); conn != nil {
+			if err := conn.Close(); err != nil {
+				logger.Errorf("error closing connection: %s", err)
+			}
 		}
 		logger.Infof("ssh connection closed")
 		p.wg.Done()
 	}()
-	p.conn = conn
 	return nil
 }
 
+// ConnStats returns statistics about the ssh connection.
+func (p *SSHProxy) ConnStats() ConnStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Parked returns the number of connections waiting for the ssh connection.
+func (p *SSHProxy) Parked() int {
+	return int(atomic.LoadInt32(&p.parked))
+}
+
+// Connected reports whether p has an ssh connection. It is false before
+// Connect and while a lost connection is not replaced.
+func (p *SSHProxy) Connected() bool {
+	return p.client() != nil
+}
+
+// Disconnect closes the ssh connection as lost, for when it is known to be
+// dead before keepalives notice, e.g. after the system slept. Connections
+// through it are closed and new ones park until Connect is called again.
+func (p *SSHProxy) Disconnect() error {
+	conn := p.client()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// Client returns the ssh connection p manages, or nil while there is none,
+// so sessions, subsystems and channels can be opened over it without a
+// second handshake. It may be called from any goroutine and the client is
+// safe for concurrent use. The connection is replaced on reconnects, after
+// which an earlier client fails every request, so call Client for each use
+// instead of keeping it. Use Disconnect rather than closing it.
+func (p *SSHProxy) Client() *ssh.Client {
+	return p.client()
+}
+
+// WaitClient is like Client, but while there is no ssh connection it waits
+// up to the park timeout for one, like forwarded connections do.
+func (p *SSHProxy) WaitClient() (*ssh.Client, error) {
+	return p.parkedClient()
+}
+
+// client returns the current ssh connection.
+func (p *SSHProxy) client() *ssh.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn
+}
+
+// parkedClient returns the current ssh connection. If there is none it
+// waits up to the park timeout for one.
+func (p *SSHProxy) parkedClient() (*ssh.Client, error) {
+	p.mu.Lock()
+	conn, up := p.conn, p.up
+	p.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	if p.cfg.ParkTimeout <= 0 {
+		return nil, wrapError(ErrNotConnected, nil)
+	}
+	n := atomic.AddInt32(&p.parked, 1)
+	defer atomic.AddInt32(&p.parked, -1)
+	if p.cfg.ParkQueue > 0 && int(n) > p.cfg.ParkQueue {
+		logger.Warningf("%d connections already waiting for the ssh connection, failing another", p.cfg.ParkQueue)
+		return nil, wrapError(ErrNotConnected, nil)
+	}
+	logger.Debugf("parking connection until the ssh connection is back")
+	timer := time.NewTimer(p.cfg.ParkTimeout)
+	defer timer.Stop()
+	select {
+	case <-up:
+		if conn := p.client(); conn != nil {
+			return conn, nil
+		}
+	case <-timer.C:
+	case <-p.done:
+	}
+	return nil, wrapError(ErrNotConnected, nil)
+}
+
 // Forward forwards a remote addess to a local port. Set localPort to 0 to generate a random port.
+// The forward is named after the remote address.
 func (p *SSHProxy) Forward(remote, localPort string) (string, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%s", localPort))
+	return p.NamedForward(remote, remote, localPort)
+}
+
+// NamedForward forwards a remote address to a local port under the given name.
+// The name is used to refer to the forward later, e.g. to pause it. The
+// remote may also be a command run on the ssh server for each connection,
+// given as exec:command, for services only reachable through a helper
+// that talks over stdin and stdout.
+func (p *SSHProxy) NamedForward(name, remote, localPort string) (string, error) {
+	return p.ForwardWithOptions(name, remote, localPort, nil)
+}
+
+// ForwardWithOptions is like NamedForward, but tunes the forward with opts,
+// which may be nil. Forwards listen on loopback unless localPort is a
+// host:port, e.g. 0.0.0.0:8080 for the LAN. On Windows localPort may also
+// be a named pipe, given as npipe:////./pipe/name.
+func (p *SSHProxy) ForwardWithOptions(name, remote, localPort string, opts *ForwardOptions) (string, error) {
+	if opts == nil {
+		opts = &ForwardOptions{}
+	}
+	mode, err := forwardModeOf(opts)
+	if err != nil {
+		return "", err
+	}
+	fwd := &forward{name: name, mode: mode, log: newForwardLoggers(name)}
+	settings, err := p.newSettings(fwd, remote, opts)
+	if err != nil {
+		return "", err
+	}
+	fwd.settings.Store(settings)
+	if settings.watch > 0 {
+		fwd.down = 1
+	}
+	err = p.addForward(fwd, func() (net.Listener, error) {
+		if opts.Listener != nil {
+			return opts.Listener, nil
+		}
+		if isPipe(localPort) {
+			if mode == modeTransparent {
+				return nil, errors.New("transparent mode needs a TCP port")
+			}
+			return listenPipe(pipePath(localPort))
+		}
+		addr := localPort
+		if _, _, err := net.SplitHostPort(localPort); err != nil {
+			addr = net.JoinHostPort("127.0.0.1", localPort)
+		}
+		if mode == modeTransparent {
+			return listenTransparent(addr)
+		}
+		return net.Listen("tcp", addr)
+	})
 	if err != nil {
 		return "", err
 	}
+	listener := fwd.listener
+	handle := func(local net.Conn, settings *forwardSettings) {
+		go p.handleClient(local, fwd, settings)
+	}
+	stop := func() {}
+	switch mode {
+	case modeConnect:
+		handle = func(local net.Conn, settings *forwardSettings) {
+			go p.handleProxy(local, fwd, settings, &connectProtocol{upstream: settings.upstream})
+		}
+	case modeSOCKS:
+		handle = func(local net.Conn, settings *forwardSettings) {
+			go p.handleProxy(local, fwd, settings, socksProtocol{})
+		}
+	case modeTransparent:
+		handle = func(local net.Conn, settings *forwardSettings) {
+			go p.handleProxy(local, fwd, settings, transparentProtocol{})
+		}
+	case modeHTTP:
+		l := newConnListener(listener.Addr())
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.serveHTTP(fwd, l)
+		}()
+		// Requests use the settings current when they are read.
+		handle = func(local net.Conn, _ *forwardSettings) { l.push(local) }
+		stop = func() { l.Close() }
+	}
+	p.serveForward(fwd, handle, stop)
+	p.startWatch(fwd)
+	p.hooks.forwardUp(name, listener.Addr().String(), remote)
+	p.emit(Event{Type: EventForwardUp, Forward: name, Addr: listener.Addr().String()})
+	return listener.Addr().String(), nil
+}
+
+// forwardModeOf returns the mode opts ask for.
+func forwardModeOf(opts *ForwardOptions) (forwardMode, error) {
+	mode, modes := modeTCP, 0
+	if opts.HTTP || len(opts.HTTPRoutes) > 0 {
+		mode = modeHTTP
+		modes++
+	}
+	if opts.Connect {
+		mode = modeConnect
+		modes++
+	}
+	if opts.SOCKS {
+		mode = modeSOCKS
+		modes++
+	}
+	if opts.Transparent {
+		mode = modeTransparent
+		modes++
+	}
+	if modes > 1 {
+		return mode, errors.New("L7, CONNECT, SOCKS and transparent modes cannot be combined")
+	}
+	return mode, nil
+}
+
+// newSettings checks opts against the mode of fwd and compiles them with
+// remote into settings for it.
+func (p *SSHProxy) newSettings(fwd *forward, remote string, opts *ForwardOptions) (*forwardSettings, error) {
+	s := &forwardSettings{
+		remote:  remote,
+		limiter: newRateLimiter(opts.AcceptRate, opts.AcceptBurst),
+		dump:    opts.Dump,
+		tls:     opts.TLS,
+		origin:  opts.RemoteTLS,
+		probes:  routeRemotes(remote, opts.SNIRoutes, opts.HTTPRoutes),
+
+		acceptTimeout: opts.AcceptTimeout,
+		dialTimeout:   opts.DialTimeout,
+		maxLifetime:   opts.MaxLifetime,
+		priority:      opts.Priority,
+		chaos:         opts.Chaos,
+		watch:         opts.Watch,
+	}
+	if opts.Watch > 0 && len(s.probes) == 0 {
+		return nil, errors.New("watching needs a remote")
+	}
+	if opts.Chaos != nil {
+		if err := checkChaos(opts.Chaos); err != nil {
+			return nil, err
+		}
+	}
+	switch opts.Priority {
+	case "", PriorityHigh, PriorityNormal, PriorityLow:
+	default:
+		return nil, fmt.Errorf("unknown priority %q", opts.Priority)
+	}
+	if len(opts.SNIRoutes) > 0 {
+		if opts.TLS != nil {
+			return nil, errors.New("SNI routing cannot be combined with TLS termination")
+		}
+		if opts.RemoteTLS != nil {
+			return nil, errors.New("SNI routing cannot be combined with TLS origination")
+		}
+		if fwd.mode != modeTCP {
+			return nil, errors.New("SNI routing cannot be combined with L7 or proxy modes")
+		}
+		for _, route := range opts.SNIRoutes {
+			if len(route.Headers) > 0 {
+				return nil, errors.New("SNI routes cannot match headers")
+			}
+		}
+		s.route = sniRouter(opts.SNIRoutes, remote, orDefault(opts.AcceptTimeout, sniTimeout))
+	}
+	switch fwd.mode {
+	case modeTransparent:
+		if opts.TLS != nil {
+			return nil, errors.New("transparent mode cannot be combined with TLS termination")
+		}
+		fallthrough
+	case modeConnect, modeSOCKS:
+		acl, err := compileDestinationRules(opts.Destinations)
+		if err != nil {
+			return nil, err
+		}
+		s.acl = acl
+	case modeHTTP:
+		h, err := p.newHTTPForward(fwd, remote, opts)
+		if err != nil {
+			return nil, err
+		}
+		s.http = h
+	}
+	if (isExec(remote) || isService(remote)) && fwd.mode != modeTCP {
+		return nil, errors.New("exec, srv and consul remotes require a plain forward")
+	}
+	if opts.Mirror != nil && fwd.mode != modeHTTP {
+		return nil, errors.New("mirroring requires L7 mode")
+	}
+	if opts.RemoteTLS != nil && fwd.mode != modeTCP && fwd.mode != modeHTTP {
+		return nil, errors.New("TLS origination requires a plain or L7 forward")
+	}
+	if s.acl == nil && len(opts.Destinations) > 0 {
+		return nil, errors.New("destination rules require a proxy mode")
+	}
+	if opts.Upstream != nil {
+		if fwd.mode != modeConnect {
+			return nil, errors.New("an upstream proxy requires CONNECT mode")
+		}
+		s.upstream = opts.Upstream
+		s.probes = append(s.probes, opts.Upstream.Addr)
+	}
+	if err := p.checkPolicyRemotes(s.probes...); err != nil {
+		return nil, err
+	}
+	if opts.Mirror != nil {
+		if err := p.checkPolicyRemotes(opts.Mirror.Remote); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Reconfigure replaces the remote and options of forward name, e.g. after
+// the configuration was reloaded. Connections accepted from now on use
+// them, while open connections keep the settings they were accepted with.
+// For reverse forwards remote is the local target. The local port, the
+// address a reverse forward listens on and the mode (plain, L7, CONNECT,
+// SOCKS or transparent) cannot be changed this way.
+func (p *SSHProxy) Reconfigure(name, remote string, opts *ForwardOptions) error {
+	if opts == nil {
+		opts = &ForwardOptions{}
+	}
+	fwd, err := p.lookupForward(name)
+	if err != nil {
+		return err
+	}
+	mode, err := forwardModeOf(opts)
+	if err != nil {
+		return err
+	}
+	if mode != fwd.mode {
+		return fmt.Errorf("forward %s: the mode cannot be changed", name)
+	}
+	var settings *forwardSettings
+	if fwd.reverse {
+		settings, err = reverseSettings(remote, opts)
+	} else {
+		settings, err = p.newSettings(fwd, remote, opts)
+	}
+	if err != nil {
+		return err
+	}
+	old := fwd.current()
+	fwd.settings.Store(settings)
+	if old.http != nil {
+		old.http.closeIdleConnections()
+	}
+	if !fwd.reverse {
+		p.startWatch(fwd)
+	}
+	fwd.log.forward.Infof("forward %s reconfigured", name)
+	return nil
+}
+
+// addForward registers fwd under its name with a listener from listen.
+func (p *SSHProxy) addForward(fwd *forward, listen func() (net.Listener, error)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.forwards[fwd.name]; ok {
+		return fmt.Errorf("forward %q already exists", fwd.name)
+	}
+	listener, err := listen()
+	if err != nil {
+		return err
+	}
+	fwd.listener = listener
+	p.forwards[fwd.name] = fwd
+	return nil
+}
+
+// serveForward accepts connections on the listener of fwd and passes them
+// to handle, with the settings of fwd when they were accepted, until the
+// listener is closed, then calls stop. Connections are wrapped with TLS if
+// the settings have a TLS config.
+func (p *SSHProxy) serveForward(fwd *forward, handle func(net.Conn, *forwardSettings), stop func()) {
 	p.wg.Add(1)
 	go func() {
+		defer p.wg.Done()
+		defer stop()
 		for {
-			local, err := listener.Accept()
-			if err != nil {
-				logger.Errorf("error connecting to local port: %s", err)
+			if !fwd.current().limiter.wait(p.done) {
 				return
 			}
-			go p.handleClient(local, remote)
-			select {
-			case <-p.done:
-				if err := listener.Close(); err != nil {
-					logger.Errorf("error shutting down listener: %s", err)
+			conn, err := fwd.listener.Accept()
+			if err != nil {
+				select {
+				case <-p.done:
+				default:
+					if fwd.isClosed() {
+						return
+					}
+					fwd.log.forward.Errorf("forward %s: error accepting connection: %s", fwd.name, err)
+					p.hooks.forwardError(fwd.name, err)
+					p.emit(Event{Type: EventForwardError, Forward: fwd.name, Err: err})
 				}
-				p.wg.Done()
 				return
-			default:
 			}
+			if fwd.isPaused() {
+				fwd.log.conns.Debugf("forward %s is paused, rejecting connection", fwd.name)
+				if err := conn.Close(); err != nil {
+					fwd.log.conns.Errorf("error closing connection: %s", err)
+				}
+				continue
+			}
+			if fwd.isTargetDown() {
+				fwd.log.conns.Debugf("forward %s: target down, refusing connection", fwd.name)
+				if err := conn.Close(); err != nil {
+					fwd.log.conns.Errorf("error closing connection: %s", err)
+				}
+				continue
+			}
+			settings := fwd.current()
+			if settings.chaos.drop() {
+				fwd.log.conns.Debugf("forward %s: chaos dropped connection from %s", fwd.name, conn.RemoteAddr())
+				if err := conn.Close(); err != nil {
+					fwd.log.conns.Errorf("error closing connection: %s", err)
+				}
+				continue
+			}
+			p.hooks.clientAccepted(fwd.name, conn.RemoteAddr())
+			if settings.tls != nil {
+				conn = tls.Server(conn, settings.tls)
+			}
+			handle(conn, settings)
 		}
 	}()
-	return listener.Addr().String(), nil
 }
 
-func (p *SSHProxy) parsePrivateKey() (ssh.Signer, error) {
-	buff, err := ioutil.ReadFile(p.cfg.PrivateKeyPath)
+// Pause stops a forward from accepting new connections. The local port stays
+// bound and existing connections are left alone.
+func (p *SSHProxy) Pause(name string) error {
+	fwd, err := p.lookupForward(name)
+	if err != nil {
+		return err
+	}
+	fwd.setPaused(true)
+	fwd.log.forward.Infof("forward %s paused", name)
+	p.emit(Event{Type: EventForwardPaused, Forward: name})
+	return nil
+}
+
+// Resume allows a paused forward to accept new connections again.
+func (p *SSHProxy) Resume(name string) error {
+	fwd, err := p.lookupForward(name)
 	if err != nil {
+		return err
+	}
+	fwd.setPaused(false)
+	fwd.log.forward.Infof("forward %s resumed", name)
+	p.emit(Event{Type: EventForwardResumed, Forward: name})
+	return nil
+}
+
+// CloseForward stops a forward and releases its port, so the name can be
+// used again. Existing connections are left alone.
+func (p *SSHProxy) CloseForward(name string) error {
+	p.mu.Lock()
+	fwd, ok := p.forwards[name]
+	delete(p.forwards, name)
+	p.mu.Unlock()
+	if !ok {
+		return wrapError(ErrUnknownForward, fmt.Errorf("%q", name))
+	}
+	atomic.StoreInt32(&fwd.closed, 1)
+	err := fwd.listener.Close()
+	fwd.log.forward.Infof("forward %s closed", name)
+	p.emit(Event{Type: EventForwardDown, Forward: name})
+	return err
+}
+
+func (p *SSHProxy) lookupForward(name string) (*forward, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fwd, ok := p.forwards[name]
+	if !ok {
+		return nil, wrapError(ErrUnknownForward, fmt.Errorf("%q", name))
+	}
+	return fwd, nil
+}
+
+// dial opens a connection to addr, the remote of a forward, on the remote
+// side of the ssh connection for a forward of priority prio.
+func (p *SSHProxy) dial(addr string, prio Priority) (net.Conn, error) {
+	resolve := p.cfg.HappyEyeballs || p.preferFamily() != FamilyAuto || p.cfg.ResolveCacheTTL > 0 || p.dns != nil
+	return p.dialAddr(addr, prio, resolve)
+}
+
+// dialDestination is dial for addr chosen by a client of a proxy mode. Its
+// name is never resolved locally, which would leak it to the local
+// resolver and miss names only known behind the ssh server: it is left to
+// the ssh server, or looked up with the DNS server of the config.
+func (p *SSHProxy) dialDestination(addr string, prio Priority) (net.Conn, error) {
+	return p.dialAddr(addr, prio, p.dns != nil)
+}
+
+// dialAddr opens a connection to addr, resolving its name first with
+// dialResolved if resolve is set.
+func (p *SSHProxy) dialAddr(addr string, prio Priority, resolve bool) (net.Conn, error) {
+	if err := p.checkPolicy(addr); err != nil {
 		return nil, err
 	}
-	return ssh.ParsePrivateKey(buff)
+	var conn net.Conn
+	var err error
+	if resolve {
+		conn, err = p.dialResolved(addr, prio)
+	} else {
+		conn, err = p.dialChannel(addr, prio)
+	}
+	if err != nil {
+		p.countDialFailure(err)
+	}
+	return conn, err
 }
 
-func (p *SSHProxy) makeConfig() (*ssh.ClientConfig, error) {
-	key, err := p.parsePrivateKey()
+// dialChannel opens a single channel to addr, leaving name resolution to
+// the ssh server. With MaxStartups, it waits for a slot by priority prio.
+// With Paths, the channel may be opened over the connection of a path.
+func (p *SSHProxy) dialChannel(addr string, prio Priority) (net.Conn, error) {
+	conn, err := p.streamClient()
 	if err != nil {
 		return nil, err
 	}
+	if p.startups != nil {
+		if !p.startups.acquire(prio, p.done) {
+			return nil, wrapError(ErrNotConnected, nil)
+		}
+		defer p.startups.release()
+	}
+	remote, err := conn.Dial("tcp", addr)
+	if err != nil && p.cfg.ParkTimeout > 0 && !p.usable(conn) {
+		// The connection was lost or replaced under the dial, try again
+		// over the next one.
+		if conn, err = p.streamClient(); err != nil {
+			return nil, err
+		}
+		remote, err = conn.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, wrapError(ErrRemoteDial, fmt.Errorf("%s: %w", addr, classifyChannelError(err)))
+	}
+	return p.tunneled(conn, remote, prio), nil
+}
+
+func (p *SSHProxy) parsePrivateKey() (ssh.Signer, error) {
+	buff := p.cfg.PrivateKey
+	if len(buff) == 0 {
+		var err error
+		if buff, err = ioutil.ReadFile(p.cfg.PrivateKeyPath); err != nil {
+			return nil, err
+		}
+	}
+	if p.cfg.Passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(buff, []byte(p.cfg.Passphrase))
+	}
+	return ssh.ParsePrivateKey(buff)
+}
+
+func (p *SSHProxy) makeConfig() (*ssh.ClientConfig, error) {
+	auth := append([]ssh.AuthMethod(nil), p.cfg.AuthMethods...)
+	if p.cfg.GSSAPI != nil {
+		method, err := p.gssapiAuth()
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, method)
+	}
+	if p.cfg.PrivateKeyPath != "" || len(p.cfg.PrivateKey) > 0 || (p.cfg.Password == "" && len(auth) == 0) {
+		key, err := p.parsePrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(key))
+	}
+	if p.cfg.Password != "" {
+		auth = append(auth, ssh.Password(p.cfg.Password))
+	}
 	config := &ssh.ClientConfig{
-		User: p.cfg.RemoteUser,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(key),
-		},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		User:            p.cfg.RemoteUser,
+		Auth:            auth,
+		HostKeyCallback: p.cfg.HostKeyCallback,
+		ClientVersion:   p.cfg.ClientVersion,
+	}
+	if config.HostKeyCallback == nil {
+		config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
 			// Always accept key.
 			return nil
-		},
+		}
+	}
+	if p.cfg.ClientConfig != nil {
+		if err := p.cfg.ClientConfig(config); err != nil {
+			return nil, err
+		}
 	}
 	return config, nil
 }
 
-func (p *SSHProxy) handleClient(local net.Conn, remoteConnect string) {
-	logger.Debugf("handle client called")
-	remote, err := p.conn.Dial("tcp", remoteConnect)
+// gssapiAuth returns the gssapi-with-mic auth method of a new GSSAPI
+// client for the service principal of the ssh server.
+func (p *SSHProxy) gssapiAuth() (ssh.AuthMethod, error) {
+	target := p.cfg.GSSAPITarget
+	if target == "" {
+		host, _, err := net.SplitHostPort(p.cfg.RemoteAddress)
+		if err != nil {
+			return nil, err
+		}
+		target = host
+	}
+	client, err := p.cfg.GSSAPI()
 	if err != nil {
-		logger.Errorf("remote dial error: %s", err)
+		return nil, fmt.Errorf("gssapi: %w", err)
+	}
+	return ssh.GSSAPIWithMICAuthMethod(client, target), nil
+}
+
+// handleClient forwards a client of fwd to its remote. settings are those
+// of fwd when the client was accepted, which the connection keeps.
+func (p *SSHProxy) handleClient(local net.Conn, fwd *forward, settings *forwardSettings) {
+	fwd.log.conns.Debugf("forward %s: connection from %s", fwd.name, local.RemoteAddr())
+	if !p.memory.acquire(settings.priority) {
+		err := wrapError(ErrOverloaded, nil)
+		fwd.log.conns.Warningf("shedding connection to %s: %s", fwd.name, err)
+		p.rejectClient(local, fwd, "", err)
 		return
 	}
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	go func() {
-		_, err := io.Copy(local, remote)
+	var localReader io.Reader = local
+	remoteConnect := settings.remote
+	if settings.route != nil {
+		r, remote, err := settings.route(local)
 		if err != nil {
-			logger.Errorf("error while copying remote -> local: %s", err)
+			err = wrapError(ErrNoRoute, err)
+			fwd.log.conns.Errorf("forward %s: %s", fwd.name, err)
+			p.rejectClient(local, fwd, "", err)
+			p.memory.release()
+			return
 		}
-		logger.Debugf("local -> remote done")
+		localReader, remoteConnect = r, remote
+	}
+	settings.chaos.delay(p.done)
+	start := time.Now()
+	remote, err := dialContext(p.ctx, settings.dialTimeout, remoteConnect, func() (net.Conn, error) {
+		conn, err := p.dialTarget(remoteConnect, settings.priority)
+		if err != nil || settings.origin == nil {
+			return conn, err
+		}
+		return originateTLS(conn, settings.origin, remoteConnect)
+	})
+	if err != nil {
+		logForwardError(fwd, err)
+		p.rejectClient(local, fwd, remoteConnect, err)
+		p.memory.release()
+		return
+	}
+	p.checkDial(fwd, remoteConnect, time.Since(start))
+	p.splice(fwd, settings, local, localReader, remote, remoteConnect)
+}
+
+// splice copies data between a client connection and the target at
+// targetAddr it was forwarded to until both directions are done, then
+// closes both, applying the settings of fwd the client was accepted with.
+// It takes over the copy buffers reserved for the connection.
+func (p *SSHProxy) splice(fwd *forward, settings *forwardSettings, client net.Conn, clientReader io.Reader, target net.Conn, targetAddr string) {
+	clientAddr := client.RemoteAddr().String()
+	p.connOpened(fwd.name, clientAddr)
+	audit := p.auditStart(fwd, clientAddr, targetAddr)
+	prog := new(progress)
+	done := make(chan struct{})
+	go p.monitor(fwd, clientAddr, prog, done)
+	go closeOnTunnelLoss(fwd, client, target, done)
+	if lifetime := settings.maxLifetime; lifetime > 0 {
+		go closeAfter(fwd, client, target, lifetime, done)
+	}
+	var up, down io.Reader = progressReader{clientReader, &prog.up}, progressReader{settings.chaos.truncate(target), &prog.down}
+	up, down = audit.readers(up, down)
+	if dump := settings.dump; dump != nil {
+		stream := dump.stream(client.RemoteAddr(), client.LocalAddr())
+		up = dumpReader{up, stream, true}
+		down = dumpReader{down, stream, false}
+	}
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		pipe(fwd.log.copy, &p.memory, client, down, "target -> client")
 		wg.Done()
 	}()
-	wg.Add(1)
 	go func() {
-		_, err := io.Copy(remote, local)
-		if err != nil {
-			logger.Errorf("error while copying local -> remote: %s", err)
-		}
-		logger.Debugf("remote -> local done")
+		pipe(fwd.log.copy, &p.memory, target, up, "client -> target")
 		wg.Done()
 	}()
 	p.wg.Add(1)
 	go func() {
 		wg.Wait()
-		logger.Debugf("shutting down %s", remoteConnect)
-		if err := local.Close(); err != nil {
-			logger.Errorf("error closing local connection: %s", err)
+		close(done)
+		fwd.log.conns.Debugf("shutting down connection from %s on %s", clientAddr, fwd.name)
+		if err := client.Close(); err != nil {
+			fwd.log.conns.Errorf("error closing client connection: %s", err)
 		}
-		if err := remote.Close(); err != nil {
-			logger.Errorf("error closing remote connection: %s", err)
+		if err := target.Close(); err != nil {
+			fwd.log.conns.Errorf("error closing target connection: %s", err)
 		}
+		p.memory.release()
+		audit.finish(nil)
+		p.connClosed(fwd.name, clientAddr)
 		p.wg.Done()
 	}()
 }
+
+// rejectClient reports err for a client connection to target, which is
+// empty if none was chosen yet, and closes it.
+func (p *SSHProxy) rejectClient(local net.Conn, fwd *forward, target string, err error) {
+	p.auditStart(fwd, local.RemoteAddr().String(), target).finish(err)
+	p.hooks.forwardError(fwd.name, err)
+	p.emit(Event{Type: EventForwardError, Forward: fwd.name, Err: err})
+	if err := local.Close(); err != nil {
+		fwd.log.conns.Errorf("error closing local connection: %s", err)
+	}
+}
+
+// closeWriter is implemented by connections that support half-close, such as
+// *net.TCPConn and ssh channels.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies src to dst until src reaches EOF and then propagates the EOF
+// by closing dst for writing, leaving the other direction open. It logs to
+// log, the copy logger of the forward, and counts the copied data in memory.
+func pipe(log *logging.Logger, memory *memoryBudget, dst net.Conn, src io.Reader, direction string) {
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	if err := memory.copy(dst, src, buf); err != nil {
+		log.Errorf("error while copying %s: %s", direction, err)
+	}
+	log.Debugf("%s done", direction)
+	if cw, ok := dst.(closeWriter); ok {
+		if err := cw.CloseWrite(); err != nil {
+			log.Debugf("error closing %s for writing: %s", direction, err)
+		}
+	}
+}
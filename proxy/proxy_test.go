@@ -0,0 +1,2946 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rc4"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"github.com/elliotpeele/sshhttpproxy/proxy/proxytest"
+	logging "github.com/op/go-logging"
+	"golang.org/x/crypto/ssh"
+)
+
+func connect(t *testing.T, srv *proxytest.Server) *proxy.SSHProxy {
+	t.Helper()
+	p, err := proxy.New(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Shutdown)
+	return p
+}
+
+func echo(t *testing.T, addr, msg string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q, want %q", buf, msg)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	p := connect(t, srv)
+	if stats := p.ConnStats(); stats.Connects != 1 || stats.Reconnects != 0 {
+		t.Fatalf("unexpected stats after connect: %+v", stats)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.ConnStats(); stats.Connects != 2 || stats.Reconnects != 1 {
+		t.Fatalf("unexpected stats after reconnect: %+v", stats)
+	}
+}
+
+func TestWithDialer(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	addr := cfg.RemoteAddress
+	cfg.RemoteAddress = "bastion.invalid:22"
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialed string
+	p.WithDialer(func(ctx context.Context, network, target string) (net.Conn, error) {
+		dialed = target
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	})
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if dialed != "bastion.invalid:22" {
+		t.Fatalf("dialer called with %q", dialed)
+	}
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "through the dialer")
+}
+
+func TestConnectCustomAuth(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	cfg := srv.Config()
+	pem, err := ioutil.ReadFile(cfg.PrivateKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.PrivateKeyPath = ""
+	cfg.AuthMethods = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	var hostKey ssh.PublicKey
+	cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if hostKey != nil {
+			return errors.New("unknown host key")
+		}
+		hostKey = key
+		return nil
+	}
+	configured := false
+	cfg.ClientConfig = func(c *ssh.ClientConfig) error {
+		c.ClientVersion = "SSH-2.0-test"
+		configured = true
+		return nil
+	}
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if hostKey == nil || !configured {
+		t.Fatal("host key callback or client config hook not called")
+	}
+	if err := p.Connect(); !errors.Is(err, proxy.ErrHostKeyMismatch) {
+		t.Fatalf("got %v, want ErrHostKeyMismatch", err)
+	}
+}
+
+func TestConnectAuthFailed(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	cfg := srv.Config()
+	cfg.RemoteUser = "nobody"
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); !errors.Is(err, proxy.ErrAuthFailed) {
+		t.Fatalf("got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "hello")
+	echo(t, local, "world")
+}
+
+func TestForwardListenAddress(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	local, err := p.NamedForward("any", backend.Addr, "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %s", err)
+	}
+	if !strings.HasPrefix(local, "[::1]:") {
+		t.Fatalf("listening on %s, want [::1]", local)
+	}
+	echo(t, local, "hello")
+}
+
+func TestForwardHalfClose(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "half-closed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	// The echo server only closes its side after seeing our EOF, so
+	// reading to EOF checks the FIN made it through in both directions.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "half-closed" {
+		t.Fatalf("got %q, want %q", buf, "half-closed")
+	}
+}
+
+func TestForwardHTTP(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewHTTPServer("backend")
+	defer backend.Close()
+	p := connect(t, srv)
+
+	local, err := p.Forward(backend.Listener.Addr().String(), "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + local + "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "backend GET /path" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestForwardRemoteDialError(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	srv.DenyForwarding = true
+	p := connect(t, srv)
+	errs := make(chan error, 1)
+	p.WithHooks(&proxy.Hooks{
+		OnForwardError: func(name string, err error) { errs <- err },
+	})
+
+	local, err := p.Forward("127.0.0.1:1", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected local connection to be closed, got %v", err)
+	}
+	if err := <-errs; !errors.Is(err, proxy.ErrRemoteDial) {
+		t.Fatalf("got %v, want ErrRemoteDial", err)
+	}
+}
+
+func TestRemoteDialErrorClasses(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	p := connect(t, srv)
+	if _, err := p.NamedForward("down", "127.0.0.1:1", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Probe("down"); !errors.Is(err, proxy.ErrTargetUnreachable) || !errors.Is(err, proxy.ErrRemoteDial) {
+		t.Fatalf("got %v, want ErrTargetUnreachable", err)
+	}
+	srv.DenyForwarding = true
+	if err := p.Probe("down"); !errors.Is(err, proxy.ErrForwardingProhibited) {
+		t.Fatalf("got %v, want ErrForwardingProhibited", err)
+	}
+	want := proxy.DialFailures{Prohibited: 1, Unreachable: 1}
+	if got := p.DialFailures(); got != want {
+		t.Fatalf("got dial failures %+v, want %+v", got, want)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	local, err := p.NamedForward("echo", backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Pause("echo"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected paused forward to reject connection, got %v", err)
+	}
+	conn.Close()
+	if err := p.Resume("echo"); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "resumed")
+	if err := p.Pause("missing"); !errors.Is(err, proxy.ErrUnknownForward) {
+		t.Fatalf("got %v, want ErrUnknownForward", err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p, err := proxy.New(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := p.Events()
+	defer unsubscribe()
+	// An unsubscribed channel is closed and gets no more events.
+	gone, unsubscribeGone := p.Events()
+	unsubscribeGone()
+	unsubscribeGone()
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if ev, ok := <-gone; ok {
+		t.Fatalf("unsubscribed channel got %v", ev.Type)
+	}
+	local, err := p.NamedForward("echo", backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "ping")
+	p.Shutdown()
+
+	var got []proxy.EventType
+	for ev := range events {
+		got = append(got, ev.Type)
+	}
+	want := []proxy.EventType{
+		proxy.EventConnected,
+		proxy.EventForwardUp,
+		proxy.EventConnOpen,
+		proxy.EventConnClose,
+	}
+	// Other events may be interleaved, e.g. the disconnect on shutdown.
+	i := 0
+	for _, typ := range got {
+		if i < len(want) && typ == want[i] {
+			i++
+		}
+	}
+	if i != len(want) {
+		t.Fatalf("got events %v, want %v in order", got, want)
+	}
+}
+
+func TestForwardSNIRoutes(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+	a, b := newBackend("a"), newBackend("b")
+	defer a.Close()
+	defer b.Close()
+	p := connect(t, srv)
+
+	local, err := p.ForwardWithOptions("tls", b.Listener.Addr().String(), "0", &proxy.ForwardOptions{
+		SNIRoutes: []proxy.Route{{Host: "*.a.test", Remote: a.Listener.Addr().String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for serverName, want := range map[string]string{"app.a.test": "a", "other.test": "b"} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		}}
+		resp, err := client.Get("https://" + local + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want {
+			t.Errorf("server name %s: got backend %q, want %q", serverName, body, want)
+		}
+	}
+}
+
+func TestForwardHTTPRoutes(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	a, b := proxytest.NewHTTPServer("a"), proxytest.NewHTTPServer("b")
+	defer a.Close()
+	defer b.Close()
+	p := connect(t, srv)
+
+	local, err := p.ForwardWithOptions("web", b.Listener.Addr().String(), "0", &proxy.ForwardOptions{
+		HTTPRoutes: []proxy.Route{
+			{Host: "app.example.com", Remote: a.Listener.Addr().String()},
+			{Host: ".a.example.com", Remote: a.Listener.Addr().String()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"app.example.com":     "a GET /x",
+		"a.example.com:8080":  "a GET /x",
+		"www.a.example.com":   "a GET /x",
+		"other.example.com":   "b GET /x",
+		"xapp.example.com":    "b GET /x",
+		"www.app.example.com": "b GET /x",
+	} {
+		req, err := http.NewRequest("GET", "http://"+local+"/x", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want {
+			t.Errorf("host %s: got %q, want %q", host, body, want)
+		}
+		if got := resp.Header.Get("Request-Host"); got != host {
+			t.Errorf("host %s: backend saw host %q", host, got)
+		}
+	}
+
+	counts := make(map[string]uint64)
+	for _, h := range p.HTTPLatency() {
+		if h.Forward != "web" {
+			t.Errorf("latency of unexpected forward %q", h.Forward)
+		}
+		if last := h.Counts[len(h.Counts)-1]; last != h.Count {
+			t.Errorf("route %s: %d of %d requests in buckets", h.Route, last, h.Count)
+		}
+		counts[h.Route] = h.Count
+	}
+	want := map[string]uint64{"app.example.com": 1, ".a.example.com": 2, "default": 3}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("got latency counts %v, want %v", counts, want)
+	}
+}
+
+func TestForwardHTTPPathRoutes(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	a, b := proxytest.NewHTTPServer("a"), proxytest.NewHTTPServer("b")
+	defer a.Close()
+	defer b.Close()
+	p := connect(t, srv)
+
+	local, err := p.ForwardWithOptions("web", "", "0", &proxy.ForwardOptions{
+		HTTPRoutes: []proxy.Route{
+			{Path: "/api/*", Remote: a.Listener.Addr().String(), StripPrefix: true},
+			{Path: "/grafana", Remote: b.Listener.Addr().String()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"/api/v1/users?x=1": "a GET /v1/users?x=1",
+		"/api":              "a GET /",
+		"/grafana/d/1":      "b GET /grafana/d/1",
+		"/apiary":           "502",
+		"/":                 "502",
+	} {
+		resp, err := http.Get("http://" + local + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := string(body)
+		if resp.StatusCode != http.StatusOK {
+			got = fmt.Sprint(resp.StatusCode)
+		}
+		if got != want {
+			t.Errorf("path %s: got %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestForwardHTTPHeaderRoutes(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	staging, prod := proxytest.NewHTTPServer("staging"), proxytest.NewHTTPServer("prod")
+	defer staging.Close()
+	defer prod.Close()
+	p := connect(t, srv)
+
+	local, err := p.ForwardWithOptions("web", prod.Listener.Addr().String(), "0", &proxy.ForwardOptions{
+		HTTPRoutes: []proxy.Route{
+			{Headers: map[string]string{"x-env": "staging"}, Remote: staging.Listener.Addr().String()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for env, want := range map[string]string{"Staging": "staging GET /", "prod": "prod GET /", "": "prod GET /"} {
+		req, _ := http.NewRequest("GET", "http://"+local+"/", nil)
+		if env != "" {
+			req.Header.Set("X-Env", env)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want {
+			t.Errorf("X-Env %q: got %q, want %q", env, body, want)
+		}
+	}
+}
+
+func TestForwardHTTPMirror(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewHTTPServer("backend")
+	defer backend.Close()
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	p := connect(t, srv)
+
+	local, err := p.ForwardWithOptions("web", backend.Listener.Addr().String(), "0", &proxy.ForwardOptions{
+		HTTP:   true,
+		Mirror: &proxy.Mirror{Remote: shadow.Listener.Addr().String(), Percent: 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post("http://"+local+"/items", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "backend POST /items" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	select {
+	case got := <-mirrored:
+		if got != "POST /items payload" {
+			t.Errorf("mirrored %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not mirrored")
+	}
+	if _, err := p.ForwardWithOptions("plain", backend.Listener.Addr().String(), "0", &proxy.ForwardOptions{
+		Mirror: &proxy.Mirror{Remote: shadow.Listener.Addr().String(), Percent: 100},
+	}); err == nil {
+		t.Fatal("mirroring accepted without L7 mode")
+	}
+}
+
+func TestForwardHTTPHeaderRules(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewHTTPServer("backend")
+	defer backend.Close()
+	p := connect(t, srv)
+
+	local, err := p.ForwardWithOptions("web", backend.Listener.Addr().String(), "0", &proxy.ForwardOptions{
+		HTTP: true,
+		RequestHeaders: []proxy.HeaderRule{
+			{Action: proxy.HeaderRemove, Name: "X-Internal-Auth"},
+			{Action: proxy.HeaderSet, Name: "X-Api-Key", Value: "secret"},
+			{Action: proxy.HeaderReplace, Name: "User-Agent", Match: `^curl/(.*)$`, Value: "tunnel-curl/$1"},
+		},
+		ResponseHeaders: []proxy.HeaderRule{
+			{Action: proxy.HeaderAdd, Name: "X-Tunnel", Value: "yes"},
+			{Action: proxy.HeaderRemove, Name: "Request-Host"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "http://"+local+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Internal-Auth", "token")
+	req.Header.Set("X-Api-Key", "client")
+	req.Header.Set("User-Agent", "curl/7.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for name, want := range map[string]string{
+		"Request-X-Internal-Auth": "",
+		"Request-X-Api-Key":       "secret",
+		"Request-User-Agent":      "tunnel-curl/7.0",
+		"Request-Host":            "",
+		"X-Tunnel":                "yes",
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("header %s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestForwardHTTPBearerToken(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewHTTPServer("backend")
+	defer backend.Close()
+	p := connect(t, srv)
+
+	calls := 0
+	token := proxy.CachedToken(proxy.TokenFunc(func() (string, error) {
+		calls++
+		return fmt.Sprintf("token-%d", calls), nil
+	}), time.Hour)
+	local, err := p.ForwardWithOptions("web", backend.Listener.Addr().String(), "0", &proxy.ForwardOptions{
+		HTTP:        true,
+		BearerToken: token,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get("http://" + local + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Request-Authorization"); got != "Bearer token-1" {
+			t.Errorf("request %d: got authorization %q", i, got)
+		}
+	}
+}
+
+func TestReverseForward(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	remote, err := p.ReverseForward("echo", "0", backend.Addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host, _, _ := net.SplitHostPort(remote); host != "127.0.0.1" {
+		t.Fatalf("reverse forward bound %s, want loopback", remote)
+	}
+	infos := p.Forwards()
+	if len(infos) != 1 || !infos[0].Reverse || infos[0].Remote != remote || infos[0].Local != backend.Addr {
+		t.Fatalf("unexpected forwards: %+v", infos)
+	}
+	echo(t, remote, "hello")
+	echo(t, remote, "world")
+}
+
+func TestReverseForwardOrigins(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	allowed, err := p.ReverseForward("allowed", "0", backend.Addr, &proxy.ForwardOptions{
+		Origins: []proxy.DestinationRule{{Host: "127.0.0.0/8"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, allowed, "hello")
+	denied, err := p.ReverseForward("denied", "0", backend.Addr, &proxy.ForwardOptions{
+		Origins: []proxy.DestinationRule{{Host: "10.0.0.0/8"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello"))
+	if n, err := conn.Read(make([]byte, 5)); err == nil {
+		t.Fatalf("connection from a denied origin echoed %d bytes", n)
+	}
+	if _, err := p.ReverseForward("ports", "0", backend.Addr, &proxy.ForwardOptions{
+		Origins: []proxy.DestinationRule{{Host: "127.0.0.1", Ports: []int{22}}},
+	}); err == nil {
+		t.Fatal("origin rules with ports were accepted")
+	}
+}
+
+func TestReverseForwardTLSHandshakeTimeout(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	// Only the certificate of the test server is used.
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+	p := connect(t, srv)
+
+	remote, err := p.ReverseForward("tls", "0", backend.Addr, &proxy.ForwardOptions{
+		TLS:           &tls.Config{Certificates: certSrv.TLS.Certificates},
+		AcceptTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A client that never sends its ClientHello is disconnected.
+	idle, err := net.Dial("tcp", remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v from an idle connection, want EOF", err)
+	}
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Fatalf("idle connection closed after %s, before the timeout", took)
+	}
+
+	conn, err := tls.Dial("tcp", remote, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Fatalf("got %q, %v through the TLS reverse forward", got, err)
+	}
+}
+
+func TestCloseForward(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	local, err := p.NamedForward("echo", backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "hello")
+	if err := p.CloseForward("echo"); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.Dial("tcp", local); err == nil {
+		conn.Close()
+		t.Fatal("closed forward still accepts connections")
+	}
+	if err := p.CloseForward("echo"); !errors.Is(err, proxy.ErrUnknownForward) {
+		t.Fatalf("closing twice: got %v, want ErrUnknownForward", err)
+	}
+	// The name can be used again.
+	local, err = p.NamedForward("echo", backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "world")
+}
+
+func TestProbe(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	if _, err := p.NamedForward("up", backend.Addr, "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Probe("up"); err != nil {
+		t.Fatalf("probing a reachable remote: %s", err)
+	}
+	if _, err := p.NamedForward("down", "127.0.0.1:1", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Probe("down"); !errors.Is(err, proxy.ErrRemoteDial) {
+		t.Fatalf("probing an unreachable remote: got %v, want ErrRemoteDial", err)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	healthy := true
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || !healthy {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	p := connect(t, srv)
+
+	if _, err := p.NamedForward("api", strings.TrimPrefix(backend.URL, "http://"), "0"); err != nil {
+		t.Fatal(err)
+	}
+	check := func(want int) {
+		t.Helper()
+		resp, err := p.CheckHealth(context.Background(), "api", "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("got status %d, want %d", resp.StatusCode, want)
+		}
+	}
+	check(http.StatusOK)
+	healthy = false
+	check(http.StatusServiceUnavailable)
+	if _, err := p.CheckHealth(context.Background(), "missing", "/healthz"); !errors.Is(err, proxy.ErrUnknownForward) {
+		t.Fatalf("checking an unknown forward: got %v, want ErrUnknownForward", err)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	cfg.Paths = []string{"127.0.0.1"}
+	cfg.PathMode = proxy.PathFailover
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.Paths()[0].Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("the path did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "hello")
+	// Without the main connection, connections fail over to the path.
+	if err := p.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	for p.Connected() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	echo(t, local, "world")
+	if _, err := proxy.New(&proxy.Config{Paths: []string{"127.0.0.1"}, PathMode: "bond"}); err == nil {
+		t.Fatal("an unknown path mode was accepted")
+	}
+
+	// Paths are dialed directly, so they cannot be used with a dialer.
+	withDialer, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withDialer.WithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	})
+	if err := withDialer.Connect(); err == nil {
+		withDialer.Shutdown()
+		t.Fatal("paths were combined with a dialer")
+	}
+}
+
+func TestKnock(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	tcpKnock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpKnock.Close()
+	udpKnock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpKnock.Close()
+	knocks := make(chan string, 2)
+	go func() {
+		if conn, err := tcpKnock.Accept(); err == nil {
+			conn.Close()
+			knocks <- "tcp"
+		}
+	}()
+	go func() {
+		if _, _, err := udpKnock.ReadFrom(make([]byte, 16)); err == nil {
+			knocks <- "udp"
+		}
+	}()
+	cfg := srv.Config()
+	cfg.Knock = []proxy.KnockStep{
+		{Port: tcpKnock.Addr().(*net.TCPAddr).Port},
+		{Port: udpKnock.LocalAddr().(*net.UDPAddr).Port, Protocol: "udp", Delay: time.Millisecond},
+	}
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	for _, want := range []string{"tcp", "udp"} {
+		select {
+		case got := <-knocks:
+			if got != want {
+				t.Fatalf("got a %s knock, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s knock before connecting", want)
+		}
+	}
+	if _, err := proxy.New(&proxy.Config{Knock: []proxy.KnockStep{{Port: 7000, Protocol: "icmp"}}}); err == nil {
+		t.Fatal("an unknown knock protocol was accepted")
+	}
+}
+
+func TestObfuscatedSSH(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	banners := make(chan string, 1)
+	relay := obfuscatedRelay(t, srv.Addr, "keyword", banners)
+	cfg := srv.Config()
+	cfg.RemoteAddress = relay
+	cfg.ClientVersion = "SSH-2.0-OpenSSH_9.6"
+	cfg.Obfuscate = proxy.ObfuscatedSSH("keyword")
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if banner := <-banners; banner != "SSH-2.0-OpenSSH_9.6" {
+		t.Fatalf("the server got banner %q", banner)
+	}
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "hello")
+	if _, err := proxy.New(&proxy.Config{ClientVersion: "OpenSSH_9.6"}); err == nil {
+		t.Fatal("a client version without SSH-2.0- was accepted")
+	}
+}
+
+// obfuscatedRelay listens for one obfuscated-openssh connection, the
+// server side of proxy.ObfuscatedSSH, and relays it to addr in the clear,
+// sending the ssh banner of the client to banners.
+func obfuscatedRelay(t *testing.T, addr, keyword string, banners chan<- string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	key := func(seed []byte, direction string) []byte {
+		sum := sha1.Sum(append(append(append([]byte(nil), seed...), keyword...), direction...))
+		for i := 0; i < 6000; i++ {
+			sum = sha1.Sum(sum[:])
+		}
+		return sum[:16]
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		seed := make([]byte, 16)
+		if _, err := io.ReadFull(conn, seed); err != nil {
+			return
+		}
+		in, _ := rc4.NewCipher(key(seed, "client_to_server"))
+		out, _ := rc4.NewCipher(key(seed, "server_to_client"))
+		head := make([]byte, 8)
+		io.ReadFull(conn, head)
+		in.XORKeyStream(head, head)
+		if binary.BigEndian.Uint32(head) != 0x0BF5CA7E {
+			return
+		}
+		padding := make([]byte, binary.BigEndian.Uint32(head[4:]))
+		io.ReadFull(conn, padding)
+		in.XORKeyStream(padding, padding)
+		server, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer server.Close()
+		r := bufio.NewReader(cipher.StreamReader{S: in, R: conn})
+		banner, _ := r.ReadString('\n')
+		banners <- strings.TrimSpace(banner)
+		io.WriteString(server, banner)
+		go io.Copy(server, r)
+		io.Copy(cipher.StreamWriter{S: out, W: conn}, server)
+	}()
+	return l.Addr().String()
+}
+
+func TestGSSAPI(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	cfg.PrivateKeyPath = ""
+	cfg.GSSAPI = func() (ssh.GSSAPIClient, error) { return fakeGSSAPI{}, nil }
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err == nil {
+		p.Shutdown()
+		t.Fatal("connected without gssapi on the server")
+	}
+	srv.GSSAPI = fakeGSSAPI{}
+	p, err = proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "kerberos")
+}
+
+// fakeGSSAPI is both ends of a GSSAPI context for host@127.0.0.1 whose
+// MIC is the field it covers.
+type fakeGSSAPI struct{}
+
+func (fakeGSSAPI) InitSecContext(target string, token []byte, deleg bool) ([]byte, bool, error) {
+	return []byte(target), false, nil
+}
+
+func (fakeGSSAPI) GetMIC(micField []byte) ([]byte, error) {
+	return micField, nil
+}
+
+func (fakeGSSAPI) AcceptSecContext(token []byte) ([]byte, string, bool, error) {
+	if string(token) != "host@127.0.0.1" {
+		return nil, "", false, fmt.Errorf("unknown service %q", token)
+	}
+	return nil, proxytest.User + "@EXAMPLE.COM", false, nil
+}
+
+func (fakeGSSAPI) VerifyMIC(micField, micToken []byte) error {
+	if !bytes.Equal(micField, micToken) {
+		return errors.New("bad mic")
+	}
+	return nil
+}
+
+func (fakeGSSAPI) DeleteSecContext() error {
+	return nil
+}
+
+func TestIdle(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Idle() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("proxy is idle with an open connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.Close()
+	for p.Idle() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("proxy is not idle after the connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPcapDump(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	out := new(syncBuffer)
+	dump, err := proxy.NewPcapWriter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := connect(t, srv)
+	local, err := p.ForwardWithOptions("dumped", backend.Addr, "0", &proxy.ForwardOptions{Dump: dump})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Larger than a synthesized segment, so it is split.
+	msg := bytes.Repeat([]byte("0123456789"), 2000)
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	type segment struct {
+		fromClient bool
+		flags      byte
+		seq        uint32
+		payload    []byte
+	}
+	// parse returns the tcp segments of the dump, checking the framing.
+	parse := func(data []byte) []segment {
+		if len(data) < 24 {
+			t.Fatalf("dump of %d bytes has no header", len(data))
+		}
+		hdr := data[:24]
+		if magic := binary.LittleEndian.Uint32(hdr); magic != 0xa1b2c3d4 {
+			t.Fatalf("magic %#x", magic)
+		}
+		if major, minor := binary.LittleEndian.Uint16(hdr[4:]), binary.LittleEndian.Uint16(hdr[6:]); major != 2 || minor != 4 {
+			t.Fatalf("version %d.%d", major, minor)
+		}
+		if link := binary.LittleEndian.Uint32(hdr[20:]); link != 101 {
+			t.Fatalf("link type %d, want raw IP", link)
+		}
+		var segs []segment
+		var clientPort uint16
+		for rest := data[24:]; len(rest) > 0; {
+			if len(rest) < 16 {
+				t.Fatalf("truncated record header")
+			}
+			caplen, origlen := binary.LittleEndian.Uint32(rest[8:]), binary.LittleEndian.Uint32(rest[12:])
+			if caplen != origlen || int(caplen) > len(rest)-16 {
+				t.Fatalf("record of %d bytes, %d captured, %d left", origlen, caplen, len(rest)-16)
+			}
+			pkt := rest[16 : 16+caplen]
+			rest = rest[16+caplen:]
+			if pkt[0] != 0x45 || pkt[9] != 6 || int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+				t.Fatalf("bad ip header % x", pkt[:20])
+			}
+			tcp := pkt[20:]
+			if clientPort == 0 {
+				clientPort = binary.BigEndian.Uint16(tcp)
+			}
+			segs = append(segs, segment{
+				fromClient: binary.BigEndian.Uint16(tcp) == clientPort,
+				flags:      tcp[13],
+				seq:        binary.BigEndian.Uint32(tcp[4:]),
+				payload:    tcp[20:],
+			})
+		}
+		return segs
+	}
+	const fin = 0x01
+	var segs []segment
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		segs = parse([]byte(out.String()))
+		fins := 0
+		for _, seg := range segs {
+			if seg.flags&fin != 0 {
+				fins++
+			}
+		}
+		if fins == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d FINs in the dump, want 2", fins)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Each side's sequence numbers advance by its payload, and by one for
+	// SYN and FIN, and its payload is the data it sent.
+	var next [2]uint32
+	var sent [2][]byte
+	for i, seg := range segs {
+		dir := 1
+		if seg.fromClient {
+			dir = 0
+		}
+		if next[dir] != 0 && seg.seq != next[dir] {
+			t.Fatalf("segment %d has sequence number %d, want %d", i, seg.seq, next[dir])
+		}
+		next[dir] = seg.seq + uint32(len(seg.payload))
+		if seg.flags&(fin|0x02) != 0 {
+			next[dir]++
+		}
+		if len(seg.payload) > 16384 {
+			t.Fatalf("segment %d has %d bytes", i, len(seg.payload))
+		}
+		sent[dir] = append(sent[dir], seg.payload...)
+	}
+	if !bytes.Equal(sent[0], msg) || !bytes.Equal(sent[1], msg) {
+		t.Fatalf("dumped %d bytes from the client and %d from the server, want %d each", len(sent[0]), len(sent[1]), len(msg))
+	}
+}
+
+func TestStalledConnection(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	// The backend reads requests but never answers them.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	out := new(syncBuffer)
+	logging.SetBackend(logging.NewLogBackend(out, "", 0))
+	t.Cleanup(func() { logging.SetBackend(logging.NewLogBackend(os.Stderr, "", log.LstdFlags)) })
+	cfg := srv.Config()
+	cfg.SlowThreshold = 100 * time.Millisecond
+	cfg.StallThreshold = 200 * time.Millisecond
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Shutdown)
+	local, err := p.ForwardWithOptions("hung", l.Addr().String(), "0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := p.ProblemStats()
+		if stats.SlowResponses == 1 && stats.Stalls == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %+v, want a slow response and a stall", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// A stall is counted once, however long it lasts.
+	time.Sleep(500 * time.Millisecond)
+	if stats := p.ProblemStats(); stats.SlowResponses != 1 || stats.Stalls != 1 {
+		t.Fatalf("got %+v after the stall went on", stats)
+	}
+	logs := out.String()
+	for _, want := range []string{"forward hung: no response for 100ms", "forward hung: no progress for"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("%q not logged:\n%s", want, logs)
+		}
+	}
+}
+
+func TestForwardLogModules(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	// The backend is restored after the proxy shuts down, its logging
+	// goroutines read it.
+	out := new(syncBuffer)
+	logging.SetBackend(logging.NewLogBackend(out, "", 0))
+	t.Cleanup(func() { logging.SetBackend(logging.NewLogBackend(os.Stderr, "", log.LstdFlags)) })
+	logging.SetLevel(logging.ERROR, "")
+	logging.SetLevel(logging.DEBUG, proxy.ForwardLogModule("loud", proxy.LogConnections))
+	p := connect(t, srv)
+	for _, name := range []string{"loud", "quiet"} {
+		local, err := p.ForwardWithOptions(name, backend.Addr, "0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, local, name)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), "shutting down connection") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	logs := out.String()
+	if !strings.Contains(logs, "forward loud: connection from") {
+		t.Errorf("connection of loud not logged:\n%s", logs)
+	}
+	if strings.Contains(logs, "quiet") {
+		t.Errorf("quiet logged below its level:\n%s", logs)
+	}
+	if strings.Contains(logs, "done") {
+		t.Errorf("copy messages logged below their level:\n%s", logs)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p, err := proxy.New(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log syncBuffer
+	audit, err := proxy.NewAuditLog(&log, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Digests = true
+	p.WithAudit(audit)
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "hello")
+	echo(t, local, "world")
+	p.Shutdown()
+
+	records := log.String()
+	if n, err := proxy.VerifyAuditLog(strings.NewReader(records)); err != nil || n != 2 {
+		t.Fatalf("verifying audit log: %d records, %v", n, err)
+	}
+	if !strings.Contains(records, `"bytes_up":5`) {
+		t.Fatalf("audit log lacks byte counts: %s", records)
+	}
+	tampered := strings.Replace(records, `"bytes_up":5`, `"bytes_up":6`, 1)
+	if _, err := proxy.VerifyAuditLog(strings.NewReader(tampered)); err == nil {
+		t.Fatal("tampered audit log verified")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// connectVia sends a CONNECT request for target to the proxy at addr and
+// returns the response status and the connection.
+func connectVia(t *testing.T, addr, target string) (int, net.Conn) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Read byte by byte so no tunneled data is buffered away.
+	var head []byte
+	buf := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		head = append(head, buf[0])
+	}
+	conn.SetReadDeadline(time.Time{})
+	var status int
+	if _, err := fmt.Sscanf(string(head), "HTTP/1.1 %d", &status); err != nil {
+		t.Fatal(err)
+	}
+	return status, conn
+}
+
+func TestSessionStats(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p, err := proxy.New(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := proxy.NewSessionStats()
+	p.WithSessionStats(session)
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	local, err := p.NamedForward("echo", backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "hello")
+	echo(t, local, "world!")
+	p.Shutdown()
+
+	want := []proxy.ForwardTotals{{Forward: "echo", Connections: 2, BytesUp: 11, BytesDown: 11}}
+	if got := session.Forwards(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got forward totals %+v, want %+v", got, want)
+	}
+	wantDest := []proxy.DestinationTotals{{Destination: backend.Addr, Connections: 2, Bytes: 22}}
+	if got := session.TopDestinations(10); !reflect.DeepEqual(got, wantDest) {
+		t.Errorf("got destinations %+v, want %+v", got, wantDest)
+	}
+}
+
+func TestForwardConnectDestinations(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+	var log syncBuffer
+	p.WithConnectLog(proxy.NewConnectLog(&log))
+
+	_, port, _ := net.SplitHostPort(backend.Addr)
+	local, err := p.ForwardWithOptions("proxy", "", "0", &proxy.ForwardOptions{
+		Connect: true,
+		Destinations: []proxy.DestinationRule{
+			{Deny: true, Ports: []int{25}},
+			{Deny: true, Host: "127.0.0.2"},
+			{Host: "127.0.0.0/8"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, conn := connectVia(t, local, backend.Addr)
+	if status != http.StatusOK {
+		t.Fatalf("allowed destination: got status %d", status)
+	}
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q, %v through tunnel", buf, err)
+	}
+	for _, target := range []string{"127.0.0.1:25", "127.0.0.2:" + port, "db.internal:" + port} {
+		if status, _ := connectVia(t, local, target); status != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want %d", target, status, http.StatusForbidden)
+		}
+	}
+	var outcomes []string
+	for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+		var rec proxy.ConnectRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		outcomes = append(outcomes, rec.Destination+" "+rec.Outcome)
+	}
+	want := []string{
+		backend.Addr + " connected",
+		"127.0.0.1:25 denied",
+		"127.0.0.2:" + port + " denied",
+		"db.internal:" + port + " denied",
+	}
+	if !reflect.DeepEqual(outcomes, want) {
+		t.Errorf("got connect log %q, want %q", outcomes, want)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Addr)
+	portNum, _ := strconv.Atoi(port)
+	cfg := srv.Config()
+	cfg.Policy = []proxy.DestinationRule{{Host: "127.0.0.1", Ports: []int{portNum}}}
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "hello")
+	for _, remote := range []string{"127.0.0.2:" + port, "127.0.0.1:25", "exec:cat"} {
+		if _, err := p.Forward(remote, "0"); !errors.Is(err, proxy.ErrDenied) {
+			t.Errorf("%s: got %v, want ErrDenied", remote, err)
+		}
+	}
+
+	local, err = p.ForwardWithOptions("proxy", "", "0", &proxy.ForwardOptions{Connect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := connectVia(t, local, backend.Addr); status != http.StatusOK {
+		t.Errorf("allowed destination: got status %d", status)
+	}
+	if status, _ := connectVia(t, local, "127.0.0.1:25"); status != http.StatusForbidden {
+		t.Errorf("denied destination: got status %d, want %d", status, http.StatusForbidden)
+	}
+	if _, err := p.OpenTun(0); !errors.Is(err, proxy.ErrDenied) {
+		t.Errorf("tun: got %v, want ErrDenied", err)
+	}
+}
+
+func TestForwardSOCKS(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	local, err := p.ForwardWithOptions("socks", "", "0", &proxy.ForwardOptions{
+		SOCKS:        true,
+		Destinations: []proxy.DestinationRule{{Host: "localhost"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(backend.Addr)
+	portNum, _ := strconv.Atoi(port)
+	request := func(host string) (byte, net.Conn) {
+		conn, err := net.Dial("tcp", local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// Send the destination as a domain name, for the ssh server to
+		// resolve.
+		msg := []byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}
+		msg = append(msg, host...)
+		msg = append(msg, byte(portNum>>8), byte(portNum))
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 12)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply[:2], []byte{5, 0}) {
+			t.Fatalf("got method selection %v", reply[:2])
+		}
+		return reply[3], conn
+	}
+	code, conn := request("localhost")
+	if code != 0 {
+		t.Fatalf("got reply %d", code)
+	}
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q, %v through tunnel", buf, err)
+	}
+	if code, _ := request("db.internal"); code != 2 {
+		t.Errorf("denied destination: got reply %d, want 2", code)
+	}
+}
+
+func TestForwardHappyEyeballs(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	cfg.HappyEyeballs = true
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	// localhost may resolve to ::1 as well, where nothing listens, which
+	// must not keep the IPv4 address from being used.
+	_, port, _ := net.SplitHostPort(backend.Addr)
+	local, err := p.Forward(net.JoinHostPort("localhost", port), "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "hello")
+}
+
+func TestResolvedDestinations(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	cfg.HappyEyeballs = true
+	// localhost is allowed by name, but not at its addresses.
+	cfg.Policy = []proxy.DestinationRule{
+		{Host: "localhost"},
+		{Host: "127.0.0.0/8", Deny: true},
+		{Host: "::1/128", Deny: true},
+	}
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	_, port, _ := net.SplitHostPort(backend.Addr)
+	target := net.JoinHostPort("localhost", port)
+
+	// The remote of a forward resolves locally, to denied addresses.
+	local, err := p.Forward(target, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "hello")
+	if n, err := conn.Read(make([]byte, 5)); err == nil {
+		t.Errorf("got %d bytes from a remote resolving to denied addresses", n)
+	}
+
+	// Destinations of clients are left to the ssh server.
+	local, err = p.ForwardWithOptions("proxy", "", "0", &proxy.ForwardOptions{Connect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := connectVia(t, local, target); status != http.StatusOK {
+		t.Errorf("destination by name: got status %d", status)
+	}
+}
+
+func TestDNSServerDestinations(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	dns := proxytest.NewDNSServer()
+	defer dns.Close()
+	cfg := srv.Config()
+	cfg.DNSServer = dns.Addr
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	// With a DNS server on the remote network, destinations of clients
+	// are looked up with it.
+	local, err := p.ForwardWithOptions("proxy", "", "0", &proxy.ForwardOptions{Connect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(backend.Addr)
+	status, conn := connectVia(t, local, net.JoinHostPort("svc.example.test", port))
+	if status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	io.WriteString(conn, "hello")
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q, %v through tunnel", buf, err)
+	}
+	if dns.Queries() == 0 {
+		t.Error("destination not looked up with the DNS server")
+	}
+}
+
+func TestDNSServerMultiplexed(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	dns := proxytest.NewDNSServer()
+	defer dns.Close()
+	cfg := srv.Config()
+	cfg.DNSServer = dns.Addr
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	_, port, _ := net.SplitHostPort(backend.Addr)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		local, err := p.Forward(net.JoinHostPort(fmt.Sprintf("svc%d.example.test", i), port), "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			echo(t, local, "ping")
+		}()
+	}
+	wg.Wait()
+	if dns.Queries() < 5 {
+		t.Errorf("got %d queries, want at least 5", dns.Queries())
+	}
+	if dns.Conns() != 1 {
+		t.Errorf("queries took %d connections, want 1", dns.Conns())
+	}
+}
+
+func TestPreferFamily(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	cfg.PreferFamily = "ipx"
+	if _, err := proxy.New(cfg); err == nil {
+		t.Fatal("unknown family accepted")
+	}
+	// The test server only listens on IPv4, so preferring IPv6 must fall
+	// back.
+	cfg.PreferFamily = proxy.FamilyIPv6
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	_, port, _ := net.SplitHostPort(backend.Addr)
+	local, err := p.Forward(net.JoinHostPort("localhost", port), "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "hello")
+}
+
+func TestReconfigure(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	a, b := proxytest.NewHTTPServer("a"), proxytest.NewHTTPServer("b")
+	defer a.Close()
+	defer b.Close()
+	p := connect(t, srv)
+
+	local, err := p.NamedForward("web", a.Listener.Addr().String(), "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A connection opened before the change keeps its remote.
+	open, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	// Wait for the connection to be spliced to its remote.
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Idle() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := p.Reconfigure("web", b.Listener.Addr().String(), nil); err != nil {
+		t.Fatal(err)
+	}
+	get := func(conn net.Conn) string {
+		t.Helper()
+		if _, err := io.WriteString(conn, "GET /x HTTP/1.0\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	if got := get(open); got != "a GET /x" {
+		t.Errorf("open connection: got %q", got)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := get(conn); got != "b GET /x" {
+		t.Errorf("new connection: got %q", got)
+	}
+	if err := p.Reconfigure("web", "", &proxy.ForwardOptions{Connect: true}); err == nil {
+		t.Error("changing the mode succeeded")
+	}
+}
+
+func TestListenerHandover(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	echo := proxytest.NewEchoServer()
+	defer echo.Close()
+	old, next := connect(t, srv), connect(t, srv)
+
+	local, err := old.NamedForward("echo", echo.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := old.ListenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.FileListener(files["echo"])
+	files["echo"].Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := next.ForwardWithOptions("echo", echo.Addr, "0", &proxy.ForwardOptions{Listener: l})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != local {
+		t.Errorf("got local address %s, want %s", got, local)
+	}
+	// Only the new proxy is left to serve the socket.
+	if err := old.CloseForward("echo"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("got %q, %v", buf, err)
+	}
+}
+
+func TestParkWhileDisconnected(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	cfg.ParkTimeout = 5 * time.Second
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	events, unsubscribe := p.Events()
+	defer unsubscribe()
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.CloseConnections()
+	for ev := range events {
+		if ev.Type == proxy.EventDisconnected {
+			break
+		}
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := p.Connect(); err != nil {
+			t.Error(err)
+		}
+	}()
+	// The listener stays bound and the connection waits for the new ssh
+	// connection.
+	echo(t, local, "parked")
+}
+
+func TestParkBeforeConnect(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	cfg.ParkTimeout = 5 * time.Second
+	cfg.ParkQueue = 1
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err := io.WriteString(first, "queued"); err != nil {
+		t.Fatal(err)
+	}
+	for p.Parked() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The queue is full, so the next connection fails at once.
+	second, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(first, buf); err != nil || string(buf) != "queued" {
+		t.Errorf("got %q, %v", buf, err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p, err := proxy.New(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if p.Client() != nil {
+		t.Fatal("got a client before Connect")
+	}
+	if _, err := p.WaitClient(); !errors.Is(err, proxy.ErrNotConnected) {
+		t.Fatalf("got %v, want ErrNotConnected", err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	// Channels opened over the client share the connection of the proxy.
+	conn, err := p.Client().Dial("tcp", backend.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "shared"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "shared" {
+		t.Errorf("got %q, %v", buf, err)
+	}
+	if got := p.ConnStats().Connects; got != 1 {
+		t.Errorf("got %d connects, want 1", got)
+	}
+}
+
+func TestWatchTarget(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	p, err := proxy.New(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	events, unsubscribe := p.Events()
+	defer unsubscribe()
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := l.Addr().String()
+	l.Close()
+	local, err := p.ForwardWithOptions("watched", target, "0", &proxy.ForwardOptions{Watch: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Connections are refused until the target listens.
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+	conn.Close()
+	if infos := p.Forwards(); !infos[0].Down {
+		t.Error("forward not down")
+	}
+	backend := proxytest.NewEchoServerAt(target)
+	defer backend.Close()
+	for ev := range events {
+		if ev.Type == proxy.EventTargetUp && ev.Forward == "watched" {
+			break
+		}
+	}
+	echo(t, local, "watched")
+}
+
+func TestDisconnect(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	p, err := proxy.New(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	events, unsubscribe := p.Events()
+	defer unsubscribe()
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	for ev := range events {
+		if ev.Type == proxy.EventDisconnected {
+			break
+		}
+	}
+	if p.Connected() {
+		t.Fatal("still connected")
+	}
+	if err := p.Disconnect(); err != nil {
+		t.Fatalf("disconnecting again: %s", err)
+	}
+}
+
+func TestForwardsSurviveReconnect(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p, err := proxy.New(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	events, unsubscribe := p.Events()
+	defer unsubscribe()
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := p.ReverseForward("reverse", "0", backend.Addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.CloseConnections()
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	// The reverse forward listens again once the server released its
+	// port.
+	for ev := range events {
+		if ev.Type == proxy.EventForwardUp && ev.Forward == "reverse" {
+			if ev.Addr != remote {
+				t.Errorf("reverse forward moved from %s to %s", remote, ev.Addr)
+			}
+			break
+		}
+	}
+	echo(t, local, "local")
+	echo(t, remote, "reverse")
+}
+
+func TestForwardConnectPlainHTTP(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewHTTPServer("a")
+	defer backend.Close()
+	p := connect(t, srv)
+
+	local, err := p.ForwardWithOptions("proxy", "", "0", &proxy.ForwardOptions{Connect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL, _ := url.Parse("http://" + local)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(backend.URL+"/x", "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "a POST /x" {
+			t.Errorf("got %q", body)
+		}
+	}
+}
+
+func TestForwardConnectUpstream(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+		if !ok || user != "me" || pass != "secret" {
+			http.Error(w, "who are you", http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != http.MethodConnect {
+			fmt.Fprintf(w, "upstream %s", r.URL)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	}))
+	defer upstream.Close()
+	upstreamAddr := strings.TrimPrefix(upstream.URL, "http://")
+
+	forward := func(name, password string) string {
+		local, err := p.ForwardWithOptions(name, "", "0", &proxy.ForwardOptions{
+			Connect:  true,
+			Upstream: &proxy.Upstream{Addr: upstreamAddr, Username: "me", Password: password},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return local
+	}
+	connectTo := func(local string) (int, net.Conn) {
+		conn, err := net.Dial("tcp", local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+backend.Addr, nil)
+		req.Host = backend.Addr
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", backend.Addr, backend.Addr)
+		// The response has no body, so nothing after it is buffered.
+		resp, err := http.ReadResponse(bufio.NewReaderSize(conn, 16), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, conn
+	}
+
+	local := forward("chained", "secret")
+	status, conn := connectTo(local)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if _, err := io.WriteString(conn, "through squid"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("through squid"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "through squid" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+
+	proxyURL, _ := url.Parse("http://" + local)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://internal.invalid/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "upstream http://internal.invalid/x" {
+		t.Errorf("got %q", body)
+	}
+
+	if status, _ := connectTo(forward("rejected", "wrong")); status != http.StatusBadGateway {
+		t.Fatalf("with wrong credentials got status %d", status)
+	}
+}
+
+// parseProxyAuth decodes a basic Proxy-Authorization header.
+func parseProxyAuth(header string) (user, pass string, ok bool) {
+	r := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return r.BasicAuth()
+}
+
+func TestForwardTransparentNotRedirected(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("transparent mode is only supported on Linux")
+	}
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	p := connect(t, srv)
+
+	local, err := p.ForwardWithOptions("transparent", "", "0", &proxy.ForwardOptions{Transparent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Without a firewall rule the destination would be the forward itself.
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+// freezableConn stops delivering data once frozen, like a connection
+// whose peer went away without closing it.
+type freezableConn struct {
+	net.Conn
+	frozen chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *freezableConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.frozen:
+		<-c.closed
+		return 0, io.EOF
+	default:
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *freezableConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestLastKeepAlive(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	cfg := srv.Config()
+	cfg.KeepAliveInterval = 20 * time.Millisecond
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if age := p.ConnStats().KeepAliveAge(); age != 0 {
+		t.Fatalf("keepalive age %s before connecting", age)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	stats := p.ConnStats()
+	if !stats.LastKeepAlive.After(stats.LastConnect.Add(stats.HandshakeDuration)) {
+		t.Fatal("no keepalive answered")
+	}
+	if age := stats.KeepAliveAge(); age > time.Second {
+		t.Fatalf("keepalive age %s", age)
+	}
+}
+
+func TestKeepAliveTunnelLost(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	cfg.KeepAliveInterval = 50 * time.Millisecond
+	cfg.KeepAliveCountMax = 2
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	frozen := make(chan struct{})
+	p.WithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &freezableConn{Conn: conn, frozen: frozen, closed: make(chan struct{})}, nil
+	})
+	events, unsubscribe := p.Events()
+	defer unsubscribe()
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	close(frozen)
+	for ev := range events {
+		if ev.Type == proxy.EventTunnelLost {
+			break
+		}
+	}
+	// The connection is torn down without the client having to send
+	// anything.
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Idle() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection still open after the tunnel was lost")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lost := p.ConnStats().TunnelsLost; lost != 1 {
+		t.Fatalf("got %d lost tunnels, want 1", lost)
+	}
+}
+
+func TestOpenTun(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	p, err := proxy.New(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	tun, err := p.OpenTun(proxy.TunAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	// An IPv4 and an IPv6 header with a few bytes of payload each.
+	v4 := []byte{0x45, 0, 0, 24, 0, 0, 0, 0, 64, 17, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2, 1, 2, 3, 4}
+	v6 := make([]byte, 43)
+	v6[0], v6[5], v6[6] = 0x60, 3, 17
+	for _, pkt := range [][]byte{v4, v6, v4} {
+		if err := tun.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range [][]byte{v4, v6, v4} {
+		got, err := tun.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got packet %x, want %x", got, want)
+		}
+	}
+}
+
+func TestForwardExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test server runs commands with sh")
+	}
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	p := connect(t, srv)
+	local, err := p.NamedForward("cat", "exec:cat", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "through a remote command")
+	if err := p.Probe("cat"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.ForwardWithOptions("socks", "exec:cat", "0", &proxy.ForwardOptions{SOCKS: true})
+	if err == nil {
+		t.Fatal("exec remote accepted in SOCKS mode")
+	}
+}
+
+func TestForwardExecMaxStartups(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test server runs commands with sh")
+	}
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	cfg := srv.Config()
+	cfg.MaxStartups = 1
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	local, err := p.NamedForward("cat", "exec:cat", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each command gives its startup slot back once it runs.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			echo(t, local, fmt.Sprintf("command %d", i))
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestForwardTimeouts(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	cfg.ParkTimeout = time.Minute
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	local, err := p.ForwardWithOptions("short", backend.Addr, "0", &proxy.ForwardOptions{
+		DialTimeout: 100 * time.Millisecond,
+		MaxLifetime: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v after the maximum lifetime, want EOF", err)
+	}
+
+	// Without an ssh connection, the dial gives up long before the park
+	// timeout.
+	srv.CloseConnections()
+	for p.Connected() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	conn, err = net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want EOF", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("dial gave up after %s", d)
+	}
+}
+
+func TestForwardConsulCached(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Addr)
+	var lookups int32
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		if r.URL.Path != "/v1/health/service/echo" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `[{"Node":{"Address":"127.0.0.1"},"Service":{"Address":"","Port":%s}}]`, port)
+	}))
+	defer consul.Close()
+	cfg := srv.Config()
+	cfg.ConsulAddress = consul.Listener.Addr().String()
+	cfg.ResolveCacheTTL = time.Minute
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	local, err := p.NamedForward("echo", "consul:echo", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "first")
+	echo(t, local, "second")
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Fatalf("got %d lookups, want 1", n)
+	}
+}
+
+// connMemory is the memory a connection reserves against MaxBufferedBytes,
+// its 2MB channel window and two 32KB copy buffers.
+const connMemory = 2<<20 + 64<<10
+
+func TestMaxBufferedBytes(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	cfg.MaxBufferedBytes = connMemory
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.ReservedBytes(); n != connMemory {
+		t.Fatalf("%d bytes reserved, want %d", n, connMemory)
+	}
+
+	shed, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shed.Close()
+	shed.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := shed.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v for a connection over the limit, want EOF", err)
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.ReservedBytes() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d bytes still reserved after close", p.ReservedBytes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	echo(t, local, "after release")
+	if n := p.BufferedBytes(); n != 0 {
+		t.Fatalf("%d bytes buffered with no data in flight", n)
+	}
+}
+
+func TestForwardPriority(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	// Room for two connections, one at low priority.
+	cfg.MaxBufferedBytes = 2 * connMemory
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if _, err := p.ForwardWithOptions("bad", backend.Addr, "0", &proxy.ForwardOptions{Priority: "urgent"}); err == nil {
+		t.Fatal("unknown priority accepted")
+	}
+	low, err := p.ForwardWithOptions("low", backend.Addr, "0", &proxy.ForwardOptions{Priority: proxy.PriorityLow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, err := p.ForwardWithOptions("high", backend.Addr, "0", &proxy.ForwardOptions{Priority: proxy.PriorityHigh})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	shed, err := net.Dial("tcp", low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shed.Close()
+	shed.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := shed.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v for a second low priority connection, want EOF", err)
+	}
+	echo(t, high, "ping")
+}
+
+func TestFairScheduling(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	cfg := srv.Config()
+	cfg.FairScheduling = true
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	bulk, err := p.ForwardWithOptions("bulk", backend.Addr, "0", &proxy.ForwardOptions{Priority: proxy.PriorityLow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	interactive, err := p.ForwardWithOptions("interactive", backend.Addr, "0", &proxy.ForwardOptions{Priority: proxy.PriorityHigh})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", bulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	data := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		errc <- err
+	}()
+	// Interactive traffic gets through while the bulk stream is going.
+	for i := 0; i < 5; i++ {
+		echo(t, interactive, "ping")
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("bulk stream corrupted")
+	}
+}
+
+func TestForwardRemoteTLS(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.ServerName)
+	}))
+	defer backend.Close()
+	p := connect(t, srv)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+	// The test certificate is for example.com, not the address dialed.
+	origin := &tls.Config{ServerName: "example.com", RootCAs: roots}
+	for _, opts := range []*proxy.ForwardOptions{{RemoteTLS: origin}, {RemoteTLS: origin, HTTP: true}} {
+		local, err := p.ForwardWithOptions(fmt.Sprintf("http=%t", opts.HTTP), backend.Listener.Addr().String(), "0", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Get("http://" + local + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "example.com" {
+			t.Errorf("L7 %t: got server name %q", opts.HTTP, body)
+		}
+	}
+
+	local, err := p.ForwardWithOptions("untrusted", backend.Listener.Addr().String(), "0", &proxy.ForwardOptions{
+		RemoteTLS: &tls.Config{ServerName: "other.test", RootCAs: roots},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.Get("http://" + local + "/"); err == nil {
+		resp.Body.Close()
+		t.Fatal("request succeeded with a wrong server name")
+	}
+	if _, err := p.ForwardWithOptions("socks", "", "0", &proxy.ForwardOptions{SOCKS: true, RemoteTLS: origin}); err == nil {
+		t.Fatal("TLS origination accepted in SOCKS mode")
+	}
+}
+
+func TestForwardRemoteTLSClientCert(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.Organization[0])
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+	for name, certs := range map[string][]tls.Certificate{"anonymous": nil, "client": backend.TLS.Certificates} {
+		local, err := p.ForwardWithOptions(name, backend.Listener.Addr().String(), "0", &proxy.ForwardOptions{
+			HTTP:      true,
+			RemoteTLS: &tls.Config{ServerName: "example.com", RootCAs: roots, Certificates: certs},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Get("http://" + local + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if name == "anonymous" && resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("got status %d without a client certificate", resp.StatusCode)
+		}
+		if name == "client" && string(body) != "Acme Co" {
+			t.Errorf("got %q with a client certificate", body)
+		}
+	}
+}
+
+func TestForwardChaos(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+	p := connect(t, srv)
+
+	if _, err := p.ForwardWithOptions("bad", backend.Addr, "0", &proxy.ForwardOptions{Chaos: &proxy.Chaos{DropPercent: 150}}); err == nil {
+		t.Fatal("invalid drop percentage accepted")
+	}
+	read := func(chaos *proxy.Chaos) (string, time.Duration) {
+		t.Helper()
+		local, err := p.ForwardWithOptions(fmt.Sprint(chaos), backend.Addr, "0", &proxy.ForwardOptions{Chaos: chaos})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		io.WriteString(conn, "ping")
+		buf := make([]byte, 4)
+		n, _ := io.ReadFull(conn, buf)
+		return string(buf[:n]), time.Since(start)
+	}
+	if got, _ := read(&proxy.Chaos{DropPercent: 100}); got != "" {
+		t.Errorf("got %q from a dropped connection", got)
+	}
+	if got, _ := read(&proxy.Chaos{TruncatePercent: 100, TruncateAfter: 2}); got != "pi" {
+		t.Errorf("got %q from a truncated connection, want %q", got, "pi")
+	}
+	if got, d := read(&proxy.Chaos{Latency: 100 * time.Millisecond}); got != "ping" || d < 100*time.Millisecond {
+		t.Errorf("got %q after %s with injected latency", got, d)
+	}
+}
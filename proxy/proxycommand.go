@@ -0,0 +1,114 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shellCommand returns a command running command with the system shell.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// expandProxyCommand replaces %h, %p and %r in command with the host, port
+// and user of the ssh server, and %% with %, like OpenSSH.
+func expandProxyCommand(command, addr, user string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "22"
+	}
+	return strings.NewReplacer("%%", "%", "%h", host, "%p", port, "%r", user).Replace(command)
+}
+
+// dialCommand starts the proxy command of the config and returns a
+// connection over its stdin and stdout.
+func (p *SSHProxy) dialCommand() (net.Conn, error) {
+	command := expandProxyCommand(p.cfg.ProxyCommand, p.cfg.RemoteAddress, p.cfg.RemoteUser)
+	line := command
+	if runtime.GOOS != "windows" {
+		// Replace the shell, so closing the connection stops the command
+		// itself, as OpenSSH does.
+		line = "exec " + command
+	}
+	cmd := shellCommand(line)
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	r, stdout, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		w.Close()
+		return nil, err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, os.Stderr
+	err = cmd.Start()
+	// The command has its own copies of its ends now.
+	stdin.Close()
+	stdout.Close()
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, fmt.Errorf("proxy command: %w", err)
+	}
+	logger.Debugf("started proxy command %q", command)
+	return &commandConn{cmd: cmd, r: r, w: w, addr: commandAddr(command)}, nil
+}
+
+// commandAddr is the address of a commandConn, its command line.
+type commandAddr string
+
+func (a commandAddr) Network() string { return "exec" }
+func (a commandAddr) String() string  { return string(a) }
+
+// commandConn is a connection to the stdin and stdout of a command.
+type commandConn struct {
+	cmd  *exec.Cmd
+	r    *os.File
+	w    *os.File
+	addr commandAddr
+
+	// The ssh connection closes its transport from more than one place.
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (c *commandConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *commandConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// Close closes the pipes and stops the command.
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.w.Close()
+		c.closeErr = c.r.Close()
+		if err := c.cmd.Process.Kill(); err != nil {
+			logger.Debugf("error stopping proxy command: %s", err)
+		}
+		go c.cmd.Wait()
+	})
+	return c.closeErr
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return c.addr }
+func (c *commandConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *commandConn) SetDeadline(t time.Time) error {
+	if err := c.r.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.w.SetWriteDeadline(t)
+}
+
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return c.r.SetReadDeadline(t) }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return c.w.SetWriteDeadline(t) }
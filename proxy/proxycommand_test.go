@@ -0,0 +1,124 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"github.com/elliotpeele/sshhttpproxy/proxy/proxytest"
+)
+
+// proxyCommandArg makes the test binary act as a proxy command, see
+// netcat.
+const proxyCommandArg = "proxy-command"
+
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == proxyCommandArg {
+		os.Exit(netcat(os.Args[2:]))
+	}
+	os.Exit(m.Run())
+}
+
+// netcat connects its stdin and stdout to host and port, the first two
+// args, if the user, the third, is the one of the test server.
+func netcat(args []string) int {
+	if len(args) != 3 || args[2] != proxytest.User {
+		fmt.Fprintf(os.Stderr, "unexpected arguments %q\n", args)
+		return 2
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(args[0], args[1]))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.Close()
+	}()
+	io.Copy(os.Stdout, conn)
+	return 0
+}
+
+// proxyCommand returns a proxy command running the test binary as
+// netcat.
+func proxyCommand(args string) string {
+	return fmt.Sprintf("%q %s %s", os.Args[0], proxyCommandArg, args)
+}
+
+func TestProxyCommand(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	backend := proxytest.NewEchoServer()
+	defer backend.Close()
+
+	cfg := srv.Config()
+	cfg.ProxyCommand = proxyCommand("%h %p %r")
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	local, err := p.Forward(backend.Addr, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "through a proxy command")
+
+	// The connection is made again with a new command.
+	if err := p.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, local, "after a reconnect")
+}
+
+func TestProxyCommandFailure(t *testing.T) {
+	srv := proxytest.NewServer()
+	defer srv.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	for name, change := range map[string]func(*proxy.Config){
+		// The command fails to reach the server and exits.
+		"unreachable": func(cfg *proxy.Config) {
+			cfg.RemoteAddress = closedAddr
+			cfg.ProxyCommand = proxyCommand("%h %p %r")
+		},
+		// The command exits at once without output.
+		"bad arguments": func(cfg *proxy.Config) {
+			cfg.ProxyCommand = proxyCommand("%h")
+		},
+		"no such command": func(cfg *proxy.Config) {
+			cfg.ProxyCommand = fmt.Sprintf("%q %%h %%p", filepath.Join(os.TempDir(), "no-such-command"))
+		},
+	} {
+		cfg := srv.Config()
+		change(cfg)
+		p, err := proxy.New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Connect(); err == nil {
+			p.Shutdown()
+			t.Errorf("%s: connected", name)
+		}
+	}
+	if _, err := proxy.New(&proxy.Config{ProxyCommand: "nc %h %p", Paths: []string{"127.0.0.1"}}); err == nil {
+		t.Error("paths were combined with a proxy command")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxytest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// EchoServer is a tcp server that writes back everything it reads.
+type EchoServer struct {
+	// Addr is the address the server listens on, in host:port form.
+	Addr string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewEchoServer starts and returns a new EchoServer. The caller should call
+// Close when finished, to shut it down. NewEchoServer panics on error.
+func NewEchoServer() *EchoServer {
+	return NewEchoServerAt("127.0.0.1:0")
+}
+
+// NewEchoServerAt is like NewEchoServer, but listens on addr, e.g. to bring
+// back a server on the address of one that was closed.
+func NewEchoServerAt(addr string) *EchoServer {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(fmt.Sprintf("proxytest: %s", err))
+	}
+	s := &EchoServer{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close shuts down the server, closing any open connections.
+func (s *EchoServer) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *EchoServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+			io.Copy(conn, conn)
+			conn.(*net.TCPConn).CloseWrite()
+			conn.Close()
+		}()
+	}
+}
+
+// NewHTTPServer starts an HTTP server that answers every request with a body
+// of "<name> <method> <request uri>". Request headers are reflected back as
+// response headers prefixed with "Request-", so tests can check what reached
+// the backend. The caller should call Close when finished.
+func NewHTTPServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, values := range r.Header {
+			for _, value := range values {
+				w.Header().Add("Request-"+key, value)
+			}
+		}
+		w.Header().Set("Request-Host", r.Host)
+		fmt.Fprintf(w, "%s %s %s", name, r.Method, r.URL.RequestURI())
+	}))
+}
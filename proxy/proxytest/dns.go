@@ -0,0 +1,118 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxytest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// DNSServer is a DNS over TCP server answering every A query with
+// 127.0.0.1 and other queries with no records. It answers pipelined
+// queries on a connection as they come.
+type DNSServer struct {
+	// Addr is the address the server listens on, in host:port form.
+	Addr string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+	conns    int32
+	queries  int32
+}
+
+// NewDNSServer starts and returns a new DNSServer. The caller should call
+// Close when finished, to shut it down. NewDNSServer panics on error.
+func NewDNSServer() *DNSServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("proxytest: %s", err))
+	}
+	s := &DNSServer{Addr: listener.Addr().String(), listener: listener}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Conns returns the number of connections the server accepted.
+func (s *DNSServer) Conns() int { return int(atomic.LoadInt32(&s.conns)) }
+
+// Queries returns the number of queries the server answered.
+func (s *DNSServer) Queries() int { return int(atomic.LoadInt32(&s.queries)) }
+
+// Close shuts down the server. Open connections end with the clients.
+func (s *DNSServer) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *DNSServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.conns, 1)
+		go s.answer(conn)
+	}
+}
+
+func (s *DNSServer) answer(conn net.Conn) {
+	defer conn.Close()
+	var size [2]byte
+	for {
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		reply := dnsReply(query)
+		if reply == nil {
+			return
+		}
+		atomic.AddInt32(&s.queries, 1)
+		frame := make([]byte, 2, 2+len(reply))
+		binary.BigEndian.PutUint16(frame, uint16(len(reply)))
+		if _, err := conn.Write(append(frame, reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// dnsReply returns the answer to query, which must have one question, or
+// nil if it is malformed.
+func dnsReply(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+	reply := append([]byte(nil), query[:end]...)
+	// A response with recursion available, one question and no
+	// authority or additional records.
+	binary.BigEndian.PutUint16(reply[2:], 0x8180)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	binary.BigEndian.PutUint16(reply[6:], 0)
+	binary.BigEndian.PutUint16(reply[8:], 0)
+	binary.BigEndian.PutUint16(reply[10:], 0)
+	if qtype == 1 {
+		binary.BigEndian.PutUint16(reply[6:], 1)
+		// The name of the question, type A, class IN, a TTL of 60
+		// seconds and the address.
+		reply = append(reply, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+	}
+	return reply
+}
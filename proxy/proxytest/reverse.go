@@ -0,0 +1,144 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxytest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// tcpipForward is the payload of a tcpip-forward request, see RFC 4254
+// section 7.1.
+type tcpipForward struct {
+	Addr string
+	Port uint32
+}
+
+// forwardedTCPIP is the extra data of a forwarded-tcpip channel.
+type forwardedTCPIP struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// reverseListeners tracks the listeners opened for one ssh connection.
+type reverseListeners struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+// handleRequests serves global requests of conn, implementing remote port
+// forwarding. It closes all listeners once reqs is closed.
+func (s *Server) handleRequests(conn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	rl := &reverseListeners{listeners: make(map[string]net.Listener)}
+	defer func() {
+		rl.mu.Lock()
+		for _, l := range rl.listeners {
+			l.Close()
+		}
+		rl.mu.Unlock()
+	}()
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			s.handleTCPIPForward(conn, rl, req)
+		case "cancel-tcpip-forward":
+			var payload tcpipForward
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			key := net.JoinHostPort(payload.Addr, fmt.Sprint(payload.Port))
+			rl.mu.Lock()
+			l, ok := rl.listeners[key]
+			delete(rl.listeners, key)
+			rl.mu.Unlock()
+			if ok {
+				l.Close()
+			}
+			req.Reply(ok, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *Server) handleTCPIPForward(conn *ssh.ServerConn, rl *reverseListeners, req *ssh.Request) {
+	var payload tcpipForward
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil || s.DenyForwarding {
+		req.Reply(false, nil)
+		return
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(payload.Addr, fmt.Sprint(payload.Port)))
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	_, portStr, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	rl.mu.Lock()
+	rl.listeners[net.JoinHostPort(payload.Addr, portStr)] = l
+	rl.mu.Unlock()
+	var reply []byte
+	if payload.Port == 0 {
+		reply = ssh.Marshal(struct{ Port uint32 }{uint32(port)})
+	}
+	req.Reply(true, reply)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			origin := c.RemoteAddr().(*net.TCPAddr)
+			extra := ssh.Marshal(&forwardedTCPIP{
+				Addr:       payload.Addr,
+				Port:       uint32(port),
+				OriginAddr: origin.IP.String(),
+				OriginPort: uint32(origin.Port),
+			})
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				ch, reqs, err := conn.OpenChannel("forwarded-tcpip", extra)
+				if err != nil {
+					c.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				splice(ch, c.(*net.TCPConn))
+			}()
+		}
+	}()
+}
+
+// splice copies between an ssh channel and a tcp connection, propagating
+// half-closes, and closes both once done.
+func splice(ch ssh.Channel, c *net.TCPConn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, c)
+		ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(c, ch)
+		c.CloseWrite()
+	}()
+	wg.Wait()
+	ch.Close()
+	c.Close()
+}
@@ -0,0 +1,324 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+// Package proxytest provides an in-process ssh server and backends for
+// testing code that uses the proxy package, similar to net/http/httptest.
+package proxytest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/elliotpeele/sshhttpproxy/proxy"
+	"golang.org/x/crypto/ssh"
+)
+
+// User is the only user name accepted by Server.
+const User = "proxytest"
+
+// Server is an ssh server listening on a loopback address that accepts
+// public key authentication with a generated client key. It serves
+// direct-tcpip channels by dialing the requested address locally and
+// tcpip-forward requests by listening locally. Sessions run exec requests
+// with the local shell and tun@openssh.com channels send back whatever is
+// written to them.
+type Server struct {
+	// Addr is the address the server listens on, in host:port form.
+	Addr string
+	// PrivateKeyPath is the path of a file holding the client private key.
+	PrivateKeyPath string
+	// HostKey is the public host key presented by the server.
+	HostKey ssh.PublicKey
+	// DenyForwarding makes the server reject all port forwarding.
+	DenyForwarding bool
+	// GSSAPI, if set, lets User log in with gssapi-with-mic, accepting
+	// the contexts it accepts with a source name of User@<realm>.
+	GSSAPI ssh.GSSAPIServer
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+	dir      string
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[*ssh.ServerConn]struct{}
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished, to shut it down. NewServer panics on error.
+func NewServer() *Server {
+	s, err := newServer()
+	if err != nil {
+		panic(fmt.Sprintf("proxytest: %s", err))
+	}
+	return s
+}
+
+func newServer() (*Server, error) {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, err
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	clientPub, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "proxytest")
+	if err != nil {
+		return nil, err
+	}
+	keyPath := filepath.Join(dir, "id_ecdsa")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == User && bytes.Equal(key.Marshal(), clientPub.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	s := &Server{
+		Addr:           listener.Addr().String(),
+		PrivateKeyPath: keyPath,
+		HostKey:        hostSigner.PublicKey(),
+		listener:       listener,
+		config:         config,
+		dir:            dir,
+		conns:          make(map[*ssh.ServerConn]struct{}),
+	}
+	config.GSSAPIWithMICConfig = &ssh.GSSAPIWithMICConfig{
+		AllowLogin: func(meta ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+			if meta.User() == User && strings.HasPrefix(srcName, User+"@") {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		},
+		Server: gssapiServer{s},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// gssapiServer hands gssapi-with-mic logins to the GSSAPI field of the
+// server, failing them while it is nil.
+type gssapiServer struct {
+	s *Server
+}
+
+func (g gssapiServer) AcceptSecContext(token []byte) ([]byte, string, bool, error) {
+	if g.s.GSSAPI == nil {
+		return nil, "", false, errors.New("gssapi not enabled")
+	}
+	return g.s.GSSAPI.AcceptSecContext(token)
+}
+
+func (g gssapiServer) VerifyMIC(micField, micToken []byte) error {
+	if g.s.GSSAPI == nil {
+		return errors.New("gssapi not enabled")
+	}
+	return g.s.GSSAPI.VerifyMIC(micField, micToken)
+}
+
+func (g gssapiServer) DeleteSecContext() error {
+	if g.s.GSSAPI == nil {
+		return nil
+	}
+	return g.s.GSSAPI.DeleteSecContext()
+}
+
+// Config returns a proxy configuration for connecting to the server.
+func (s *Server) Config() *proxy.Config {
+	return &proxy.Config{
+		PrivateKeyPath: s.PrivateKeyPath,
+		RemoteUser:     User,
+		RemoteAddress:  s.Addr,
+	}
+}
+
+// CloseConnections drops all established ssh connections, leaving the
+// server running so clients can reconnect.
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close shuts down the server and blocks until all connections are closed.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.CloseConnections()
+	s.wg.Wait()
+	os.RemoveAll(s.dir)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.handleConn(nc)
+	}
+}
+
+func (s *Server) handleConn(nc net.Conn) {
+	defer s.wg.Done()
+	conn, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	go s.handleRequests(conn, reqs)
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "direct-tcpip":
+			s.wg.Add(1)
+			go s.handleDirect(newCh)
+		case "session":
+			s.wg.Add(1)
+			go s.handleSession(newCh)
+		case "tun@openssh.com":
+			s.wg.Add(1)
+			go s.handleTun(newCh)
+		default:
+			newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// execPayload is the payload of an exec request, see RFC 4254 section
+// 6.5.
+type execPayload struct {
+	Command string
+}
+
+// handleSession runs the command of the first exec request of a session
+// with its stdio connected to the channel.
+func (s *Server) handleSession(newCh ssh.NewChannel) {
+	defer s.wg.Done()
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	for req := range reqs {
+		var payload execPayload
+		if req.Type != "exec" || ssh.Unmarshal(req.Payload, &payload) != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(reqs)
+		cmd := exec.Command("sh", "-c", payload.Command)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = ch, ch, ch.Stderr()
+		status := uint32(0)
+		if err := cmd.Run(); err != nil {
+			status = 1
+		}
+		ch.CloseWrite()
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+// handleTun echoes the packets of a tun channel.
+func (s *Server) handleTun(newCh ssh.NewChannel) {
+	defer s.wg.Done()
+	if s.DenyForwarding {
+		newCh.Reject(ssh.Prohibited, "tunnel forwarding is disabled")
+		return
+	}
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	io.Copy(ch, ch)
+	ch.Close()
+}
+
+// directPayload is the extra data of a direct-tcpip channel open request,
+// see RFC 4254 section 7.2.
+type directPayload struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+func (s *Server) handleDirect(newCh ssh.NewChannel) {
+	defer s.wg.Done()
+	if s.DenyForwarding {
+		newCh.Reject(ssh.Prohibited, "port forwarding is disabled")
+		return
+	}
+	var payload directPayload
+	if err := ssh.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+		newCh.Reject(ssh.ConnectionFailed, "malformed request")
+		return
+	}
+	addr := net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port))
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	splice(ch, target.(*net.TCPConn))
+}
@@ -0,0 +1,224 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// srvPrefix marks a remote looked up as a DNS SRV record, e.g.
+	// srv:_postgres._tcp.db.internal.
+	srvPrefix = "srv:"
+	// consulPrefix marks a remote looked up as a service in the Consul
+	// catalog, e.g. consul:postgres.
+	consulPrefix = "consul:"
+)
+
+// isService reports whether remote names a service to look up rather than
+// an address.
+func isService(remote string) bool {
+	return strings.HasPrefix(remote, srvPrefix) || strings.HasPrefix(remote, consulPrefix)
+}
+
+// resolveCache keeps the results of lookups for a TTL. Expired entries are
+// still served while they are looked up again in the background.
+type resolveCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*resolveEntry
+}
+
+// resolveEntry is a cached lookup. A nil addrs with no error is cached for
+// names that do not resolve, which are left to the ssh server.
+type resolveEntry struct {
+	addrs      []string
+	expires    time.Time
+	refreshing bool
+}
+
+// get returns the result of lookup for key, from the cache if the TTL is
+// not 0.
+func (c *resolveCache) get(key string, lookup func() ([]string, error)) ([]string, error) {
+	if c.ttl <= 0 {
+		return lookup()
+	}
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) && !e.refreshing {
+		e.refreshing = true
+		go c.refresh(key, lookup)
+	}
+	c.mu.Unlock()
+	if ok {
+		return e.addrs, nil
+	}
+	addrs, err := lookup()
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, addrs)
+	return addrs, nil
+}
+
+// refresh looks up key again, keeping the old entry if that fails.
+func (c *resolveCache) refresh(key string, lookup func() ([]string, error)) {
+	addrs, err := lookup()
+	if err != nil {
+		logger.Debugf("refreshing %s: %s", key, err)
+		c.mu.Lock()
+		c.entries[key].refreshing = false
+		c.mu.Unlock()
+		return
+	}
+	c.store(key, addrs)
+}
+
+func (c *resolveCache) store(key string, addrs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &resolveEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+}
+
+// resolver returns the resolver for target names: the DNS server of the
+// config queried over TCP through the ssh connection, or the local one.
+func (p *SSHProxy) resolver() *net.Resolver {
+	if p.dns == nil {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		// Not being a PacketConn, the mux is spoken to over TCP.
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return p.dns.dial(), nil
+		},
+	}
+}
+
+// lookupHost returns the addresses of host, from the cache if it is
+// enabled, or none if it does not resolve.
+func (p *SSHProxy) lookupHost(host string) []net.IP {
+	addrs, _ := p.cache.get(host, func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(p.ctx, resolveTimeout)
+		defer cancel()
+		ips, err := p.resolver().LookupIPAddr(ctx, host)
+		if err != nil {
+			// Left to the ssh server, which may know internal names.
+			logger.Debugf("resolving %s: %s", host, err)
+			return nil, nil
+		}
+		addrs := make([]string, len(ips))
+		for i, ip := range ips {
+			addrs[i] = ip.String()
+		}
+		return addrs, nil
+	})
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, net.ParseIP(addr))
+	}
+	return ips
+}
+
+// lookupService returns the host:port addresses of the srv: or consul:
+// remote in the order they should be tried.
+func (p *SSHProxy) lookupService(remote string) ([]string, error) {
+	addrs, err := p.cache.get(remote, func() ([]string, error) {
+		if strings.HasPrefix(remote, srvPrefix) {
+			return p.lookupSRV(strings.TrimPrefix(remote, srvPrefix))
+		}
+		return p.lookupConsul(strings.TrimPrefix(remote, consulPrefix))
+	})
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses")
+	}
+	if err != nil {
+		return nil, wrapError(ErrRemoteDial, fmt.Errorf("%s: %w", remote, err))
+	}
+	return addrs, nil
+}
+
+// lookupSRV returns the targets of the SRV record name by priority. The
+// target names are resolved by the ssh server.
+func (p *SSHProxy) lookupSRV(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(p.ctx, resolveTimeout)
+	defer cancel()
+	_, srvs, err := p.resolver().LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	// LookupSRV already orders by priority and randomizes by weight.
+	addrs := make([]string, len(srvs))
+	for i, srv := range srvs {
+		addrs[i] = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+	}
+	return addrs, nil
+}
+
+// consulEntry is an entry of the Consul health API.
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// lookupConsul returns the addresses of the passing instances of service
+// from the Consul agent of the config, asked through the ssh connection.
+func (p *SSHProxy) lookupConsul(service string) ([]string, error) {
+	if p.cfg.ConsulAddress == "" {
+		return nil, errors.New("no Consul address configured")
+	}
+	client := &http.Client{
+		Timeout: resolveTimeout,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return p.dialChannel(p.cfg.ConsulAddress, PriorityNormal)
+			},
+		},
+	}
+	u := fmt.Sprintf("http://%s/v1/health/service/%s?passing=true", p.cfg.ConsulAddress, url.PathEscape(service))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.cfg.ConsulToken != "" {
+		req.Header.Set("X-Consul-Token", p.cfg.ConsulToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul: %s", resp.Status)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("consul: %w", err)
+	}
+	addrs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,299 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// localDialTimeout bounds dials to local targets of reverse forwards.
+const localDialTimeout = 10 * time.Second
+
+// handshakeTimeout bounds the TLS handshake of connections to reverse
+// forwards terminating TLS, unless AcceptTimeout is set.
+const handshakeTimeout = 10 * time.Second
+
+// acmeALPNProto is the ALPN protocol of ACME TLS-ALPN-01 challenges.
+const acmeALPNProto = "acme-tls/1"
+
+// rebindMaxBackoff caps the delay between attempts to listen again on a new
+// ssh connection. The server may not have released the port of the old
+// connection yet.
+const rebindMaxBackoff = 5 * time.Second
+
+// ReverseForward asks the ssh server to listen on remoteAddr and forwards
+// connections it receives to target on the local side, like ssh -R. The
+// forward is registered under name and the address the server listens on
+// is returned. If remoteAddr is only a port, the server listens on
+// loopback unless opts.Public is set. Of opts, AcceptRate, AcceptBurst,
+// Dump, Origins and TLS apply; with TLS set, TLS is terminated locally and
+// target receives plain text. When the ssh connection is replaced, the
+// forward listens again on the new one, on the same port if the server
+// allows it.
+func (p *SSHProxy) ReverseForward(name, remoteAddr, target string, opts *ForwardOptions) (string, error) {
+	if opts == nil {
+		opts = &ForwardOptions{}
+	}
+	settings, err := reverseSettings(target, opts)
+	if err != nil {
+		return "", err
+	}
+	remoteAddr = reverseBindAddr(remoteAddr, opts.Public)
+	conn := p.client()
+	if conn == nil {
+		return "", wrapError(ErrNotConnected, nil)
+	}
+	fwd := &forward{name: name, reverse: true, log: newForwardLoggers(name)}
+	fwd.settings.Store(settings)
+	err = p.addForward(fwd, func() (net.Listener, error) {
+		l, err := conn.Listen("tcp", remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		return newReverseListener(remoteAddr, l), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	handle := func(conn net.Conn, settings *forwardSettings) {
+		go p.handleReverse(conn, fwd, settings)
+	}
+	p.serveForward(fwd, handle, func() {})
+	bound := fwd.listener.Addr().String()
+	p.hooks.forwardUp(name, target, bound)
+	p.emit(Event{Type: EventForwardUp, Forward: name, Addr: bound})
+	return bound, nil
+}
+
+// reverseSettings checks opts for a reverse forward to target and returns
+// its settings.
+func reverseSettings(target string, opts *ForwardOptions) (*forwardSettings, error) {
+	if opts.HTTP || len(opts.HTTPRoutes) > 0 || len(opts.SNIRoutes) > 0 {
+		return nil, errors.New("routing is not supported on reverse forwards")
+	}
+	if opts.Connect || opts.SOCKS || len(opts.Destinations) > 0 {
+		return nil, errors.New("proxy modes are not supported on reverse forwards")
+	}
+	if opts.Watch > 0 {
+		return nil, errors.New("watching is not supported on reverse forwards")
+	}
+	s := &forwardSettings{
+		remote:  target,
+		limiter: newRateLimiter(opts.AcceptRate, opts.AcceptBurst),
+		dump:    opts.Dump,
+		tls:     opts.TLS,
+
+		acceptTimeout: opts.AcceptTimeout,
+	}
+	if len(opts.Origins) > 0 {
+		for _, rule := range opts.Origins {
+			if len(rule.Ports) > 0 {
+				return nil, errors.New("origin rules cannot have ports")
+			}
+		}
+		acl, err := compileDestinationRules(opts.Origins)
+		if err != nil {
+			return nil, err
+		}
+		s.origins = acl
+	}
+	return s, nil
+}
+
+// reverseBindAddr adds the bind host to addr if it is only a port.
+func reverseBindAddr(addr string, public bool) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = "", addr
+	}
+	if host != "" {
+		return addr
+	}
+	if public {
+		host = "0.0.0.0"
+	} else {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// handleReverse forwards a connection accepted by the ssh server to the
+// local target of fwd, with the settings of fwd when it was accepted.
+func (p *SSHProxy) handleReverse(conn net.Conn, fwd *forward, settings *forwardSettings) {
+	if acl := settings.origins; acl != nil {
+		if err := acl.check(conn.RemoteAddr().String()); err != nil {
+			fwd.log.conns.Warningf("forward %s: refusing connection from %s", fwd.name, conn.RemoteAddr())
+			p.rejectClient(conn, fwd, "", err)
+			return
+		}
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		// ssh channels have no deadlines, so a client that does not
+		// finish the handshake in time is cut off by closing it.
+		timer := time.AfterFunc(orDefault(settings.acceptTimeout, handshakeTimeout), func() { conn.Close() })
+		err := tc.Handshake()
+		if !timer.Stop() && err == nil {
+			err = errors.New("handshake timed out")
+		}
+		// TLS-ALPN-01 challenges end with the handshake, they must not
+		// reach the target.
+		if err != nil || tc.ConnectionState().NegotiatedProtocol == acmeALPNProto {
+			if err != nil {
+				fwd.log.conns.Debugf("forward %s: TLS handshake with %s: %s", fwd.name, conn.RemoteAddr(), err)
+			}
+			conn.Close()
+			return
+		}
+	}
+	if !p.memory.acquire(settings.priority) {
+		err := wrapError(ErrOverloaded, nil)
+		fwd.log.conns.Warningf("shedding connection to %s: %s", fwd.name, err)
+		p.rejectClient(conn, fwd, "", err)
+		return
+	}
+	addr := settings.remote
+	start := time.Now()
+	target, err := net.DialTimeout("tcp", addr, localDialTimeout)
+	if err != nil {
+		fwd.log.conns.Errorf("forward %s: %s", fwd.name, err)
+		p.rejectClient(conn, fwd, addr, err)
+		p.memory.release()
+		return
+	}
+	p.checkDial(fwd, addr, time.Since(start))
+	p.splice(fwd, settings, conn, conn, target, addr)
+}
+
+// reverseListener is the listener of a reverse forward. It survives
+// reconnects: Accept waits for rebind when the ssh connection of the
+// current listener is lost.
+type reverseListener struct {
+	// addr is the address asked for.
+	addr string
+
+	mu sync.Mutex
+	l  net.Listener
+	// changed is closed when l is replaced or the listener is closed.
+	changed chan struct{}
+	closed  bool
+}
+
+func newReverseListener(addr string, l net.Listener) *reverseListener {
+	return &reverseListener{addr: addr, l: l, changed: make(chan struct{})}
+}
+
+func (r *reverseListener) Accept() (net.Conn, error) {
+	for {
+		r.mu.Lock()
+		l, changed := r.l, r.changed
+		r.mu.Unlock()
+		conn, err := l.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		<-changed
+		r.mu.Lock()
+		closed := r.closed
+		r.mu.Unlock()
+		if closed {
+			return nil, err
+		}
+	}
+}
+
+func (r *reverseListener) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.changed)
+	return r.l.Close()
+}
+
+func (r *reverseListener) Addr() net.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.l.Addr()
+}
+
+// rebind listens on conn, asking for the port bound so far so the address
+// stays the same. Failing that it asks for the original address.
+func (r *reverseListener) rebind(conn *ssh.Client) error {
+	addr := r.addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if _, port, err := net.SplitHostPort(r.Addr().String()); err == nil {
+			addr = net.JoinHostPort(host, port)
+		}
+	}
+	l, err := conn.Listen("tcp", addr)
+	if err != nil && addr != r.addr {
+		l, err = conn.Listen("tcp", r.addr)
+	}
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return l.Close()
+	}
+	old := r.l
+	r.l = l
+	close(r.changed)
+	r.changed = make(chan struct{})
+	old.Close()
+	return nil
+}
+
+// rebindReverse makes all reverse forwards listen on conn, the new ssh
+// connection, retrying in the background until that works or conn is
+// replaced in turn.
+func (p *SSHProxy) rebindReverse(conn *ssh.Client) {
+	p.mu.Lock()
+	var forwards []*forward
+	for _, fwd := range p.forwards {
+		if fwd.reverse {
+			forwards = append(forwards, fwd)
+		}
+	}
+	p.mu.Unlock()
+	for _, fwd := range forwards {
+		fwd := fwd
+		l, ok := fwd.listener.(*reverseListener)
+		if !ok {
+			continue
+		}
+		go func() {
+			backoff := 100 * time.Millisecond
+			for {
+				err := l.rebind(conn)
+				if err == nil {
+					bound := l.Addr().String()
+					fwd.log.forward.Infof("reverse forward %s listening on %s again", fwd.name, bound)
+					p.emit(Event{Type: EventForwardUp, Forward: fwd.name, Addr: bound})
+					return
+				}
+				fwd.log.forward.Debugf("reverse forward %s: %s", fwd.name, err)
+				select {
+				case <-p.done:
+					return
+				case <-time.After(backoff):
+				}
+				if fwd.isClosed() || p.client() != conn {
+					return
+				}
+				if backoff *= 2; backoff > rebindMaxBackoff {
+					backoff = rebindMaxBackoff
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Route sends connections or requests matching it to a different remote
+// address than the default of the forward.
+type Route struct {
+	// Host is matched against the requested host name. It is either an
+	// exact name, a wildcard like "*.example.com" matching any subdomain,
+	// or a suffix like ".example.com" matching the domain and subdomains.
+	// An empty Host matches any host.
+	Host string
+	// Path is a path prefix like "/api/*" or "/api" matched against the
+	// request path in L7 mode. It matches "/api" and everything below
+	// "/api/". An empty Path matches any path.
+	Path string
+	// StripPrefix removes the matched Path prefix from the request path
+	// before it is sent to the remote.
+	StripPrefix bool
+	// Headers must all be present in the request in L7 mode, e.g.
+	// "X-Env: staging", with the value compared case-insensitively, or
+	// with any value for "*".
+	Headers map[string]string
+	// Remote is the address connections are forwarded to.
+	Remote string
+}
+
+// matchHost reports whether host matches pattern as described on Route.
+func matchHost(pattern, host string) bool {
+	if pattern == "" {
+		return true
+	}
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	}
+	return host == pattern
+}
+
+// pathPrefix returns the prefix of a Path pattern without its trailing
+// wildcard or slash.
+func pathPrefix(pattern string) string {
+	return strings.TrimRight(strings.TrimSuffix(pattern, "*"), "/")
+}
+
+// matchPath reports whether path matches pattern as described on Route.
+func matchPath(pattern, path string) bool {
+	prefix := pathPrefix(pattern)
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// stripPath removes the prefix of pattern from path.
+func stripPath(pattern, path string) string {
+	path = strings.TrimPrefix(path, pathPrefix(pattern))
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// matchHeaders reports whether header has all headers described on Route.
+func matchHeaders(headers map[string]string, header http.Header) bool {
+	for name, want := range headers {
+		values, ok := header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return false
+		}
+		if want == "*" {
+			continue
+		}
+		found := false
+		for _, v := range values {
+			if strings.EqualFold(strings.TrimSpace(v), want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRoute returns the first route matching host, path and header.
+func matchRoute(routes []Route, host, path string, header http.Header) (*Route, bool) {
+	for i := range routes {
+		if matchHost(routes[i].Host, host) && matchPath(routes[i].Path, path) && matchHeaders(routes[i].Headers, header) {
+			return &routes[i], true
+		}
+	}
+	return nil, false
+}
+
+// sniTimeout bounds how long a client may take to send its ClientHello.
+const sniTimeout = 10 * time.Second
+
+var errHelloRead = errors.New("client hello read")
+
+// readOnlyConn lets crypto/tls parse a ClientHello without answering it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// peekSNI reads the TLS ClientHello from conn, waiting up to timeout, and
+// returns the requested server name along with a reader that replays the
+// consumed bytes.
+func peekSNI(conn net.Conn, timeout time.Duration) (string, io.Reader, error) {
+	var buf bytes.Buffer
+	var serverName string
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", nil, err
+	}
+	err := tls.Server(readOnlyConn{conn, io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return "", nil, err
+	}
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, err
+	}
+	return serverName, io.MultiReader(&buf, conn), nil
+}
+
+// sniRouter picks the remote of a connection from its TLS server name,
+// falling back to the default remote of the forward.
+func sniRouter(routes []Route, fallback string, timeout time.Duration) router {
+	return func(local net.Conn) (io.Reader, string, error) {
+		serverName, r, err := peekSNI(local, timeout)
+		if err != nil {
+			return nil, "", err
+		}
+		if route, ok := matchRoute(routes, serverName, "", nil); ok {
+			return r, route.Remote, nil
+		}
+		if fallback == "" {
+			return nil, "", fmt.Errorf("no route for server name %q", serverName)
+		}
+		return r, fallback, nil
+	}
+}
+
+// router chooses the remote address for a local connection. It returns a
+// reader to use in place of local, since choosing may consume data.
+type router func(local net.Conn) (io.Reader, string, error)
@@ -0,0 +1,109 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"sort"
+	"sync"
+)
+
+// ForwardTotals are the connections through one forward in a session.
+type ForwardTotals struct {
+	Forward     string `json:"forward"`
+	Connections int64  `json:"connections"`
+	// Errors counts the connections that ended with an error.
+	Errors int64 `json:"errors"`
+	// BytesUp is sent by the clients, BytesDown by the targets.
+	BytesUp   int64 `json:"bytes_up"`
+	BytesDown int64 `json:"bytes_down"`
+}
+
+// DestinationTotals are the connections to one target in a session.
+type DestinationTotals struct {
+	Destination string `json:"destination"`
+	Connections int64  `json:"connections"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// SessionStats totals the connections through the forwards of one or
+// more proxies, for a summary when the session ends. It is safe for
+// concurrent use.
+type SessionStats struct {
+	mu           sync.Mutex
+	forwards     map[string]*ForwardTotals
+	destinations map[string]*DestinationTotals
+}
+
+// NewSessionStats returns empty SessionStats.
+func NewSessionStats() *SessionStats {
+	return &SessionStats{
+		forwards:     make(map[string]*ForwardTotals),
+		destinations: make(map[string]*DestinationTotals),
+	}
+}
+
+// WithSessionStats totals every connection through the forwards of p in
+// s. It must be called before forwards are set up.
+func (p *SSHProxy) WithSessionStats(s *SessionStats) {
+	p.session = s
+}
+
+func (s *SessionStats) record(rec AuditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fwd, ok := s.forwards[rec.Forward]
+	if !ok {
+		fwd = &ForwardTotals{Forward: rec.Forward}
+		s.forwards[rec.Forward] = fwd
+	}
+	fwd.Connections++
+	if rec.Error != "" {
+		fwd.Errors++
+	}
+	fwd.BytesUp += rec.BytesUp
+	fwd.BytesDown += rec.BytesDown
+	if rec.Target == "" {
+		return
+	}
+	dest, ok := s.destinations[rec.Target]
+	if !ok {
+		dest = &DestinationTotals{Destination: rec.Target}
+		s.destinations[rec.Target] = dest
+	}
+	dest.Connections++
+	dest.Bytes += rec.BytesUp + rec.BytesDown
+}
+
+// Forwards returns the totals of the forwards that had connections, sorted
+// by name.
+func (s *SessionStats) Forwards() []ForwardTotals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totals := make([]ForwardTotals, 0, len(s.forwards))
+	for _, fwd := range s.forwards {
+		totals = append(totals, *fwd)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Forward < totals[j].Forward })
+	return totals
+}
+
+// TopDestinations returns up to n of the targets with the most
+// connections, most first.
+func (s *SessionStats) TopDestinations(n int) []DestinationTotals {
+	s.mu.Lock()
+	totals := make([]DestinationTotals, 0, len(s.destinations))
+	for _, dest := range s.destinations {
+		totals = append(totals, *dest)
+	}
+	s.mu.Unlock()
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Connections != totals[j].Connections {
+			return totals[i].Connections > totals[j].Connections
+		}
+		return totals[i].Destination < totals[j].Destination
+	})
+	if len(totals) > n {
+		totals = totals[:n]
+	}
+	return totals
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ProblemStats counts connections that were slow or stopped making progress.
+type ProblemStats struct {
+	// SlowDials is the number of remote dials slower than SlowThreshold.
+	SlowDials int64
+	// SlowResponses is the number of connections where the first response
+	// byte took longer than SlowThreshold after the first request byte.
+	SlowResponses int64
+	// Stalls is the number of times a connection waiting for a response
+	// made no progress for StallThreshold.
+	Stalls int64
+}
+
+// ProblemStats returns counts of slow and stalled connections.
+func (p *SSHProxy) ProblemStats() ProblemStats {
+	return ProblemStats{
+		SlowDials:     atomic.LoadInt64(&p.problems.SlowDials),
+		SlowResponses: atomic.LoadInt64(&p.problems.SlowResponses),
+		Stalls:        atomic.LoadInt64(&p.problems.Stalls),
+	}
+}
+
+// progress records when each direction of a connection last read data.
+// Times are unix nanoseconds, 0 means nothing was read yet.
+type progress struct {
+	up   int64 // local -> remote
+	down int64 // remote -> local
+}
+
+// progressReader updates a timestamp on every successful read.
+type progressReader struct {
+	io.Reader
+	last *int64
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(r.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// checkDial logs and counts a slow dial of addr.
+func (p *SSHProxy) checkDial(fwd *forward, addr string, took time.Duration) {
+	if p.cfg.SlowThreshold > 0 && took > p.cfg.SlowThreshold {
+		atomic.AddInt64(&p.problems.SlowDials, 1)
+		fwd.log.conns.Warningf("forward %s: dialing %s took %s", fwd.name, addr, took)
+	}
+}
+
+// monitor watches a connection for a slow first response and for stalls
+// until done is closed.
+func (p *SSHProxy) monitor(fwd *forward, client string, prog *progress, done <-chan struct{}) {
+	interval := p.cfg.SlowThreshold
+	if p.cfg.StallThreshold > 0 && (interval == 0 || p.cfg.StallThreshold < interval) {
+		interval = p.cfg.StallThreshold
+	}
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	var firstUp int64
+	reportedSlow, stalled := false, false
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			up := atomic.LoadInt64(&prog.up)
+			down := atomic.LoadInt64(&prog.down)
+			if firstUp == 0 {
+				firstUp = up
+			}
+			if !reportedSlow && p.cfg.SlowThreshold > 0 && firstUp != 0 && down == 0 &&
+				now.Sub(time.Unix(0, firstUp)) > p.cfg.SlowThreshold {
+				reportedSlow = true
+				atomic.AddInt64(&p.problems.SlowResponses, 1)
+				fwd.log.conns.Warningf("forward %s: no response for %s after request from %s",
+					fwd.name, p.cfg.SlowThreshold, client)
+			}
+			// A connection is stalled if it sent data that has not been
+			// answered and nothing moved since.
+			if p.cfg.StallThreshold == 0 || up <= down {
+				stalled = false
+				continue
+			}
+			idle := now.Sub(time.Unix(0, up))
+			if idle < p.cfg.StallThreshold {
+				stalled = false
+			} else if !stalled {
+				stalled = true
+				atomic.AddInt64(&p.problems.Stalls, 1)
+				fwd.log.conns.Warningf("forward %s: no progress for %s on connection from %s",
+					fwd.name, idle.Round(time.Second), client)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 protocol constants, see RFC 1928.
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+
+	socksConnect = 1
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+
+	socksSucceeded          = 0
+	socksGeneralFailure     = 1
+	socksNotAllowed         = 2
+	socksHostUnreachable    = 4
+	socksCommandUnsupported = 7
+	socksAddressUnsupported = 8
+)
+
+var (
+	// errSOCKSHandshake means the client did not offer a usable SOCKS5
+	// handshake, so no reply can be sent.
+	errSOCKSHandshake = errors.New("bad SOCKS handshake")
+	// errSOCKSCommand means the client asked for something other than
+	// CONNECT.
+	errSOCKSCommand = errors.New("unsupported SOCKS command")
+	// errSOCKSAddress means the client sent an unknown address type.
+	errSOCKSAddress = errors.New("unsupported SOCKS address type")
+)
+
+// socksProtocol is SOCKS5 without authentication, supporting the CONNECT
+// command with IPv4, IPv6 and domain name destinations.
+type socksProtocol struct{}
+
+func (socksProtocol) request(conn net.Conn) (string, io.Reader, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", nil, fmt.Errorf("%w: %s", errSOCKSHandshake, err)
+	}
+	if head[0] != socksVersion {
+		return "", nil, fmt.Errorf("%w: version %d", errSOCKSHandshake, head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", nil, fmt.Errorf("%w: %s", errSOCKSHandshake, err)
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", nil, err
+	}
+	if method == socksNoAcceptable {
+		return "", nil, fmt.Errorf("%w: no acceptable authentication method", errSOCKSHandshake)
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", nil, fmt.Errorf("%w: %s", errSOCKSHandshake, err)
+	}
+	if req[0] != socksVersion {
+		return "", nil, fmt.Errorf("%w: version %d", errSOCKSHandshake, req[0])
+	}
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", nil, fmt.Errorf("%w: %s", errSOCKSHandshake, err)
+		}
+		host = ip.String()
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", nil, fmt.Errorf("%w: %s", errSOCKSHandshake, err)
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", nil, fmt.Errorf("%w: %s", errSOCKSHandshake, err)
+		}
+		host = string(name)
+	default:
+		return "", nil, fmt.Errorf("%w: %d", errSOCKSAddress, req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", nil, fmt.Errorf("%w: %s", errSOCKSHandshake, err)
+	}
+	if req[1] != socksConnect {
+		return "", nil, fmt.Errorf("%w: %d", errSOCKSCommand, req[1])
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	return addr, conn, nil
+}
+
+// reply writes a SOCKS5 reply with an unspecified bound address, unless the
+// handshake failed before a request was read.
+func (socksProtocol) reply(conn net.Conn, err error) error {
+	code := byte(socksSucceeded)
+	switch {
+	case err == nil:
+	case errors.Is(err, errSOCKSHandshake):
+		return nil
+	case errors.Is(err, ErrDenied), errors.Is(err, ErrForwardingProhibited):
+		code = socksNotAllowed
+	case errors.Is(err, ErrRemoteDial):
+		code = socksHostUnreachable
+	case errors.Is(err, errSOCKSCommand):
+		code = socksCommandUnsupported
+	case errors.Is(err, errSOCKSAddress):
+		code = socksAddressUnsupported
+	default:
+		code = socksGeneralFailure
+	}
+	_, err = conn.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,50 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import "time"
+
+// ConnStats describes the history of the ssh connection.
+type ConnStats struct {
+	// Connects is the number of times the connection was established.
+	Connects int
+	// Reconnects is the number of times the connection was re-established.
+	Reconnects int
+	// LastConnect is when the current connection was established.
+	LastConnect time.Time
+	// HandshakeDuration is how long the last ssh handshake took.
+	HandshakeDuration time.Duration
+	// TunnelsLost is the number of times the connection was closed
+	// because the server stopped answering keepalives.
+	TunnelsLost int
+	// LastKeepAlive is when the server last answered a keepalive, or
+	// the last handshake if it did not answer one since.
+	LastKeepAlive time.Time
+}
+
+// Age returns the time since the last (re)connect.
+func (s ConnStats) Age() time.Duration {
+	if s.LastConnect.IsZero() {
+		return 0
+	}
+	return time.Since(s.LastConnect)
+}
+
+func (s *ConnStats) connected(at time.Time, handshake time.Duration) {
+	if s.Connects > 0 {
+		s.Reconnects++
+	}
+	s.Connects++
+	s.LastConnect = at
+	s.HandshakeDuration = handshake
+	s.LastKeepAlive = at.Add(handshake)
+}
+
+// KeepAliveAge returns the time since the server last proved alive, or 0
+// if it never did.
+func (s ConnStats) KeepAliveAge() time.Duration {
+	if s.LastKeepAlive.IsZero() {
+		return 0
+	}
+	return time.Since(s.LastKeepAlive)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// orDefault returns d, or def if d is not positive.
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// dialContext calls dial for addr, giving up once ctx is done or, if
+// timeout is positive, after timeout. A connection dial returns after
+// giving up is closed.
+func dialContext(ctx context.Context, timeout time.Duration, addr string, dial func() (net.Conn, error)) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if ctx.Done() == nil {
+		return dial()
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		ch <- result{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, wrapError(ErrRemoteDial, fmt.Errorf("%s: %w", addr, ctx.Err()))
+	}
+}
+
+// closeAfter closes client and target once they have been open for
+// lifetime, unless done is closed first.
+func closeAfter(fwd *forward, client, target net.Conn, lifetime time.Duration, done <-chan struct{}) {
+	t := time.NewTimer(lifetime)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		fwd.log.conns.Infof("forward %s: closing %s after %s", fwd.name, client.RemoteAddr(), lifetime)
+		client.Close()
+		target.Close()
+	case <-done:
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource supplies bearer tokens that are injected into requests of
+// L7 forwards.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// TokenFunc adapts a function to a TokenSource.
+type TokenFunc func() (string, error)
+
+// Token calls f.
+func (f TokenFunc) Token() (string, error) {
+	return f()
+}
+
+// EnvToken reads the token from the environment variable name.
+func EnvToken(name string) TokenSource {
+	return TokenFunc(func() (string, error) {
+		token := strings.TrimSpace(os.Getenv(name))
+		if token == "" {
+			return "", fmt.Errorf("environment variable %s is empty", name)
+		}
+		return token, nil
+	})
+}
+
+// FileToken reads the token from the file at path, so rotated tokens are
+// picked up without a restart.
+func FileToken(path string) TokenSource {
+	return TokenFunc(func() (string, error) {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		token := strings.TrimSpace(string(buf))
+		if token == "" {
+			return "", fmt.Errorf("token file %s is empty", path)
+		}
+		return token, nil
+	})
+}
+
+// CommandToken runs command with the system shell and uses its output as
+// the token.
+func CommandToken(command string) TokenSource {
+	return TokenFunc(func() (string, error) {
+		cmd := shellCommand(command)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("token command: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		token := strings.TrimSpace(string(out))
+		if token == "" {
+			return "", errors.New("token command printed nothing")
+		}
+		return token, nil
+	})
+}
+
+// CachedToken returns a TokenSource that reuses tokens of src for ttl
+// before fetching a new one.
+func CachedToken(src TokenSource, ttl time.Duration) TokenSource {
+	c := &cachedToken{src: src, ttl: ttl}
+	return c
+}
+
+type cachedToken struct {
+	src TokenSource
+	ttl time.Duration
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Token returns the cached token, fetching a new one once it expired.
+func (c *cachedToken) Token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+	token, err := c.src.Token()
+	if err != nil {
+		return "", err
+	}
+	c.token, c.expires = token, time.Now().Add(c.ttl)
+	return token, nil
+}
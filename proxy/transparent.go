@@ -0,0 +1,38 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// errNotRedirected means a connection reached a transparent forward
+// directly instead of being redirected to it.
+var errNotRedirected = errors.New("connection was not redirected")
+
+// transparentProtocol takes the destination of a connection from the
+// firewall rule that redirected it to the forward.
+type transparentProtocol struct{}
+
+func (transparentProtocol) request(conn net.Conn) (string, io.Reader, error) {
+	dst, err := originalDst(conn)
+	if err != nil {
+		return "", nil, err
+	}
+	if dst.String() == conn.LocalAddr().String() {
+		// TPROXY keeps the destination as the local address, while a
+		// connection that was not redirected has the listen address.
+		if l, ok := conn.LocalAddr().(*net.TCPAddr); ok && l.IP.IsLoopback() {
+			return "", nil, errNotRedirected
+		}
+	}
+	return dst.String(), conn, nil
+}
+
+// reply does nothing, clients of a transparent forward do not know about
+// it. Failed connections are closed.
+func (transparentProtocol) reply(conn net.Conn, err error) error {
+	return nil
+}
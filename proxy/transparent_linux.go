@@ -0,0 +1,63 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h.
+const soOriginalDst = 80
+
+// originalDst returns the destination conn had before iptables REDIRECT
+// sent it to the forward, or its local address if there is none, which is
+// the original destination of connections diverted with TPROXY.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dst *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// The option returns a struct sockaddr_in, which fits the 16
+		// bytes of an ipv6_mreq.
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		a := mreq.Multiaddr
+		dst = &net.TCPAddr{IP: net.IPv4(a[4], a[5], a[6], a[7]), Port: int(a[2])<<8 | int(a[3])}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		logger.Debugf("no original destination, using the local address: %s", sockErr)
+		return tc.LocalAddr().(*net.TCPAddr), nil
+	}
+	return dst, nil
+}
+
+// listenTransparent listens on addr with IP_TRANSPARENT set if the process
+// may set it, so TPROXY can divert connections to the listener.
+func listenTransparent(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+					logger.Debugf("%s: IP_TRANSPARENT not set, TPROXY will not work: %s", address, err)
+				}
+			})
+		},
+	}
+	return lc.Listen(context.Background(), "tcp4", addr)
+}
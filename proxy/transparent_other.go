@@ -0,0 +1,23 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// errTransparentUnsupported means transparent mode is not available on this
+// platform.
+var errTransparentUnsupported = errors.New("transparent mode is only supported on Linux")
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparent(addr string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
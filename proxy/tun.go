@@ -0,0 +1,120 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TunAny asks the ssh server to pick a free tun device for OpenTun.
+const TunAny = 0x7fffffff
+
+const (
+	// tunPointToPoint is the layer 3 tunnel mode of OpenSSH, as used by
+	// ssh -w.
+	tunPointToPoint = 1
+	// tunAFInet and tunAFInet6 are the address families that prefix every
+	// packet on the channel, numbered as on OpenBSD.
+	tunAFInet  = 2
+	tunAFInet6 = 24
+	// maxTunPacket bounds the packets read from the channel.
+	maxTunPacket = 65535
+)
+
+var errBadPacket = errors.New("malformed tunnel packet")
+
+// TunChannel carries IP packets to and from a tun device on the ssh server,
+// like the tunnel of ssh -w.
+type TunChannel struct {
+	ch ssh.Channel
+	r  *bufio.Reader
+
+	wmu sync.Mutex
+}
+
+// OpenTun opens a layer 3 tunnel to tun device unit of the ssh server, or
+// to any free one for TunAny. The server must allow it with PermitTunnel,
+// and addresses, routes and forwarding of its side have to be set up
+// there.
+func (p *SSHProxy) OpenTun(unit uint32) (*TunChannel, error) {
+	if p.policy != nil {
+		return nil, wrapError(ErrDenied, fmt.Errorf("tun device: %w", errPolicyExec))
+	}
+	conn, err := p.parkedClient()
+	if err != nil {
+		return nil, err
+	}
+	payload := ssh.Marshal(struct {
+		Mode uint32
+		Unit uint32
+	}{tunPointToPoint, unit})
+	ch, reqs, err := conn.OpenChannel("tun@openssh.com", payload)
+	if err != nil {
+		return nil, wrapError(ErrRemoteDial, fmt.Errorf("tun: %w", classifyChannelError(err)))
+	}
+	go ssh.DiscardRequests(reqs)
+	return &TunChannel{ch: ch, r: bufio.NewReader(ch)}, nil
+}
+
+// ReadPacket returns the next IP packet from the server.
+func (t *TunChannel) ReadPacket() ([]byte, error) {
+	// Channel data does not keep message boundaries, so packets are
+	// delimited by the length in their IP header.
+	var af [4]byte
+	if _, err := io.ReadFull(t.r, af[:]); err != nil {
+		return nil, err
+	}
+	hdr, err := t.r.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	switch binary.BigEndian.Uint32(af[:]) {
+	case tunAFInet:
+		n = int(binary.BigEndian.Uint16(hdr[2:4]))
+	case tunAFInet6:
+		n = 40 + int(binary.BigEndian.Uint16(hdr[4:6]))
+	default:
+		return nil, errBadPacket
+	}
+	if n < len(hdr) || n > maxTunPacket {
+		return nil, errBadPacket
+	}
+	pkt := make([]byte, n)
+	if _, err := io.ReadFull(t.r, pkt); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// WritePacket sends the IP packet pkt to the server.
+func (t *TunChannel) WritePacket(pkt []byte) error {
+	if len(pkt) == 0 {
+		return errBadPacket
+	}
+	af := uint32(tunAFInet)
+	if pkt[0]>>4 == 6 {
+		af = tunAFInet6
+	}
+	// OpenSSH takes each channel message as one packet, so the header
+	// and packet go out in a single write.
+	buf := make([]byte, 4+len(pkt))
+	binary.BigEndian.PutUint32(buf, af)
+	copy(buf[4:], pkt)
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	_, err := t.ch.Write(buf)
+	return err
+}
+
+// Close closes the tunnel.
+func (t *TunChannel) Close() error {
+	return t.ch.Close()
+}
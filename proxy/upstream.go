@@ -0,0 +1,105 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// maxUpstreamHeader caps the size of the response of an upstream proxy to a
+// CONNECT request.
+const maxUpstreamHeader = 16 << 10
+
+// Upstream is an HTTP proxy on the remote network, e.g. a corporate proxy
+// only reachable internally, that a CONNECT mode forward chains to instead
+// of opening channels to destinations itself.
+type Upstream struct {
+	// Addr is the address of the proxy, dialed over the ssh connection.
+	Addr string
+	// Username and Password, if set, are sent to the proxy with basic
+	// authentication.
+	Username string
+	Password string
+}
+
+// authorization returns the Proxy-Authorization header value for u, or ""
+// without credentials.
+func (u *Upstream) authorization() string {
+	if u.Username == "" && u.Password == "" {
+		return ""
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(u.Username+":"+u.Password))
+}
+
+// destinationDialer is implemented by protocols that reach destinations
+// other than by opening a channel to them.
+type destinationDialer interface {
+	dial(p *SSHProxy, target string, prio Priority) (net.Conn, error)
+}
+
+// dial opens a tunnel to target through the upstream proxy, or a
+// connection to the proxy itself for plain HTTP requests, which carry
+// their destination.
+func (c *connectProtocol) dial(p *SSHProxy, target string, prio Priority) (net.Conn, error) {
+	if c.upstream == nil {
+		return p.dialDestination(target, prio)
+	}
+	if c.plain {
+		return p.dial(c.upstream.Addr, prio)
+	}
+	return p.dialUpstream(c.upstream, target, prio)
+}
+
+// dialUpstream asks the upstream proxy up for a tunnel to target.
+func (p *SSHProxy) dialUpstream(up *Upstream, target string, prio Priority) (net.Conn, error) {
+	conn, err := p.dial(up.Addr, prio)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if auth := up.authorization(); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, wrapError(ErrRemoteDial, fmt.Errorf("upstream proxy %s: %w", up.Addr, err))
+	}
+	resp, err := readUpstreamResponse(conn, req)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = errors.New(resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, wrapError(ErrRemoteDial, fmt.Errorf("upstream proxy %s: %s: %w", up.Addr, target, err))
+	}
+	return conn, nil
+}
+
+// readUpstreamResponse reads the response to req from conn a byte at a
+// time, so nothing the destination sends right after it is consumed.
+func readUpstreamResponse(conn net.Conn, req *http.Request) (*http.Response, error) {
+	var head bytes.Buffer
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head.Bytes(), []byte("\r\n\r\n")) {
+		if head.Len() >= maxUpstreamHeader {
+			return nil, errors.New("response header too long")
+		}
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		head.Write(b)
+	}
+	return http.ReadResponse(bufio.NewReader(&head), req)
+}
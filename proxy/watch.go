@@ -0,0 +1,65 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// watchTarget probes the targets of fwd every watch interval of its
+// settings and lets it accept connections only while they are listening,
+// until fwd is closed, p is shut down or the interval is set to 0. It is
+// started with fwd marked down, so connections are refused until the first
+// probe succeeds.
+func (p *SSHProxy) watchTarget(fwd *forward) {
+	defer p.wg.Done()
+	defer atomic.StoreInt32(&fwd.watching, 0)
+	for {
+		interval := fwd.current().watch
+		if interval <= 0 || fwd.isClosed() {
+			p.setTargetDown(fwd, nil)
+			return
+		}
+		p.setTargetDown(fwd, p.probe(fwd))
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-p.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// startWatch starts watchTarget for fwd unless it is running.
+func (p *SSHProxy) startWatch(fwd *forward) {
+	if fwd.current().watch <= 0 || !atomic.CompareAndSwapInt32(&fwd.watching, 0, 1) {
+		return
+	}
+	p.wg.Add(1)
+	go p.watchTarget(fwd)
+}
+
+// setTargetDown records whether the targets of fwd were reachable, err
+// being why they were not, and reports the transitions.
+func (p *SSHProxy) setTargetDown(fwd *forward, err error) {
+	var down int32
+	if err != nil {
+		down = 1
+	}
+	if atomic.SwapInt32(&fwd.down, down) == down {
+		return
+	}
+	if err != nil {
+		fwd.log.forward.Warningf("forward %s: target down, refusing connections: %s", fwd.name, err)
+		p.emit(Event{Type: EventTargetDown, Forward: fwd.name, Err: err})
+		return
+	}
+	fwd.log.forward.Infof("forward %s: target up", fwd.name)
+	p.emit(Event{Type: EventTargetUp, Forward: fwd.name})
+}
+
+func (f *forward) isTargetDown() bool {
+	return atomic.LoadInt32(&f.down) == 1
+}
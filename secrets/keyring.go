@@ -0,0 +1,103 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package secrets
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+const (
+	keyringService = "sshhttpproxy"
+	keyringAccount = "secret-key"
+)
+
+// KeyEnv names an environment variable holding the hex encoded key. It
+// takes precedence over the keyring, for machines without one.
+const KeyEnv = "SSHHTTPPROXY_SECRET_KEY"
+
+// ErrNoKey is returned by LoadKey if no key has been stored.
+var ErrNoKey = errors.New("no secret key found, run sshhttpproxy secret init")
+
+// LoadKey returns the key from KeyEnv or the keyring of the operating
+// system: the login keychain on macOS and the secret service (through
+// secret-tool) on Linux.
+func LoadKey() ([]byte, error) {
+	if env := os.Getenv(KeyEnv); env != "" {
+		return decodeKey(env)
+	}
+	return readKeyring()
+}
+
+func readKeyring() ([]byte, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password",
+			"-s", keyringService, "-a", keyringAccount, "-w")
+	case "linux":
+		cmd = exec.Command("secret-tool", "lookup",
+			"service", keyringService, "account", keyringAccount)
+	default:
+		return nil, fmt.Errorf("no keyring support on %s, set %s", runtime.GOOS, KeyEnv)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, ErrNoKey
+		}
+		return nil, fmt.Errorf("%s: %w", cmd.Path, err)
+	}
+	return decodeKey(stdout.String())
+}
+
+// StoreKey stores key in the keyring of the operating system, replacing a
+// previous key. The key is passed on stdin, never as an argument other
+// users could read in the process list.
+func StoreKey(key []byte) error {
+	encoded := hex.EncodeToString(key)
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// security only takes the password as an argument, but in
+		// interactive mode it reads its commands from stdin.
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+			keyringService, keyringAccount, encoded))
+	case "linux":
+		cmd = exec.Command("secret-tool", "store", "--label=sshhttpproxy secret key",
+			"service", keyringService, "account", keyringAccount)
+		cmd.Stdin = strings.NewReader(encoded)
+	default:
+		return fmt.Errorf("no keyring support on %s, set %s=%s", runtime.GOOS, KeyEnv, encoded)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", cmd.Path, err)
+	}
+	// security exits successfully in interactive mode even if a command
+	// failed, so the key is read back.
+	stored, err := readKeyring()
+	if err != nil {
+		return fmt.Errorf("reading back the stored key: %w", err)
+	}
+	if !bytes.Equal(stored, key) {
+		return errors.New("the key was not stored in the keyring")
+	}
+	return nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != KeySize {
+		return nil, errors.New("secret key must be 64 hex digits")
+	}
+	return key, nil
+}
@@ -0,0 +1,131 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+const (
+	vaultPrefix       = "vault:"
+	onePasswordPrefix = "op://"
+)
+
+// IsReference reports whether value refers to a secret in an external
+// secret manager.
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, vaultPrefix) || strings.HasPrefix(value, onePasswordPrefix)
+}
+
+// Resolve returns the secret ref refers to. References have the form
+// vault:<path>#<field> for HashiCorp Vault, read over its HTTP API with
+// VAULT_ADDR and VAULT_TOKEN (or ~/.vault-token), and
+// op://<vault>/<item>/<field> for 1Password, read with the op CLI.
+func Resolve(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, vaultPrefix):
+		return resolveVault(strings.TrimPrefix(ref, vaultPrefix))
+	case strings.HasPrefix(ref, onePasswordPrefix):
+		return resolveOnePassword(ref)
+	}
+	return "", fmt.Errorf("unknown secret reference %q", ref)
+}
+
+func resolveVault(ref string) (string, error) {
+	i := strings.LastIndex(ref, "#")
+	if i < 0 {
+		return "", fmt.Errorf("vault reference %q has no #field", ref)
+	}
+	path, field := strings.Trim(ref[:i], "/"), ref[i+1:]
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("vault:%s: VAULT_ADDR is not set", ref)
+	}
+	token, err := vaultToken()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault:%s: %s", path, resp.Status)
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("vault:%s: %s", path, err)
+	}
+	data := secret.Data
+	// KV version 2 nests the secret next to its metadata.
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("vault:%s: no field %q", path, field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// vaultToken returns the token the vault CLI would use.
+func vaultToken() (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return "", fmt.Errorf("no vault token, set VAULT_TOKEN or run vault login")
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// OnePasswordCLI is the op command run to read 1Password references. It
+// may be set to a full path.
+var OnePasswordCLI = "op"
+
+func resolveOnePassword(ref string) (string, error) {
+	cmd := exec.Command(OnePasswordCLI, "read", "--no-newline", ref)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("op read %s: %s", ref, msg)
+		}
+		return "", fmt.Errorf("op read %s: %w", ref, err)
+	}
+	return stdout.String(), nil
+}
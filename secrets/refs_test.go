@@ -0,0 +1,163 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package secrets_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elliotpeele/sshhttpproxy/secrets"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// opEnv makes the test binary act as the op CLI, for secrets.OnePasswordCLI.
+const opEnv = "SECRETS_TEST_OP"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(opEnv) != "" {
+		os.Exit(fakeOp(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeOp reads the items of a 1Password vault with one login like op read.
+func fakeOp(args []string) int {
+	if len(args) != 3 || args[0] != "read" || args[1] != "--no-newline" {
+		fmt.Fprintf(os.Stderr, "[ERROR] unexpected arguments %q\n", args)
+		return 2
+	}
+	switch args[2] {
+	case "op://Private/bastion/password":
+		fmt.Print("hunter2")
+		return 0
+	case "op://Private/silent/password":
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "[ERROR] could not read secret %s: item not found\n", args[2])
+	return 1
+}
+
+func TestResolveOnePassword(t *testing.T) {
+	saved := secrets.OnePasswordCLI
+	t.Cleanup(func() { secrets.OnePasswordCLI = saved })
+	secrets.OnePasswordCLI = os.Args[0]
+	setenv(t, opEnv, "1")
+
+	got, err := secrets.Resolve("op://Private/bastion/password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hunter2" {
+		t.Errorf("got %q, want hunter2", got)
+	}
+	_, err = secrets.Resolve("op://Private/missing/password")
+	if err == nil || !strings.Contains(err.Error(), "item not found") {
+		t.Errorf("missing item got %v, want the error of op", err)
+	}
+	_, err = secrets.Resolve("op://Private/silent/password")
+	if err == nil || !strings.Contains(err.Error(), "exit status 1") {
+		t.Errorf("failure without output got %v, want the exit status", err)
+	}
+
+	secrets.OnePasswordCLI = filepath.Join(os.TempDir(), "no-such-op")
+	if _, err := secrets.Resolve("op://Private/bastion/password"); err == nil {
+		t.Error("resolved without the op CLI")
+	}
+}
+
+// vaultServer serves the secrets of a vault with KV version 1 mounted at
+// kv1 and version 2 at kv2, for the token.
+func vaultServer(t *testing.T, token string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv1/ssh":
+			fmt.Fprint(w, `{"data":{"password":"v1-secret","port":2222}}`)
+		case "/v1/kv2/data/ssh":
+			fmt.Fprint(w, `{"data":{"data":{"password":"v2-secret"},"metadata":{"version":3}}}`)
+		case "/v1/kv1/nested":
+			// A KV version 1 secret with a field named data.
+			fmt.Fprint(w, `{"data":{"data":{"password":"inner"},"password":"outer"}}`)
+		default:
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResolveVault(t *testing.T) {
+	srv := vaultServer(t, "s.token")
+	setenv(t, "VAULT_ADDR", srv.URL+"/")
+	setenv(t, "VAULT_TOKEN", "s.token")
+
+	for ref, want := range map[string]string{
+		"vault:kv1/ssh#password":       "v1-secret",
+		"vault:kv1/ssh#port":           "2222",
+		"vault:/kv2/data/ssh#password": "v2-secret",
+		"vault:kv1/nested#password":    "outer",
+	} {
+		got, err := secrets.Resolve(ref)
+		if err != nil {
+			t.Errorf("%s: %v", ref, err)
+		} else if got != want {
+			t.Errorf("%s: got %q, want %q", ref, got, want)
+		}
+	}
+
+	for ref, want := range map[string]string{
+		"vault:kv1/ssh#user":          `no field "user"`,
+		"vault:kv2/data/ssh#metadata": `no field "metadata"`,
+		"vault:kv1/missing#password":  "404 Not Found",
+		"vault:kv1/ssh":               "no #field",
+	} {
+		_, err := secrets.Resolve(ref)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an error with %q", ref, err, want)
+		}
+	}
+
+	setenv(t, "VAULT_TOKEN", "s.wrong")
+	if _, err := secrets.Resolve("vault:kv1/ssh#password"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("wrong token got %v, want 403 Forbidden", err)
+	}
+}
+
+func TestResolveVaultTokenFile(t *testing.T) {
+	srv := vaultServer(t, "s.file")
+	setenv(t, "VAULT_ADDR", srv.URL)
+	setenv(t, "VAULT_TOKEN", "")
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	setenv(t, "HOME", home)
+	setenv(t, "USERPROFILE", home)
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+
+	if _, err := secrets.Resolve("vault:kv1/ssh#password"); err == nil || !strings.Contains(err.Error(), "no vault token") {
+		t.Errorf("without a token got %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, ".vault-token"), []byte("s.file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := secrets.Resolve("vault:kv1/ssh#password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "v1-secret" {
+		t.Errorf("got %q, want v1-secret", got)
+	}
+}
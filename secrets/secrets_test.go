@@ -0,0 +1,144 @@
+// Copyright (c) Elliot Peele <elliot@bentlogic.net>
+
+package secrets_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/elliotpeele/sshhttpproxy/secrets"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range []string{"", "hunter2", "ünïcødé and spaces\n", strings.Repeat("x", 4096)} {
+		value, err := secrets.Encrypt(key, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !secrets.IsEncrypted(value) {
+			t.Fatalf("%q has no prefix", value)
+		}
+		if plaintext != "" && strings.Contains(value, plaintext) {
+			t.Fatalf("%q contains the plain text", value)
+		}
+		got, err := secrets.Decrypt(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != plaintext {
+			t.Fatalf("got %q, want %q", got, plaintext)
+		}
+	}
+	// A fresh nonce makes every encryption different.
+	a, _ := secrets.Encrypt(key, "same")
+	b, _ := secrets.Encrypt(key, "same")
+	if a == b {
+		t.Fatal("encrypting twice gave the same value")
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	key, _ := secrets.GenerateKey()
+	other, _ := secrets.GenerateKey()
+	if bytes.Equal(key, other) {
+		t.Fatal("generated the same key twice")
+	}
+	value, err := secrets.Encrypt(key, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := secrets.Decrypt(other, value); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Fatalf("got %q, %v decrypting with another key", got, err)
+	}
+	if _, err := secrets.Decrypt(key[:16], value); err == nil {
+		t.Fatal("decrypted with a short key")
+	}
+	if _, err := secrets.Encrypt(key[:16], "hunter2"); err == nil {
+		t.Fatal("encrypted with a short key")
+	}
+}
+
+func TestDecryptMalformed(t *testing.T) {
+	key, _ := secrets.GenerateKey()
+	value, err := secrets.Encrypt(key, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, secrets.Prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	tampered := secrets.Prefix + base64.RawURLEncoding.EncodeToString(sealed)
+
+	for _, tt := range []struct {
+		name  string
+		value string
+		err   error
+	}{
+		{"no prefix", "hunter2", secrets.ErrMalformed},
+		{"prefix only", secrets.Prefix, secrets.ErrMalformed},
+		{"not base64", secrets.Prefix + "!!!", secrets.ErrMalformed},
+		{"shorter than a nonce", secrets.Prefix + base64.RawURLEncoding.EncodeToString([]byte("short")), secrets.ErrMalformed},
+		{"tampered", tampered, nil},
+	} {
+		got, err := secrets.Decrypt(key, tt.value)
+		if err == nil {
+			t.Errorf("%s: decrypted to %q", tt.name, got)
+			continue
+		}
+		if tt.err != nil && err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// setenv sets the environment variable name to value for the rest of the
+// test.
+func setenv(t *testing.T, name, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func TestLoadKeyFromEnv(t *testing.T) {
+	for _, tt := range []struct {
+		env  string
+		want []byte
+	}{
+		{"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef\n", []byte{
+			0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef,
+			0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef,
+		}},
+		{"0123", nil},
+		{"not hex", nil},
+	} {
+		setenv(t, secrets.KeyEnv, tt.env)
+		got, err := secrets.LoadKey()
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: loaded %x", tt.env, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("%q: got %x, %v", tt.env, got, err)
+		}
+	}
+}